@@ -0,0 +1,139 @@
+package qotp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// Streams opened by the peer are queued when their first frame arrives, AcceptStream returns them in that
+// order, like net.Listener.Accept. The frames are only received while Listen is called, e.g., by Loop in
+// another goroutine. Listen still returns the streams, AcceptStream is an alternative to tracking them. The
+// connections that peers dialed are queued the same way for Accept of the listener.
+//
+// Nothing is queued until Accept is called the first time, so an application that does not accept does not
+// keep the connections in the queue. The streams of a connection are queued once AcceptStream was called on
+// it, or for the connections of peers once Accept was called, so that the first stream, which arrives with the
+// init, is not lost. Connections and streams that were closed while they were queued are skipped.
+
+// acceptQueueSize is the number of streams of the peer, or connections of peers, that are queued until they are
+// accepted, once it is full, new ones are only returned by Listen
+const acceptQueueSize = 256
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// onConnAccepted queues a connection a peer dialed, it never blocks the receive path
+func (l *Listener) onConnAccepted(c *Conn) {
+	if !l.isAccepting.Load() {
+		return
+	}
+	select {
+	case l.acceptConnCh <- c:
+	default:
+		slog.Debug("Accept/ConnQueueFull", gId(), c.debug())
+	}
+}
+
+// Accept blocks until a peer dials a new connection or the listener is closed. The connection is returned once
+// its init arrived, its streams are returned by AcceptStream. Connections we dialed are not accepted, and
+// connections that arrived before the first call neither, so call it before the peers dial.
+func (l *Listener) Accept() (*Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is Accept that returns the error of ctx once it is done
+func (l *Listener) AcceptContext(ctx context.Context) (*Conn, error) {
+	l.isAccepting.Store(true)
+	for {
+		select {
+		case c := <-l.acceptConnCh:
+			if !c.isClosedForAccept() {
+				return c, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-l.closeCh:
+			return nil, ErrListenerClosed
+		case <-l.context().Done():
+			return nil, l.ctxErr()
+		}
+	}
+}
+
+// isClosedForAccept is true for a connection that was closed while it was queued
+func (c *Conn) isClosedForAccept() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isCloseConnRequested || c.closeErr != nil
+}
+
+// onStreamOpened queues a stream the peer opened, it never blocks the receive path
+func (c *Conn) onStreamOpened(s *Stream) {
+	if !c.isAccepting.Load() && (c.isSenderOnInit || !c.listener.isAccepting.Load()) {
+		return
+	}
+	select {
+	case c.acceptCh <- s:
+	default:
+		slog.Debug("Accept/QueueFull", gId(), c.debug(), slog.Uint64("streamID", uint64(s.streamID)))
+	}
+}
+
+// AcceptStream blocks until the peer opens a new stream or the connection is closed. Streams opened before the
+// first call are not returned, except for the connections of Accept.
+func (c *Conn) AcceptStream() (*Stream, error) {
+	return c.AcceptStreamContext(context.Background())
+}
+
+// AcceptStreamContext is AcceptStream that returns the error of ctx once it is done. Streams that were queued
+// before the connection was closed are still returned, unless they were closed as well.
+func (c *Conn) AcceptStreamContext(ctx context.Context) (*Stream, error) {
+	c.isAccepting.Store(true)
+	for {
+		select {
+		case s := <-c.acceptCh:
+			if !c.isClosedStream(s) {
+				return s, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.Context().Done():
+			return c.acceptQueuedStream()
+		}
+	}
+}
+
+// acceptQueuedStream returns a stream that was queued before the connection was closed
+func (c *Conn) acceptQueuedStream() (*Stream, error) {
+	for {
+		select {
+		case s := <-c.acceptCh:
+			if !c.isClosedStream(s) {
+				return s, nil
+			}
+		default:
+			return nil, c.acceptErr()
+		}
+	}
+}
+
+// isClosedStream is true for a stream that was closed while it was queued
+func (c *Conn) isClosedStream(s *Stream) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return s.closedAtNano.Load() != 0
+}
+
+// acceptErr is the reason the connection was closed, the error of the context of the listener, or
+// ErrConnectionClosed
+func (c *Conn) acceptErr() error {
+	if err := c.listener.ctxErr(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeErr != nil {
+		return c.closeErr
+	}
+	return ErrConnectionClosed
+}
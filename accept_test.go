@@ -0,0 +1,163 @@
+package qotp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptStream(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.isAccepting.Store(true) // as after Accept
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	// the stream of the handshake is queued, like the streams A opens later
+	s, err := connB.AcceptStream()
+	assert.Nil(t, err)
+	assert.Same(t, streamB, s)
+
+	_, err = connA.Stream(5).Write([]byte("five"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + secondNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && !connB.streams.Contains(5); i++ {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+	}
+	s, err = connB.AcceptStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5), s.streamID)
+	b, err := s.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("five"), b)
+
+	// our own streams are not accepted
+	connB.Stream(9)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = connB.AcceptStreamContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAcceptStreamClosed(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.isAccepting.Store(true) // as after Accept
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	s, err := connB.AcceptStream()
+	assert.Nil(t, err)
+	assert.Same(t, streamB, s)
+
+	// a blocked accept returns once the connection is gone
+	errCh := make(chan error)
+	go func() {
+		_, err := connB.AcceptStream()
+		errCh <- err
+	}()
+	connB.cleanupConn(nil, 0)
+	assert.ErrorIs(t, <-errCh, ErrConnectionClosed)
+	_, err = connB.AcceptStream()
+	assert.ErrorIs(t, err, ErrConnectionClosed)
+}
+
+func TestAcceptConn(t *testing.T) {
+	server, err := Listen(WithListenAddr("127.0.0.1:0"), WithSeed(testPrvSeed2))
+	assert.Nil(t, err)
+	loopDone := make(chan struct{})
+	go func() {
+		server.Loop(func(s *Stream) (bool, error) { return true, nil })
+		close(loopDone)
+	}()
+	server.isAccepting.Store(true) // the clients may dial before AcceptContext is called
+
+	// two clients dial concurrently, each sends on stream 0 until it is closed
+	var wg sync.WaitGroup
+	clients := make([]*Listener, 2)
+	for i := range clients {
+		clients[i], err = Listen(WithListenAddr("127.0.0.1:0"), WithSeed([32]byte{byte(i + 3)}))
+		assert.Nil(t, err)
+		wg.Add(1)
+		go func(client *Listener, data string) {
+			defer wg.Done()
+			conn, err := client.DialWithCryptoString(server.localConn.LocalAddrString(), hexPubKey2)
+			assert.Nil(t, err)
+			_, err = conn.Stream(0).Write([]byte(data))
+			assert.Nil(t, err)
+			client.Loop(func(s *Stream) (bool, error) { return true, nil })
+		}(clients[i], fmt.Sprintf("client %d", i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	received := map[string]bool{}
+	for range clients {
+		conn, err := server.AcceptContext(ctx)
+		if !assert.Nil(t, err) {
+			break
+		}
+		s, err := conn.AcceptStreamContext(ctx)
+		assert.Nil(t, err)
+		var b []byte
+		for i := 0; i < 100 && len(b) == 0; i++ {
+			b, err = s.Read()
+			assert.Nil(t, err)
+			time.Sleep(time.Millisecond)
+		}
+		received[string(b)] = true
+	}
+	assert.Equal(t, map[string]bool{"client 0": true, "client 1": true}, received)
+
+	// our own connections are not accepted, a blocked accept returns once the listener is closed
+	cancel()
+	for _, client := range clients {
+		_, err = client.AcceptContext(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Nil(t, client.Close())
+	}
+	wg.Wait()
+	errCh := make(chan error)
+	go func() {
+		_, err := server.Accept()
+		errCh <- err
+	}()
+	assert.Nil(t, server.Close())
+	assert.ErrorIs(t, <-errCh, ErrListenerClosed)
+
+	// the Loop ends, and removes the connections in its goroutine
+	<-loopDone
+	assert.Zero(t, server.connMap.Size())
+}
+
+func TestAcceptNotCalled(t *testing.T) {
+	// without Accept, neither the connection nor its streams are queued
+	connA, listenerB, connPair := setupStreamTest(t)
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.Empty(t, listenerB.acceptConnCh)
+	assert.Empty(t, streamB.conn.acceptCh)
+
+	// a connection and a stream that were closed while they were queued are skipped
+	connA, listenerB, connPair = setupStreamTest(t)
+	listenerB.isAccepting.Store(true)
+	_, streamB = handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	assert.Len(t, listenerB.acceptConnCh, 1)
+	assert.Len(t, connB.acceptCh, 1)
+	streamB.closedAtNano.Store(connPair.Conn2.localTime)
+	connB.closeErr = ErrConnectionClosed
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := listenerB.AcceptContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = connB.AcceptStreamContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, listenerB.acceptConnCh)
+	assert.Empty(t, connB.acceptCh)
+}
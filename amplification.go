@@ -0,0 +1,46 @@
+package qotp
+
+import "log/slog"
+
+// defaultAmplificationFactor limits what we send to an unverified address, like QUIC, to three times what we
+// received from it, see WithAmplificationFactor
+const defaultAmplificationFactor = 3
+
+// Anti-amplification. An init can be sent with a spoofed source address, so the receiver of an init does not
+// send more than the amplification factor times the bytes it received on the connection until the address is
+// verified. The address is verified with the first Data packet of the peer, it could only encrypt it with the
+// keys of our reply, so it received the reply at that address. A retransmitted init adds to the credit. The
+// sender of the init chose the address itself, it is verified from the start.
+
+// IsAddressVerified returns true once the address of the peer is verified, until then the connection sends
+// at most the amplification factor times the bytes it received
+func (c *Conn) IsAddressVerified() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isAddressVerified()
+}
+
+func (c *Conn) isAddressVerified() bool {
+	return c.isSenderOnInit || c.isHandshakeDoneOnRcv
+}
+
+// isAmplificationLimited checks if the next packet could exceed the credit of an unverified address, the
+// packet can be as large as the handshake MTU
+func (c *Conn) isAmplificationLimited() bool {
+	if c.isAddressVerified() {
+		return false
+	}
+	if c.bytesSent+uint64(c.listener.handshakeMtu) <= c.listener.amplificationFactor()*c.bytesReceived {
+		return false
+	}
+	slog.Debug(" Flush/AmplificationLimit", gId(), c.debug(), slog.Uint64("sent", c.bytesSent),
+		slog.Uint64("received", c.bytesReceived))
+	return true
+}
+
+func (l *Listener) amplificationFactor() uint64 {
+	if l.amplificationLimit == 0 {
+		return defaultAmplificationFactor
+	}
+	return uint64(l.amplificationLimit)
+}
@@ -0,0 +1,128 @@
+package qotp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAmplificationLimit(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	assert.True(t, connA.IsAddressVerified())
+
+	// a single init of A, B replies with a lot of data
+	streamA := connA.Stream(0)
+	_, err := streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	nowNano := connPair.Conn1.localTime
+	connA.listener.Flush(nowNano)
+	initData := bytes.Clone(connPair.Conn1.writeQueue[0].data)
+	initLen := len(initData)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	var streamB *Stream
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, streamB)
+	connB := streamB.conn
+	assert.False(t, connB.IsAddressVerified())
+	_, err = streamB.Write(make([]byte, 20*initLen))
+	assert.Nil(t, err)
+
+	sentBytes := func() (n int) {
+		for _, p := range connPair.Conn2.writeQueue {
+			n += len(p.data)
+		}
+		return n
+	}
+	for i := 0; i < 50; i++ {
+		nowNano += 100 * msNano
+		listenerB.Flush(nowNano)
+	}
+	assert.NotZero(t, sentBytes())
+	assert.LessOrEqual(t, sentBytes(), defaultAmplificationFactor*initLen)
+	assert.Equal(t, uint64(sentBytes()), connB.bytesSent)
+
+	// a retransmitted init adds to the credit
+	sent := sentBytes()
+	connPair.Conn1.writeQueue = append(connPair.Conn1.writeQueue, packetData{data: initData})
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, nowNano)
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		nowNano += 100 * msNano
+		listenerB.Flush(nowNano)
+	}
+	assert.Greater(t, sentBytes(), sent)
+	assert.LessOrEqual(t, sentBytes(), 2*defaultAmplificationFactor*initLen)
+
+	// the Data of A verifies the address, the limit is gone
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsSender() > 0 {
+		_, err = connA.listener.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	assert.True(t, connA.isHandshakeDoneOnRcv)
+	nowNano += secondNano
+	connA.listener.Flush(nowNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsRecipient() > 0 {
+		_, err = listenerB.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	assert.True(t, connB.IsAddressVerified())
+	for i := 0; i < 50; i++ {
+		nowNano += 100 * msNano
+		listenerB.Flush(nowNano)
+	}
+	assert.Greater(t, connB.bytesSent, uint64(2*defaultAmplificationFactor*initLen))
+}
+
+func TestAmplificationReplySize(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.amplificationLimit = 1
+
+	streamA := connA.Stream(0)
+	_, err := streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	nowNano := connPair.Conn1.localTime
+	connA.listener.Flush(nowNano)
+	initLen := len(connPair.Conn1.writeQueue[0].data)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	var streamB *Stream
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, streamB)
+
+	// even with a factor of 1, the reply fits, but nothing more is sent
+	_, err = streamB.Write(make([]byte, 10*initLen))
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		nowNano += 100 * msNano
+		listenerB.Flush(nowNano)
+	}
+	assert.Len(t, connPair.Conn2.writeQueue, 1)
+	assert.LessOrEqual(t, len(connPair.Conn2.writeQueue[0].data), initLen)
+	assert.LessOrEqual(t, streamB.conn.bytesSent, uint64(initLen))
+}
+
+func TestAmplificationOption(t *testing.T) {
+	_, err := Listen(WithAmplificationFactor(2), WithAmplificationFactor(2))
+	assert.Error(t, err)
+	_, err = Listen(WithAmplificationFactor(0))
+	assert.Error(t, err)
+
+	listener, err := Listen(WithAmplificationFactor(5), WithListenAddr("127.0.0.1:0"))
+	assert.Nil(t, err)
+	defer listener.Close()
+	assert.Equal(t, uint64(5), listener.amplificationFactor())
+}
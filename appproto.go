@@ -0,0 +1,35 @@
+package qotp
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// maxAppProtoSize is the longest application protocol, its length is encoded in one byte
+const maxAppProtoSize = 255
+
+// ErrProtocolMismatch is returned if the peers do not agree on the application protocol, see
+// WithApplicationProtocols
+var ErrProtocolMismatch = errors.New("application protocol mismatch")
+
+// NegotiatedProtocol returns the application protocol of the connection. It is empty if none was offered, or
+// if we dialed and the reply of the peer did not arrive yet.
+func (c *Conn) NegotiatedProtocol() string {
+	if c.isSenderOnInit && !c.isHandshakeDoneOnRcv {
+		return ""
+	}
+	return c.appProto
+}
+
+// acceptAppProto checks the protocol the peer offered, like acceptConn, it is called before any state of a
+// new connection is created
+func (l *Listener) acceptAppProto(appProto string) error {
+	if l.appProtos == nil || slices.Contains(l.appProtos, appProto) {
+		return nil
+	}
+	if appProto == "" {
+		return fmt.Errorf("%w: no protocol offered", ErrProtocolMismatch)
+	}
+	return fmt.Errorf("%w: %q is not accepted", ErrProtocolMismatch, appProto)
+}
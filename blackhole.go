@@ -0,0 +1,93 @@
+package qotp
+
+import "log/slog"
+
+// Black hole detection, enabled with WithBlackHoleDetectionThreshold. A path that drops packets above some size
+// without an ICMP error, e.g., a tunnel behind a firewall that filters ICMP, loses every large packet while
+// small ones, like acks, still arrive. After threshold large packets in a row were sent again, as a probe or
+// after their RTO, without an ack of a large packet in between, the size of Data packets is halved. Once a packet of the halved size is
+// acked, the black hole is detected and the halved size is the MTU of the path from then on. If the halved
+// packets are lost too, it was loss and not a black hole, the size goes back. The don't fragment bit is set on
+// the socket of the listener, it cannot be cleared for a single path.
+//
+// It is disabled by default, as heavy loss looks like a black hole for a few packets, and the halved size
+// would stay for the connection.
+
+// minBlackHoleMtu is the smallest size the MTU is halved to, the minimum of IPv4 that every path supports
+const minBlackHoleMtu = 576
+
+// IsBlackHoleDetected is true once the path dropped the packets of the MTU but delivered the halved ones, Mtu
+// returns the halved size then
+func (c *Conn) IsBlackHoleDetected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isBlackHoleDetected
+}
+
+// isLargePacket is true if data would not fit a packet of the halved size
+func (c *Conn) isLargePacket(dataLen int) bool {
+	return dataLen*2 > c.payloadMtu(Data)
+}
+
+// onBlackHoleLoss is called with the data of a packet sent again, as a probe or after its RTO
+func (c *Conn) onBlackHoleLoss(dataLen int, nowNano uint64) {
+	if c.listener.blackHoleThreshold == 0 || c.isBlackHoleDetected || c.msgType() != Data {
+		return
+	}
+	if c.blackHoleMtu != 0 {
+		// the halved packets are lost too
+		c.blackHoleLosses++
+		if c.blackHoleLosses >= c.listener.blackHoleThreshold {
+			slog.Debug("BlackHole/Loss", gId(), c.debug(), slog.Int("size", c.blackHoleMtu))
+			c.blackHoleMtu = 0
+			c.blackHoleLosses = 0
+		}
+		return
+	}
+
+	if !c.isLargePacket(dataLen) {
+		return
+	}
+	c.blackHoleLosses++
+	if c.blackHoleLosses < c.listener.blackHoleThreshold {
+		return
+	}
+	c.blackHoleLosses = 0
+	size := max(c.dataMtu()/2, minBlackHoleMtu)
+	if size >= c.dataMtu() {
+		return
+	}
+	slog.Debug("BlackHole/Suspected", gId(), c.debug(), slog.Int("old", c.dataMtu()), slog.Int("new", size))
+	c.blackHoleMtu = size
+	c.blackHoleSinceNano = nowNano
+	c.pmtuProbeSize = 0
+}
+
+// onBlackHoleAck is called with the acked data and the time its packet was sent
+func (c *Conn) onBlackHoleAck(dataLen int, sentTimeNano uint64) {
+	if c.listener.blackHoleThreshold == 0 || c.isBlackHoleDetected || c.msgType() != Data || dataLen == 0 {
+		return
+	}
+	if c.blackHoleMtu == 0 {
+		if c.isLargePacket(dataLen) {
+			// large packets get through
+			c.blackHoleLosses = 0
+		}
+		return
+	}
+
+	if dataLen > c.payloadMtu(Data) {
+		// a packet larger than the halved size arrived after all
+		slog.Debug("BlackHole/Large", gId(), c.debug(), slog.Int("size", c.blackHoleMtu))
+		c.blackHoleMtu = 0
+		c.blackHoleLosses = 0
+		return
+	}
+	if sentTimeNano < c.blackHoleSinceNano {
+		return
+	}
+	slog.Debug("BlackHole/Detected", gId(), c.debug(), slog.Int("size", c.blackHoleMtu))
+	c.isBlackHoleDetected = true
+	c.pmtu = 0
+	c.pmtuSearchHigh = c.blackHoleMtu
+}
@@ -0,0 +1,109 @@
+package qotp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exchangeBlackHoleTest sends data from A to B over a path that drops packets larger than pathMtu, until B
+// read all of it
+func exchangeBlackHoleTest(t *testing.T, pathMtu int) (connA *Conn, data []byte) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connPair.Conn1.pathMtu = pathMtu
+	connA.listener.blackHoleThreshold = 3
+	connA.srtt, connA.rttvar, connA.bwMax = 10*msNano, 1*msNano, 0
+
+	data = bytes.Repeat([]byte{'x'}, 5000)
+	_, err := streamA.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, streamA.Flush())
+
+	var received []byte
+	nowNano := connPair.Conn1.localTime
+	for i := 0; i < 100 && len(received) < len(data); i++ {
+		nowNano += secondNano // past the pacing and the RTO
+		connA.listener.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		b, err := streamB.Read()
+		assert.Nil(t, err)
+		received = append(received, b...)
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, len(data), len(received))
+	return connA, data
+}
+
+func TestBlackHoleDetected(t *testing.T) {
+	connA, _ := exchangeBlackHoleTest(t, 1000)
+	assert.True(t, connA.IsBlackHoleDetected())
+	assert.Equal(t, 700, connA.Mtu())
+	assert.False(t, connA.isPmtuSearching())
+}
+
+func TestBlackHoleNone(t *testing.T) {
+	connA, _ := exchangeBlackHoleTest(t, 0)
+	assert.False(t, connA.IsBlackHoleDetected())
+	assert.Equal(t, 1400, connA.Mtu())
+}
+
+func TestBlackHoleLoss(t *testing.T) {
+	// the halved packets are lost too, the size goes back
+	connA, listenerB, connPair := setupStreamTest(t)
+	handshakeStreamTest(t, connA, listenerB, connPair)
+	connA.listener.blackHoleThreshold = 2
+	connA.onBlackHoleLoss(1300, 10)
+	assert.Zero(t, connA.blackHoleMtu)
+	connA.onBlackHoleLoss(1300, 20)
+	assert.Equal(t, 700, connA.Mtu())
+	assert.False(t, connA.IsBlackHoleDetected())
+
+	// an ack of a packet sent before the halving does not confirm it
+	connA.onBlackHoleAck(100, 15)
+	assert.False(t, connA.IsBlackHoleDetected())
+	connA.onBlackHoleLoss(600, 30)
+	connA.onBlackHoleLoss(600, 40)
+	assert.Equal(t, 1400, connA.Mtu())
+
+	// an ack of a large packet resets the count
+	connA.onBlackHoleLoss(1300, 50)
+	connA.onBlackHoleAck(1300, 50)
+	connA.onBlackHoleLoss(1300, 60)
+	assert.Equal(t, 1400, connA.Mtu())
+	// small packets do not count
+	connA.onBlackHoleLoss(100, 70)
+	assert.Equal(t, 1400, connA.Mtu())
+}
+
+func TestBlackHoleOption(t *testing.T) {
+	_, err := Listen(WithBlackHoleDetectionThreshold(2), WithBlackHoleDetectionThreshold(2))
+	assert.Error(t, err)
+	_, err = Listen(WithBlackHoleDetectionThreshold(0))
+	assert.Error(t, err)
+	_, err = Listen(WithDontFragment(true), WithDontFragment(true))
+	assert.Error(t, err)
+
+	connPair := NewConnPair("alice", "bob")
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithDontFragment(false))
+	assert.Error(t, err)
+	l, err := Listen(WithNetworkConn(connPair.Conn1))
+	assert.Nil(t, err)
+	assert.Zero(t, l.blackHoleThreshold)
+
+	l, err = Listen(WithListenAddr("127.0.0.1:0"), WithDontFragment(false))
+	assert.Nil(t, err)
+	assert.Nil(t, l.Close())
+}
@@ -0,0 +1,33 @@
+package qotp
+
+import "sync"
+
+// pooledBufferSize covers the MTU of any UDP path, larger buffers are allocated and not pooled
+const pooledBufferSize = 1500
+
+// bufferPool holds the buffers for received datagrams and their decrypted payloads, so that decoding does
+// not allocate per packet
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, pooledBufferSize)
+		return &b
+	},
+}
+
+// getBuffer returns a buffer of size bytes, it is returned with putBuffer once nothing refers to it anymore
+func getBuffer(size int) *[]byte {
+	if size > pooledBufferSize {
+		b := make([]byte, size)
+		return &b
+	}
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:size]
+	return b
+}
+
+func putBuffer(b *[]byte) {
+	if b == nil || cap(*b) != pooledBufferSize {
+		return
+	}
+	bufferPool.Put(b)
+}
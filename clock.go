@@ -0,0 +1,47 @@
+package qotp
+
+import "time"
+
+// Clock is the time source of a listener, in nanoseconds since the Unix epoch. Pacing, RTO, idle timeout and
+// the stream deadlines read from it, so that tests can move the time forward without sleeping.
+type Clock interface {
+	Now() int64
+}
+
+// TimerClock is a Clock that also runs the timers of the listener, the stream deadlines. Without it, they are
+// timers of the wall clock. See qotptest.SimulatedClock.
+type TimerClock interface {
+	Clock
+	// AfterFunc calls f once the clock passed d, stop cancels it and returns false if f was called already,
+	// like time.AfterFunc. Unlike there, f may run in the goroutine that moves the clock forward, e.g., in
+	// SimulatedClock.Advance, so f must not wait for it. The timers of the listener only wake up a waiting call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// wallClock is the default Clock
+type wallClock struct{}
+
+func (wallClock) Now() int64 {
+	return time.Now().UnixNano()
+}
+
+// nowNano returns the time of the clock of the listener, the wall clock if none is set
+func (l *Listener) nowNano() uint64 {
+	if l.clock == nil {
+		return uint64(wallClock{}.Now())
+	}
+	return uint64(l.clock.Now())
+}
+
+// now is nowNano as time, for the stream deadlines
+func (l *Listener) now() time.Time {
+	return time.Unix(0, int64(l.nowNano()))
+}
+
+// afterFunc runs f once d passed on the clock of the listener, a timer of the wall clock if it has no timers
+func (l *Listener) afterFunc(d time.Duration, f func()) (stop func() bool) {
+	if clock, ok := l.clock.(TimerClock); ok {
+		return clock.AfterFunc(d, f)
+	}
+	return time.AfterFunc(d, f).Stop
+}
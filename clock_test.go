@@ -0,0 +1,107 @@
+package qotp
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/qo-proto/qotp/qotptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// manualClock is a Clock that only moves when the test moves it
+type manualClock struct {
+	nowNano int64
+}
+
+func (c *manualClock) Now() int64 {
+	return c.nowNano
+}
+
+func TestClockDeadline(t *testing.T) {
+	clock := &manualClock{nowNano: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()}
+	connPair := NewConnPair("alice", "bob")
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithClock(clock))
+	assert.Nil(t, err)
+	conn, err := listener.Dial(netip.AddrPort{})
+	assert.Nil(t, err)
+	stream := conn.Stream(0)
+
+	// the deadline is far in the future of the wall clock, it only passes once the clock moves
+	deadline := time.Unix(0, clock.nowNano).Add(time.Second)
+	assert.Nil(t, stream.SetDeadline(deadline))
+	_, err = stream.Read()
+	assert.Nil(t, err)
+	_, err = stream.Write([]byte("hallo"))
+	assert.Nil(t, err)
+
+	clock.nowNano += 2 * int64(time.Second)
+	_, err = stream.Read()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	_, err = stream.Write([]byte("late"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	stream.readDeadline.stop()
+	stream.writeDeadline.stop()
+}
+
+func TestClockLoopIdleTimeout(t *testing.T) {
+	clock := &manualClock{nowNano: int64(secondNano)}
+	connPair := NewConnPair("alice", "bob")
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithClock(clock))
+	assert.Nil(t, err)
+	conn, err := listener.Dial(netip.AddrPort{})
+	assert.Nil(t, err)
+	_, err = conn.Stream(0).Write([]byte("hallo"))
+	assert.Nil(t, err)
+
+	loopOnce := func() {
+		listener.Loop(func(s *Stream) (bool, error) { return false, nil })
+	}
+	loopOnce()
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	assert.Equal(t, 1, listener.connMap.Size())
+
+	// no reply, the handshake is given up once the clock passed the timeout, without any sleep
+	clock.nowNano += int64(defaultHandshakeMaxTimeout) + int64(secondNano)
+	loopOnce()
+	loopOnce()
+	assert.Equal(t, 0, listener.connMap.Size())
+}
+
+func TestClockTimer(t *testing.T) {
+	clock := qotptest.NewSimulatedClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	var _ TimerClock = clock
+	connPair := NewConnPair("alice", "bob")
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithClock(clock))
+	assert.Nil(t, err)
+
+	// the timer of a deadline runs on the clock of the listener, not on the wall clock
+	var d deadline
+	isWoken := false
+	d.set(listener.now().Add(time.Second), listener, func() { isWoken = true })
+	clock.WaitForTimers(1)
+	clock.Advance(999 * time.Millisecond)
+	assert.False(t, isWoken)
+	clock.Advance(time.Millisecond)
+	assert.True(t, isWoken)
+
+	// a moved deadline stops the old timer
+	isWoken = false
+	d.set(listener.now().Add(time.Second), listener, func() { isWoken = true })
+	d.set(time.Time{}, listener, func() {})
+	clock.Advance(2 * time.Second)
+	assert.False(t, isWoken)
+}
+
+func TestClockOption(t *testing.T) {
+	_, err := Listen(WithClock(nil))
+	assert.Error(t, err)
+	_, err = Listen(WithClock(&manualClock{}), WithClock(&manualClock{}))
+	assert.Error(t, err)
+
+	// without a clock, the wall clock is used
+	now := uint64(time.Now().UnixNano())
+	assert.GreaterOrEqual(t, (&Listener{}).nowNano(), now)
+	assert.Equal(t, uint64(42), (&Listener{clock: &manualClock{nowNano: 42}}).nowNano())
+}
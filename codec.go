@@ -2,6 +2,7 @@ package qotp
 
 import (
 	"crypto/ecdh"
+	"crypto/ed25519"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,7 +11,59 @@ import (
 	"strings"
 )
 
+var (
+	// errOversizedInit is returned for an init larger than WithMaxHandshakeSize, it is not decrypted
+	errOversizedInit = errors.New("oversized init")
+	// errConnNotFound is returned for a reply or a Data packet of a connection we do not have
+	errConnNotFound = errors.New("connection not found")
+)
+
+const (
+	// snRotateAfter is the SN at which the send epoch rotates, well before the 48 bits of the SN wrap
+	snRotateAfter = uint64(1) << 47
+	// maxEpochCrypto is the last epoch, 47 bits
+	maxEpochCrypto = uint64(1)<<47 - 1
+)
+
+// DecodeError is returned by Listen for a received packet that is dropped, e.g., a corrupted or forged one. It
+// wraps the reason, ErrShortHeader, ErrShortPayload, ErrBadSequenceNumber, ErrDecrypt, ErrUnsupportedVersion
+// or ErrUnknownPayloadType, for errors.Is. The listener and its connections are not affected, Loop continues
+// after it. Any other error of Listen is fatal.
+type DecodeError struct {
+	MsgType CryptoMsgType // from the header of the packet
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode %v: %v", e.MsgType, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// newDecodeError wraps err in a DecodeError if a packet caused it, other errors are returned as they are
+func newDecodeError(encData []byte, err error) error {
+	for _, reason := range []error{ErrShortHeader, ErrShortPayload, ErrBadSequenceNumber, ErrDecrypt,
+		ErrUnsupportedVersion, ErrUnknownPayloadType, ErrUnknownMsgType, ErrLowOrderPoint, errConnNotFound} {
+		if errors.Is(err, reason) {
+			msgType := CryptoMsgType(encData[0] >> 5)
+			if msgType == DataPadded {
+				msgType = Data
+			}
+			return &DecodeError{MsgType: msgType, Err: err}
+		}
+	}
+	return err
+}
+
 func (conn *Conn) encode(p *PayloadHeader, userData []byte, msgType CryptoMsgType) (encData []byte, err error) {
+	return conn.encodeTo(nil, p, userData, msgType)
+}
+
+// encodeTo is encode that appends a Data packet to dst, see send. The inits are rare and allocated.
+func (conn *Conn) encodeTo(dst []byte, p *PayloadHeader, userData []byte, msgType CryptoMsgType) (
+	encData []byte, err error) {
 	// Create payload early for cases that need it
 	var packetData []byte
 
@@ -18,25 +71,37 @@ func (conn *Conn) encode(p *PayloadHeader, userData []byte, msgType CryptoMsgTyp
 		slog.Int("l(userData)", len(userData)),
 		slog.String("b…", string(userData[:min(16, len(userData))])))
 
+	if err = conn.putConnId(p, msgType); err != nil {
+		return nil, err
+	}
+
 	// Handle message encoding based on connection state
 	switch msgType {
 	case InitSnd:
-		_, encData = encryptInitSnd(
+		_, encData, err = encryptInitSnd(
 			conn.listener.prvKeyId.PublicKey(),
 			conn.prvKeyEpSnd.PublicKey(),
-			conn.listener.mtu,
+			conn.listener.handshakeMtu,
 		)
+		if err != nil {
+			return nil, err
+		}
+		// the nonce scheme and the packet cipher we offer follow the keys, they are not encrypted
+		encData[HeaderSize+(2*PubKeySize)] = byte(conn.nonceScheme)
+		encData[HeaderSize+(2*PubKeySize)+1] = conn.packetCipher().ID
 		conn.isInitSentOnSnd = true
 		slog.Debug("   Encode/InitSnd", gId(), conn.debug(),
 			slog.Int("l(encData)", len(encData)))
 	case InitCryptoSnd:
 		packetData, _ = EncodePayload(p, userData)
+		packetData = greasePayload(packetData)
+		packetData = putInitParams(conn.initParams(), packetData)
 		_, encData, err = encryptInitCryptoSnd(
 			conn.pubKeyIdRcv,
 			conn.listener.prvKeyId.PublicKey(),
 			conn.prvKeyEpSnd,
 			conn.snCrypto,
-			conn.listener.mtu,
+			conn.listener.handshakeMtu,
 			packetData,
 		)
 		if err != nil {
@@ -46,8 +111,29 @@ func (conn *Conn) encode(p *PayloadHeader, userData []byte, msgType CryptoMsgTyp
 		slog.Debug("   Encode/InitCryptoSnd", gId(), conn.debug(),
 			slog.Int("l(packetData)", len(packetData)),
 			slog.Int("l(encData)", len(encData)))
+	case InitSignedSnd:
+		packetData, _ = EncodePayload(p, userData)
+		packetData = greasePayload(packetData)
+		packetData = putInitParams(conn.initParams(), packetData)
+		_, encData, err = encryptInitSignedSnd(
+			conn.pubKeyIdRcv,
+			conn.listener.prvKeyEd,
+			conn.prvKeyEpSnd,
+			conn.snCrypto,
+			conn.listener.handshakeMtu,
+			packetData,
+		)
+		if err != nil {
+			return nil, err
+		}
+		conn.isInitSentOnSnd = true
+		slog.Debug("   Encode/InitSignedSnd", gId(), conn.debug(),
+			slog.Int("l(packetData)", len(packetData)),
+			slog.Int("l(encData)", len(encData)))
 	case InitCryptoRcv:
 		packetData, _ = EncodePayload(p, userData)
+		packetData = greasePayload(packetData)
+		packetData = append(conn.ownResetToken(), putInitParams(conn.initParams(), packetData)...)
 		encData, err = encryptInitCryptoRcv(
 			conn.connId,
 			conn.pubKeyEpRcv,
@@ -64,6 +150,8 @@ func (conn *Conn) encode(p *PayloadHeader, userData []byte, msgType CryptoMsgTyp
 			slog.Int("l(encData)", len(encData)))
 	case InitRcv:
 		packetData, _ = EncodePayload(p, userData)
+		packetData = greasePayload(packetData)
+		packetData = append(conn.ownResetToken(), putInitParams(conn.initParams(), packetData)...)
 		encData, err = encryptInitRcv(
 			conn.connId,
 			conn.listener.prvKeyId.PublicKey(),
@@ -81,12 +169,32 @@ func (conn *Conn) encode(p *PayloadHeader, userData []byte, msgType CryptoMsgTyp
 			slog.Int("l(encData)", len(encData)))
 	case Data:
 		packetData, _ = EncodePayload(p, userData)
-		encData, err = encryptData(
-			conn.connId,
+		packetData = greasePayload(packetData)
+		fillLen, isPadded := conn.paddingLen(len(packetData))
+		if isPadded {
+			packetData = padData(fillLen, packetData)
+		}
+		if conn.epochCryptoSnd > maxEpochCrypto {
+			// no packet can be sent anymore, not even the close, the peer times out
+			conn.closeErr = ErrSequenceExhausted
+			return nil, ErrSequenceExhausted
+		}
+		if err = conn.maybeRekey(); err != nil {
+			return nil, err
+		}
+		a, err := conn.dataAeads()
+		if err != nil {
+			return nil, err
+		}
+		encData, err = encryptDataTo(
+			dst,
+			conn.dataConnId(),
 			conn.isSenderOnInit,
-			conn.sharedSecret,
+			a,
+			conn.ivSnd,
 			conn.snCrypto,
 			conn.epochCryptoSnd,
+			isPadded,
 			packetData,
 		)
 		if err != nil {
@@ -96,81 +204,104 @@ func (conn *Conn) encode(p *PayloadHeader, userData []byte, msgType CryptoMsgTyp
 			slog.Int("len(payRaw)", len(packetData)),
 			slog.Int("len(dataEnc)", len(encData)))
 	default:
-		return nil, errors.New("unknown message type")
+		return nil, fmt.Errorf("%w: %v", ErrUnknownMsgType, msgType)
+	}
+
+	maxLen := conn.listener.handshakeMtu
+	if msgType == Data {
+		maxLen = conn.listener.maxPmtu() // path MTU probes are larger than the MTU
 	}
+	if len(encData) > maxLen {
+		return nil, fmt.Errorf("encoded packet of %v bytes exceeds mtu of %v bytes", len(encData), maxLen)
+	}
+	conn.bytesSent += uint64(len(encData))
+	if msgType == Data {
+		conn.bytesSinceRekey += uint64(len(encData))
+		conn.packetsSinceRekey++
+	}
+	conn.listener.metrics.onSent(len(encData))
+	conn.listener.packetsSent.Add(1)
+	conn.packetsSent++
+	conn.traceHandshakeSent(msgType)
 
 	//update state ofter encode of packet
 	conn.snCrypto++
-	//rollover
-	if conn.snCrypto > (1<<48)-1 {
-		if conn.epochCryptoSnd+1 > (1<<47)-1 {
-			//47, as the last bit is used for sender / receiver differentiation
-			//quic has key rotation (via bitflip), qotp does not.
-			return nil, errors.New("exhausted 2^95 sn number, cannot continue, you just " +
-				"sent ~5 billion ZettaBytes.\nNow you need to reconnect manually. This " +
-				"is roughly 28 million times all the data humanity has ever created.")
-		}
-		conn.epochCryptoSnd++
-		conn.snCrypto = 0
+	if conn.snCrypto >= snRotateAfter {
+		conn.rotateEpoch()
 	}
 	return encData, nil
 }
 
-func (l *Listener) decode(encData []byte, rAddr netip.AddrPort) (
-	conn *Conn, userData []byte, msgType CryptoMsgType, err error) {
+// rotateEpoch starts the next epoch of our SNs, the SN starts from 0 again. The peer tries the next epoch
+// for a packet that does not open with its current one. After the last epoch, no Data packet can be sent
+// anymore, see ErrSequenceExhausted.
+func (c *Conn) rotateEpoch() {
+	slog.Debug("Epoch/Rotate", gId(), c.debug(), slog.Uint64("epoch", c.epochCryptoSnd+1))
+	c.epochCryptoSnd++
+	c.snCrypto = 0
+	if c.state == connEstablished {
+		c.state = connRotating
+	}
+}
+
+// decode returns the decrypted message, its payload may use a pooled buffer, the caller releases it once the
+// payload is processed. The message is nil for InitSnd, it has no payload.
+func (l *Listener) decode(encData []byte, rAddr netip.AddrPort, nowNano uint64) (
+	conn *Conn, m *Message, msgType CryptoMsgType, err error) {
 	// Read the header byte and connId
 	if len(encData) < MinPacketSize {
-		return nil, nil, 0, fmt.Errorf("header needs to be at least %v bytes", MinPacketSize)
+		return nil, nil, 0, fmt.Errorf("%w: %d bytes, at least %v", ErrShortHeader, len(encData), MinPacketSize)
 	}
 
 	header := encData[0]
     version := header & 0x1F           // Extract bits 0-4 (mask 0001 1111)
-    if version != CryptoVersion {
-		return nil, nil, 0, errors.New("unsupported version version")
+	if isHeaderProtected(header) {
+		msgType = Data // the version is masked, decryptData checks it and strips the filler
+	} else if !isCryptoVersion(version) {
+		return nil, nil, 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	} else {
+		msgType = CryptoMsgType(header >> 5)
+	}
+
+	if msgType != Data && l.maxHandshakeSize > 0 && len(encData) > l.maxHandshakeSize {
+		return nil, nil, 0, fmt.Errorf("%w: %v of %d bytes, at most %d", errOversizedInit, msgType, len(encData),
+			l.maxHandshakeSize)
+	}
+
+	if isPeerInit(msgType) && !l.handshakeRateLimiter.allow(rAddr.Addr().Unmap(), nowNano) {
+		return nil, nil, 0, fmt.Errorf("%w: %v from %v", errHandshakeRateLimited, msgType, rAddr.Addr())
+	}
+
+	if err := l.acceptPeer(msgType, encData, rAddr); err != nil {
+		return nil, nil, 0, err
 	}
-    msgType = CryptoMsgType(header >> 5)
 
 	connId := Uint64(encData[HeaderSize : ConnIdSize+HeaderSize])
 
 	slog.Debug("  Decode", gId(), l.debug(), slog.Int("l(data)", len(encData)), slog.Any("msgType", msgType))
 
+	// a new connection is only created by an init, see decodeInitSnd and connOnInitCrypto
+	if conn := l.connById(connId); conn != nil && !conn.isMsgTypeValid(msgType) {
+		return conn, nil, 0, fmt.Errorf("%w: %v while %v", errUnexpectedMsgType, msgType, conn.state)
+	}
+
 	switch msgType {
 	case InitSnd:
-		// Decode S0 message
-		pubKeyIdSnd, pubKeyEpSnd, err := decryptInitSnd(encData, l.mtu)
-		if err != nil {
-			return nil, nil, 0, fmt.Errorf("failed to decode InitHandshakeS0: %w", err)
+		if len(encData) < HeaderSize+(2*PubKeySize)+2 {
+			return nil, nil, 0, fmt.Errorf("%w: InitSnd of %d bytes", ErrShortHeader, len(encData))
 		}
-		conn := l.connMap.Get(connId)
-		//we might have received this a multiple times due to retransmission in the first packet
-		//however the other side send us this, so we are expected to drop the old keys
-		var prvKeyEpRcv *ecdh.PrivateKey
-		if conn == nil {
-			prvKeyEpRcv, err = generateKey()
-			if err != nil {
-				return nil, nil, 0, fmt.Errorf("failed to generate keys: %w", err)
-			}
-			conn, err = l.newConn(connId, rAddr, prvKeyEpRcv, pubKeyIdSnd, pubKeyEpSnd, false, false)
-			if err != nil {
-				return nil, nil, 0, fmt.Errorf("failed to create connection: %w", err)
-			}
-			l.connMap.Put(connId, conn)
-		} else {
-			prvKeyEpRcv = conn.prvKeyEpSnd
-		}
-
-		sharedSecret, err := prvKeyEpRcv.ECDH(pubKeyEpSnd)
-		if err != nil {
-			return nil, nil, 0, fmt.Errorf("failed to create connection: %w", err)
+		if err := l.acceptPacketCipher(encData[HeaderSize+(2*PubKeySize)+1]); err != nil {
+			return nil, nil, 0, err
 		}
-		conn.sharedSecret = sharedSecret
-		slog.Debug(" Decode/InitSnd", gId(), l.debug())
-		return conn, []byte{}, InitSnd, nil
+		return l.decodeInitSnd(encData, connId, rAddr, initParams{
+			nonceScheme: nonceScheme(encData[HeaderSize+(2*PubKeySize)]),
+			cipherID:    encData[HeaderSize+(2*PubKeySize)+1],
+		})
 	case InitRcv:
 		connId := Uint64(encData[HeaderSize : HeaderSize+ConnIdSize])
 		conn := l.connMap.Get(connId)
 		if conn == nil {
-			return nil, nil, 0, errors.New("connection not found for InitRcv")
+			return nil, nil, 0, fmt.Errorf("%w: InitRcv", errConnNotFound)
 		}
 
 		// Decode R0 message
@@ -181,48 +312,110 @@ func (l *Listener) decode(encData []byte, rAddr netip.AddrPort) (
 			return nil, nil, 0, fmt.Errorf("failed to decode InitRcv: %w", err)
 		}
 
+		if len(message.PayloadRaw) < ResetTokenSize {
+			return nil, nil, 0, fmt.Errorf("%w: InitRcv is missing the reset token", ErrShortPayload)
+		}
+
+		if conn.isWithCryptoOnInit {
+			// we sent InitCryptoSnd, but the peer replied as to InitSnd, it could not decrypt with its identity key.
+			// Anyone on the path can send this reply, so its identity key is not trusted and the early data is
+			// not sent again, a redial with Dial is up to the application.
+			zeroize(sharedSecret)
+			return conn, nil, 0, fmt.Errorf("%w: peer replied with InitRcv", ErrWrongServerIdentityKey)
+		}
+
+		params, packetData, err := decodeInitParams(message.PayloadRaw[ResetTokenSize:])
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to decode InitRcv: %w", err)
+		}
+		if err = conn.checkReplyParams(params); err != nil {
+			zeroize(sharedSecret)
+			return conn, nil, 0, err
+		}
+
+		if err = l.pinKey(conn.remoteAddr, pubKeyIdRcv); err != nil {
+			zeroize(sharedSecret)
+			return conn, nil, 0, err
+		}
+
 		conn.pubKeyIdRcv = pubKeyIdRcv
 		conn.pubKeyEpRcv = pubKeyEpRcv
-		conn.sharedSecret = sharedSecret
+		conn.setSharedSecret(sharedSecret)
+		conn.setNonceScheme(params.nonceScheme)
+		conn.setPacketCipher(params.cipherID)
+		conn.resetToken = message.PayloadRaw[:ResetTokenSize]
+		message.PayloadRaw = packetData
 
 		slog.Debug(" Decode/InitRcv", gId(), l.debug())
-		return conn, message.PayloadRaw, InitRcv, nil
+		return conn, message, InitRcv, nil
 	case InitCryptoSnd:
 		// Decode crypto S0 message
 		pubKeyIdSnd, pubKeyEpSnd, message, err := decryptInitCryptoSnd(
-			encData, l.prvKeyId, l.mtu)
+			encData, l.prvKeyId, minInitSize)
+		if errors.Is(err, ErrWrongServerIdentityKey) {
+			// reply as to InitSnd, the dialer fails with ErrWrongServerIdentityKey, the early data is lost
+			slog.Info("InitCryptoSnd with wrong identity key, replying with InitRcv", l.debug(), slog.Any("error", err))
+			return l.decodeInitSnd(encData, connId, rAddr, initParams{nonceScheme: nonceSplit, cipherID: chachaSuite.ID})
+		}
 		if err != nil {
 			return nil, nil, 0, fmt.Errorf("failed to decode InitWithCryptoS0: %w", err)
 		}
-		//we might have received this a multiple times due to retransmission in the first packet
-		//however the other side send us this, so we are expected to drop the old keys
-		conn := l.connMap.Get(connId)
-
-		var prvKeyEpRcv *ecdh.PrivateKey
-		if conn == nil {
-			prvKeyEpRcv, err = generateKey()
-			if err != nil {
-				return nil, nil, 0, fmt.Errorf("failed to generate keys: %w", err)
+		params, packetData, err := decodeInitParams(message.PayloadRaw)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to decode InitWithCryptoS0: %w", err)
+		}
+		conn, err := l.connOnInitCrypto(connId, rAddr, pubKeyIdSnd, pubKeyEpSnd, func() error {
+			if err := l.acceptAppProto(params.appProto); err != nil {
+				return err
 			}
-			conn, err = l.newConn(connId, rAddr, prvKeyEpRcv, pubKeyIdSnd, pubKeyEpSnd, false, true)
-			if err != nil {
-				return nil, nil, 0, fmt.Errorf("failed to create connection: %w", err)
+			if err := l.acceptPacketCipher(params.cipherID); err != nil {
+				return err
 			}
-			l.connMap.Put(connId, conn)
-		} else {
-			prvKeyEpRcv = conn.prvKeyEpSnd
+			return l.acceptConn(pubKeyIdSnd, rAddr)
+		})
+		if err != nil {
+			return conn, nil, 0, err
 		}
-
-		sharedSecret, err := prvKeyEpRcv.ECDH(pubKeyEpSnd)
-
-		conn.sharedSecret = sharedSecret
+		conn.appProto = params.appProto
+		conn.setNonceScheme(l.chooseNonceScheme(params.nonceScheme))
+		conn.cipherSuite = l.choosePacketCipher(params.cipherID)
+		message.PayloadRaw = packetData
 		slog.Debug(" Decode/InitCryptoSnd", gId(), l.debug())
-		return conn, message.PayloadRaw, InitCryptoSnd, nil
+		return conn, message, InitCryptoSnd, nil
+	case InitSignedSnd:
+		// the signature is verified first, a forged init does not create any state
+		pubKeyEdSnd, pubKeyEpSnd, message, err := decryptInitSignedSnd(encData, l.prvKeyId, minInitSignedSize)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to decode InitSignedSnd: %w", err)
+		}
+		params, packetData, err := decodeInitParams(message.PayloadRaw)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to decode InitSignedSnd: %w", err)
+		}
+		conn, err := l.connOnInitCrypto(connId, rAddr, nil, pubKeyEpSnd, func() error {
+			if err := l.acceptAppProto(params.appProto); err != nil {
+				return err
+			}
+			if err := l.acceptPacketCipher(params.cipherID); err != nil {
+				return err
+			}
+			return l.acceptConnEd25519(pubKeyEdSnd, rAddr)
+		})
+		if err != nil {
+			return conn, nil, 0, err
+		}
+		conn.pubKeyEdRcv = pubKeyEdSnd
+		conn.appProto = params.appProto
+		conn.setNonceScheme(l.chooseNonceScheme(params.nonceScheme))
+		conn.cipherSuite = l.choosePacketCipher(params.cipherID)
+		message.PayloadRaw = packetData
+		slog.Debug(" Decode/InitSignedSnd", gId(), l.debug())
+		return conn, message, InitSignedSnd, nil
 	case InitCryptoRcv:
 		connId := Uint64(encData[HeaderSize : HeaderSize+ConnIdSize])
 		conn := l.connMap.Get(connId)
 		if conn == nil {
-			return nil, nil, 0, errors.New("connection not found for InitWithCryptoR0")
+			return nil, nil, 0, fmt.Errorf("%w: InitCryptoRcv", errConnNotFound)
 		}
 
 		// Decode crypto R0 message
@@ -231,35 +424,199 @@ func (l *Listener) decode(encData []byte, rAddr netip.AddrPort) (
 			return nil, nil, 0, fmt.Errorf("failed to decode InitWithCryptoR0: %w", err)
 		}
 
+		if len(message.PayloadRaw) < ResetTokenSize {
+			return nil, nil, 0, fmt.Errorf("%w: InitCryptoRcv is missing the reset token", ErrShortPayload)
+		}
+		params, packetData, err := decodeInitParams(message.PayloadRaw[ResetTokenSize:])
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to decode InitWithCryptoR0: %w", err)
+		}
+		if err = conn.checkReplyParams(params); err != nil {
+			zeroize(sharedSecret)
+			return conn, nil, 0, err
+		}
+
+		// the peer could decrypt InitCryptoSnd, so it holds the identity key we dialed with
+		if err = l.pinKey(conn.remoteAddr, conn.pubKeyIdRcv); err != nil {
+			zeroize(sharedSecret)
+			return conn, nil, 0, err
+		}
+
 		conn.pubKeyEpRcv = pubKeyEpRcv
-		conn.sharedSecret = sharedSecret
+		conn.setSharedSecret(sharedSecret)
+		conn.setNonceScheme(params.nonceScheme)
+		conn.setPacketCipher(params.cipherID)
+		conn.resetToken = message.PayloadRaw[:ResetTokenSize]
+		message.PayloadRaw = packetData
 
 		slog.Debug(" Decode/InitCryptoRcv", gId(), l.debug())
-		return conn, message.PayloadRaw, InitCryptoRcv, nil
+		return conn, message, InitCryptoRcv, nil
 	case Data:
 		connId := Uint64(encData[HeaderSize : HeaderSize+ConnIdSize])
-		conn := l.connMap.Get(connId)
+		conn := l.connById(connId)
 		if conn == nil {
+			// a stateless reset of the peer is sent to the ID it issued to us, see connid.go
+			if peerConn := l.peerConnIds.Get(connId); peerConn != nil && isStatelessReset(encData, peerConn.resetToken) {
+				slog.Debug(" Decode/StatelessReset", gId(), l.debug(), slog.Uint64("connId", connId))
+				return peerConn, nil, Data, ErrConnectionReset
+			}
 			slog.Debug("No connection", slog.Uint64("connId", connId), slog.Int("available", l.connMap.Size()))
-			return nil, nil, 0, errors.New("connection not found for DataMessage")
+			// Reply with a stateless reset, but only to packets larger than the reset itself, so
+			// that two endpoints without state cannot keep resetting each other
+			if len(encData) > ResetPacketSize && l.isStatelessReset {
+				err = l.sendStatelessReset(connId, rAddr, nowNano)
+				if err != nil {
+					return nil, nil, 0, err
+				}
+			}
+			return nil, nil, 0, fmt.Errorf("%w: Data", errConnNotFound)
 		}
 
 		// Decode Data message
-		message, err := decryptData(encData, conn.isSenderOnInit, conn.epochCryptoRcv, conn.sharedSecret)
+		message, err := conn.openData(encData)
 		if err != nil {
+			if isStatelessReset(encData, conn.resetToken) {
+				slog.Debug(" Decode/StatelessReset", gId(), l.debug(), slog.Uint64("connId", connId))
+				return conn, nil, Data, ErrConnectionReset
+			}
 			return nil, nil, 0, err
 		}
 
+		// only now the packet is authenticated, a replay is dropped before it reaches a stream
+		seq := replaySeq(message.currentEpochCrypt, message.SnConn)
+		if conn.replay.isAhead(seq, l.snWindow()) {
+			message.Release()
+			return conn, nil, Data, fmt.Errorf("%w: sn %v, epoch %v", errSnOutOfWindow, message.SnConn,
+				message.currentEpochCrypt)
+		}
+		if !conn.replay.accept(seq, l.replayWindow()) {
+			message.Release()
+			return conn, nil, Data, fmt.Errorf("%w: sn %v, epoch %v", errReplayedPacket, message.SnConn,
+				message.currentEpochCrypt)
+		}
+
+		conn.onConnIdUsed(connId)
+
 		//we decoded conn.epochCrypto + 1, that means we can safely move forward with the epoch
 		if message.currentEpochCrypt > conn.epochCryptoRcv {
 			conn.epochCryptoRcv = message.currentEpochCrypt
 		}
 
 		slog.Debug(" Decode/Data", gId(), l.debug(), slog.Int("l(buffer)", len(encData)))
-		return conn, message.PayloadRaw, Data, nil
+		return conn, message, Data, nil
 	default:
-		return nil, nil, 0, fmt.Errorf("unknown message type: %v", msgType)
+		return nil, nil, 0, fmt.Errorf("%w: %v", ErrUnknownMsgType, msgType)
+	}
+}
+
+// acceptConn runs the accept filter before any state of a new connection is created. It is called only after
+// the init was fully decoded and decrypted, so a rejection takes as long as an accept up to the filter itself.
+func (l *Listener) acceptConn(pubKeyIdSnd *ecdh.PublicKey, rAddr netip.AddrPort) error {
+	if l.isStopping.Load() {
+		return fmt.Errorf("%w: %w", ErrConnectionRejected, errListenerStopping)
+	}
+	if l.acceptFilter == nil {
+		return nil
+	}
+	if err := l.acceptFilter(pubKeyIdSnd, rAddr); err != nil {
+		return fmt.Errorf("%w: %w", ErrConnectionRejected, err)
+	}
+	return nil
+}
+
+// acceptConnEd25519 is acceptConn for a peer with an Ed25519 identity. The accept filter for X25519 keys cannot
+// check it, so with only that filter set, such a peer is rejected.
+func (l *Listener) acceptConnEd25519(pubKeyEdSnd ed25519.PublicKey, rAddr netip.AddrPort) error {
+	if l.isStopping.Load() {
+		return fmt.Errorf("%w: %w", ErrConnectionRejected, errListenerStopping)
+	}
+	if l.peers.hasAllowList() {
+		return fmt.Errorf("%w: %w, an Ed25519 identity", ErrConnectionRejected, errPeerNotAllowed)
+	}
+	if l.acceptFilterEd25519 == nil {
+		if l.acceptFilter != nil {
+			return fmt.Errorf("%w: no accept filter for Ed25519 identities", ErrConnectionRejected)
+		}
+		return nil
+	}
+	if err := l.acceptFilterEd25519(pubKeyEdSnd, rAddr); err != nil {
+		return fmt.Errorf("%w: %w", ErrConnectionRejected, err)
+	}
+	return nil
+}
+
+// connOnInitCrypto creates the connection for a decrypted InitCryptoSnd or InitSignedSnd and derives the
+// shared secret from the ephemeral keys. accept is only called for a new connection, an init for an existing
+// one is a retransmission, see checkDuplicateInit.
+func (l *Listener) connOnInitCrypto(connId uint64, rAddr netip.AddrPort, pubKeyIdSnd *ecdh.PublicKey,
+	pubKeyEpSnd *ecdh.PublicKey, accept func() error) (*Conn, error) {
+	conn := l.connMap.Get(connId)
+	if conn != nil {
+		return conn, conn.checkDuplicateInit(pubKeyEpSnd)
+	}
+	err := accept()
+	if err != nil {
+		return nil, err
+	}
+	prvKeyEpRcv, err := generateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate keys: %w", err)
+	}
+	// before newConn, a low order key of the peer leaves no connection without keys behind
+	sharedSecret, err := sharedSecretECDH(prvKeyEpRcv, pubKeyEpSnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection: %w", err)
+	}
+	conn, err = l.newConn(connId, rAddr, prvKeyEpRcv, pubKeyIdSnd, pubKeyEpSnd, false, true)
+	if err != nil {
+		zeroize(sharedSecret)
+		return nil, fmt.Errorf("failed to create connection: %w", err)
+	}
+	l.connMap.Put(connId, conn)
+
+	conn.setSharedSecret(sharedSecret)
+	return conn, nil
+}
+
+// decodeInitSnd creates the connection for an InitSnd, or for an InitCryptoSnd that we could not decrypt, then
+// nothing is offered. An init for an existing connection is a retransmission, see checkDuplicateInit.
+func (l *Listener) decodeInitSnd(encData []byte, connId uint64, rAddr netip.AddrPort, offered initParams) (
+	conn *Conn, m *Message, msgType CryptoMsgType, err error) {
+	// Decode S0 message
+	pubKeyIdSnd, pubKeyEpSnd, err := decryptInitSnd(encData, minInitSize)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to decode InitHandshakeS0: %w", err)
+	}
+	conn = l.connMap.Get(connId)
+	if conn != nil {
+		return conn, nil, 0, conn.checkDuplicateInit(pubKeyEpSnd)
+	}
+	// an application protocol can only be offered in an init with crypto
+	if err = l.acceptAppProto(""); err != nil {
+		return nil, nil, 0, err
+	}
+	if err = l.acceptConn(pubKeyIdSnd, rAddr); err != nil {
+		return nil, nil, 0, err
+	}
+	prvKeyEpRcv, err := generateKey()
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to generate keys: %w", err)
+	}
+	sharedSecret, err := sharedSecretECDH(prvKeyEpRcv, pubKeyEpSnd)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to create connection: %w", err)
+	}
+	conn, err = l.newConn(connId, rAddr, prvKeyEpRcv, pubKeyIdSnd, pubKeyEpSnd, false, false)
+	if err != nil {
+		zeroize(sharedSecret)
+		return nil, nil, 0, fmt.Errorf("failed to create connection: %w", err)
 	}
+	l.connMap.Put(connId, conn)
+	conn.setSharedSecret(sharedSecret)
+	conn.setNonceScheme(l.chooseNonceScheme(offered.nonceScheme))
+	conn.cipherSuite = l.choosePacketCipher(offered.cipherID)
+	slog.Debug(" Decode/InitSnd", gId(), l.debug())
+	return conn, nil, InitSnd, nil
 }
 
 func decodeHex(pubKeyHex string) ([]byte, error) {
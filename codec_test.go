@@ -35,8 +35,9 @@ func createTestConnection(isSender, withCrypto, handshakeDone bool) *Conn {
 		snCrypto: 0,
 		pubKeyIdRcv: prvIdBob.PublicKey(),
 		prvKeyEpSnd: prvEpAlice,
-		listener:     &Listener{prvKeyId: prvIdAlice, mtu: 1400},
+		listener:     &Listener{prvKeyId: prvIdAlice, mtu: 1400, handshakeMtu: 1400},
 		snd:          NewSendBuffer(sndBufferCapacity),
+		loss:         NewLossRecovery(maxRTO),
 		rcv:          NewReceiveBuffer(1000),
 		streams:      NewLinkedMap[uint32, *Stream](),
 		sharedSecret: bytes.Repeat([]byte{1}, 32),
@@ -59,11 +60,13 @@ func createTestListeners() (*Listener, *Listener) {
 		connMap:  NewLinkedMap[uint64, *Conn](),
 		prvKeyId: prvIdAlice,
 		mtu: 1400,
+		handshakeMtu: 1400,
 	}
 	lBob := &Listener{
 		connMap:  NewLinkedMap[uint64, *Conn](),
 		prvKeyId: prvIdBob,
 		mtu: 1400,
+		handshakeMtu: 1400,
 	}
 	return lAlice, lBob
 }
@@ -104,6 +107,17 @@ func TestCodecConnectionClosed(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCodecInitLowOrderPoint(t *testing.T) {
+	// the ECDH fails before the connection is created, none without keys stays in the map
+	_, listenerB, _ := setupStreamTest(t)
+	lowOrder, err := ecdh.X25519().NewPublicKey(lowOrderPoints[2][:])
+	assert.Nil(t, err)
+	_, err = listenerB.connOnInitCrypto(1234, netip.AddrPort{}, testPrvKey1.PublicKey(), lowOrder,
+		func() error { return nil })
+	assert.ErrorIs(t, err, ErrLowOrderPoint)
+	assert.Zero(t, listenerB.connMap.Size())
+}
+
 // Overhead Calculation Tests - Updated to use CalcMaxOverhead function
 func TestCodecOverheadInitSndNoData(t *testing.T) {
 	overhead := calcCryptoOverheadWithData(InitSnd, nil, 100)
@@ -112,7 +126,7 @@ func TestCodecOverheadInitSndNoData(t *testing.T) {
 
 func TestCodecOverheadInitRcvNoAck(t *testing.T) {
 	overhead := calcCryptoOverheadWithData(InitRcv, nil, 100)
-	expected := calcProtoOverhead(false, false, false) + MinInitRcvSizeHdr + FooterDataSize
+	expected := calcProtoOverhead(false, false, false) + MinInitRcvSizeHdr + FooterDataSize + ResetTokenSize
 	assert.Equal(t, expected, overhead)
 }
 
@@ -124,7 +138,7 @@ func TestCodecOverheadInitCryptoSnd(t *testing.T) {
 
 func TestCodecOverheadInitCryptoRcv(t *testing.T) {
 	overhead := calcCryptoOverheadWithData(InitCryptoRcv, nil, 100)
-	expected := calcProtoOverhead(false, false, false) + MinInitCryptoRcvSizeHdr + FooterDataSize
+	expected := calcProtoOverhead(false, false, false) + MinInitCryptoRcvSizeHdr + FooterDataSize + ResetTokenSize
 	assert.Equal(t, expected, overhead)
 }
 
@@ -173,11 +187,11 @@ func TestCodecDataSizeZero(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, encoded)
 
-	connBob, payload, msgType, err := lBob.decode(encoded, getTestRemoteAddr())
+	connBob, m, msgType, err := lBob.decode(encoded, getTestRemoteAddr(), 0)
 	assert.NoError(t, err)
 
 	if msgType == InitCryptoRcv {
-		p, u, err := DecodePayload(payload)
+		p, u, err := DecodePayload(m.PayloadRaw)
 		s, err := connBob.decode(p, u, 0, 0)
 		assert.NoError(t, err)
 		assert.NotNil(t, s)
@@ -202,10 +216,10 @@ func TestCodecDataSizeOne(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, encoded)
 
-	connBob, payload, _, err := lBob.decode(encoded, getTestRemoteAddr())
+	connBob, m, _, err := lBob.decode(encoded, getTestRemoteAddr(), 0)
 	assert.NoError(t, err)
 
-	p, u, err := DecodePayload(payload)
+	p, u, err := DecodePayload(m.PayloadRaw)
 	s, err := connBob.decode(p, u, 0, 0)
 	assert.NoError(t, err)
 	_, rb, _ := s.conn.rcv.RemoveOldestInOrder(s.streamID)
@@ -230,10 +244,10 @@ func TestCodecDataSizeHundred(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, encoded)
 
-	connBob, payload, _, err := lBob.decode(encoded, getTestRemoteAddr())
+	connBob, m, _, err := lBob.decode(encoded, getTestRemoteAddr(), 0)
 	assert.NoError(t, err)
 
-	p, u, err := DecodePayload(payload)
+	p, u, err := DecodePayload(m.PayloadRaw)
 	s, err := connBob.decode(p, u, 0, 0)
 	assert.NoError(t, err)
 	_, rb, _ := s.conn.rcv.RemoveOldestInOrder(s.streamID)
@@ -258,10 +272,10 @@ func TestCodecDataSizeThousand(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, encoded)
 
-	connBob, payload, _, err := lBob.decode(encoded, getTestRemoteAddr())
+	connBob, m, _, err := lBob.decode(encoded, getTestRemoteAddr(), 0)
 	assert.NoError(t, err)
 
-	p, u, err := DecodePayload(payload)
+	p, u, err := DecodePayload(m.PayloadRaw)
 	s, err := connBob.decode(p, u, 0, 0)
 	assert.NoError(t, err)
 	_, rb, _ := s.conn.rcv.RemoveOldestInOrder(s.streamID)
@@ -286,10 +300,10 @@ func TestCodecDataSizeLarge(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, encoded)
 
-	connBob, payload, _, err := lBob.decode(encoded, getTestRemoteAddr())
+	connBob, m, _, err := lBob.decode(encoded, getTestRemoteAddr(), 0)
 	assert.NoError(t, err)
 
-	p, u, err := DecodePayload(payload)
+	p, u, err := DecodePayload(m.PayloadRaw)
 	s, err := connBob.decode(p, u, 0, 0)
 	assert.NoError(t, err)
 	_, rb, _ := s.conn.rcv.RemoveOldestInOrder(s.streamID)
@@ -320,7 +334,7 @@ func TestCodecFullHandshake(t *testing.T) {
 	assert.NotNil(t, encoded)
 
 	// Step 2: Bob receives and decodes InitSnd
-	connBob, _, msgTypeS0, err := lBob.decode(encoded, remoteAddr)
+	connBob, _, msgTypeS0, err := lBob.decode(encoded, remoteAddr, 0)
 	assert.NoError(t, err)
 	assert.NotNil(t, connBob)
 	assert.Equal(t, InitSnd, msgTypeS0)
@@ -333,11 +347,11 @@ func TestCodecFullHandshake(t *testing.T) {
 	assert.NotNil(t, encodedR0)
 
 	// Step 4: Alice receives and decodes InitRcv
-	c, payload, msgType, err := lAlice.decode(encodedR0, remoteAddr)
+	c, m, msgType, err := lAlice.decode(encodedR0, remoteAddr, 0)
 	assert.NoError(t, err)
 	assert.Equal(t, InitRcv, msgType)
 
-	p, u, err := DecodePayload(payload)
+	p, u, err := DecodePayload(m.PayloadRaw)
 	s, err := c.decode(p, u, 0, 0)
 	assert.NoError(t, err)
 	_, rb, _ := s.conn.rcv.RemoveOldestInOrder(s.streamID)
@@ -364,12 +378,12 @@ func TestCodecFullHandshake(t *testing.T) {
 	assert.NotNil(t, encoded)
 
 	// Step 7: Bob receives and decodes Data message
-	c, payload, msgType, err = lBob.decode(encoded, remoteAddr)
+	c, m, msgType, err = lBob.decode(encoded, remoteAddr, 0)
 	assert.NoError(t, err)
 	assert.NotNil(t, c)
 	assert.Equal(t, Data, msgType)
 
-	p, u, err = DecodePayload(payload)
+	p, u, err = DecodePayload(m.PayloadRaw)
 	s, err = c.decode(p, u, 0, 0)
 	assert.NoError(t, err)
 	_, rb, _ = s.conn.rcv.RemoveOldestInOrder(s.streamID)
@@ -379,33 +393,41 @@ func TestCodecFullHandshake(t *testing.T) {
 // Sequence Number Tests
 func TestCodecSequenceNumberRollover(t *testing.T) {
 	conn := createTestConnection(true, false, true)
-	conn.snCrypto = (1 << 48) - 2 // Near rollover
+	conn.snCrypto = snRotateAfter - 2 // Near rotation
 	conn.epochCryptoSnd = 0
+	conn.state = connEstablished
 
-	// First encode should succeed and rollover snCrypto
+	// First encode should succeed and increment snCrypto
 	p := &PayloadHeader{}
 	_, err := conn.encode(p, []byte("test"), Data)
 	assert.NoError(t, err)
-	assert.Equal(t, uint64((1<<48)-1), conn.snCrypto)
+	assert.Equal(t, snRotateAfter-1, conn.snCrypto)
 
-	// Second encode should trigger rollover
+	// Second encode should trigger the rotation, half of the 48 bits are never used
 	p = &PayloadHeader{}
 	_, err = conn.encode(p, []byte("test"), Data)
 	assert.NoError(t, err)
 	assert.Equal(t, uint64(0), conn.snCrypto)
 	assert.Equal(t, uint64(1), conn.epochCryptoSnd)
+	assert.Equal(t, connRotating, conn.state)
 }
 
 func TestCodecSequenceNumberExhaustion(t *testing.T) {
 	conn := createTestConnection(true, false, true)
-	conn.snCrypto = (1 << 48) - 1
-	conn.epochCryptoSnd = (1 << 47) - 1 // Max epoch
+	conn.snCrypto = snRotateAfter - 1
+	conn.epochCryptoSnd = maxEpochCrypto
 
-	// Should fail with exhaustion error
+	// The last SN of the last epoch is sent
 	p := &PayloadHeader{}
 	_, err := conn.encode(p, []byte("test"), Data)
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "exhausted")
+	assert.NoError(t, err)
+	assert.Nil(t, conn.closeErr)
+
+	// Should fail with exhaustion error and close the connection
+	p = &PayloadHeader{}
+	_, err = conn.encode(p, []byte("test"), Data)
+	assert.ErrorIs(t, err, ErrSequenceExhausted)
+	assert.ErrorIs(t, conn.closeErr, ErrSequenceExhausted)
 }
 
 // Error Tests
@@ -415,8 +437,7 @@ func TestCodecInvalidMessageType(t *testing.T) {
 	// Test with invalid message type
 	p := &PayloadHeader{}
 	_, err := conn.encode(p, []byte("test"), CryptoMsgType(99))
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "unknown message type")
+	assert.ErrorIs(t, err, ErrUnknownMsgType)
 }
 
 func TestCodecDecodeEmptyBuffer(t *testing.T) {
@@ -425,7 +446,7 @@ func TestCodecDecodeEmptyBuffer(t *testing.T) {
 		prvKeyId: prvIdAlice,
 	}
 
-	_, _, _, err := l.decode([]byte{}, getTestRemoteAddr())
+	_, _, _, err := l.decode([]byte{}, getTestRemoteAddr(), 0)
 	assert.Error(t, err)
 }
 
@@ -435,7 +456,7 @@ func TestCodecDecodeInvalidHeader(t *testing.T) {
 		prvKeyId: prvIdAlice,
 	}
 
-	_, _, _, err := l.decode([]byte{0xFF}, getTestRemoteAddr())
+	_, _, _, err := l.decode([]byte{0xFF}, getTestRemoteAddr(), 0)
 	assert.Error(t, err)
 }
 
@@ -446,7 +467,7 @@ func TestCodecDecodeConnectionNotFoundInitRcv(t *testing.T) {
 	}
 
 	buffer := append([]byte{byte(InitRcv)}, make([]byte, 15)...)
-	_, _, _, err := l.decode(buffer, getTestRemoteAddr())
+	_, _, _, err := l.decode(buffer, getTestRemoteAddr(), 0)
 	assert.Error(t, err)
 }
 
@@ -457,7 +478,7 @@ func TestCodecDecodeConnectionNotFoundData(t *testing.T) {
 	}
 
 	buffer := append([]byte{byte(Data)}, make([]byte, 15)...)
-	_, _, _, err := l.decode(buffer, getTestRemoteAddr())
+	_, _, _, err := l.decode(buffer, getTestRemoteAddr(), 0)
 	assert.Error(t, err)
 }
 
@@ -491,3 +512,64 @@ func TestCodecMsgTypeData(t *testing.T) {
 	msgType := conn.msgType()
 	assert.Equal(t, Data, msgType)
 }
+
+// BenchmarkCodecDecodeData decodes a Data packet with 1000 bytes, the decrypted payload is in a pooled buffer
+// that is released after each packet
+func BenchmarkCodecDecodeData(b *testing.B) {
+	lAlice, lBob := createTestListeners()
+	connAlice := createTestConnection(true, false, true)
+	connAlice.listener = lAlice
+	connBob := createTestConnection(false, false, true)
+	connBob.listener = lBob
+	connBob.connId = connAlice.connId
+	lBob.connMap.Put(connBob.connId, connBob)
+
+	encData, err := connAlice.encode(&PayloadHeader{StreamID: 1}, make([]byte, 1000), Data)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		connBob.replay = replayWindow{} // the same packet again is not a replay
+		_, m, _, err := lBob.decode(encData, getTestRemoteAddr(), 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.Release()
+	}
+}
+
+func BenchmarkCodecEncodeData(b *testing.B) {
+	lAlice, _ := createTestListeners()
+	connAlice := createTestConnection(true, false, true)
+	connAlice.listener = lAlice
+	userData := make([]byte, 1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := connAlice.encode(&PayloadHeader{StreamID: 1}, userData, Data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCodecEncodeDataTo encodes into one reused buffer like the send path, compare the allocations with
+// BenchmarkCodecEncodeData
+func BenchmarkCodecEncodeDataTo(b *testing.B) {
+	lAlice, _ := createTestListeners()
+	connAlice := createTestConnection(true, false, true)
+	connAlice.listener = lAlice
+	userData := make([]byte, 1000)
+	buf := make([]byte, 0, pooledBufferSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := connAlice.encodeTo(buf, &PayloadHeader{StreamID: 1}, userData, Data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
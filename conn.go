@@ -1,30 +1,69 @@
 package qotp
 
 import (
+	"cmp"
+	"context"
 	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	ErrConnectionClosed   = errors.New("connection closed")
+	ErrConnectionReset    = errors.New("connection reset by peer")
+	ErrStreamLimitReached = errors.New("stream limit reached")
+	ErrHandshakeTimeout   = errors.New("handshake timeout")
+	// ErrConnectionRejected is returned by decode if the accept filter rejected the identity of the peer
+	ErrConnectionRejected = errors.New("connection rejected")
+	// ErrSequenceExhausted closes a connection that used up the SNs of all epochs, 2^94 Data packets
+	ErrSequenceExhausted = errors.New("sequence numbers exhausted")
 )
 
 type Conn struct {
 	// Connection identification
-	connId     uint64
-	remoteAddr netip.AddrPort
+	connId      uint64
+	remoteAddr  netip.AddrPort
+	pathHistory []PathInfo // the addresses before a migration and the current one, see PathHistory
 
 	// Core components
-	listener *Listener
-	streams  *LinkedMap[uint32, *Stream]
+	listener          *Listener
+	streams           *LinkedMap[uint32, *Stream]
+	streamsHighWater  uint32
+	streamIDNext      uint32        // above all stream IDs used so far, the first stream of WriteParallel
+	streamIDNextUni   uint32        // above all unidirectional stream IDs used so far, see OpenUniStream
+	rejectedStreamIDs []uint32      // streams of the peer above the limit, a limit error is pending
+	acceptCh          chan *Stream  // streams opened by the peer, see AcceptStream
+	isAccepting       atomic.Bool   // AcceptStream was called, the streams of the peer are queued from then on
+	receivedCh        chan struct{} // closed once a packet of the peer was processed, see ReadAll
 
 	// Cryptographic keys
 	prvKeyEpSnd *ecdh.PrivateKey
 	pubKeyEpRcv *ecdh.PublicKey
 	pubKeyIdRcv *ecdh.PublicKey
+	pubKeyEdRcv ed25519.PublicKey // only set if the peer signed its init, then pubKeyIdRcv is nil
+	appProto    string            // offered by us when dialing, by the peer otherwise, see NegotiatedProtocol
 
 	// Shared secrets
 	sharedSecret []byte
+	aeads        *aeads             // of the shared secret, built with the first Data packet, see dataAeads
+	resetToken   []byte             // stateless reset token of the peer, only known by the sender
+	nonceScheme  nonceScheme        // offered by us when dialing until the reply, negotiated otherwise
+	cipherSuite  *PacketCipherSuite // nil means ChaCha20-Poly1305, offered by us when dialing until the reply
+	ivSnd        []byte             // IV of the nonce of our packets, nil with nonceSplit
+	ivRcv        []byte             // IV of the nonce of the packets of the peer, nil with nonceSplit
 
 	// Buffers and flow control
+	loss         *LossRecovery
 	snd          *SendBuffer
 	rcv          *ReceiveBuffer
 	dataInFlight int
@@ -35,15 +74,124 @@ type Conn struct {
 	isWithCryptoOnInit   bool
 	isHandshakeDoneOnRcv bool
 	isInitSentOnSnd      bool
+	isInitReplyPending   bool   // the peer retransmitted its init, our reply is sent again, see flushInitReply
+	handshakeStartNano   uint64 // when the first init packet was sent
+	state                connState
+
+	// Connection close
+	isCloseConnRequested bool
+	closeConnStreamID    uint32
+	closeConnSentNano    uint64
+	closeConnDeadline    uint64
+	closeErr             error
+	closeCode            uint64 // sent with the close frame, see CloseWithError
+	closeReason          string
 
 	nextWriteTime uint64
+	sendState     SendState // what limited the last flush, see SendState
+
+	vTime uint64 // virtual time of the stream scheduler, see scheduleStreams
+
+	// Connection summary, logged once when the connection is removed
+	startNano       uint64
+	bytesSent       uint64
+	bytesReceived   uint64
+	retransmits     uint64
+	droppedPackets  uint64 // replayed, beyond the sequence window, or with a message type not valid in the state
+	isSummaryLogged bool
+
+	// Counters of Stats, bytes and retransmits are shared with the summary
+	packetsSent     uint64
+	packetsReceived uint64
+	packetsLost     uint64
+	statsBase       ConnectionStats // counters at the last ResetStats
+	sendRate        rateMeter       // samples of bytesSent, see rate.go
+	receiveRate     rateMeter
+
+	// Path validation of a new address of the peer, see path.go
+	pathChallengeAddr      netip.AddrPort
+	pathChallengeNonce     uint64
+	pathChallengeStartNano uint64
+	pathChallengeSentNano  uint64
+	isPathChallengePending bool
+	isPathChallengeSent    bool
+	pathResponseAddr       netip.AddrPort
+	pathResponseNonce      uint64
+	isPathResponsePending  bool
+	onMigration            func(oldAddr, newAddr net.Addr)
+
+	// Path MTU discovery, see pmtu.go
+	pmtu              int // validated size of Data packets, 0 until it is above the MTU of the listener
+	pmtuSearchHigh    int // largest size that may still work
+	pmtuProbeSize     int // size of the probe in flight, 0 if there is none
+	pmtuProbeNonce    uint64
+	pmtuProbeSentNano uint64
+	pmtuProbeAttempts int
+
+	// Black hole detection, see blackhole.go
+	blackHoleMtu        int    // halved size of Data packets while a black hole is suspected or detected, 0 if none
+	blackHoleSinceNano  uint64 // when the size was halved, only acks of later packets confirm the black hole
+	blackHoleLosses     int    // large packets lost in a row, or halved ones while a black hole is suspected
+	isBlackHoleDetected bool
+
+	// ECN, see ecn.go
+	ecnRcv         ecnCounts // marks of the packets we received, echoed in our acks
+	ecnAcked       ecnCounts // marks of our packets the peer echoed last
+	ecnCE          uint64    // CE marks of our packets, not wrapped
+	ecnReducedNano uint64    // when the bandwidth was reduced for CE marks last
+
+	// Delayed ack, an ack-only packet is held back until ackTimerNano, so that it can go out with data
+	pendingAck   *Ack
+	ackTimerNano uint64
 
 	// Crypto and performance
 	snCrypto       uint64 //this is 48bit
 	epochCryptoSnd uint64 //this is 47bit
 	epochCryptoRcv uint64 //this is 47bit
+
+	replay replayWindow // SNs of the Data packets of the peer, see replay.go
+
+	// Rekeying, see rekey.go
+	keyGen            atomic.Uint64 // generation of the shared secret, 0 is the one of the handshake
+	sharedSecretPrev  []byte        // kept for reordered packets of the peer, until prevKeysUntilNano
+	aeadsPrev         *aeads
+	prevKeysUntilNano uint64
+	sharedSecretNext  []byte // derived once a packet does not open with the current one
+	aeadsNext         *aeads
+	isRekeyPending    bool        // we switched, until a packet of the peer with the new secret arrives
+	isRekeyRequested  atomic.Bool // by Rekey, done with the next Data packet
+	bytesSinceRekey   uint64
+	packetsSinceRekey uint64
+	onRekey           func(RekeyEvent)
+
+	exporterSecret []byte // of the shared secret of the handshake, see ExportKeyingMaterial
+
+	// Issued connection IDs, see connid.go
+	connIdSnd                 uint64         // in the header of our Data packets, issued by the peer, or connId
+	connIdSeed                uint64         // of the IDs we issue, see issueConnId
+	connIdCtr                 uint64         // of the last ID we issued
+	connIdsIssued             []issuedConnId // registered at the listener, in the order issued
+	connIdsSpare              []uint64       // the spares the peer issued, for the next path change
+	connIdsAck                []uint64       // the spares of the peer we ack next
+	connIdSpareNext           int            // our spares not acked yet are sent in turns
+	isConnIdRotationRequested atomic.Bool
+
+	userData any // state of the application, see SetUserData
+
+	// Padding of Data packets, see padding.go
+	paddingMode  PaddingMode
+	paddingBlock int
+
+	// Spans, nil without a tracer, see trace.go
+	span             trace.Span
+	handshakeSpan    trace.Span
+	handshakeMsgType CryptoMsgType
+
 	Measurements
 
+	ctx       context.Context // child of the context of the listener, done once the connection is cleaned up
+	cancelCtx context.CancelFunc
+
 	mu sync.Mutex
 }
 
@@ -54,6 +202,9 @@ func (c *Conn) msgType() CryptoMsgType {
 
 	switch {
 	case c.isWithCryptoOnInit && c.isSenderOnInit:
+		if c.listener.prvKeyEd != nil {
+			return InitSignedSnd
+		}
 		return InitCryptoSnd
 	case c.isWithCryptoOnInit && !c.isSenderOnInit:
 		return InitCryptoRcv
@@ -64,6 +215,33 @@ func (c *Conn) msgType() CryptoMsgType {
 	}
 }
 
+// isHandshakeReplyPending checks if we received an init, but did not reply yet
+func (c *Conn) isHandshakeReplyPending() bool {
+	return !c.isSenderOnInit && !c.isInitSentOnSnd
+}
+
+// PeerEd25519Key returns the Ed25519 identity key the peer signed its init with, or nil if the peer used an
+// X25519 identity key
+func (c *Conn) PeerEd25519Key() ed25519.PublicKey {
+	return c.pubKeyEdRcv
+}
+
+// SetUserData associates state of the application with the connection, e.g., a session, so that a handler
+// of a stream can get it with s.Conn().UserData() instead of a map by connection ID. It is safe to call from
+// any goroutine.
+func (c *Conn) SetUserData(v any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.userData = v
+}
+
+// UserData returns the value of SetUserData, nil if none was set
+func (c *Conn) UserData() any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.userData
+}
+
 func (c *Conn) Close() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -73,6 +251,30 @@ func (c *Conn) Close() {
 	}
 }
 
+// CloseConnection closes the whole connection, not only a single stream. A connection close
+// frame is sent with the next flush and retransmitted until the peer acknowledges it or
+// CloseDeadLine has passed. Afterwards, all streams of this connection and of the peer's
+// connection return ErrConnectionClosed.
+func (c *Conn) CloseConnection() error {
+	c.mu.Lock()
+	if c.isCloseConnRequested || c.closeErr != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.isCloseConnRequested = true
+	c.onClosing()
+	c.mu.Unlock()
+
+	// Flush iterates over streams, so we need at least one to send the close frame
+	if c.streams.Size() == 0 {
+		c.Stream(0)
+	}
+	return c.listener.localConn.TimeoutReadNow()
+}
+
+// Stream returns the stream with the ID, it is created if it does not exist yet. An ID of 1<<31 or above is a
+// unidirectional stream like the ones of OpenUniStream: only the side of its lowest bit, 0 for the dialer and 1
+// for the receiver, writes to it and the other side reads, otherwise ErrStreamUnidirectional is returned.
 func (c *Conn) Stream(streamID uint32) (s *Stream) {
 	//c.mu.Lock()
 	//defer c.mu.Unlock() Deadlock
@@ -86,8 +288,17 @@ func (c *Conn) Stream(streamID uint32) (s *Stream) {
 		streamID: streamID,
 		conn:     c,
 		mu:       sync.Mutex{},
+		weight:   DefaultPriority,
+		vTime:    c.vTime,
 	}
+	s.traceStreamOpen()
 	c.streams.Put(streamID, s)
+	if isUniStream(streamID) && streamID >= c.streamIDNextUni {
+		c.streamIDNextUni = streamID + 1
+	} else if !isUniStream(streamID) && streamID >= c.streamIDNext {
+		c.streamIDNext = streamID + 1
+	}
+	c.streamsHighWater = max(c.streamsHighWater, uint32(c.streams.Size()))
 	return s
 }
 
@@ -95,42 +306,259 @@ func (c *Conn) decode(p *PayloadHeader, userData []byte, rawLen int, nowNano uin
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	s = c.Stream(p.StreamID)
-	if p.Ack != nil {
-		ackStatus, sentTimeNano := c.snd.AcknowledgeRange(p.Ack) //remove data from rbSnd if we got the ack
-		if ackStatus == AckStatusOk {
-			c.dataInFlight -= rawLen
-		} else if ackStatus == AckDup {
-			c.onDuplicateAck()
-		} else {
-			slog.Debug("No stream")
+	if p.PathMsgType != PathNone && !isConnIdFrame(p.PathMsgType) {
+		// path frames are sent on their own, except the ones of connid.go, see connid.go, they were handled by decodePath, we only process the piggybacked ack
+		if p.Ack != nil {
+			c.decodeAck(p.Ack, rawLen, nowNano)
+		}
+		return nil, nil
+	}
+
+	if p.LimitError {
+		// the peer rejected our stream, we only process the piggybacked ack
+		if p.Ack != nil {
+			c.decodeAck(p.Ack, rawLen, nowNano)
 		}
-		c.rcvWndSize = p.Ack.rcvWnd
+		c.onStreamLimitError(p.StreamID)
+		return nil, nil
+	}
 
-		if c.checkStreamFullyAcked(s.streamID) {
-			s.closedAtNano = nowNano
+	if p.IsReset {
+		if p.Ack != nil {
+			c.decodeAck(p.Ack, rawLen, nowNano)
 		}
+		c.rcv.EmptyInsert(p.StreamID, p.StreamOffset, nowNano) // ack the reset frame, also for unknown streams
+		c.onStreamReset(p.StreamID, p.ResetCode, nowNano)
+		return c.streams.Get(p.StreamID), nil
+	}
 
-		if nowNano > sentTimeNano && ackStatus == AckStatusOk {
-			rttNano := nowNano - sentTimeNano
-			c.updateMeasurements(rttNano, uint64(p.Ack.len), nowNano)
+	if p.CloseRead {
+		if p.Ack != nil {
+			c.decodeAck(p.Ack, rawLen, nowNano)
 		}
+		c.rcv.EmptyInsert(p.StreamID, p.StreamOffset, nowNano) // ack the stop sending frame
+		c.onStopSending(p.StreamID, nowNano)
+		return c.streams.Get(p.StreamID), nil
 	}
 
-	if len(userData) > 0 {
+	if userData == nil && !p.IsClose {
+		// just an ack, this must not open a new stream
+		if p.Ack != nil {
+			c.decodeAck(p.Ack, rawLen, nowNano)
+		}
+		return c.streams.Get(p.StreamID), nil
+	}
+
+	if !p.IsCloseConn && c.isStreamLimitReached(p.StreamID) {
+		slog.Debug("Stream limit reached", gId(), c.debug(), slog.Uint64("streamID", uint64(p.StreamID)))
+		if p.Ack != nil {
+			c.decodeAck(p.Ack, rawLen, nowNano)
+		}
+		if !slices.Contains(c.rejectedStreamIDs, p.StreamID) {
+			c.rejectedStreamIDs = append(c.rejectedStreamIDs, p.StreamID)
+		}
+		return nil, nil
+	}
+
+	isOpened := !c.streams.Contains(p.StreamID)
+	s = c.Stream(p.StreamID)
+	if isOpened {
+		c.onStreamOpened(s)
+	}
+	if p.Ack != nil {
+		c.decodeAck(p.Ack, rawLen, nowNano)
+	}
+
+	if len(userData) > 0 && (s.isCloseRead || s.isSendOnly()) {
+		c.rcv.Discard(s.streamID, p.StreamOffset, nowNano, len(userData)) // not read anymore or send only, just ack
+	} else if len(userData) > 0 {
 		c.rcv.Insert(s.streamID, p.StreamOffset, nowNano, userData)
 	} else if p.IsClose || userData != nil { //nil is not a ping, just an ack
 		c.rcv.EmptyInsert(s.streamID, p.StreamOffset, nowNano)
 	}
 
-	if p.IsClose {
+	if (p.IsClose || p.CloseWrite) && !s.isCloseRead {
 		c.rcv.Close(s.streamID, p.StreamOffset) //mark the stream closed at the just received offset
-		c.snd.Close(s.streamID)                 //also close the send buffer at the current location
+	}
+	if p.IsClose {
+		c.snd.Close(s.streamID) //also close the send buffer at the current location
+	}
+	if p.CloseWrite {
+		s.isHalfClose = true //the peer may still read, our send buffer stays open
+	}
+
+	if p.IsCloseConn && c.closeErr == nil {
+		// keep the connection for a while, so that retransmitted close frames get acked
+		c.closeErr = closeErrOf(p)
+		c.closeConnDeadline = nowNano + CloseDeadLine
+		c.onClosing()
 	}
 
 	return s, nil
 }
 
+func (c *Conn) decodeAck(ack *Ack, rawLen int, nowNano uint64) {
+	if c.isCloseConnRequested && c.closeConnSentNano != 0 &&
+		ack.streamID == c.closeConnStreamID && ack.len == 0 {
+		// the peer acknowledged our connection close frame
+		c.closeErr = ErrConnectionClosed
+	}
+
+	oldest, _ := c.snd.OldestInFlight(ack.streamID)
+	ackStatus, sentTimeNano := c.snd.AcknowledgeRange(ack) //remove data from rbSnd if we got the ack
+	if ackStatus == AckStatusOk {
+		c.dataInFlight -= rawLen
+		c.loss.onAck(ack)
+		c.loss.onStreamAck(ack.streamID, createPacketKey(ack.offset, ack.len), oldest)
+		c.onBlackHoleAck(int(ack.len), sentTimeNano)
+	} else if ackStatus == AckDup {
+		c.onDuplicateAck()
+	} else {
+		slog.Debug("No stream")
+	}
+	c.rcvWndSize = ack.rcvWnd
+
+	s := c.streams.Get(ack.streamID)
+	if s != nil {
+		s.rcvWndSize = ack.streamRcvWnd
+		s.isRcvWndLimited = ack.isStreamRcvWnd
+	}
+
+	if s != nil && c.checkStreamFullyAcked(s.streamID) {
+		if s.isHalfClose {
+			s.writeDone.Store(true)
+			s.closeIfDone(nowNano)
+		} else {
+			s.closedAtNano.Store(nowNano)
+		}
+	}
+
+	if s != nil && s.ctrlFrame != nil && s.ctrlSentNano != 0 && !s.ctrlAcked &&
+		ack.len == 0 && ack.offset == s.ctrlFrame.StreamOffset {
+		// the peer acknowledged our control frame
+		c.onCtrlFrameAcked(s, nowNano)
+	}
+
+	if nowNano > sentTimeNano && ackStatus == AckStatusOk {
+		rttNano := nowNano - sentTimeNano
+		// the peer held the ack back, this is not part of the RTT, but never go below the min RTT
+		if rttNano > ack.delayNano && rttNano-ack.delayNano >= c.rttMinNano {
+			rttNano -= ack.delayNano
+		}
+		c.updateMeasurements(rttNano, uint64(ack.len), nowNano)
+		c.listener.metrics.onRtt(rttNano)
+	}
+	if ack.isEcn {
+		c.onEcnCounts(ack.ecn, nowNano)
+	}
+}
+
+// isStreamLimitReached checks if a new stream from the peer would exceed the configured limit
+func (c *Conn) isStreamLimitReached(streamID uint32) bool {
+	if c.listener.maxStreams == 0 || c.streams.Contains(streamID) {
+		return false
+	}
+	return uint32(c.streams.Size()) >= c.listener.maxStreams
+}
+
+// onStreamLimitError terminates a stream the peer rejected, its data will never be acked
+func (c *Conn) onStreamLimitError(streamID uint32) {
+	s := c.streams.Get(streamID)
+	if s == nil {
+		return
+	}
+	slog.Debug("Stream rejected by peer", gId(), c.debug(), slog.Uint64("streamID", uint64(streamID)))
+
+	s.streamErr = ErrStreamLimitReached
+	inFlight, _ := c.snd.RemoveStream(streamID)
+	c.dataInFlight = max(0, c.dataInFlight-inFlight)
+	s.closedAtNano.CompareAndSwap(0, c.lastReadTimeNano)
+}
+
+// onStreamReset aborts a stream the peer reset, buffered data in both directions is dropped
+func (c *Conn) onStreamReset(streamID uint32, code uint32, nowNano uint64) {
+	s := c.streams.Get(streamID)
+	if s == nil || s.streamErr != nil {
+		return
+	}
+	slog.Debug("Stream reset by peer", gId(), c.debug(), slog.Uint64("streamID", uint64(streamID)),
+		slog.Uint64("code", uint64(code)))
+
+	s.streamErr = &StreamResetError{Code: code}
+	c.removeSndStream(streamID)
+	c.rcv.RemoveStream(streamID)
+	s.closedAtNano.CompareAndSwap(0, nowNano)
+}
+
+// removeSndStream drops the queued and unacked data of a stream, its packets do not count as in flight anymore
+// and are neither retransmitted nor probed, returns the offset the stream was sent up to
+func (c *Conn) removeSndStream(streamID uint32) (sentOffset uint64) {
+	inFlight, sentOffset := c.snd.RemoveStream(streamID)
+	c.dataInFlight = max(0, c.dataInFlight-inFlight)
+	c.loss.removeStream(streamID)
+	return sentOffset
+}
+
+// checkRcvWndStall marks a stream as stalled once the window of the peer blocked its queued data for longer
+// than WithFlowControlStallTimeout. Only if a packet of the peer arrived since, e.g., the ack of a window probe,
+// a silent peer is a network failure and ends with the idle timeout.
+func (c *Conn) checkRcvWndStall(s *Stream, isSendBlocked bool, nowNano uint64) {
+	timeoutNano := c.listener.flowControlStallNano
+	if timeoutNano == 0 {
+		return
+	}
+	if !isSendBlocked || !c.snd.IsQueued(s.streamID) {
+		s.rcvWndBlockedNano, s.isRcvWndStalled = 0, false
+		return
+	}
+	if s.rcvWndBlockedNano == 0 {
+		s.rcvWndBlockedNano = nowNano
+		return
+	}
+	if !s.isRcvWndStalled && nowNano >= s.rcvWndBlockedNano+timeoutNano &&
+		c.lastReadTimeNano > s.rcvWndBlockedNano {
+		slog.Debug("Stream flow control stalled", gId(), s.debug(), c.debug(), slog.Uint64("rcvWnd", s.rcvWndSize))
+		s.isRcvWndStalled = true
+	}
+}
+
+// onStopSending stops writing to a stream the peer does not read anymore, unsent data is dropped
+func (c *Conn) onStopSending(streamID uint32, nowNano uint64) {
+	s := c.streams.Get(streamID)
+	if s == nil || s.writeErr != nil || s.streamErr != nil {
+		return
+	}
+	slog.Debug("Stream stop sending by peer", gId(), c.debug(), slog.Uint64("streamID", uint64(streamID)))
+
+	s.isHalfClose = true
+	s.writeErr = ErrStreamStopSending
+	c.removeSndStream(streamID)
+	s.writeDone.Store(true)
+	s.closeIfDone(nowNano)
+}
+
+// OpenStreamCount returns the number of streams currently open on this connection
+func (c *Conn) OpenStreamCount() uint32 {
+	return uint32(c.streams.Size())
+}
+
+// StreamHighWaterMark returns the highest number of streams that were open at the same time
+func (c *Conn) StreamHighWaterMark() uint32 {
+	return c.streamsHighWater
+}
+
+// isStreamRcvWndFull checks the receive window of the peer for this stream. New data is blocked if it does
+// not fit into the window, retransmissions only if not even one packet fits, then the peer would drop them.
+func (c *Conn) isStreamRcvWndFull(s *Stream) (isRetransmitBlocked bool, isSendBlocked bool) {
+	if !s.isRcvWndLimited {
+		return false, false
+	}
+	streamInFlight := c.snd.InFlight(s.streamID)
+	isRetransmitBlocked = s.rcvWndSize < uint64(c.dataMtu())
+	isSendBlocked = isRetransmitBlocked || uint64(streamInFlight+c.dataMtu()) > s.rcvWndSize
+	return isRetransmitBlocked, isSendBlocked
+}
+
 func (c *Conn) checkStreamFullyAcked(streamID uint32) bool {
 	closeOffset := c.snd.GetOffsetClosedAt(streamID)
 	if closeOffset == nil {
@@ -140,19 +568,45 @@ func (c *Conn) checkStreamFullyAcked(streamID uint32) bool {
 	return ackedOffset >= *closeOffset
 }
 
-// We need to check if we remove the current state, if yes, then move the state to the previous stream
+// scheduleStreams returns the streams in the order they are flushed. This is weighted fair queuing: every
+// stream has a virtual time that advances by the bytes it sent divided by its weight, the stream with the
+// lowest virtual time goes first. Ties are broken by the creation order of the streams, so streams with equal
+// weights are served round-robin.
+func (c *Conn) scheduleStreams() []*Stream {
+	streams := make([]*Stream, 0, c.streams.Size())
+	for _, s := range c.streams.Iterator(nil) {
+		// a stream that was idle starts at the current virtual time, it cannot catch up with a burst
+		s.vTime = max(s.vTime, c.vTime)
+		streams = append(streams, s)
+	}
+	slices.SortStableFunc(streams, func(a, b *Stream) int {
+		return cmp.Compare(a.vTime, b.vTime)
+	})
+	return streams
+}
+
+// onStreamSent charges the sent bytes to the virtual time of the stream
+func (c *Conn) onStreamSent(s *Stream, n int) {
+	c.vTime = s.vTime
+	s.vTime += uint64(n) * uint64(DefaultPriority) / uint64(s.priority())
+}
+
 func (c *Conn) cleanupStream(streamID uint32) {
 	slog.Debug("Cleanup/Stream", gId(), c.debug(), slog.Uint64("streamID", uint64(streamID)))
 
-	if c.listener.currentStreamID != nil && streamID == *c.listener.currentStreamID {
-		*c.listener.currentStreamID, _, _ = c.streams.Next(streamID)
+	if s := c.streams.Get(streamID); s != nil {
+		s.mu.Lock()
+		s.readDeadline.stop()
+		s.writeDeadline.stop()
+		traceEnd(s.span, s.streamErr)
+		s.mu.Unlock()
 	}
 	c.streams.Remove(streamID)
 	//even if the stream size is 0, do not remove the connection yet, only after a certain timeout,
 	// so that BBR, RTT, is preserved for a bit
 }
 
-func (c *Conn) cleanupConn() {
+func (c *Conn) cleanupConn(reason error, nowNano uint64) {
 	slog.Debug("Cleanup/Stream", gId(), c.debug(),
 		slog.Uint64("connID", c.connId), slog.Any("currId", c.listener.currentConnID))
 
@@ -160,31 +614,188 @@ func (c *Conn) cleanupConn() {
 		*c.listener.currentConnID, _, _ = c.listener.connMap.Next(c.connId)
 	}
 	c.listener.connMap.Remove(c.connId)
+	c.removeConnIds()
+	c.logSummary(reason, nowNano)
+	c.traceConnEnd(reason)
+	c.zeroizeKeys()
+	if c.cancelCtx != nil {
+		c.cancelCtx()
+	}
+}
+
+// setSharedSecret replaces the shared secret, e.g., after a retransmitted handshake, the old one is zeroized
+func (c *Conn) setSharedSecret(sharedSecret []byte) {
+	if c.sharedSecret == nil || &c.sharedSecret[0] != &sharedSecret[0] {
+		c.listener.logKey(keyLogSharedSecret, c.connId, sharedSecret)
+	}
+	if c.sharedSecret != nil && &c.sharedSecret[0] != &sharedSecret[0] {
+		zeroize(c.sharedSecret)
+		zeroize(c.sharedSecretNext)
+		c.aeads.zeroize()
+		c.aeadsNext.zeroize()
+		c.aeads = nil
+		c.sharedSecretNext, c.aeadsNext = nil, nil
+	}
+	c.sharedSecret = sharedSecret
+	zeroize(c.exporterSecret)
+	c.exporterSecret = newExporterSecret(sharedSecret)
+}
+
+// dataAeads returns the aeads of the shared secret, they are built once and used for all Data packets
+func (c *Conn) dataAeads() (*aeads, error) {
+	if c.aeads == nil {
+		a, err := newAeads(c.sharedSecret, c.packetCipher())
+		if err != nil {
+			return nil, err
+		}
+		c.aeads = a
+	}
+	return c.aeads, nil
+}
+
+// zeroizeKeys overwrites the shared secret, the SN keys and the reset token of a connection that is gone. The
+// ephemeral private key and the AEAD keys are opaque and cannot be overwritten, only the references to them
+// are dropped.
+func (c *Conn) zeroizeKeys() {
+	c.aeads.zeroize()
+	c.aeadsPrev.zeroize()
+	c.aeadsNext.zeroize()
+	zeroize(c.sharedSecret)
+	zeroize(c.sharedSecretPrev)
+	zeroize(c.sharedSecretNext)
+	zeroize(c.exporterSecret)
+	zeroize(c.resetToken)
+	zeroize(c.ivSnd)
+	zeroize(c.ivRcv)
+	c.sharedSecret = nil
+	c.sharedSecretPrev = nil
+	c.sharedSecretNext = nil
+	c.exporterSecret = nil
+	c.aeads = nil
+	c.aeadsPrev = nil
+	c.aeadsNext = nil
+	c.resetToken = nil
+	c.ivSnd = nil
+	c.ivRcv = nil
+	c.prvKeyEpSnd = nil
+}
+
+// logSummary writes a single line with the totals of the connection to the summary logger, only once
+func (c *Conn) logSummary(reason error, nowNano uint64) {
+	logger := c.listener.summaryLogger
+	if logger == nil || c.isSummaryLogged {
+		return
+	}
+	c.isSummaryLogged = true
+
+	if c.closeErr != nil {
+		reason = c.closeErr
+	}
+	durationNano := uint64(0)
+	if nowNano > c.startNano {
+		durationNano = nowNano - c.startNano
+	}
+	logger.Info("connection summary",
+		slog.String("connId", fmt.Sprintf("%016x", c.connId)),
+		slog.String("peer", c.remoteAddr.String()),
+		slog.String("peerKey", fingerprint(c.pubKeyIdRcv)),
+		slog.Bool("sender", c.isSenderOnInit),
+		slog.Duration("duration", time.Duration(durationNano)),
+		slog.Uint64("bytesIn", c.bytesReceived),
+		slog.Uint64("bytesOut", c.bytesSent),
+		slog.Uint64("retransmits", c.retransmits),
+		slog.Uint64("dropped", c.droppedPackets),
+		slog.Any("reason", reason))
 }
 
 func (c *Conn) Flush(s *Stream, nowNano uint64) (data int, pacingNano uint64, err error) {
 	//update state for receiver
-	ack := c.rcv.GetSndAck()
+	ack := c.pendingAck
+	c.pendingAck = nil
+	if ack == nil {
+		ack = c.rcv.GetSndAck()
+	}
 	if ack != nil {
 		ack.rcvWnd = uint64(c.rcv.capacity) - uint64(c.rcv.Size())
+		// the stream window is only sent once half of it is used, before it does not limit the sender
+		streamRcvWnd := c.rcv.StreamRcvWindow(ack.streamID)
+		ack.streamRcvWnd = streamRcvWnd
+		ack.isStreamRcvWnd = streamRcvWnd < uint64(c.rcv.streamCapacity/2)
+		c.putEcnAck(ack)
+		ack.delayNano = 0
+		if nowNano > ack.rcvTimeNano {
+			ack.delayNano = nowNano - ack.rcvTimeNano
+		}
 		slog.Debug(" Flush/AckAvailable", gId(), s.debug(), c.debug(), slog.Uint64("offset", ack.offset))
 	} else {
 		slog.Debug(" Flush/NoAck", gId(), s.debug(), c.debug())
 	}
 
+	if c.isCloseConnRequested || c.closeErr != nil {
+		return c.flushCloseConn(s, ack, nowNano)
+	}
+
+	if c.startNano == 0 {
+		c.startNano = nowNano
+	}
+	c.expirePrevKeys(nowNano)
+
+	if !c.isInitSentOnSnd {
+		c.handshakeStartNano = nowNano
+	} else if c.isHandshakeTimeout(nowNano) {
+		slog.Debug(" Flush/HandshakeTimeout", gId(), s.debug(), c.debug())
+		c.closeErr = ErrHandshakeTimeout
+		return 0, 0, ErrHandshakeTimeout
+	}
+
+	if c.isAmplificationLimited() {
+		// nothing is sent until the peer sends more, or its Data verifies the address
+		c.pendingAck = ack
+		return 0, MinDeadLine, nil
+	}
+
+	if c.msgType() == Data {
+		if data, pacingNano, isSent, err := c.flushPath(s, ack, nowNano); isSent {
+			return data, pacingNano, err
+		}
+	}
+
+	if s.ctrlFrame != nil {
+		if data, pacingNano, isSent, err := c.flushCtrlFrame(s, ack, nowNano); isSent {
+			return data, pacingNano, err
+		}
+	}
+
+	if len(c.rejectedStreamIDs) > 0 && c.nextWriteTime <= nowNano {
+		return c.writeStreamLimitError(ack, nowNano)
+	}
+
 	// Respect pacing
 	if c.nextWriteTime > nowNano {
 		slog.Debug(" Flush/Pacing", gId(), s.debug(), c.debug(),
 			slog.Uint64("waitTime:ms", (c.nextWriteTime-nowNano)/msNano),
 			slog.Bool("ack?", ack != nil))
-		//do not sent acks, as this is also data on the line
+		//do not sent acks, as this is also data on the line, keep it for the next flush
+		c.pendingAck = ack
+		c.sendState = SendStatePacingLimited
 		return 0, c.nextWriteTime - nowNano, nil
 	}
 
+	if c.isInitReplyPending && !c.isHandshakeDoneOnRcv {
+		return c.flushInitReply(s, ack, nowNano)
+	}
+
+	if c.msgType() == Data {
+		if data, pacingNano, isSent, err := c.flushPmtuProbe(s, ack, nowNano); isSent {
+			return data, pacingNano, err
+		}
+	}
+
 	//Respect rwnd
-	if c.dataInFlight+int(c.listener.mtu) > int(c.rcvWndSize) {
+	if c.dataInFlight+c.dataMtu() > int(c.rcvWndSize) {
 		slog.Debug(" Flush/Rwnd/Rcv", gId(), s.debug(), c.debug(),
 			slog.Bool("ack?", ack != nil))
+		c.sendState = SendStateWindowLimited
 		if ack != nil {
 			// Send ACK even if receiver indicated no more data, an ack does not add data
 			return c.writeAck(s, ack, nowNano)
@@ -192,23 +803,80 @@ func (c *Conn) Flush(s *Stream, nowNano uint64) (data int, pacingNano uint64, er
 		return 0, MinDeadLine, nil
 	}
 
+	//Respect the rwnd of the stream, only this stream is blocked, the listener continues with the next one
+	isRetransmitBlocked, isSendBlocked := c.isStreamRcvWndFull(s)
+
 	// Retransmission case
 	msgType := c.msgType()
-	splitData, offset, isClose, err := c.snd.ReadyToRetransmit(s.streamID, ack, c.listener.mtu, c.rtoNano(), msgType, nowNano)
-	if err != nil {
-		slog.Debug(" Flush/RetransmitError", gId(), s.debug(), c.debug(), slog.Any("error", err))
-		return 0, 0, err
+	rtoNano := c.rtoNano()
+	if !c.isHandshakeDoneOnRcv {
+		rtoNano = c.handshakeRtoNano()
+	}
+	if !isRetransmitBlocked && c.isHandshakeDoneOnRcv {
+		if data, pacingNano, isSent, err := c.flushFastRetransmit(s, ack, msgType, nowNano); isSent {
+			return data, pacingNano, err
+		}
+		if data, pacingNano, isSent, err := c.flushProbe(s, ack, msgType, nowNano); isSent {
+			return data, pacingNano, err
+		}
+	}
+
+	if !isRetransmitBlocked {
+		var splitData []byte
+		var offset uint64
+		var isClose bool
+		var err error
+		if msgType == Data && c.isHandshakeDoneOnRcv {
+			splitData, offset, isClose, err = c.snd.ScheduledRetransmit(s.streamID, c.listener.retransmitter(), ack,
+				c.payloadMtu(msgType), rtoNano, c.srtt, nowNano)
+		} else {
+			splitData, offset, isClose, err = c.snd.ReadyToRetransmit(s.streamID, ack, c.payloadMtu(msgType), rtoNano,
+				msgType, nowNano)
+		}
+		if err != nil {
+			slog.Debug(" Flush/RetransmitError", gId(), s.debug(), c.debug(), slog.Any("error", err))
+			return 0, 0, err
+		}
+
+		if splitData != nil {
+			c.onPacketLoss()
+			c.onBlackHoleLoss(len(splitData), nowNano)
+			c.packetsLost++
+			c.listener.metrics.onPacketLost()
+			c.retransmits++
+			c.sendState = SendStateSending
+			slog.Debug(" Flush/Retransmit", gId(), s.debug(), c.debug())
+			return c.sendPacket(s, ack, splitData, offset, isClose, msgType, nowNano, false)
+		}
 	}
 
-	if splitData != nil {
-		c.onPacketLoss()
-		slog.Debug(" Flush/Retransmit", gId(), s.debug(), c.debug())
-		return c.sendPacket(s, ack, splitData, offset, isClose, msgType, nowNano, false)
+	c.checkRcvWndStall(s, isSendBlocked, nowNano)
+	if isSendBlocked {
+		slog.Debug(" Flush/Rwnd/Stream", gId(), s.debug(), c.debug(), slog.Uint64("rcvWnd", s.rcvWndSize),
+			slog.Bool("ack?", ack != nil))
+		c.sendState = SendStateWindowLimited
+		if nowNano < s.rcvWndProbeNano+rtoNano {
+			if ack != nil {
+				return c.writeAck(s, ack, nowNano)
+			}
+			return 0, MinDeadLine, nil
+		}
+		// probe the window every RTO, the ack of the ping tells us when the peer read from the stream
+		s.rcvWndProbeNano = nowNano
+		c.snd.QueuePing(s.streamID)
 	}
 
 	//next check if we can send packets, during handshake we can only send 1 packet
 	if c.isHandshakeDoneOnRcv || !c.isInitSentOnSnd {
-		splitData, offset, isClose := c.snd.ReadyToSend(s.streamID, msgType, ack, c.listener.mtu, nowNano)
+		splitData, offset, isClose := c.snd.ReadyToSend(s.streamID, msgType, ack, c.payloadMtu(msgType), nowNano)
+		// the window probe of a blocked stream is no data, it stays window limited
+		if !isSendBlocked && c.isHandshakeDoneOnRcv {
+			if splitData != nil {
+				c.sendState = SendStateSending
+			} else {
+				c.sendState = SendStateAppLimited
+			}
+		}
 
 		if splitData != nil {
 			slog.Debug(" Flush/Send", gId(), s.debug(), c.debug())
@@ -224,32 +892,114 @@ func (c *Conn) Flush(s *Stream, nowNano uint64) (data int, pacingNano uint64, er
 	if ack != nil {
 		return c.writeAck(s, ack, nowNano)
 	}
+	if waitNano := c.snd.CoalesceWait(s.streamID, nowNano); waitNano > 0 {
+		slog.Debug(" Flush/Coalesce", gId(), s.debug(), c.debug(), slog.Uint64("wait:ms", waitNano/msNano))
+		return 0, min(waitNano, MinDeadLine), nil
+	}
 	slog.Debug(" Flush/nada", gId(), s.debug(), c.debug())
 	return 0, MinDeadLine, nil
 }
 
+// flushFastRetransmit sends the oldest packet of a stream again once acks of dupAckThreshold later packets
+// arrived, see LossRecovery. It is a loss, the bandwidth is reduced once for the recovery, not reset, and new
+// data is still paced while the packet is in flight.
+func (c *Conn) flushFastRetransmit(s *Stream, ack *Ack, msgType CryptoMsgType, nowNano uint64) (
+	data int, pacingNano uint64, isSent bool, err error) {
+	key, isDue := c.loss.fastRetransmitDue(s.streamID)
+	if !isDue {
+		return 0, 0, false, nil
+	}
+	c.loss.onFastRetransmitSent(s.streamID)
+	splitData, offset, isClose := c.snd.RetransmitNow(s.streamID, key, ack, c.payloadMtu(msgType), msgType, nowNano)
+	if splitData == nil {
+		return 0, 0, false, nil
+	}
+	slog.Debug(" Flush/FastRetransmit", gId(), s.debug(), c.debug(), slog.Uint64("offset", offset))
+	c.onPacketLoss()
+	c.packetsLost++
+	c.listener.metrics.onPacketLost()
+	c.retransmits++
+	data, pacingNano, err = c.sendPacket(s, ack, splitData, offset, isClose, msgType, nowNano, false)
+	return data, pacingNano, true, err
+}
+
+// flushProbe sends a packet again if no ack arrived in time, a probe is not a loss. With no more data queued,
+// the last packet is sent after the tail loss probe timeout, otherwise the oldest packet after the PTO.
+func (c *Conn) flushProbe(s *Stream, ack *Ack, msgType CryptoMsgType, nowNano uint64) (
+	data int, pacingNano uint64, isSent bool, err error) {
+	isInFlight := func(k sentPacketKey) bool {
+		return c.snd.IsInFlight(k.streamID, k.key)
+	}
+
+	isTail := false
+	key, isProbe := c.loss.probe(nowNano, c.ptoNano(), isInFlight)
+	if !isProbe && c.snd.IsQueueEmpty() {
+		key, isProbe = c.loss.tailProbe(nowNano, c.tlpNano(), isInFlight)
+		isTail = isProbe
+	}
+	if !isProbe || key.streamID != s.streamID {
+		return 0, 0, false, nil
+	}
+
+	splitData, offset, isClose := c.snd.RetransmitNow(s.streamID, key.key, ack, c.payloadMtu(msgType), msgType, nowNano)
+	if splitData == nil {
+		return 0, 0, false, nil
+	}
+	if isTail {
+		c.loss.onTailProbeSent()
+		slog.Debug(" Flush/TailProbe", gId(), s.debug(), c.debug())
+	} else {
+		c.loss.onProbeSent()
+		slog.Debug(" Flush/Probe", gId(), s.debug(), c.debug())
+	}
+	c.retransmits++
+	c.onBlackHoleLoss(len(splitData), nowNano)
+	data, pacingNano, err = c.sendPacket(s, ack, splitData, offset, isClose, msgType, nowNano, false)
+	return data, pacingNano, true, err
+}
+
+// send encodes a packet into a pooled buffer and writes it, the NetworkConn does not keep the buffer, so one
+// buffer is reused for all packets. It returns the size of the encoded packet.
+func (c *Conn) send(p *PayloadHeader, userData []byte, msgType CryptoMsgType, nowNano uint64) (encLen int, err error) {
+	buf := getBuffer(pooledBufferSize)
+	defer putBuffer(buf)
+	encData, err := c.encodeTo((*buf)[:0], p, userData, msgType)
+	if err != nil {
+		return 0, err
+	}
+	return len(encData), c.listener.localConn.WriteToUDPAddrPort(encData, c.remoteAddr, nowNano)
+}
+
 func (c *Conn) sendPacket(s *Stream, ack *Ack, splitData []byte, offset uint64, isClose bool, msgType CryptoMsgType, nowNano uint64, trackInFlight bool) (data int, pacingNano uint64, err error) {
+	// The ack may need 48-bit offsets, which the data chunk was not sized for. In that case, send
+	// the ack in a separate packet, so that the data packet does not exceed the MTU.
+	if ack != nil && calcCryptoOverheadWithData(msgType, ack, offset)+len(splitData) > c.payloadMtu(msgType) {
+		slog.Debug(" Flush/SplitAck", gId(), s.debug(), c.debug(), slog.Int("len(data)", len(splitData)))
+		_, _, err = c.writeAck(s, ack, nowNano)
+		if err != nil {
+			return 0, 0, err
+		}
+		ack = nil
+	}
+
 	p := &PayloadHeader{
-		IsClose:      isClose,
+		IsClose:      isClose && !s.isCloseWrite,
+		CloseWrite:   isClose && s.isCloseWrite,
 		Ack:          ack,
 		StreamID:     s.streamID,
 		StreamOffset: offset,
 	}
 
-	encData, err := c.encode(p, splitData, msgType)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	err = c.listener.localConn.WriteToUDPAddrPort(encData, c.remoteAddr, nowNano)
+	encLen, err := c.send(p, splitData, msgType, nowNano)
 	if err != nil {
 		return 0, 0, err
 	}
 
 	packetLen := len(splitData)
+	c.loss.onPacketSent(s.streamID, offset, packetLen, nowNano)
 	if trackInFlight {
 		c.dataInFlight += packetLen
-		pacingNano = c.calcPacing(uint64(len(encData)))
+		pacingNano = c.calcPacing(uint64(encLen))
 	} else {
 		pacingNano = c.calcPacing(uint64(packetLen))
 	}
@@ -258,7 +1008,148 @@ func (c *Conn) sendPacket(s *Stream, ack *Ack, splitData []byte, offset uint64,
 	return packetLen, pacingNano, nil
 }
 
+func (c *Conn) flushCloseConn(s *Stream, ack *Ack, nowNano uint64) (data int, pacingNano uint64, err error) {
+	if c.closeConnDeadline == 0 {
+		c.closeConnDeadline = nowNano + CloseDeadLine
+	}
+
+	// Timed out, acked by the peer, or the peer does not know about us yet: release the connection
+	if nowNano >= c.closeConnDeadline ||
+		(c.isCloseConnRequested && (c.closeErr != nil || c.msgType() == InitSnd)) {
+		slog.Debug(" Flush/CloseConn/Release", gId(), s.debug(), c.debug())
+		c.closeErr = ErrConnectionClosed
+		return 0, 0, c.closeErr
+	}
+
+	if c.nextWriteTime > nowNano {
+		return 0, c.nextWriteTime - nowNano, nil
+	}
+
+	// Closed by the peer, we only need to ack its close frame
+	if !c.isCloseConnRequested {
+		if ack != nil {
+			return c.writeAck(s, ack, nowNano)
+		}
+		return 0, MinDeadLine, nil
+	}
+
+	rtoNano := c.rtoNano()
+	if c.closeConnSentNano != 0 && nowNano < c.closeConnSentNano+rtoNano {
+		if ack != nil {
+			return c.writeAck(s, ack, nowNano)
+		}
+		return 0, c.closeConnSentNano + rtoNano - nowNano, nil
+	}
+
+	p := &PayloadHeader{
+		IsCloseConn: true,
+		CloseCode:   c.closeCode,
+		CloseReason: c.closeReason,
+		Ack:         ack,
+		StreamID:    s.streamID,
+	}
+
+	encLen, err := c.send(p, []byte{}, c.msgType(), nowNano)
+	if err != nil {
+		return 0, 0, err
+	}
+	slog.Debug(" Flush/CloseConn", gId(), s.debug(), c.debug())
+
+	c.closeConnStreamID = s.streamID
+	c.closeConnSentNano = nowNano
+	pacingNano = c.calcPacing(uint64(encLen))
+	c.nextWriteTime = nowNano + pacingNano
+	return 0, pacingNano, nil
+}
+
+// flushCtrlFrame sends the reset or stop sending frame of a stream each RTO until acked. If isSent is false,
+// the stream continues with the regular flush.
+func (c *Conn) flushCtrlFrame(s *Stream, ack *Ack, nowNano uint64) (
+	data int, pacingNano uint64, isSent bool, err error) {
+	msgType := c.msgType()
+	if !s.ctrlAcked && msgType == InitSnd {
+		// InitSnd carries no payload, so the peer does not know anything about this stream
+		c.onCtrlFrameAcked(s, nowNano)
+	}
+
+	if !s.ctrlAcked && c.nextWriteTime <= nowNano &&
+		(s.ctrlSentNano == 0 || nowNano >= s.ctrlSentNano+c.rtoNano()) {
+		data, pacingNano, err = c.writeCtrlFrame(s, ack, msgType, nowNano)
+		return data, pacingNano, true, err
+	}
+
+	if !s.isResetRequested() {
+		return 0, 0, false, nil
+	}
+
+	// nothing else to send on a reset stream
+	if ack != nil && c.nextWriteTime <= nowNano {
+		data, pacingNano, err = c.writeAck(s, ack, nowNano)
+		return data, pacingNano, true, err
+	}
+	if c.nextWriteTime > nowNano {
+		return 0, c.nextWriteTime - nowNano, true, nil
+	}
+	return 0, MinDeadLine, true, nil
+}
+
+func (c *Conn) writeCtrlFrame(s *Stream, ack *Ack, msgType CryptoMsgType, nowNano uint64) (
+	data int, pacingNano uint64, err error) {
+	p := *s.ctrlFrame
+	p.Ack = ack
+
+	encLen, err := c.send(&p, []byte{}, msgType, nowNano)
+	if err != nil {
+		return 0, 0, err
+	}
+	slog.Debug(" Flush/CtrlFrame", gId(), s.debug(), c.debug(), slog.Bool("reset", p.IsReset),
+		slog.Bool("closeRead", p.CloseRead))
+
+	s.ctrlSentNano = nowNano
+	pacingNano = c.calcPacing(uint64(encLen))
+	c.nextWriteTime = nowNano + pacingNano
+	return 0, pacingNano, nil
+}
+
+func (c *Conn) onCtrlFrameAcked(s *Stream, nowNano uint64) {
+	s.ctrlAcked = true
+	if s.isResetRequested() {
+		s.closedAtNano.CompareAndSwap(0, nowNano)
+		return
+	}
+	// the peer stopped sending
+	s.readDone.Store(true)
+	s.closeIfDone(nowNano)
+}
+
+func (c *Conn) writeStreamLimitError(ack *Ack, nowNano uint64) (data int, pacingNano uint64, err error) {
+	streamID := c.rejectedStreamIDs[0]
+	c.rejectedStreamIDs = c.rejectedStreamIDs[1:]
+
+	p := &PayloadHeader{
+		LimitError: true,
+		Ack:        ack,
+		StreamID:   streamID,
+	}
+
+	encLen, err := c.send(p, []byte{}, c.msgType(), nowNano)
+	if err != nil {
+		return 0, 0, err
+	}
+	slog.Debug(" Flush/LimitError", gId(), c.debug(), slog.Uint64("streamID", uint64(streamID)))
+
+	pacingNano = c.calcPacing(uint64(encLen))
+	c.nextWriteTime = nowNano + pacingNano
+	return 0, pacingNano, nil
+}
+
 func (c *Conn) writeAck(s *Stream, ack *Ack, nowNano uint64) (data int, pacingNano uint64, err error) {
+	if c.isAckDelayed(ack, nowNano) {
+		slog.Debug(" Flush/AckDelayed", gId(), s.debug(), c.debug(), slog.Uint64("timer:ms", c.ackTimerNano/msNano))
+		c.pendingAck = ack
+		return 0, c.ackTimerNano - nowNano, nil
+	}
+
 	isClose := c.checkStreamFullyAcked(s.streamID)
 
 	p := &PayloadHeader{
@@ -267,30 +1158,39 @@ func (c *Conn) writeAck(s *Stream, ack *Ack, nowNano uint64) (data int, pacingNa
 		StreamID: s.streamID,
 	}
 
-	encData, err := c.encode(p, nil, c.msgType())
-	if err != nil {
-		return 0, 0, err
-	}
-	err = c.listener.localConn.WriteToUDPAddrPort(encData, c.remoteAddr, nowNano)
+	encLen, err := c.send(p, nil, c.msgType(), nowNano)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	pacingNano = c.calcPacing(uint64(len(encData)))
+	pacingNano = c.calcPacing(uint64(encLen))
 	c.nextWriteTime = nowNano + pacingNano
 	return 0, pacingNano, nil
 }
 
+// isAckDelayed checks if an ack-only packet can wait for data to piggyback on. It waits at most
+// maxAckDelay after the acked packet arrived, handshake acks are never delayed.
+func (c *Conn) isAckDelayed(ack *Ack, nowNano uint64) bool {
+	if ack == nil || c.listener.maxAckDelayNano == 0 || c.msgType() != Data {
+		return false
+	}
+	c.ackTimerNano = ack.rcvTimeNano + c.listener.maxAckDelayNano
+	return nowNano < c.ackTimerNano
+}
+
 func (c *Conn) debug() slog.Attr {
 	return slog.Group("connection",
 		slog.Uint64("nextWrt:ms", c.nextWriteTime/msNano),
 		//slog.Uint64("nextWrt:ns", c.nextWriteTime),
 		slog.Int("inFlight", c.dataInFlight+c.listener.mtu),
-		slog.Int("rcvBuf", c.rcv.capacity-c.rcv.size),
+		slog.Int("rcvBuf", c.rcv.Available()),
 		slog.Uint64("rcvWnd", c.rcvWndSize),
 		slog.Uint64("snCrypto", c.snCrypto),
 		slog.Uint64("epochSnd", c.epochCryptoSnd),
 		slog.Uint64("epochRcv", c.epochCryptoRcv),
+		slog.Uint64("keyGen", c.keyGen.Load()),
+		slog.Int("streams", c.streams.Size()),
 		slog.Bool("initsent", c.isInitSentOnSnd),
-		slog.Bool("hndshke", c.isHandshakeDoneOnRcv))
+		slog.Bool("hndshke", c.isHandshakeDoneOnRcv),
+		slog.Any("state", c.state))
 }
@@ -1,7 +1,10 @@
 package qotp
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net/netip"
 	"testing"
 )
 
@@ -39,3 +42,1052 @@ func TestConnection_GetOrNewStreamRcv(t *testing.T) {
 		})
 	}
 }
+
+func TestConnectionCloseConnection(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// Close the connection, writes fail from now on
+	err := connA.CloseConnection()
+	assert.Nil(t, err)
+	_, err = streamA.Write([]byte("too late"))
+	assert.ErrorIs(t, err, ErrConnectionClosed)
+
+	connA.listener.Flush(connPair.Conn1.localTime + 10*msNano)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	// Receiver gets the sentinel error on its streams
+	streamB = nil
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	}
+	assert.Nil(t, err)
+	assert.NotNil(t, streamB)
+	_, err = streamB.Read()
+	assert.ErrorIs(t, err, ErrConnectionClosed)
+
+	// Receiver acks the close frame
+	listenerB.Flush(connPair.Conn2.localTime + 10*msNano)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+	assert.Nil(t, err)
+
+	// Sender releases the connection after the ack
+	connA.listener.Flush(connPair.Conn1.localTime + 20*msNano)
+	assert.Equal(t, 0, connA.listener.connMap.Size())
+	_, err = streamA.Read()
+	assert.ErrorIs(t, err, ErrConnectionClosed)
+
+	// Receiver releases the connection after the deadline
+	listenerB.Flush(connPair.Conn2.localTime + CloseDeadLine + 10*msNano)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+}
+
+func TestConnectionStreamLimit(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.maxStreams = 1
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	assert.Equal(t, uint32(1), connB.OpenStreamCount())
+
+	// A second stream is above the limit of B
+	streamA2 := connA.Stream(1)
+	_, err := streamA2.Write([]byte("second"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + 10*msNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	s, err := listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+	assert.Equal(t, uint32(1), connB.OpenStreamCount())
+
+	// B rejects the stream, A gets the error
+	listenerB.Flush(connPair.Conn2.localTime + 10*msNano)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+	assert.Nil(t, err)
+	_, err = streamA2.Write([]byte("again"))
+	assert.ErrorIs(t, err, ErrStreamLimitReached)
+	_, err = streamA2.Read()
+	assert.ErrorIs(t, err, ErrStreamLimitReached)
+	assert.Zero(t, connA.snd.size)
+
+	// Closing the first stream frees a slot on B
+	_, err = streamA.Write([]byte("bye"))
+	assert.Nil(t, err)
+	streamA.Close()
+	connA.listener.Flush(connPair.Conn1.localTime + secondNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	b, err := streamB.Read()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, []byte("bye"), b)
+	listenerB.Flush(connPair.Conn2.localTime + secondNano)
+	assert.Equal(t, uint32(0), connB.OpenStreamCount())
+	assert.Equal(t, uint32(1), connB.StreamHighWaterMark())
+
+	// Deliver the remaining acks, until stream 0 is gone on both sides
+	for i := 2; i < 4; i++ {
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.Nil(t, err)
+		connA.listener.Flush(connPair.Conn1.localTime + uint64(i)*secondNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+		listenerB.Flush(connPair.Conn2.localTime + uint64(i)*secondNano)
+	}
+
+	assert.Equal(t, uint32(0), connA.OpenStreamCount())
+	assert.Equal(t, uint32(0), connB.OpenStreamCount())
+
+	// A new stream is accepted again
+	streamA3 := connA.Stream(2)
+	_, err = streamA3.Write([]byte("third"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + 4*secondNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	var streamB3 *Stream
+	for i := 0; i < 100 && streamB3 == nil; i++ {
+		streamB3, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	}
+	assert.Nil(t, err)
+	assert.NotNil(t, streamB3)
+	assert.Equal(t, uint32(2), streamB3.streamID)
+	assert.Equal(t, uint32(1), connB.OpenStreamCount())
+}
+
+func TestConnectionCloseConnectionTimeout(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+
+	streamA := connA.Stream(0)
+	_, err := streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	connA.listener.Flush(0)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, 0)
+	assert.Nil(t, err)
+	listenerB.Flush(0)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	_, err = connA.listener.Listen(MinDeadLine, 0)
+	assert.Nil(t, err)
+
+	err = connA.CloseConnection()
+	assert.Nil(t, err)
+
+	// Close frame is lost, we never get an ack
+	connA.listener.Flush(secondNano)
+	err = connPair.dropSender()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, connA.listener.connMap.Size())
+
+	// After the deadline, the connection is released anyway
+	connA.listener.Flush(secondNano + CloseDeadLine)
+	assert.Equal(t, 0, connA.listener.connMap.Size())
+}
+
+func TestConnectionHandshakeRetransmit(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	defer connPair.Conn1.Close()
+	defer connPair.Conn2.Close()
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1),
+		WithHandshakeTimeout(100*msNano, 5*secondNano))
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+
+	streamA := connA.Stream(0)
+	_, err = streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+
+	// First init is lost, keep it to deliver it late
+	listenerA.Flush(0)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	original := append([]byte{}, connPair.Conn1.writeQueue[0].data...)
+	err = connPair.dropSender()
+	assert.Nil(t, err)
+
+	// Nothing before the handshake timeout
+	listenerA.Flush(100 * msNano)
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsSender())
+
+	// First retransmission is lost as well
+	listenerA.Flush(100*msNano + 1)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	err = connPair.dropSender()
+	assert.Nil(t, err)
+
+	// Second retransmission after the doubled timeout, with the same ephemeral keys
+	listenerA.Flush((100+200)*msNano + 1)
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsSender())
+	listenerA.Flush((100+200)*msNano + 2)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	// the header byte may be greased, the connection ID is the same
+	assert.Equal(t, original[HeaderSize:HeaderSize+ConnIdSize],
+		connPair.Conn1.writeQueue[0].data[HeaderSize:HeaderSize+ConnIdSize])
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	var streamB *Stream
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	}
+	assert.Nil(t, err)
+	assert.NotNil(t, streamB)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hallo"), b)
+
+	// The late original does not create a second connection
+	connPair.Conn2.readQueue = append(connPair.Conn2.readQueue, packetData{data: original})
+	_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+
+	listenerB.Flush(connPair.Conn2.localTime)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && !connA.isHandshakeDoneOnRcv; i++ {
+		_, err = listenerA.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.Nil(t, err)
+	}
+	assert.True(t, connA.isHandshakeDoneOnRcv)
+}
+
+func TestConnectionHandshakeTimeout(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	defer connPair.Conn1.Close()
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1),
+		WithHandshakeTimeout(100*msNano, secondNano))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+
+	streamA := connA.Stream(0)
+	_, err = streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+
+	// All init packets are lost: 0, 100ms, 300ms, 700ms
+	for now := uint64(0); now <= secondNano; now += 10 * msNano {
+		listenerA.Flush(now)
+	}
+	assert.Equal(t, 4, connPair.nrOutgoingPacketsSender())
+	assert.Equal(t, 1, listenerA.connMap.Size())
+
+	listenerA.Flush(secondNano + 1)
+	assert.Equal(t, 0, listenerA.connMap.Size())
+	_, err = streamA.Read()
+	assert.ErrorIs(t, err, ErrHandshakeTimeout)
+	_, err = streamA.Write([]byte("hallo"))
+	assert.ErrorIs(t, err, ErrHandshakeTimeout)
+}
+
+func TestConnectionAckDelay(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.maxAckDelayNano = 25 * msNano
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// B gets data, the ack is held back
+	_, err := streamA.Write([]byte("more"))
+	assert.Nil(t, err)
+	connPair.Conn1.localTime += secondNano
+	connA.listener.Flush(connPair.Conn1.localTime)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	var s *Stream
+	var rcvTimeNano uint64
+	for i := 0; i < 100 && s == nil; i++ {
+		rcvTimeNano = connPair.Conn2.localTime
+		s, err = listenerB.Listen(MinDeadLine, rcvTimeNano)
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, streamB, s)
+
+	pacingNano := listenerB.Flush(rcvTimeNano + 10*msNano)
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+	assert.Equal(t, uint64(15*msNano), pacingNano)
+
+	// B writes before the timer fires, the ack goes out with the data
+	_, err = streamB.Write([]byte("reply"))
+	assert.Nil(t, err)
+	listenerB.Flush(rcvTimeNano + 20*msNano)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+	assert.Nil(t, err)
+	assert.Zero(t, connA.snd.InFlight(0))
+
+	// Without data, the ack goes out once the timer fired and carries the delay
+	_, err = streamA.Write([]byte("again"))
+	assert.Nil(t, err)
+	connPair.Conn1.localTime += secondNano
+	connA.listener.Flush(connPair.Conn1.localTime)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	s = nil
+	for i := 0; i < 100 && s == nil; i++ {
+		rcvTimeNano = connPair.Conn2.localTime
+		s, err = listenerB.Listen(MinDeadLine, rcvTimeNano)
+	}
+	assert.Nil(t, err)
+
+	listenerB.Flush(rcvTimeNano + 24*msNano)
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+	listenerB.Flush(rcvTimeNano + 25*msNano)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+
+	decoded, m, _, err := connA.listener.decode(connPair.Conn2.writeQueue[0].data, netip.AddrPort{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, connA, decoded)
+	p, _, err := DecodePayload(m.PayloadRaw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(25*msNano), p.Ack.delayNano)
+}
+
+func TestConnectionMtuBoundary48BitOffsets(t *testing.T) {
+	conn := createTestConnection(true, false, true)
+	localConn := newPairedConn("alice")
+	conn.listener.localConn = localConn
+	s := conn.Stream(1)
+
+	// Both the data offset and the ack offset need 48-bit encoding
+	sb := conn.snd.getOrCreateStream(s.streamID)
+	sb.bytesSentOffset = 0x1000000
+	_, status := conn.snd.QueueData(s.streamID, createTestData(4000))
+	assert.Equal(t, InsertStatusOk, status)
+	ack := &Ack{streamID: 2, offset: 0x1000000, len: 100, rcvWnd: 1000}
+
+	splitData, offset, isClose := conn.snd.ReadyToSend(s.streamID, Data, ack, conn.listener.mtu, 0)
+	assert.Equal(t, conn.listener.mtu-calcCryptoOverheadWithData(Data, ack, offset), len(splitData))
+
+	_, _, err := conn.sendPacket(s, ack, splitData, offset, isClose, Data, 0, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(localConn.writeQueue))
+	assert.Equal(t, conn.listener.mtu, len(localConn.writeQueue[0].data))
+}
+
+func TestConnectionMtuBoundarySplitAck(t *testing.T) {
+	conn := createTestConnection(true, false, true)
+	localConn := newPairedConn("alice")
+	conn.listener.localConn = localConn
+	s := conn.Stream(1)
+
+	// Full data chunk sized without an ack, then a 48-bit ack shows up
+	offset := uint64(0x1000000)
+	splitData := createTestData(conn.listener.mtu - calcCryptoOverheadWithData(Data, nil, offset))
+	ack := &Ack{streamID: 2, offset: 0x1000000, len: 100, rcvWnd: 1000}
+
+	n, _, err := conn.sendPacket(s, ack, splitData, offset, false, Data, 0, true)
+	assert.NoError(t, err)
+	assert.Equal(t, len(splitData), n)
+
+	// Ack is sent in a separate packet, no packet exceeds the MTU
+	assert.Equal(t, 2, len(localConn.writeQueue))
+	for _, pkt := range localConn.writeQueue {
+		assert.LessOrEqual(t, len(pkt.data), conn.listener.mtu)
+	}
+}
+
+func TestConnectionEncodeExceedsMtu(t *testing.T) {
+	conn := createTestConnection(true, false, true)
+	p := &PayloadHeader{StreamID: 1}
+
+	_, err := conn.encode(p, createTestData(conn.listener.mtu), Data)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(0), conn.snCrypto)
+}
+
+// dialWrongIdentityKey dials B with the identity key of A instead of B and sends "hallo", B cannot decrypt
+// the early data and replies as to InitSnd
+func dialWrongIdentityKey(t *testing.T) (connA *Conn, streamA *Stream, listenerB *Listener, connPair *ConnPair) {
+	connPair = NewConnPair("alice", "bob")
+	t.Cleanup(func() {
+		connPair.Conn1.Close()
+		connPair.Conn2.Close()
+	})
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	assert.Nil(t, err)
+	listenerB, err = Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))
+	assert.Nil(t, err)
+	connA, err = listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey1.PublicKey())
+	assert.Nil(t, err)
+
+	streamA = connA.Stream(0)
+	_, err = streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	listenerA.Flush(0)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	var streamB *Stream
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, streamB)
+	assert.False(t, streamB.conn.isWithCryptoOnInit)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Empty(t, b) // the early data is lost
+
+	listenerB.Flush(connPair.Conn2.localTime)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && connPair.nrIncomingPacketsSender() > 0; i++ {
+		_, err = listenerA.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.Nil(t, err)
+	}
+	return connA, streamA, listenerB, connPair
+}
+
+func TestConnectionWrongIdentityKey(t *testing.T) {
+	connA, streamA, _, connPair := dialWrongIdentityKey(t)
+
+	assert.ErrorIs(t, connA.closeErr, ErrWrongServerIdentityKey)
+	assert.Equal(t, 0, connA.listener.connMap.Size())
+	// the early data is not sent again to the unverified identity key
+	connA.listener.Flush(connPair.Conn1.localTime + secondNano)
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsSender())
+	_, err := streamA.Write([]byte("more"))
+	assert.ErrorIs(t, err, ErrWrongServerIdentityKey)
+	_, err = streamA.Read()
+	assert.ErrorIs(t, err, ErrWrongServerIdentityKey)
+}
+
+// runScheduler flushes packets of up to mtu bytes from the queued bytes of the streams and returns the bytes
+// sent per stream and the order in which the streams were picked
+func runScheduler(conn *Conn, queued map[uint32]int, packets int, mtu int) (sent map[uint32]int, order []uint32) {
+	sent = map[uint32]int{}
+	for range packets {
+		for _, s := range conn.scheduleStreams() {
+			if queued[s.streamID] == 0 {
+				continue
+			}
+			n := min(queued[s.streamID], mtu)
+			queued[s.streamID] -= n
+			sent[s.streamID] += n
+			order = append(order, s.streamID)
+			conn.onStreamSent(s, n)
+			break
+		}
+	}
+	return sent, order
+}
+
+func TestConnectionSchedulerEqualWeights(t *testing.T) {
+	conn := &Conn{streams: NewLinkedMap[uint32, *Stream]()}
+	conn.Stream(1)
+	conn.Stream(2)
+	conn.Stream(3)
+
+	_, order := runScheduler(conn, map[uint32]int{1: 10000, 2: 10000, 3: 10000}, 7, 1000)
+	assert.Equal(t, []uint32{1, 2, 3, 1, 2, 3, 1}, order)
+}
+
+func TestConnectionSchedulerWeighted(t *testing.T) {
+	conn := &Conn{streams: NewLinkedMap[uint32, *Stream]()}
+	conn.Stream(1).SetPriority(DefaultPriority)
+	conn.Stream(2).SetPriority(3 * DefaultPriority)
+
+	sent, _ := runScheduler(conn, map[uint32]int{1: 100000, 2: 100000}, 40, 1000)
+	assert.Equal(t, 10000, sent[1])
+	assert.Equal(t, 30000, sent[2])
+}
+
+func TestConnectionSchedulerIdleStream(t *testing.T) {
+	conn := &Conn{streams: NewLinkedMap[uint32, *Stream]()}
+	conn.Stream(1)
+	conn.Stream(2)
+
+	// only stream 1 has data, stream 2 must not build up credit while idle
+	queued := map[uint32]int{1: 100000}
+	runScheduler(conn, queued, 10, 1000)
+	queued[2] = 100000
+	sent, _ := runScheduler(conn, queued, 10, 1000)
+	assert.Equal(t, 5000, sent[1])
+	assert.Equal(t, 5000, sent[2])
+}
+
+func TestConnectionSchedulerZeroWeight(t *testing.T) {
+	conn := &Conn{streams: NewLinkedMap[uint32, *Stream]()}
+	conn.Stream(1).SetPriority(0)
+	conn.Stream(2).SetPriority(2)
+
+	assert.Equal(t, uint8(1), conn.Stream(1).priority())
+	sent, _ := runScheduler(conn, map[uint32]int{1: 100000, 2: 100000}, 30, 1000)
+	assert.Equal(t, 10000, sent[1])
+	assert.Equal(t, 20000, sent[2])
+}
+
+func TestConnectionZeroizeKeysOnClose(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	// keep the backing arrays, the connection drops its references
+	secretA, tokenA, secretB := connA.sharedSecret, connA.resetToken, connB.sharedSecret
+	assert.Equal(t, secretA, secretB)
+	assert.NotEqual(t, make([]byte, len(secretA)), secretA)
+	assert.NotEqual(t, make([]byte, len(tokenA)), tokenA)
+
+	connA.listener.ForceClose(connA)
+	assert.Nil(t, listenerB.Close())
+
+	assert.Equal(t, make([]byte, len(secretA)), secretA)
+	assert.Equal(t, make([]byte, len(tokenA)), tokenA)
+	assert.Equal(t, make([]byte, len(secretB)), secretB)
+	assert.Nil(t, connA.sharedSecret)
+	assert.Nil(t, connA.resetToken)
+	assert.Nil(t, connA.prvKeyEpSnd)
+	assert.Nil(t, connB.sharedSecret)
+	assert.Zero(t, listenerB.connMap.Size())
+}
+
+func TestConnectionSetSharedSecretZeroizesOld(t *testing.T) {
+	conn := &Conn{}
+	oldSecret := []byte{1, 2, 3, 4}
+	conn.setSharedSecret(oldSecret)
+	conn.setSharedSecret(oldSecret)
+	assert.Equal(t, []byte{1, 2, 3, 4}, oldSecret)
+
+	conn.setSharedSecret([]byte{1, 2, 3, 4})
+	assert.Equal(t, []byte{0, 0, 0, 0}, oldSecret)
+	assert.Equal(t, []byte{1, 2, 3, 4}, conn.sharedSecret)
+}
+
+func TestConnectionProbeTimeout(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// small RTT, so that the PTO is shorter than the minimum RTO, no bandwidth estimate for a short pacing
+	connA.srtt = 10 * msNano
+	connA.rttvar = 1 * msNano
+	connA.bwMax = 0
+	pto := connA.ptoNano()
+	assert.Equal(t, uint64(14*msNano), pto)
+	assert.Less(t, pto, connA.rtoNano())
+
+	_, err := streamA.Write([]byte("lost"))
+	assert.NoError(t, err)
+	start := connPair.Conn1.localTime + secondNano
+	_, _, err = connA.Flush(streamA, start)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	connPair.Conn1.writeQueue = nil
+
+	// no ack within the PTO, the packet is sent again as probe, the PTO doubles after the second probe
+	nowNano := start
+	for i, wait := range []uint64{pto, pto, 2 * pto} {
+		n, _, err := connA.Flush(streamA, nowNano+wait-1)
+		assert.NoError(t, err)
+		assert.Zero(t, n)
+		assert.Equal(t, 0, connPair.nrOutgoingPacketsSender())
+
+		nowNano += wait
+		n, _, err = connA.Flush(streamA, nowNano)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, n)
+		assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+		assert.Equal(t, uint64(i+1), connA.retransmits)
+		connPair.Conn1.writeQueue = nil
+	}
+	assert.Equal(t, 3, connA.loss.ptoCount)
+}
+
+func TestConnectionTailLossProbe(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	connPair.Conn1.bandwidth, connPair.Conn2.bandwidth = 0, 0
+	connPair.Conn1.latencyNano, connPair.Conn2.latencyNano = 5*msNano, 5*msNano
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// both sides share the clock of the sender
+	flushA := func() {
+		connA.listener.Flush(connPair.Conn1.localTime)
+		connPair.Conn1.localTime += msNano
+	}
+	deliverToB := func() {
+		_, err := connPair.senderToRecipientAll()
+		assert.NoError(t, err)
+		connPair.Conn2.localTime = max(connPair.Conn2.localTime, connPair.Conn1.localTime)
+		for i := 0; i < 10 && len(connPair.Conn2.readQueue) > 0; i++ {
+			_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.NoError(t, err)
+		}
+	}
+
+	testData := createTestData(4000)
+	_, err := streamA.Write(testData)
+	assert.NoError(t, err)
+	// the tail of the write is not held back, see WithCoalesceDelay
+	assert.NoError(t, streamA.Flush())
+	for i := 0; i < 1000 && !connA.snd.IsQueueEmpty(); i++ {
+		flushA()
+	}
+	nrPackets := connPair.nrOutgoingPacketsSender()
+	assert.Equal(t, 3, nrPackets)
+
+	// the last packet of the burst is lost, the acks of the others do not show the loss
+	assert.NoError(t, connPair.Conn1.dropData(nrPackets-1))
+	deliverToB()
+	for i := 0; i < 100; i++ {
+		listenerB.Flush(connPair.Conn2.localTime)
+		connPair.Conn2.localTime += msNano
+	}
+	_, err = connPair.recipientToSenderAll()
+	assert.NoError(t, err)
+	for i := 0; i < 10 && len(connPair.Conn1.readQueue) > 0; i++ {
+		_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, connA.loss.size())
+	assert.NotZero(t, connA.srtt)
+
+	// the tail loss probe sends the last packet again, well before the RTO
+	lastSentNano := connA.loss.lastSentNano
+	for i := 0; i < 1000 && connPair.nrOutgoingPacketsSender() == 0; i++ {
+		flushA()
+	}
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	assert.True(t, connA.loss.isTlpSent)
+	assert.Zero(t, connA.loss.ptoCount)
+	assert.Less(t, connPair.Conn1.localTime-lastSentNano, connA.rtoNano()/2)
+
+	deliverToB()
+	var received []byte
+	for i := 0; i < 3; i++ {
+		b, err := streamB.Read()
+		assert.NoError(t, err)
+		received = append(received, b...)
+	}
+	assert.Equal(t, testData, received)
+}
+
+func TestConnectionStateMsgTypeValid(t *testing.T) {
+	sender := &Conn{isSenderOnInit: true, listener: &Listener{}}
+	receiver := &Conn{listener: &Listener{}}
+
+	// while handshaking, the sender only accepts the reply, the receiver its init again or Data
+	assert.True(t, sender.isMsgTypeValid(InitRcv))
+	assert.True(t, sender.isMsgTypeValid(InitCryptoRcv))
+	assert.False(t, sender.isMsgTypeValid(Data))
+	assert.False(t, sender.isMsgTypeValid(InitSnd))
+	assert.True(t, receiver.isMsgTypeValid(InitSnd))
+	assert.True(t, receiver.isMsgTypeValid(InitSignedSnd))
+	assert.True(t, receiver.isMsgTypeValid(Data))
+	assert.False(t, receiver.isMsgTypeValid(InitCryptoRcv))
+
+	// a close requested while handshaking takes effect once the handshake is done
+	sender.isCloseConnRequested = true
+	sender.onClosing()
+	assert.Equal(t, connHandshaking, sender.state)
+	sender.onHandshakeDone(0)
+	receiver.onHandshakeDone(0)
+	assert.Equal(t, connClosing, sender.state)
+	assert.Equal(t, connEstablished, receiver.state)
+
+	for _, c := range []*Conn{sender, receiver} {
+		assert.True(t, c.isMsgTypeValid(Data))
+		assert.False(t, c.isMsgTypeValid(InitSnd))
+		assert.False(t, c.isMsgTypeValid(InitCryptoSnd))
+		assert.False(t, c.isMsgTypeValid(InitRcv))
+		assert.False(t, c.isMsgTypeValid(InitCryptoRcv))
+	}
+}
+
+func TestConnectionStateDuplicateInit(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA := connA.Stream(0)
+	_, err := streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	init := bytes.Clone(connPair.Conn1.writeQueue[0].data)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	var streamB *Stream
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, streamB)
+	connB := streamB.conn
+	sharedSecret := connB.sharedSecret
+
+	// the reply with data is lost
+	_, err = streamB.Write([]byte("world"))
+	assert.Nil(t, err)
+	listenerB.Flush(connPair.Conn2.localTime)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+	assert.Nil(t, connPair.dropReceiver())
+
+	// the retransmitted init does not touch the connection
+	connPair.Conn2.readQueue = append(connPair.Conn2.readQueue, packetData{data: init})
+	s, err := listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+	assert.Same(t, &sharedSecret[0], &connB.sharedSecret[0])
+	assert.True(t, connB.isInitReplyPending)
+	assert.Zero(t, connB.droppedPackets)
+
+	// the original reply is sent again without waiting for its timeout
+	listenerB.Flush(connPair.Conn2.localTime + secondNano)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+	assert.False(t, connB.isInitReplyPending)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && !connA.isHandshakeDoneOnRcv; i++ {
+		_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, connEstablished, connA.state)
+	b, err := streamA.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("world"), b)
+}
+
+func TestConnectionStateUnexpectedMsgType(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA := connA.Stream(0)
+	_, err := streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	init := bytes.Clone(connPair.Conn1.writeQueue[0].data)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	var streamB *Stream
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, streamB)
+	connB := streamB.conn
+
+	listenerB.Flush(connPair.Conn2.localTime)
+	reply := bytes.Clone(connPair.Conn2.writeQueue[0].data)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && !connA.isHandshakeDoneOnRcv; i++ {
+		_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.Nil(t, err)
+	}
+
+	nowNano := connPair.Conn1.localTime
+	sendAToB := func(data string) {
+		nowNano += secondNano // past the pacing of both
+		_, err := streamA.Write([]byte(data))
+		assert.Nil(t, err)
+		connA.listener.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+
+		// the ack, so that the data is not retransmitted with the next send
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.Nil(t, err)
+	}
+	_, err = streamB.Read()
+	assert.Nil(t, err)
+	sendAToB("data")
+	assert.Equal(t, connEstablished, connA.state)
+	assert.Equal(t, connEstablished, connB.state)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), b)
+
+	// a late init and a late reply are dropped and counted, not fatal
+	connPair.Conn2.readQueue = append(connPair.Conn2.readQueue, packetData{data: init})
+	s, err := listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+	assert.Equal(t, uint64(1), connB.droppedPackets)
+	assert.False(t, connB.isInitReplyPending)
+
+	connPair.Conn1.readQueue = append(connPair.Conn1.readQueue, packetData{data: reply})
+	s, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+	assert.Equal(t, uint64(1), connA.droppedPackets)
+
+	// both connections survive
+	assert.Equal(t, 1, listenerB.connMap.Size())
+	assert.Equal(t, 1, connA.listener.connMap.Size())
+	sendAToB("more")
+	b, err = streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("more"), b)
+}
+
+func TestConnectionStats(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	statsA := connA.Stats()
+	assert.Equal(t, uint64(1), statsA.PacketsSent)
+	assert.Equal(t, uint64(1), statsA.PacketsReceived)
+	assert.Equal(t, connA.bytesSent, statsA.BytesSent)
+	assert.Equal(t, connA.bytesReceived, statsA.BytesReceived)
+	assert.NotZero(t, statsA.SmoothedRTT)
+	assert.Equal(t, connB.Stats().BytesReceived, statsA.BytesSent)
+
+	// a lost packet is sent again as probe, a probe is a retransmission, but not a loss
+	connA.ResetStats()
+	assert.Equal(t, ConnectionStats{SmoothedRTT: statsA.SmoothedRTT, BandwidthEstimate: statsA.BandwidthEstimate,
+		CWND: statsA.CWND}, connA.Stats())
+	_, err := streamA.Write([]byte("lost"))
+	assert.NoError(t, err)
+	nowNano := connPair.Conn1.localTime + secondNano
+	_, _, err = connA.Flush(streamA, nowNano)
+	assert.NoError(t, err)
+	assert.NoError(t, connPair.dropSender())
+	_, _, err = connA.Flush(streamA, nowNano+10*secondNano)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+
+	statsA = connA.Stats()
+	assert.Equal(t, uint64(2), statsA.PacketsSent)
+	assert.Zero(t, statsA.PacketsLost)
+	assert.Equal(t, uint64(1), statsA.Retransmissions)
+	assert.Zero(t, statsA.PacketsReceived)
+	assert.Equal(t, uint64(len(connPair.Conn1.writeQueue[0].data))*2, statsA.BytesSent)
+
+	// the listener sums its connections
+	assert.Equal(t, statsA, connA.listener.AggregateStats())
+	_, err = connA.listener.DialString("127.0.0.1:8080")
+	assert.NoError(t, err)
+	aggregate := connA.listener.AggregateStats()
+	assert.Equal(t, statsA.PacketsSent, aggregate.PacketsSent)
+	assert.Equal(t, statsA.SmoothedRTT, aggregate.SmoothedRTT)
+}
+
+func BenchmarkConnStats(b *testing.B) {
+	connPair := NewConnPair("alice", "bob")
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := listener.Dial(netip.AddrPort{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { _ = conn.Stats() }); allocs != 0 {
+		b.Fatalf("Stats allocates %v times", allocs)
+	}
+
+	b.ReportAllocs()
+	var stats ConnectionStats
+	for i := 0; i < b.N; i++ {
+		stats = conn.Stats()
+	}
+	_ = stats
+}
+
+func TestConnectionFastRetransmit(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connA.srtt, connA.rttvar, connA.bwMax = 100*msNano, 10*msNano, 0
+
+	// 5 packets, the first is lost
+	_, err := streamA.Write(make([]byte, 6000))
+	assert.Nil(t, err)
+	nowNano := connPair.Conn1.localTime + secondNano
+	startNano := nowNano
+	for i := 0; i < 20 && connPair.nrOutgoingPacketsSender() < 5; i++ {
+		nowNano = max(nowNano+msNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+	}
+	assert.Equal(t, 5, connPair.nrOutgoingPacketsSender())
+	first, ok := connA.snd.OldestInFlight(streamA.streamID)
+	assert.True(t, ok)
+	_, err = connPair.senderToRecipient(1, 2, 3, 4)
+	assert.Nil(t, err)
+
+	// B acks the four packets, each ack leaves the gap of the first packet
+	for connPair.nrIncomingPacketsRecipient() > 0 {
+		_, err = listenerB.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		nowNano = max(nowNano+msNano, streamB.conn.nextWriteTime)
+		listenerB.Flush(nowNano)
+	}
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsSender() > 0 {
+		_, err = connA.listener.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	key, isDue := connA.loss.fastRetransmitDue(streamA.streamID)
+	assert.True(t, isDue)
+	assert.Equal(t, first, key)
+
+	// the first packet is sent again right away, long before its RTO
+	connA.listener.Flush(nowNano)
+	assert.Less(t, nowNano-startNano, connA.rtoNano())
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	assert.Equal(t, uint64(1), connA.packetsLost)
+	var received []byte
+	for i := 0; i < 10 && len(received) < 6000; i++ {
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		b, err := streamB.Read()
+		assert.Nil(t, err)
+		received = append(received, b...)
+		nowNano = max(nowNano+msNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+	}
+	assert.Len(t, received, 6000)
+
+	// its ack ends the recovery
+	listenerB.Flush(nowNano)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsSender() > 0 {
+		_, err = connA.listener.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	assert.Empty(t, connA.loss.fastRetransmits)
+}
+
+func TestConnectionSequenceExhausted(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// the SNs of the last epoch are used up, the connection closes instead of failing each send
+	connA.epochCryptoSnd, connA.snCrypto = maxEpochCrypto, snRotateAfter-1
+	_, err := streamA.Write([]byte("last"))
+	assert.Nil(t, err)
+	assert.Nil(t, streamA.Flush())
+	nowNano := connPair.Conn1.localTime + secondNano
+	connA.listener.Flush(nowNano)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	assert.Equal(t, maxEpochCrypto+1, connA.epochCryptoSnd)
+
+	_, err = streamA.Write([]byte("too many"))
+	assert.Nil(t, err)
+	connA.listener.Flush(nowNano + secondNano)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	assert.Nil(t, connA.listener.connMap.Get(connA.connId))
+	_, err = streamA.Write([]byte("closed"))
+	assert.ErrorIs(t, err, ErrSequenceExhausted)
+}
+
+func TestConnectionAeadsEpochRollover(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	// the SN of A rolls over with the second packet, the third is sent in epoch 1, the jump of the SN is
+	// within the sequence window of B
+	connA.srtt, connA.rttvar, connA.bwMax = 10*msNano, 1*msNano, 0
+	listenerB.snWindowPackets = snRotateAfter
+	nowNano := connPair.Conn1.localTime + secondNano
+	var aeadsA, aeadsB *aeads
+	var received []byte
+	for _, data := range []string{"first", "last of epoch 0", "first of epoch 1"} {
+		if aeadsA == nil && connA.aeads != nil {
+			// the aeads are built with the first Data packet
+			aeadsA, aeadsB = connA.aeads, connB.aeads
+			assert.NotNil(t, aeadsB)
+			connA.snCrypto = snRotateAfter - 1
+		}
+		_, err := streamA.Write([]byte(data))
+		assert.Nil(t, err)
+		assert.Nil(t, streamA.Flush()) // each write is a packet
+		for i := 0; i < 6 && connPair.nrOutgoingPacketsSender() == 0; i++ {
+			nowNano = max(nowNano+msNano, connA.nextWriteTime)
+			connA.listener.Flush(nowNano)
+		}
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for i := 0; i < 100 && len(received) < len(data); i++ {
+			_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.Nil(t, err)
+			b, err := streamB.Read()
+			assert.Nil(t, err)
+			received = append(received, b...)
+		}
+		assert.Equal(t, data, string(received))
+		received = nil
+	}
+	assert.Equal(t, uint64(1), connA.epochCryptoSnd)
+	assert.Equal(t, uint64(1), connB.epochCryptoRcv)
+	assert.NotNil(t, aeadsA)
+
+	// the key does not change with the epoch, the aeads are reused
+	assert.Same(t, aeadsA, connA.aeads)
+	assert.Same(t, aeadsB, connB.aeads)
+
+	// a new shared secret gets new aeads, the same one keeps them
+	connA.setSharedSecret(connA.sharedSecret)
+	assert.Same(t, aeadsA, connA.aeads)
+	connA.setSharedSecret(bytes.Repeat([]byte{7}, 32))
+	assert.Nil(t, connA.aeads)
+	a, err := connA.dataAeads()
+	assert.Nil(t, err)
+	assert.NotSame(t, aeadsA, a)
+	connA.zeroizeKeys()
+	assert.Nil(t, connA.aeads)
+}
+
+func TestConnectionUserData(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	assert.Nil(t, connA.UserData())
+	connA.SetUserData("session of alice") // at dial
+
+	// the handler of the streams of B sets the session of a connection at accept and gets it for later streams
+	type session struct{ streams []uint32 }
+	handler := func(s *Stream) {
+		sess, ok := s.Conn().UserData().(*session)
+		if !ok {
+			sess = &session{}
+			s.Conn().SetUserData(sess)
+		}
+		sess.streams = append(sess.streams, s.StreamID())
+	}
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	handler(streamB)
+	_, err := connA.Stream(5).Write([]byte("five"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + secondNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	s, err := listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5), s.StreamID())
+	handler(s)
+
+	assert.Equal(t, &session{streams: []uint32{streamB.StreamID(), 5}}, streamB.Conn().UserData())
+	assert.Equal(t, "session of alice", streamA.Conn().UserData())
+}
@@ -0,0 +1,322 @@
+package qotp
+
+import (
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"slices"
+)
+
+const (
+	// maxConnIdAttempts is how often the next connection ID is taken if it is already in use
+	maxConnIdAttempts = 8
+	// maxConnIdPool is the maximum of WithMaxConnectionIDs, and of the spares we keep of a peer
+	maxConnIdPool = 8
+	// connIdCtrBits is the counter in an issued connection ID, the other 48 bits are the seed, see encryptConnId
+	connIdCtrBits = 16
+)
+
+var ErrConnIdsNotIssued = errors.New("connection IDs are not issued, see WithIssuedConnIds")
+
+// Issued connection IDs, see WithIssuedConnIds. The connection ID of the init is derived from the ephemeral key
+// of the sender and is in clear in every Data packet, so an observer can link all packets of a connection to
+// its handshake. With issued connection IDs, each side issues an ID and sends it encrypted in a path frame,
+// the receiver of the init already in InitRcv or InitCryptoRcv, the sender in InitCryptoSnd, InitSignedSnd, or
+// its first Data packet. The peer then sends its Data packets to that ID instead. The frame is repeated until
+// a packet of the peer arrives on the new ID, only the ID of the init stays in the connection map, the issued
+// IDs are looked up in a second map. A rotation issues a new ID, the older ones are retired once the peer
+// switched.
+//
+// With WithMaxConnectionIDs, spare IDs are issued as well, each repeated until the peer acks it. On a path
+// change, when we see a new address of the peer or get a path challenge, we switch to the next spare of the
+// peer at once. The issuer retires the ID used before once a packet arrives on the spare, and issues a new one.
+//
+// An issued ID is a keyed permutation of a random 48 bit seed of the connection and a counter, and the reset
+// token is derived from the seed. After a restart, the listener recovers the seed from any ID it issued and
+// replies with the right token, see statelessResetToken. The peer looks up its current ID in a map of the IDs
+// it sends to. Only a Data packet to the ID of the init gets no valid reset, as the seed is not in it.
+
+// issuedConnId is a connection ID we issued, it is registered at the listener until it is retired
+type issuedConnId struct {
+	connId  uint64
+	isSpare bool // for a path change of the peer, see WithMaxConnectionIDs
+	isAcked bool // the peer has the spare, it is not sent anymore
+	isUsed  bool // a packet of the peer arrived on it
+}
+
+// RotateConnId issues a new connection ID to the peer with the next packet, the current one is retired once
+// the peer switched
+func (c *Conn) RotateConnId() error {
+	if !c.listener.isIssuedConnIds {
+		return ErrConnIdsNotIssued
+	}
+	c.isConnIdRotationRequested.Store(true)
+	return nil
+}
+
+// connById finds a connection by the ID of the init or by an ID we issued
+func (l *Listener) connById(connId uint64) *Conn {
+	if conn := l.connMap.Get(connId); conn != nil || l.issuedConnIds == nil {
+		return conn
+	}
+	return l.issuedConnIds.Get(connId)
+}
+
+func (l *Listener) maxConnectionIds() int {
+	if l.maxConnIds == 0 {
+		return 1
+	}
+	return l.maxConnIds
+}
+
+// statelessResetToken is the reset token of the connection a Data packet to an unknown connection ID is for
+func (l *Listener) statelessResetToken(connId uint64) []byte {
+	if l.isIssuedConnIds {
+		return issuedResetToken(l.prvKeyId, decryptConnId(l.connIdKey, connId)>>connIdCtrBits)
+	}
+	return resetToken(l.prvKeyId, connId)
+}
+
+// ownResetToken is the reset token we send to the sender of the init, see statelessResetToken
+func (c *Conn) ownResetToken() []byte {
+	if c.listener.isIssuedConnIds {
+		return issuedResetToken(c.listener.prvKeyId, c.connIdSeed)
+	}
+	return resetToken(c.listener.prvKeyId, c.connId)
+}
+
+// issueConnId issues and registers the next connection ID, it is sent until the peer uses it, or as a spare
+// until the peer acks it
+func (c *Conn) issueConnId(isSpare bool) error {
+	if c.connIdCtr == 0 {
+		var b [8]byte
+		if _, err := rand.Read(b[2:]); err != nil {
+			return err
+		}
+		c.connIdSeed = Uint64(b[:]) >> connIdCtrBits
+	}
+	for range maxConnIdAttempts {
+		if c.connIdCtr == 1<<connIdCtrBits-1 {
+			break
+		}
+		c.connIdCtr++
+		connId := encryptConnId(c.listener.connIdKey, c.connIdSeed<<connIdCtrBits|c.connIdCtr)
+		if c.listener.connMap.Contains(connId) || c.listener.issuedConnIds.Contains(connId) {
+			continue
+		}
+		c.listener.issuedConnIds.Put(connId, c)
+		c.connIdsIssued = append(c.connIdsIssued, issuedConnId{connId: connId, isSpare: isSpare})
+		slog.Debug("ConnId/Issued", gId(), c.debug(), slog.Uint64("issued", connId), slog.Bool("spare", isSpare))
+		return nil
+	}
+	return errors.New("no unused connection ID")
+}
+
+// dataConnId is the connection ID in the header of our Data packets
+func (c *Conn) dataConnId() uint64 {
+	if c.connIdSnd != 0 {
+		return c.connIdSnd
+	}
+	return c.connId
+}
+
+// setConnIdSnd switches to an ID the peer issued, as the sender of the init we keep it for a stateless reset
+func (c *Conn) setConnIdSnd(connId uint64) {
+	slog.Debug("ConnId/Switch", gId(), c.debug(), slog.Uint64("old", c.dataConnId()), slog.Uint64("new", connId))
+	c.removePeerConnId()
+	c.connIdSnd = connId
+	if c.resetToken != nil {
+		c.listener.peerConnIds.Put(connId, c)
+	}
+}
+
+func (c *Conn) removePeerConnId() {
+	if c.connIdSnd != 0 && c.listener.peerConnIds.Get(c.connIdSnd) == c {
+		c.listener.peerConnIds.Remove(c.connIdSnd)
+	}
+}
+
+// isConnIdFrame is true for the path frames of connid.go, they are sent with the data, see Conn.decode
+func isConnIdFrame(t PathMsgType) bool {
+	return t == PathConnId || t == PathConnIdSpare || t == PathConnIdAck
+}
+
+// decodeConnId handles the path frame of a decrypted packet, if it is one of connid.go
+func (c *Conn) decodeConnId(p *PayloadHeader) {
+	switch p.PathMsgType {
+	case PathConnId:
+		c.onConnIdFrame(p.PathNonce)
+	case PathConnIdSpare:
+		c.onConnIdSpare(p.PathNonce)
+	case PathConnIdAck:
+		c.onConnIdAck(p.PathNonce)
+	}
+}
+
+// onConnIdFrame switches to the connection ID the peer issued
+func (c *Conn) onConnIdFrame(connId uint64) {
+	if connId == 0 || connId == c.connIdSnd {
+		return
+	}
+	c.setConnIdSnd(connId)
+}
+
+// onConnIdSpare keeps a spare ID of the peer for the next path change, it is acked even if we have it already
+func (c *Conn) onConnIdSpare(connId uint64) {
+	if connId == 0 {
+		return
+	}
+	if !slices.Contains(c.connIdsAck, connId) && len(c.connIdsAck) < maxConnIdPool {
+		c.connIdsAck = append(c.connIdsAck, connId)
+	}
+	if connId == c.connIdSnd || slices.Contains(c.connIdsSpare, connId) || len(c.connIdsSpare) >= maxConnIdPool {
+		return
+	}
+	c.connIdsSpare = append(c.connIdsSpare, connId)
+}
+
+// onConnIdAck stops sending a spare, the peer has it
+func (c *Conn) onConnIdAck(connId uint64) {
+	for i := range c.connIdsIssued {
+		if c.connIdsIssued[i].connId == connId && c.connIdsIssued[i].isSpare {
+			c.connIdsIssued[i].isAcked = true
+		}
+	}
+}
+
+// switchConnIdSpare switches to the oldest spare of the peer after a path change, if there is one
+func (c *Conn) switchConnIdSpare() {
+	if len(c.connIdsSpare) == 0 {
+		return
+	}
+	connId := c.connIdsSpare[0]
+	c.connIdsSpare = slices.Delete(c.connIdsSpare, 0, 1)
+	c.setConnIdSnd(connId)
+}
+
+// onConnIdUsed marks an issued ID once the peer used it, and retires the ones the peer used before
+func (c *Conn) onConnIdUsed(connId uint64) {
+	i := slices.IndexFunc(c.connIdsIssued, func(id issuedConnId) bool { return id.connId == connId })
+	if i < 0 || c.connIdsIssued[i].isUsed {
+		return
+	}
+	c.connIdsIssued[i].isUsed = true
+	c.connIdsIssued = slices.DeleteFunc(c.connIdsIssued, func(id issuedConnId) bool {
+		if id.connId == connId || !id.isUsed {
+			return false
+		}
+		c.listener.issuedConnIds.Remove(id.connId)
+		return true
+	})
+}
+
+// isConnIdUsed is true if the peer uses the newest ID that is not a spare, or if it switched to a spare since
+func (c *Conn) isConnIdUsed() bool {
+	for _, id := range slices.Backward(c.connIdsIssued) {
+		if !id.isSpare {
+			return id.isUsed
+		}
+	}
+	return true
+}
+
+// nrConnIdSpares counts the spares the peer did not use yet, and of these the ones it did not ack yet
+func (c *Conn) nrConnIdSpares() (nrUnused int, nrUnacked int) {
+	for _, id := range c.connIdsIssued {
+		if id.isSpare && !id.isUsed {
+			nrUnused++
+			if !id.isAcked {
+				nrUnacked++
+			}
+		}
+	}
+	return nrUnused, nrUnacked
+}
+
+// connIdFrameLen is the space reserved in a packet for a path frame of connid.go, while one is sent
+func (c *Conn) connIdFrameLen() int {
+	if !c.isConnIdPending() {
+		return 0
+	}
+	return calcExtLen(ExtPath)
+}
+
+func (c *Conn) isConnIdPending() bool {
+	if len(c.connIdsAck) > 0 {
+		return true
+	}
+	if len(c.connIdsIssued) == 0 {
+		return false
+	}
+	if !c.isConnIdUsed() || c.isConnIdRotationRequested.Load() {
+		return true
+	}
+	nrUnused, nrUnacked := c.nrConnIdSpares()
+	return nrUnacked > 0 || nrUnused < c.listener.maxConnectionIds()-1
+}
+
+// putConnId adds a path frame of connid.go to an encrypted packet, if the path frame is not used otherwise: the
+// ack of a spare of the peer, the newest issued ID until the peer uses it, or one of our spares not acked yet
+func (c *Conn) putConnId(p *PayloadHeader, msgType CryptoMsgType) error {
+	if msgType == InitSnd || p.PathMsgType != PathNone || (p.Ack != nil && p.Ack.isEcn) {
+		return nil
+	}
+	if len(c.connIdsAck) > 0 {
+		p.PathMsgType = PathConnIdAck
+		p.PathNonce = c.connIdsAck[0]
+		c.connIdsAck = slices.Delete(c.connIdsAck, 0, 1)
+		return nil
+	}
+	if len(c.connIdsIssued) == 0 {
+		return nil
+	}
+	if c.isConnIdUsed() && c.isConnIdRotationRequested.Load() {
+		c.isConnIdRotationRequested.Store(false)
+		if err := c.issueConnId(false); err != nil {
+			return err
+		}
+	}
+	if !c.isConnIdUsed() {
+		for _, id := range slices.Backward(c.connIdsIssued) {
+			if !id.isSpare {
+				p.PathMsgType = PathConnId
+				p.PathNonce = id.connId
+				return nil
+			}
+		}
+	}
+
+	// the spares are topped up once the peer uses an issued ID, and sent in turns
+	nrUnused, nrUnacked := c.nrConnIdSpares()
+	for ; nrUnused < c.listener.maxConnectionIds()-1; nrUnused++ {
+		if err := c.issueConnId(true); err != nil {
+			return err
+		}
+		nrUnacked++
+	}
+	if nrUnacked == 0 {
+		return nil
+	}
+	c.connIdSpareNext = (c.connIdSpareNext + 1) % nrUnacked
+	i := c.connIdSpareNext
+	for _, id := range c.connIdsIssued {
+		if id.isSpare && !id.isUsed && !id.isAcked {
+			if i == 0 {
+				p.PathMsgType = PathConnIdSpare
+				p.PathNonce = id.connId
+				return nil
+			}
+			i--
+		}
+	}
+	return nil
+}
+
+// removeConnIds removes the issued IDs of a closed connection from the listener
+func (c *Conn) removeConnIds() {
+	for _, id := range c.connIdsIssued {
+		c.listener.issuedConnIds.Remove(id.connId)
+	}
+	c.connIdsIssued = nil
+	c.removePeerConnId()
+}
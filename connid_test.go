@@ -0,0 +1,230 @@
+package qotp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connIdTest is a connection with issued connection IDs on both sides
+type connIdTest struct {
+	t                *testing.T
+	connA            *Conn
+	listenerB        *Listener
+	connPair         *ConnPair
+	streamA, streamB *Stream
+	nowNano          uint64
+}
+
+// setupConnIdTest issues up to maxConnIds IDs on both sides, and does the handshake
+func setupConnIdTest(t *testing.T, maxConnIds int) *connIdTest {
+	connA, listenerB, connPair := setupStreamTest(t)
+	connA.listener.isIssuedConnIds, listenerB.isIssuedConnIds = true, true
+	connA.listener.maxConnIds, listenerB.maxConnIds = maxConnIds, maxConnIds
+	assert.Nil(t, connA.issueConnId(false))
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	return &connIdTest{t: t, connA: connA, listenerB: listenerB, connPair: connPair, streamA: streamA,
+		streamB: streamB, nowNano: connPair.Conn1.localTime}
+}
+
+func (c *connIdTest) deliver(isSenderA bool) {
+	if isSenderA {
+		_, err := c.connPair.senderToRecipientAll()
+		assert.Nil(c.t, err)
+		for c.connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = c.listenerB.Listen(MinDeadLine, c.nowNano)
+			assert.Nil(c.t, err)
+		}
+		return
+	}
+	_, err := c.connPair.recipientToSenderAll()
+	assert.Nil(c.t, err)
+	for c.connPair.nrIncomingPacketsSender() > 0 {
+		_, err = c.connA.listener.Listen(MinDeadLine, c.nowNano)
+		assert.Nil(c.t, err)
+	}
+}
+
+// flush flushes one side, it returns the connection ID of the first packet sent
+func (c *connIdTest) flush(isSenderA bool) uint64 {
+	conn, queue := c.streamB.conn, &c.connPair.Conn2.writeQueue
+	if isSenderA {
+		conn, queue = c.connA, &c.connPair.Conn1.writeQueue
+	}
+	c.nowNano = max(c.nowNano+msNano, conn.nextWriteTime)
+	conn.listener.Flush(c.nowNano)
+	assert.NotEmpty(c.t, *queue)
+	return Uint64((*queue)[0].data[HeaderSize : HeaderSize+ConnIdSize])
+}
+
+// exchange sends "hallo" and the ack back, it returns the connection ID of the Data packet
+func (c *connIdTest) exchange(isSenderA bool) uint64 {
+	s, dst := c.streamB, c.streamA
+	if isSenderA {
+		s, dst = c.streamA, c.streamB
+	}
+	_, err := s.Write([]byte("hallo"))
+	assert.Nil(c.t, err)
+	c.nowNano += secondNano
+	connId := c.flush(isSenderA)
+	c.deliver(isSenderA)
+	data, err := dst.Read()
+	assert.Nil(c.t, err)
+	assert.Equal(c.t, []byte("hallo"), data)
+
+	c.flush(!isSenderA)
+	c.deliver(!isSenderA)
+	return connId
+}
+
+func TestConnIdIssued(t *testing.T) {
+	c := setupConnIdTest(t, 0)
+	connA, connB, listenerB := c.connA, c.streamB.conn, c.listenerB
+
+	// both sides learned the ID of the peer in the encrypted inits
+	assert.Equal(t, connB.connIdsIssued[0].connId, connA.connIdSnd)
+	assert.Equal(t, connA.connIdsIssued[0].connId, connB.connIdSnd)
+	assert.NotEqual(t, connA.connId, connA.connIdSnd)
+
+	// the Data packets carry the issued IDs, not the one of the init
+	assert.Equal(t, connB.connIdsIssued[0].connId, c.exchange(true))
+	assert.True(t, connB.isConnIdUsed())
+	assert.Equal(t, connA.connIdsIssued[0].connId, c.exchange(false))
+	assert.True(t, connA.isConnIdUsed())
+
+	// a rotation, the old ID is retired once A sent to the new one
+	oldId := connB.connIdsIssued[0].connId
+	assert.Nil(t, connB.RotateConnId())
+	c.exchange(false)
+	newId := connA.connIdSnd
+	assert.NotEqual(t, oldId, newId)
+	assert.Equal(t, []issuedConnId{{connId: newId, isUsed: true}}, connB.connIdsIssued)
+	assert.False(t, listenerB.issuedConnIds.Contains(oldId))
+	assert.Equal(t, connB, listenerB.connById(newId))
+	assert.Equal(t, newId, c.exchange(true))
+
+	// without WithMaxConnectionIDs, no spares
+	assert.Empty(t, connA.connIdsSpare)
+	assert.Empty(t, connB.connIdsSpare)
+
+	// the issued IDs are removed with the connection
+	connB.cleanupConn(nil, c.nowNano)
+	assert.False(t, listenerB.issuedConnIds.Contains(newId))
+}
+
+func TestConnIdPool(t *testing.T) {
+	c := setupConnIdTest(t, 3)
+	connA, connB, listenerB := c.connA, c.streamB.conn, c.listenerB
+
+	// each side issues 2 spares once its first ID is used, they are sent in turns until acked
+	for range 4 {
+		c.exchange(true)
+		c.exchange(false)
+	}
+	assert.Len(t, connA.connIdsSpare, 2)
+	assert.Len(t, connB.connIdsSpare, 2)
+	nrUnused, nrUnacked := connB.nrConnIdSpares()
+	assert.Equal(t, 2, nrUnused)
+	assert.Zero(t, nrUnacked)
+	assert.Zero(t, connA.connIdFrameLen())
+	for _, connId := range connA.connIdsSpare {
+		assert.Equal(t, connB, listenerB.connById(connId))
+	}
+
+	// NAT rebinding of A, B switches to a spare of A with its path challenge to the new address
+	oldIdB, spareA, spareB := connA.connIdSnd, connB.connIdsSpare[0], connA.connIdsSpare[0]
+	connPair := c.connPair
+	connPair.Conn1.srcAddr = netip.MustParseAddrPort("192.0.2.1:4242")
+	assert.Equal(t, oldIdB, c.exchange(true))
+	assert.Equal(t, spareA, connB.connIdSnd)
+	assert.Len(t, connB.connIdsSpare, 1)
+
+	// A gets the challenge and answers from its new address on a spare of B, no round trip needed
+	c.nowNano += secondNano
+	assert.Equal(t, spareA, c.flush(false))
+	c.deliver(false)
+	assert.Equal(t, spareB, connA.connIdSnd)
+	assert.Equal(t, spareB, c.flush(true))
+	c.deliver(true)
+	assert.Equal(t, connPair.Conn1.srcAddr, connB.RemoteAddr())
+
+	// B retired the ID A used before, and issues a new spare
+	assert.False(t, listenerB.issuedConnIds.Contains(oldIdB))
+	for range 4 {
+		c.exchange(true)
+		c.exchange(false)
+	}
+	nrUnused, nrUnacked = connB.nrConnIdSpares()
+	assert.Equal(t, 2, nrUnused)
+	assert.Zero(t, nrUnacked)
+	assert.Len(t, connA.connIdsSpare, 2)
+	assert.Len(t, connB.connIdsIssued, 3)
+}
+
+func TestConnIdStatelessReset(t *testing.T) {
+	c := setupConnIdTest(t, 2)
+	connA, connB, listenerB := c.connA, c.streamB.conn, c.listenerB
+	listenerB.isStatelessReset = true // as with WithStatelessReset(true)
+
+	// after a rotation, A sends to an ID that is not the one of the init
+	c.exchange(true)
+	firstId := connA.connIdSnd
+	assert.Nil(t, connB.RotateConnId())
+	c.exchange(false)
+	c.exchange(true)
+	connId := connA.connIdSnd
+	assert.NotEqual(t, firstId, connId)
+	assert.Equal(t, connB, listenerB.connById(connId))
+
+	// B restarts and forgets the connection, the reset token is derived from the ID
+	listenerB.connMap.Remove(connB.connId)
+	connB.removeConnIds()
+	assert.Equal(t, connA.resetToken, listenerB.statelessResetToken(connId))
+	assert.NotEqual(t, connA.resetToken, listenerB.statelessResetToken(connId+1))
+
+	_, err := c.streamA.Write([]byte("anyone there?"))
+	assert.Nil(t, err)
+	c.nowNano += secondNano
+	assert.Equal(t, connId, c.flush(true))
+	connPair := c.connPair
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, c.nowNano)
+	assert.ErrorIs(t, err, errConnNotFound)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+	assert.Equal(t, connId, Uint64(connPair.Conn2.writeQueue[0].data[HeaderSize:]))
+
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsSender() > 0 {
+		_, err = connA.listener.Listen(MinDeadLine, c.nowNano)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 0, connA.listener.connMap.Size())
+	assert.Equal(t, 0, connA.listener.peerConnIds.Size())
+	_, err = c.streamA.Read()
+	assert.ErrorIs(t, err, ErrConnectionReset)
+}
+
+func TestConnIdOption(t *testing.T) {
+	_, err := Listen(WithIssuedConnIds(), WithIssuedConnIds())
+	assert.Error(t, err)
+	_, err = Listen(WithMaxConnectionIDs(2))
+	assert.Error(t, err)
+	_, err = Listen(WithIssuedConnIds(), WithMaxConnectionIDs(maxConnIdPool+1))
+	assert.Error(t, err)
+	_, err = Listen(WithIssuedConnIds(), WithMaxConnectionIDs(0))
+	assert.Error(t, err)
+	_, err = Listen(WithIssuedConnIds(), WithMaxConnectionIDs(2), WithMaxConnectionIDs(2))
+	assert.Error(t, err)
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"), WithIssuedConnIds(), WithMaxConnectionIDs(maxConnIdPool))
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	assert.Equal(t, maxConnIdPool, listener.maxConnectionIds())
+
+	connA, _, _ := setupStreamTest(t)
+	assert.ErrorIs(t, connA.RotateConnId(), ErrConnIdsNotIssued)
+	assert.Equal(t, connA.connId, connA.dataConnId())
+	assert.Equal(t, 1, connA.listener.maxConnectionIds())
+}
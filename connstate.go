@@ -0,0 +1,122 @@
+package qotp
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+)
+
+var (
+	// errUnexpectedMsgType is returned by decode for a packet whose message type is not valid in the state of
+	// its connection, the packet is dropped and counted, the connection stays
+	errUnexpectedMsgType = errors.New("unexpected message type")
+	// errDuplicateInit is returned by decode for a retransmitted init of a connection we already replied to
+	errDuplicateInit = errors.New("duplicate init")
+)
+
+// connState is the state of a connection, it decides which message types are accepted, see isMsgTypeValid
+type connState uint8
+
+const (
+	connHandshaking connState = iota // the init is sent or received, the reply did not arrive yet
+	connEstablished                  // the handshake is done, only Data packets are accepted
+	connRotating                     // our send epoch rolled over, until the next packet of the peer arrives
+	connClosing                      // the close of the connection is requested or the peer closed it
+)
+
+func (s connState) String() string {
+	switch s {
+	case connHandshaking:
+		return "handshaking"
+	case connEstablished:
+		return "established"
+	case connRotating:
+		return "rotating"
+	case connClosing:
+		return "closing"
+	}
+	return "unknown"
+}
+
+// isMsgTypeValid checks a packet of the peer against the state of the connection. While handshaking, the
+// sender accepts the reply only, the receiver a retransmitted init, or Data that finishes the handshake. Once
+// the handshake is done, only Data is accepted.
+func (c *Conn) isMsgTypeValid(msgType CryptoMsgType) bool {
+	if c.state != connHandshaking {
+		return msgType == Data
+	}
+	switch msgType {
+	case InitRcv, InitCryptoRcv:
+		return c.isSenderOnInit
+	case InitSnd, InitCryptoSnd, InitSignedSnd, Data:
+		return !c.isSenderOnInit
+	}
+	return false
+}
+
+// checkDuplicateInit checks an init for an existing connection. A retransmitted init has the same ephemeral
+// key, it leaves the connection as it is and we reply again. Another key with the same connection ID is not
+// from our peer, it is dropped.
+func (c *Conn) checkDuplicateInit(pubKeyEpSnd *ecdh.PublicKey) error {
+	if c.pubKeyEpRcv == nil || !c.pubKeyEpRcv.Equal(pubKeyEpSnd) {
+		return fmt.Errorf("%w: init with another ephemeral key", errUnexpectedMsgType)
+	}
+	return errDuplicateInit
+}
+
+// onHandshakeDone moves the connection out of the handshake, a close requested meanwhile takes effect now
+func (c *Conn) onHandshakeDone(nowNano uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.isHandshakeDoneOnRcv = true
+	c.traceHandshakeDone()
+	c.listener.metrics.onHandshakeDone(nowNano - min(c.startNano, nowNano))
+	c.state = connEstablished
+	if c.isCloseConnRequested || c.closeErr != nil {
+		c.state = connClosing
+	}
+}
+
+// onClosing moves the connection to closing, a connection that is still handshaking moves once it is done
+func (c *Conn) onClosing() {
+	if c.state != connHandshaking {
+		c.state = connClosing
+	}
+}
+
+// onDrop counts a packet that was dropped as a replay, beyond the sequence window or because of its message
+// type, the count is part of the summary
+func (c *Conn) onDrop(reason string) {
+	c.droppedPackets++
+	c.listener.metrics.onDrop(reason)
+}
+
+// flushInitReply sends our reply again after the peer retransmitted its init, it did not get the reply. The
+// oldest packet in flight is retransmitted as it was, or an ack-only reply if there is none.
+func (c *Conn) flushInitReply(s *Stream, ack *Ack, nowNano uint64) (data int, pacingNano uint64, err error) {
+	c.isInitReplyPending = false
+	msgType := c.msgType()
+	splitData, offset, isClose := c.snd.retransmitOldest(s.streamID, ack, c.payloadMtu(msgType), msgType, nowNano)
+	if splitData == nil {
+		return c.writeAck(s, ack, nowNano)
+	}
+	c.retransmits++
+	return c.sendPacket(s, ack, splitData, offset, isClose, msgType, nowNano, false)
+}
+
+// retransmitOldest resends the oldest packet in flight of a stream, regardless of its timeout
+func (sb *SendBuffer) retransmitOldest(streamID uint32, ack *Ack, mtu int, msgType CryptoMsgType, nowNano uint64) (
+	data []byte, offset uint64, isClose bool) {
+	sb.mu.Lock()
+	stream := sb.streams[streamID]
+	if stream == nil {
+		sb.mu.Unlock()
+		return nil, 0, false
+	}
+	key, _, ok := stream.dataInFlightMap.First()
+	sb.mu.Unlock()
+	if !ok {
+		return nil, 0, false
+	}
+	return sb.RetransmitNow(streamID, key, ack, mtu, msgType, nowNano)
+}
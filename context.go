@@ -0,0 +1,49 @@
+package qotp
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Cancellation with WithContext. Once the context of the listener is done, Listen and the Read and Write of
+// the streams return its error and Flush does not send anymore. Loop closes the connections, sends their
+// close frames once and closes the listener. Every connection has a child context that is done once the
+// connection is cleaned up.
+
+// context returns the context of the listener, context.Background without WithContext
+func (l *Listener) context() context.Context {
+	if l.ctx == nil {
+		return context.Background()
+	}
+	return l.ctx
+}
+
+// ctxErr is the error of the context of the listener, nil while it is not done
+func (l *Listener) ctxErr() error {
+	return l.context().Err()
+}
+
+// Context returns the context of the connection, a child of the context of the listener. It is done once the
+// connection is closed, e.g., to select on conn.Context().Done().
+func (c *Conn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// closeOnDone closes all connections and sends their close frames once, without waiting for acks, then the
+// listener is closed
+func (l *Listener) closeOnDone() error {
+	slog.Debug("Listener/ContextDone", gId(), slog.Any("error", l.ctxErr()))
+	for _, conn := range l.connMap.Iterator(nil) {
+		if err := conn.CloseConnection(); err != nil {
+			slog.Info("close on context done", conn.debug(), slog.Any("error", err))
+		}
+	}
+	nowNano := l.nowNano()
+	for i := 0; i < l.connMap.Size(); i++ {
+		l.flush(nowNano)
+	}
+	return l.Close()
+}
@@ -0,0 +1,83 @@
+package qotp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithContext(ctx))
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.Nil(t, connA.Context().Err())
+
+	cancel()
+	assert.ErrorIs(t, connA.Context().Err(), context.Canceled)
+	_, err = listenerA.Listen(MinDeadLine, connPair.Conn1.localTime)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = streamA.Read()
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = streamA.Write([]byte("data"))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// nothing is sent anymore
+	streamA.Close()
+	assert.Equal(t, MinDeadLine, listenerA.Flush(connPair.Conn1.localTime+secondNano))
+	assert.Zero(t, connPair.nrOutgoingPacketsSender())
+}
+
+func TestContextConnClosed(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// the context of a connection is done once it is cleaned up, the others are not affected
+	ctxA := connA.Context()
+	assert.Nil(t, ctxA.Err())
+	connA.cleanupConn(nil, 0)
+	<-ctxA.Done()
+	assert.Nil(t, streamB.conn.Context().Err())
+	assert.Nil(t, listenerB.ctxErr())
+}
+
+func TestContextLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithContext(ctx))
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+	handshakeStreamTest(t, connA, listenerB, connPair)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	// Loop sends the close of the connection and closes the listener once the context is done
+	calls := 0
+	listenerA.Loop(func(s *Stream) (bool, error) {
+		calls++
+		cancel()
+		return calls < 100, nil
+	})
+	assert.Equal(t, 1, calls)
+	assert.True(t, listenerA.closed)
+	assert.Zero(t, listenerA.connMap.Size())
+	assert.ErrorIs(t, connA.Context().Err(), context.Canceled)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+
+	_, err = Listen(WithContext(nil))
+	assert.Error(t, err)
+}
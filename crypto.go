@@ -1,9 +1,20 @@
 package qotp
 
 import (
+	"bytes"
 	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
 
 	"golang.org/x/crypto/chacha20"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -17,10 +28,32 @@ const (
 	InitCryptoSnd
 	InitCryptoRcv
 	Data
+	InitSignedSnd
+	DataPadded // Data with filler, see padding.go, decode returns it as Data
 )
 
+func (t CryptoMsgType) String() string {
+	switch t {
+	case InitSnd:
+		return "InitSnd"
+	case InitRcv:
+		return "InitRcv"
+	case InitCryptoSnd:
+		return "InitCryptoSnd"
+	case InitCryptoRcv:
+		return "InitCryptoRcv"
+	case Data:
+		return "Data"
+	case InitSignedSnd:
+		return "InitSignedSnd"
+	case DataPadded:
+		return "DataPadded"
+	}
+	return fmt.Sprintf("CryptoMsgType(%d)", int8(t))
+}
+
 const (
-	CryptoVersion = 0
+	CryptoVersion = 4 // 1 derives the keys with HKDF, see newAeads, 2 drops the direction bit of the nonce, 3 negotiates the packet cipher, 4 protects the header of Data packets
 	MacSize       = 16
 	SnSize        = 6 // Sequence number Size is 48bit / 6 bytes
 	//MinPayloadSize is the minimum payload Size in bytes. We need at least 8 bytes as
@@ -31,36 +64,129 @@ const (
 	HeaderSize         = 1
 	ConnIdSize         = 8
 	MsgInitFillLenSize = 2
+	ResetTokenSize     = 16
+	SignatureSize      = ed25519.SignatureSize
 
-	//MinInitSndSize          = minMtu
 	MinInitRcvSizeHdr       = HeaderSize + ConnIdSize + (2 * PubKeySize)
 	MinInitCryptoSndSizeHdr = HeaderSize + (2 * PubKeySize)
 	MinInitCryptoRcvSizeHdr = HeaderSize + ConnIdSize + PubKeySize
+	MinInitSignedSndSizeHdr = HeaderSize + (2 * PubKeySize) + SignatureSize
 	MinDataSizeHdr          = HeaderSize + ConnIdSize
 	FooterDataSize          = SnSize + MacSize
 
 	MinPacketSize = MinDataSizeHdr + FooterDataSize + MinProtoSize
+	//MinInitCryptoSndSize is the size of an InitCryptoSnd without payload, the fill target needs to be larger
+	MinInitCryptoSndSize = MinInitCryptoSndSizeHdr + FooterDataSize + MsgInitFillLenSize
+	MinInitSignedSndSize = MinInitSignedSndSizeHdr + FooterDataSize + MsgInitFillLenSize
+	// minInitSize is the smallest init of the protocol, with the init params and the smallest payload. An init
+	// is accepted down to this size, the handshake MTU of the peer may be smaller than ours.
+	minInitSize       = MinInitCryptoSndSize + initParamsSize + MinProtoSize
+	minInitSignedSize = MinInitSignedSndSize + initParamsSize + MinProtoSize
+	//ResetPacketSize is the size of a stateless reset, it looks like the smallest Data packet
+	ResetPacketSize = MinPacketSize
+)
+
+var (
+	ErrLowOrderPoint = errors.New("X25519 low order point")
+	// ErrWrongServerIdentityKey is returned if InitCryptoSnd cannot be decrypted with our identity key, most
+	// likely the dialer has a stale or wrong identity key of ours
+	ErrWrongServerIdentityKey = errors.New("wrong server identity key")
+	// ErrInvalidSignature is returned if the Ed25519 signature of InitSignedSnd does not verify
+	ErrInvalidSignature = errors.New("invalid Ed25519 signature")
+	// ErrShortHeader is returned for a packet that is shorter than the header of its message type
+	ErrShortHeader = errors.New("packet shorter than its header")
+	// ErrBadSequenceNumber is returned for a packet whose SN cannot be decrypted, or that was received before
+	ErrBadSequenceNumber = errors.New("bad sequence number")
+	// ErrDecrypt is returned for a packet that does not open with the keys of the connection, e.g., a
+	// corrupted or forged packet, or one of a connection the peer lost
+	ErrDecrypt = errors.New("decryption failed")
+	// ErrNilKey is returned by the encoders if a key of the handshake or the ciphers of the connection are nil
+	ErrNilKey = errors.New("handshake keys cannot be nil")
 )
 
+// The kinds of decode errors, under the names other protocols use. Listen penalizes the source of a packet that
+// fails to authenticate, and only drops a truncated one.
+var (
+	ErrPacketTooShort  = ErrShortHeader
+	ErrAuthFailed      = ErrDecrypt
+	ErrInvalidSequence = ErrBadSequenceNumber
+	ErrKeyInvalid      = ErrLowOrderPoint
+)
+
+// lowOrderPoints are the encodings of the X25519 points of small order, with those the shared secret does not
+// depend on our private key. The most significant bit is ignored by X25519, so it is ignored when comparing,
+// which also covers the non-canonical encodings.
+var lowOrderPoints = [][PubKeySize]byte{
+	// 0 (order 4)
+	{},
+	// 1 (order 1)
+	{0x01},
+	// order 8
+	{0xe0, 0xeb, 0x7a, 0x7c, 0x3b, 0x41, 0xb8, 0xae, 0x16, 0x56, 0xe3, 0xfa, 0xf1, 0x9f, 0xc4, 0x6a,
+		0xda, 0x09, 0x8d, 0xeb, 0x9c, 0x32, 0xb1, 0xfd, 0x86, 0x62, 0x05, 0x16, 0x5f, 0x49, 0xb8, 0x00},
+	// order 8
+	{0x5f, 0x9c, 0x95, 0xbc, 0xa3, 0x50, 0x8c, 0x24, 0xb1, 0xd0, 0xb1, 0x55, 0x9c, 0x83, 0xef, 0x5b,
+		0x04, 0x44, 0x5c, 0xc4, 0x58, 0x1c, 0x8e, 0x86, 0xd8, 0x22, 0x4e, 0xdd, 0xd0, 0x9f, 0x11, 0x57},
+	// p-1 (order 2)
+	{0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	// p, same as 0
+	{0xed, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	// p+1, same as 1
+	{0xee, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+}
+
 type Message struct {
 	SnConn            uint64
 	currentEpochCrypt uint64
 	PayloadRaw        []byte
+	buf               *[]byte // pooled buffer of PayloadRaw, see Release
+}
+
+// Release returns the buffer of a decrypted Data message to the pool. PayloadRaw and anything sliced from it
+// must not be used afterwards. Messages without a pooled buffer are not affected.
+func (m *Message) Release() {
+	if m == nil || m.buf == nil {
+		return
+	}
+	putBuffer(m.buf)
+	m.buf = nil
+	m.PayloadRaw = nil
 }
 
 // ************************************* Encoder *************************************
 
-func encryptInitSnd(pubKeyIdSnd *ecdh.PublicKey, pubKeyEpSnd *ecdh.PublicKey, mtu int) (
-	connId uint64, encData []byte) {
+// fillerRand fills the filler of the inits, so that they do not differ from each other on the wire. nil leaves
+// the filler zeros, for the known-answer vectors.
+var fillerRand io.Reader = rand.Reader
+
+// fillRandom fills the filler of an init with random bytes
+func fillRandom(filler []byte) error {
+	if fillerRand == nil {
+		return nil
+	}
+	_, err := io.ReadFull(fillerRand, filler)
+	return err
+}
+
+// encryptInitSnd carries no data. The sender knows no key of the receiver, so there is no secret to encrypt
+// with, the ephemeral key of the receiver only arrives with InitRcv, and from then on the Data packets are
+// encrypted with it anyway. Data in the filler would be sent in plain text, and anyone on the path could
+// change it, so the filler is random and ignored by the receiver. For 0-RTT data, dial with the identity key
+// of the receiver, see InitCryptoSnd.
+func encryptInitSnd(pubKeyIdSnd *ecdh.PublicKey, pubKeyEpSnd *ecdh.PublicKey, handshakeMtu int) (
+	connId uint64, encData []byte, err error) {
 
 	if pubKeyIdSnd == nil || pubKeyEpSnd == nil {
-		panic("handshake keys cannot be nil")
+		return 0, nil, ErrNilKey
 	}
 
 	// Create the buffer with the correct size
-	headerCryptoDataBuffer := make([]byte, mtu)
+	headerCryptoDataBuffer := make([]byte, handshakeMtu)
 
-	headerCryptoDataBuffer[0] = (uint8(InitSnd) << 5) | CryptoVersion
+	headerCryptoDataBuffer[0] = cryptoHeader(InitSnd)
 
 	// Directly copy the ephemeral public key to the buffer following the isSender's public key
 	copy(headerCryptoDataBuffer[HeaderSize:], pubKeyEpSnd.Bytes())
@@ -68,7 +194,12 @@ func encryptInitSnd(pubKeyIdSnd *ecdh.PublicKey, pubKeyEpSnd *ecdh.PublicKey, mt
 	// Directly copy the isSender's public key to the buffer following the connection ID
 	copy(headerCryptoDataBuffer[HeaderSize+PubKeySize:], pubKeyIdSnd.Bytes())
 
-	return Uint64(headerCryptoDataBuffer[HeaderSize:]), headerCryptoDataBuffer
+	// the init params of codec.go overwrite the first bytes of the filler
+	if err = fillRandom(headerCryptoDataBuffer[HeaderSize+(2*PubKeySize):]); err != nil {
+		return 0, nil, err
+	}
+
+	return Uint64(headerCryptoDataBuffer[HeaderSize:]), headerCryptoDataBuffer, nil
 }
 
 func encryptInitRcv(connId uint64,
@@ -79,13 +210,13 @@ func encryptInitRcv(connId uint64,
 	packetData []byte) (encData []byte, err error) {
 
 	if pubKeyIdSnd == nil || pubKeyEpRcv == nil || prvKeyEpSnd == nil {
-		panic("handshake keys cannot be nil")
+		return nil, ErrNilKey
 	}
 
 	// Create the buffer with the correct size, INIT_HANDSHAKE_R0 has 3 public keys
 	headerWithKeys := make([]byte, MinInitRcvSizeHdr)
 
-	headerWithKeys[0] = (uint8(InitRcv) << 5) | CryptoVersion
+	headerWithKeys[0] = cryptoHeader(InitRcv)
 
 	PutUint64(headerWithKeys[HeaderSize:], connId)
 
@@ -95,14 +226,15 @@ func encryptInitRcv(connId uint64,
 	// Directly copy the ephemeral public key to the buffer following the isSender's public key
 	copy(headerWithKeys[HeaderSize+ConnIdSize+PubKeySize:], pubKeyIdSnd.Bytes())
 
-	// Perform ECDH for initial encryption
-	sharedSecret, err := prvKeyEpSnd.ECDH(pubKeyEpRcv)
+	// Perform ECDH for initial encryption, the connection has its own copy of the shared secret
+	sharedSecret, err := sharedSecretECDH(prvKeyEpSnd, pubKeyEpRcv)
 	if err != nil {
 		return nil, err
 	}
+	defer zeroize(sharedSecret)
 
 	// Encrypt and write dataToSend
-	return chainedEncrypt(snCrypto, 0, false, sharedSecret, headerWithKeys, packetData)
+	return chainedEncrypt(snCrypto, 0, false, sharedSecret, nil, headerWithKeys, packetData)
 }
 
 func encryptInitCryptoSnd(
@@ -110,17 +242,17 @@ func encryptInitCryptoSnd(
 	pubKeyIdSnd *ecdh.PublicKey,
 	prvKeyEpSnd *ecdh.PrivateKey,
 	snCrypto uint64,
-	mtu int,
+	handshakeMtu int,
 	packetData []byte) (connId uint64, encData []byte, err error) {
 
 	if pubKeyIdRcv == nil || pubKeyIdSnd == nil || prvKeyEpSnd == nil {
-		panic("handshake keys cannot be nil")
+		return 0, nil, ErrNilKey
 	}
 
 	// Create the buffer with the correct size, INIT_WITH_CRYPTO_S0 has 3 public keys
 	headerWithKeys := make([]byte, MinInitCryptoSndSizeHdr)
 
-	headerWithKeys[0] = (uint8(InitCryptoSnd) << 5) | CryptoVersion
+	headerWithKeys[0] = cryptoHeader(InitCryptoSnd)
 
 	// Directly copy the isSender's public key to the buffer following the connection ID
 	copy(headerWithKeys[HeaderSize:], prvKeyEpSnd.PublicKey().Bytes())
@@ -128,33 +260,93 @@ func encryptInitCryptoSnd(
 	// Directly copy the ephemeral public key to the buffer following the isSender's public key
 	copy(headerWithKeys[HeaderSize+PubKeySize:], pubKeyIdSnd.Bytes())
 
-	// Encrypt and write dataToSend
-	fillLen := mtu - (MinInitCryptoSndSizeHdr + FooterDataSize + MsgInitFillLenSize + len(packetData))
+	paddedPacketData, err := padInitData(MinInitCryptoSndSizeHdr, handshakeMtu, packetData)
+	if err != nil {
+		return 0, nil, err
+	}
 
-	if fillLen < 0 {
-		return 0, nil, errors.New("packet dataToSend cannot be larger than MTU")
+	// Perform ECDH for initial encryption
+	nonForwardSecretKey, err := sharedSecretECDH(prvKeyEpSnd, pubKeyIdRcv)
+
+	if err != nil {
+		return 0, nil, err
 	}
+	defer zeroize(nonForwardSecretKey)
 
-	// Create payload with filler length and filler if needed
-	paddedPacketData := make([]byte, len(packetData)+MsgInitFillLenSize+fillLen)
+	encData, err = chainedEncrypt(snCrypto, 0, true, nonForwardSecretKey, nil, headerWithKeys, paddedPacketData)
+	return Uint64(headerWithKeys[HeaderSize:]), encData, err
+}
 
-	// Add filler length, this is also encrypted
-	PutUint16(paddedPacketData, uint16(fillLen))
+// encryptInitSignedSnd is InitCryptoSnd with an Ed25519 identity. Instead of our X25519 identity key, it
+// carries our Ed25519 key and a signature of signedInitTranscript. The early data is encrypted like in
+// InitCryptoSnd with the ephemeral key and the identity key of the receiver.
+func encryptInitSignedSnd(
+	pubKeyIdRcv *ecdh.PublicKey,
+	prvKeyEdSnd ed25519.PrivateKey,
+	prvKeyEpSnd *ecdh.PrivateKey,
+	snCrypto uint64,
+	handshakeMtu int,
+	packetData []byte) (connId uint64, encData []byte, err error) {
 
-	// After the filler, copy the dataToSend
-	copy(paddedPacketData[2+fillLen:], packetData)
+	if pubKeyIdRcv == nil || prvKeyEdSnd == nil || prvKeyEpSnd == nil {
+		return 0, nil, ErrNilKey
+	}
 
-	// Perform ECDH for initial encryption
-	nonForwardSecretKey, err := prvKeyEpSnd.ECDH(pubKeyIdRcv)
+	headerWithKeys := make([]byte, MinInitSignedSndSizeHdr)
 
+	headerWithKeys[0] = cryptoHeader(InitSignedSnd)
+	copy(headerWithKeys[HeaderSize:], prvKeyEpSnd.PublicKey().Bytes())
+	copy(headerWithKeys[HeaderSize+PubKeySize:], prvKeyEdSnd.Public().(ed25519.PublicKey))
+
+	transcript := signedInitTranscript(headerWithKeys, pubKeyIdRcv)
+	copy(headerWithKeys[HeaderSize+(2*PubKeySize):], ed25519.Sign(prvKeyEdSnd, transcript[:]))
+
+	paddedPacketData, err := padInitData(MinInitSignedSndSizeHdr, handshakeMtu, packetData)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	nonForwardSecretKey, err := sharedSecretECDH(prvKeyEpSnd, pubKeyIdRcv)
 	if err != nil {
 		return 0, nil, err
 	}
+	defer zeroize(nonForwardSecretKey)
 
-	encData, err = chainedEncrypt(snCrypto, 0, true, nonForwardSecretKey, headerWithKeys, paddedPacketData)
+	encData, err = chainedEncrypt(snCrypto, 0, true, nonForwardSecretKey, nil, headerWithKeys, paddedPacketData)
 	return Uint64(headerWithKeys[HeaderSize:]), encData, err
 }
 
+// signedInitTranscript is the hash signed in InitSignedSnd. It covers the header byte, our ephemeral and our
+// Ed25519 key, and the identity key of the receiver, so the signature cannot be used with another ephemeral
+// key or sent to another receiver. The ephemeral key of the receiver is not known yet when the init is sent.
+func signedInitTranscript(headerWithKeys []byte, pubKeyIdRcv *ecdh.PublicKey) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte("qotp signed init"))
+	h.Write(headerWithKeys[:HeaderSize+(2*PubKeySize)])
+	h.Write(pubKeyIdRcv.Bytes())
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// padInitData prepends the filler length and the filler, so that an init with hdrSize bytes of header fills
+// the handshake MTU
+func padInitData(hdrSize int, handshakeMtu int, packetData []byte) ([]byte, error) {
+	fillLen := handshakeMtu - (hdrSize + FooterDataSize + MsgInitFillLenSize + len(packetData))
+
+	if fillLen < 0 {
+		return nil, fmt.Errorf("init of %d bytes exceeds the handshake mtu %d",
+			hdrSize+FooterDataSize+MsgInitFillLenSize+len(packetData), handshakeMtu)
+	}
+
+	// Create payload with filler length and filler, the filler length is also encrypted
+	paddedPacketData := padData(fillLen, packetData)
+	if err := fillRandom(paddedPacketData[MsgInitFillLenSize : MsgInitFillLenSize+fillLen]); err != nil {
+		return nil, err
+	}
+	return paddedPacketData, nil
+}
+
 func encryptInitCryptoRcv(
 	connId uint64,
 	pubKeyEpRcv *ecdh.PublicKey,
@@ -163,106 +355,259 @@ func encryptInitCryptoRcv(
 	packetData []byte) (encData []byte, err error) {
 
 	if pubKeyEpRcv == nil || prvKeyEpSnd == nil {
-		panic("handshake keys cannot be nil")
+		return nil, ErrNilKey
 	}
 
 	// Create the buffer with the correct size, INIT_WITH_CRYPTO_R0 has 2 public keys
 	headerWithKeys := make([]byte, MinInitCryptoRcvSizeHdr)
 
-	headerWithKeys[0] = (uint8(InitCryptoRcv) << 5) | CryptoVersion
+	headerWithKeys[0] = cryptoHeader(InitCryptoRcv)
 
 	PutUint64(headerWithKeys[HeaderSize:], connId)
 
 	// Directly copy the ephemeral public key to the buffer following the isSender's public key
 	copy(headerWithKeys[HeaderSize+ConnIdSize:], prvKeyEpSnd.PublicKey().Bytes())
 
-	// Perform ECDH for initial encryption
-	sharedSecret, err := prvKeyEpSnd.ECDH(pubKeyEpRcv)
+	// Perform ECDH for initial encryption, the connection has its own copy of the shared secret
+	sharedSecret, err := sharedSecretECDH(prvKeyEpSnd, pubKeyEpRcv)
 	if err != nil {
 		return nil, err
 	}
+	defer zeroize(sharedSecret)
 
 	// Encrypt and write dataToSend
-	return chainedEncrypt(snCrypto, 0, false, sharedSecret, headerWithKeys, packetData)
+	return chainedEncrypt(snCrypto, 0, false, sharedSecret, nil, headerWithKeys, packetData)
 }
 
 func encryptData(
 	connId uint64,
 	isSender bool,
-	sharedSecret []byte,
+	a *aeads,
+	iv []byte,
+	snCrypto uint64,
+	epochCrypto uint64,
+	isPadded bool,
+	packetData []byte) (encData []byte, err error) {
+	return encryptDataTo(nil, connId, isSender, a, iv, snCrypto, epochCrypto, isPadded, packetData)
+}
+
+// encryptDataTo is encryptData that appends the packet to dst, see chainedEncryptTo
+func encryptDataTo(
+	dst []byte,
+	connId uint64,
+	isSender bool,
+	a *aeads,
+	iv []byte,
 	snCrypto uint64,
 	epochCrypto uint64,
+	isPadded bool,
 	packetData []byte) (encData []byte, err error) {
 
-	if sharedSecret == nil {
-		panic("pubKeyEpSnd/pubKeyEpRcv keys cannot be nil")
+	if a == nil {
+		return nil, ErrNilKey
 	}
 
-	// Create the buffer with the correct size, DATA_0 has no public key
-	headerBuffer := make([]byte, HeaderSize+ConnIdSize)
+	// DATA_0 has no public key, the header is copied to dst and does not escape
+	var headerBuffer [HeaderSize + ConnIdSize]byte
 
-	headerBuffer[0] = (uint8(Data) << 5) | CryptoVersion
+	headerBuffer[0] = cryptoHeader(Data)
+	if isPadded {
+		headerBuffer[0] = cryptoHeader(DataPadded) // packetData starts with the filler of padData
+	}
 	PutUint64(headerBuffer[HeaderSize:], connId)
 
-	// Encrypt and write dataToSend
-	return chainedEncrypt(snCrypto, epochCrypto, isSender, sharedSecret, headerBuffer, packetData)
+	// Encrypt and write dataToSend, the header is masked once the payload is sealed
+	start := len(dst)
+	encData, err = chainedEncryptTo(dst, snCrypto, epochCrypto, isSender, a, iv, headerBuffer[:], packetData)
+	if err != nil {
+		return nil, err
+	}
+	if err = protectHeader(encData[start:], &a.dirs[dirIndex(isSender)]); err != nil {
+		return nil, err
+	}
+	return encData, nil
 }
 
-func chainedEncrypt(snCrypt uint64, epochConn uint64, isSender bool, sharedSecret []byte,
-	headerAndCrypto []byte, packetData []byte) (encData []byte, err error) {
-	nonceDet := make([]byte, chacha20poly1305.NonceSize)
+// aeads are the ciphers of a shared secret. A connection builds them once with its first Data packet, the key
+// schedule does not run for each packet. The epoch is part of the nonce only, so they stay the same when the
+// epoch rolls over.
+type aeads struct {
+	dirs [2]aeadDir // of the packets of the receiver and of the dialer, see dirIndex
+	// the nonce passed to aead would escape to the heap for each packet, this one is reused
+	mu    sync.Mutex
+	nonce [chacha20poly1305.NonceSize]byte
+}
+
+// aeadDir are the keys of the packets of one direction
+type aeadDir struct {
+	snKey []byte       // encrypts the SN, zeroized when the keys are dropped
+	hpKey []byte       // masks the header byte of Data packets, see protectHeader
+	aead  PacketCipher // seals the packet data and encrypts the SN
+}
+
+// ErrUnsupportedVersion is returned for a packet of another CryptoVersion, e.g., of a peer that was not
+// updated yet. It is dropped before it is decrypted. A payload of another ProtoVersion returns it as well.
+var ErrUnsupportedVersion = errors.New("unsupported version")
+
+// ErrUnknownMsgType is returned for a packet with a message type of the header that is not defined
+var ErrUnknownMsgType = errors.New("unknown message type")
 
-	PutUint48(nonceDet, epochConn)
-	PutUint48(nonceDet[6:], snCrypt)
+// hkdfSalt is the salt of HKDF-Extract of the shared secret, it changes with the CryptoVersion, so that two
+// versions never share a key
+var hkdfSalt = []byte("qotp v4")
 
-	if !isSender {
-		// set first (highest) bit to 0
-		nonceDet[0] = nonceDet[0] &^ 0x80 // bit clear
-	} else {
-		// set first (highest) bit to 1
-		nonceDet[0] = nonceDet[0] | 0x80 // bit set
+// dirIndex is the index in aeads.dirs of the packets of the dialer if isSender is true
+func dirIndex(isSender bool) int {
+	if isSender {
+		return 1
 	}
+	return 0
+}
 
-	aead, err := chacha20poly1305.New(sharedSecret)
+// newAeads derives the keys of both directions from the shared secret with HKDF-SHA256, the raw X25519 output
+// is not used as key. The payload and the SN of each direction have their own key. The labels of a suite other
+// than ChaCha20-Poly1305 end with its name, so that two suites never share a key.
+func newAeads(sharedSecret []byte, suite *PacketCipherSuite) (*aeads, error) {
+	prk, err := hkdf.Extract(sha256.New, sharedSecret, hkdfSalt)
 	if err != nil {
 		return nil, err
 	}
-	sealed := aead.Seal(nil, nonceDet, packetData, headerAndCrypto)
+	defer zeroize(prk)
+
+	suffix := ""
+	if suite.ID != chachaSuite.ID {
+		suffix = " " + suite.Name
+	}
+	a := &aeads{}
+	for i, direction := range []string{"receiver", "dialer"} {
+		dataKey, err := hkdf.Expand(sha256.New, prk, "qotp "+direction+" data"+suffix, suite.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		snKey, err := hkdf.Expand(sha256.New, prk, "qotp "+direction+" sn"+suffix, suite.KeySize)
+		if err != nil {
+			zeroize(dataKey)
+			return nil, err
+		}
+		hpKey, err := hkdf.Expand(sha256.New, prk, "qotp "+direction+" hp"+suffix, chacha20.KeySize)
+		if err != nil {
+			zeroize(dataKey)
+			zeroize(snKey)
+			return nil, err
+		}
+		aead, err := suite.New(dataKey, snKey)
+		zeroize(dataKey) // the aead has its own copy
+		if err == nil && (aead.NonceSize() != chacha20poly1305.NonceSize || aead.Overhead() != MacSize) {
+			// the nonce is built by putNonceDet and the packet sizes count with the tag of MacSize
+			err = fmt.Errorf("packet cipher %q needs a nonce of %d bytes and a tag of %d bytes", suite.Name,
+				chacha20poly1305.NonceSize, MacSize)
+		}
+		if err != nil {
+			zeroize(snKey)
+			zeroize(hpKey)
+			return nil, err
+		}
+		a.dirs[i] = aeadDir{snKey: snKey, hpKey: hpKey, aead: aead}
+	}
+	return a, nil
+}
 
-	encData = make([]byte, len(headerAndCrypto)+SnSize+len(sealed))
-	copy(encData, headerAndCrypto)
+// zeroize overwrites the SN and header keys, the aead keys are opaque, the references to them are dropped
+func (a *aeads) zeroize() {
+	if a == nil {
+		return
+	}
+	for i := range a.dirs {
+		zeroize(a.dirs[i].snKey)
+		zeroize(a.dirs[i].hpKey)
+		a.dirs[i] = aeadDir{}
+	}
+}
 
-	aeadSn, err := chacha20poly1305.NewX(sharedSecret)
+// chainedEncrypt is chainedEncryptAeads for a single packet, as in the handshake, with ChaCha20-Poly1305
+func chainedEncrypt(snCrypt uint64, epochConn uint64, isSender bool, sharedSecret []byte, iv []byte,
+	headerAndCrypto []byte, packetData []byte) (encData []byte, err error) {
+	a, err := newAeads(sharedSecret, &chachaSuite)
 	if err != nil {
 		return nil, err
 	}
+	defer a.zeroize()
+	return chainedEncryptAeads(snCrypt, epochConn, isSender, a, iv, headerAndCrypto, packetData)
+}
+
+// chainedEncryptAeads seals packetData with the nonce of putNonceDet, iv is nil for the split nonce. The SN
+// is encrypted separately with the first 24 bytes of the sealed data as sample, see PacketCipher.XorSn.
+func chainedEncryptAeads(snCrypt uint64, epochConn uint64, isSender bool, a *aeads, iv []byte,
+	headerAndCrypto []byte, packetData []byte) (encData []byte, err error) {
+	return chainedEncryptTo(nil, snCrypt, epochConn, isSender, a, iv, headerAndCrypto, packetData)
+}
 
+// chainedEncryptTo is chainedEncryptAeads that appends the packet to dst, e.g., a pooled buffer of the send
+// path. dst is only grown if it has not enough capacity, nil allocates the packet with its exact size.
+func chainedEncryptTo(dst []byte, snCrypt uint64, epochConn uint64, isSender bool, a *aeads, iv []byte,
+	headerAndCrypto []byte, packetData []byte) (encData []byte, err error) {
+	// sealed in place, after the header and the SN
+	start := len(dst)
+	encData = slices.Grow(dst, len(headerAndCrypto)+SnSize+len(packetData)+chacha20poly1305.Overhead)
+	encData = append(encData, headerAndCrypto...)
+	encData = encData[:len(encData)+SnSize]
+	aad := encData[start : start+len(headerAndCrypto)]
+
+	dir := &a.dirs[dirIndex(isSender)]
+	a.mu.Lock()
+	putNonceDet(a.nonce[:], iv, epochConn, snCrypt)
+	encData = dir.aead.Seal(encData, a.nonce[:], packetData, aad)
+	a.mu.Unlock()
+
+	// the SN is encrypted in place, a separate array would escape to the heap
+	snBytes := encData[start+len(headerAndCrypto) : start+len(headerAndCrypto)+SnSize]
+	PutUint48(snBytes, snCrypt)
+	sealed := encData[start+len(headerAndCrypto)+SnSize:]
 	nonceRand := sealed[0:24]
-	encSn := aeadSn.Seal(nil, nonceRand, nonceDet[6:12], nil)
-	copy(encData[len(headerAndCrypto):], encSn[:SnSize])
-	copy(encData[len(headerAndCrypto)+SnSize:], sealed)
+	return encData, dir.aead.XorSn(nonceRand, snBytes, snBytes)
+}
 
-	// Write the full message in one operation
-	return encData, nil
+// putNonceDet writes the deterministic nonce of a packet. Without an IV, the nonce is split: the epoch and the
+// SN with 48 bits each. With the IV of the direction, the epoch and the SN are XORed with the IV, see
+// deriveNonceIVs. The directions have their own keys, see newAeads, so they can use the same nonces.
+func putNonceDet(nonce []byte, iv []byte, epoch uint64, sn uint64) {
+	PutUint48(nonce, epoch)
+	PutUint48(nonce[6:], sn)
+
+	if iv != nil {
+		subtle.XORBytes(nonce, nonce, iv)
+	}
+}
+
+// deriveNonceIVs derives the IVs of the XOR nonce from the shared secret, one for the packets of the dialer
+// and one for the packets of the receiver. The IVs are different, so the directions use different nonces.
+func deriveNonceIVs(sharedSecret []byte) (ivSender []byte, ivReceiver []byte) {
+	derive := func(direction byte) []byte {
+		mac := hmac.New(sha256.New, sharedSecret)
+		mac.Write([]byte("qotp nonce iv"))
+		mac.Write([]byte{direction})
+		return mac.Sum(nil)[:chacha20poly1305.NonceSize]
+	}
+	return derive(0), derive(1)
 }
 
 // ************************************* Decoder *************************************
 
-func decryptInitSnd(encData []byte, mtu int) (
+func decryptInitSnd(encData []byte, minSize int) (
 	pubKeyIdSnd *ecdh.PublicKey,
 	pubKeyEpSnd *ecdh.PublicKey,
 	err error) {
 
-	if len(encData) < mtu {
-		return nil, nil, errors.New("size is below minimum init")
+	if len(encData) < minSize {
+		return nil, nil, fmt.Errorf("%w: size is below minimum init", ErrShortHeader)
 	}
 
-	pubKeyEpSnd, err = ecdh.X25519().NewPublicKey(encData[HeaderSize : HeaderSize+PubKeySize])
+	pubKeyEpSnd, err = newPubKey(encData[HeaderSize : HeaderSize+PubKeySize])
 	if err != nil {
 		return nil, nil, err
 	}
 
-	pubKeyIdSnd, err = ecdh.X25519().NewPublicKey(encData[HeaderSize+PubKeySize : HeaderSize+(2*PubKeySize)])
+	pubKeyIdSnd, err = newPubKey(encData[HeaderSize+PubKeySize : HeaderSize+(2*PubKeySize)])
 	if err != nil {
 		return nil, nil, err
 	}
@@ -278,21 +623,21 @@ func decryptInitRcv(encData []byte, prvKeyEpSnd *ecdh.PrivateKey) (
 	err error) {
 
 	if len(encData) < MinInitRcvSizeHdr+FooterDataSize {
-		return nil, nil, nil, nil, errors.New("size is below minimum init reply")
+		return nil, nil, nil, nil, fmt.Errorf("%w: size is below minimum init reply", ErrShortHeader)
 	}
 
-	pubKeyEpRcv, err = ecdh.X25519().NewPublicKey(encData[HeaderSize+ConnIdSize : HeaderSize+ConnIdSize+PubKeySize])
+	pubKeyEpRcv, err = newPubKey(encData[HeaderSize+ConnIdSize : HeaderSize+ConnIdSize+PubKeySize])
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
-	pubKeyIdRcv, err = ecdh.X25519().NewPublicKey(
+	pubKeyIdRcv, err = newPubKey(
 		encData[HeaderSize+ConnIdSize+PubKeySize : HeaderSize+ConnIdSize+(2*PubKeySize)])
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
-	sharedSecret, err = prvKeyEpSnd.ECDH(pubKeyEpRcv)
+	sharedSecret, err = sharedSecretECDH(prvKeyEpSnd, pubKeyEpRcv)
 
 	if err != nil {
 		return nil, nil, nil, nil, err
@@ -306,6 +651,7 @@ func decryptInitRcv(encData []byte, prvKeyEpSnd *ecdh.PrivateKey) (
 		encData[HeaderSize+ConnIdSize+(2*PubKeySize):],
 	)
 	if err != nil {
+		zeroize(sharedSecret)
 		return nil, nil, nil, nil, err
 	}
 
@@ -320,31 +666,32 @@ func decryptInitRcv(encData []byte, prvKeyEpSnd *ecdh.PrivateKey) (
 func decryptInitCryptoSnd(
 	encData []byte,
 	prvKeyIdRcv *ecdh.PrivateKey,
-	mtu int) (
+	minSize int) (
 	pubKeyIdSnd *ecdh.PublicKey,
 	pubKeyEpSnd *ecdh.PublicKey,
 	m *Message,
 	err error) {
 
-	if len(encData) < mtu {
-		return nil, nil, nil, errors.New("size is below minimum init")
+	if len(encData) < minSize || len(encData) < MinInitCryptoSndSize {
+		return nil, nil, nil, fmt.Errorf("%w: size is below minimum init", ErrShortHeader)
 	}
 
-	pubKeyEpSnd, err = ecdh.X25519().NewPublicKey(encData[HeaderSize : HeaderSize+PubKeySize])
+	pubKeyEpSnd, err = newPubKey(encData[HeaderSize : HeaderSize+PubKeySize])
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	pubKeyIdSnd, err = ecdh.X25519().NewPublicKey(encData[HeaderSize+PubKeySize : HeaderSize+(2*PubKeySize)])
+	pubKeyIdSnd, err = newPubKey(encData[HeaderSize+PubKeySize : HeaderSize+(2*PubKeySize)])
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	nonForwardSecretKey, err := prvKeyIdRcv.ECDH(pubKeyEpSnd)
+	nonForwardSecretKey, err := sharedSecretECDH(prvKeyIdRcv, pubKeyEpSnd)
 
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	defer zeroize(nonForwardSecretKey)
 
 	snConn, currentEpochCrypt, packetData, err := chainedDecrypt(
 		false,
@@ -354,12 +701,15 @@ func decryptInitCryptoSnd(
 		encData[HeaderSize+(2*PubKeySize):],
 	)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, fmt.Errorf("%w: %w", ErrWrongServerIdentityKey, err)
 	}
 
 	// Extract actual dataToSend - Remove filler_length and filler
 	fillerLen := Uint16(packetData)
-	actualData := packetData[2+int(fillerLen):]
+	if MsgInitFillLenSize+int(fillerLen) > len(packetData) {
+		return nil, nil, nil, fmt.Errorf("%w: filler of %d bytes exceeds the init", ErrShortPayload, fillerLen)
+	}
+	actualData := packetData[MsgInitFillLenSize+int(fillerLen):]
 
 	return pubKeyIdSnd, pubKeyEpSnd, &Message{
 		PayloadRaw:        actualData,
@@ -368,6 +718,63 @@ func decryptInitCryptoSnd(
 	}, nil
 }
 
+// decryptInitSignedSnd verifies the signature before anything else is done with the keys of the sender, then
+// the early data is decrypted like in InitCryptoSnd
+func decryptInitSignedSnd(
+	encData []byte,
+	prvKeyIdRcv *ecdh.PrivateKey,
+	minSize int) (
+	pubKeyEdSnd ed25519.PublicKey,
+	pubKeyEpSnd *ecdh.PublicKey,
+	m *Message,
+	err error) {
+
+	if len(encData) < minSize || len(encData) < MinInitSignedSndSize {
+		return nil, nil, nil, fmt.Errorf("%w: size is below minimum init", ErrShortHeader)
+	}
+
+	headerWithKeys := encData[:MinInitSignedSndSizeHdr]
+	pubKeyEdSnd = ed25519.PublicKey(bytes.Clone(headerWithKeys[HeaderSize+PubKeySize : HeaderSize+(2*PubKeySize)]))
+	transcript := signedInitTranscript(headerWithKeys, prvKeyIdRcv.PublicKey())
+	if !ed25519.Verify(pubKeyEdSnd, transcript[:], headerWithKeys[HeaderSize+(2*PubKeySize):]) {
+		return nil, nil, nil, ErrInvalidSignature
+	}
+
+	pubKeyEpSnd, err = newPubKey(encData[HeaderSize : HeaderSize+PubKeySize])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	nonForwardSecretKey, err := sharedSecretECDH(prvKeyIdRcv, pubKeyEpSnd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer zeroize(nonForwardSecretKey)
+
+	snConn, currentEpochCrypt, packetData, err := chainedDecrypt(
+		false,
+		0,
+		nonForwardSecretKey,
+		headerWithKeys,
+		encData[MinInitSignedSndSizeHdr:],
+	)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %w", ErrWrongServerIdentityKey, err)
+	}
+
+	fillerLen := Uint16(packetData)
+	if MsgInitFillLenSize+int(fillerLen) > len(packetData) {
+		return nil, nil, nil, fmt.Errorf("%w: filler of %d bytes exceeds the init", ErrShortPayload, fillerLen)
+	}
+	actualData := packetData[MsgInitFillLenSize+int(fillerLen):]
+
+	return pubKeyEdSnd, pubKeyEpSnd, &Message{
+		PayloadRaw:        actualData,
+		SnConn:            snConn,
+		currentEpochCrypt: currentEpochCrypt,
+	}, nil
+}
+
 // decryptInitCryptoRcv is decoded by the isSender
 func decryptInitCryptoRcv(
 	encData []byte,
@@ -378,15 +785,15 @@ func decryptInitCryptoRcv(
 	err error) {
 
 	if len(encData) < MinInitCryptoRcvSizeHdr+FooterDataSize {
-		return nil, nil, nil, errors.New("size is below minimum init reply")
+		return nil, nil, nil, fmt.Errorf("%w: size is below minimum init reply", ErrShortHeader)
 	}
 
-	pubKeyEpRcv, err = ecdh.X25519().NewPublicKey(encData[HeaderSize+ConnIdSize : HeaderSize+ConnIdSize+PubKeySize])
+	pubKeyEpRcv, err = newPubKey(encData[HeaderSize+ConnIdSize : HeaderSize+ConnIdSize+PubKeySize])
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	sharedSecret, err = prvKeyEpSnd.ECDH(pubKeyEpRcv)
+	sharedSecret, err = sharedSecretECDH(prvKeyEpSnd, pubKeyEpRcv)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -399,6 +806,7 @@ func decryptInitCryptoRcv(
 		encData[HeaderSize+ConnIdSize+PubKeySize:],
 	)
 	if err != nil {
+		zeroize(sharedSecret)
 		return nil, nil, nil, err
 	}
 
@@ -413,89 +821,122 @@ func decryptData(
 	encData []byte,
 	isSender bool,
 	epochCrypt uint64,
-	sharedSecret []byte) (*Message, error) {
+	a *aeads,
+	iv []byte) (*Message, error) {
 
 	if len(encData) < MinDataSizeHdr+FooterDataSize {
-		return nil, errors.New("size is below minimum")
+		return nil, fmt.Errorf("%w: size is below minimum", ErrShortHeader)
 	}
 
-	snConn, currentEpochCrypt, packetData, err := chainedDecrypt(
+	// the header is unmasked in place for the AD and masked again afterwards, the packet can then be tried
+	// with other keys
+	mask, err := a.dirs[dirIndex(!isSender)].headerMask(encData)
+	if err != nil {
+		return nil, err
+	}
+	header := encData[0] ^ mask
+	if version := header & 0x1F; !isCryptoVersion(version) {
+		// the keys of another version are different, the mask is wrong, e.g., of a corrupted sample
+		return nil, fmt.Errorf("%w: version %d after the header mask", ErrDecrypt, version)
+	}
+	encData[0] = header
+
+	// the plaintext is shorter than encData, it is decrypted into a pooled buffer
+	buf := getBuffer(len(encData))
+	snConn, currentEpochCrypt, packetData, err := chainedDecryptTo(
+		(*buf)[:0],
 		isSender,
 		epochCrypt,
-		sharedSecret,
+		a,
+		iv,
 		encData[0:HeaderSize+ConnIdSize],
 		encData[HeaderSize+ConnIdSize:],
 	)
+	encData[0] ^= mask
 	if err != nil {
+		putBuffer(buf)
 		return nil, err
 	}
+	if CryptoMsgType(header>>5) == DataPadded {
+		packetData, err = unpadData(packetData)
+		if err != nil {
+			putBuffer(buf)
+			return nil, err
+		}
+	}
 
 	return &Message{
 		PayloadRaw:        packetData,
 		SnConn:            snConn,
 		currentEpochCrypt: currentEpochCrypt,
+		buf:               buf,
 	}, nil
 }
 
+// chainedDecrypt opens a single packet, as in the handshake, with ChaCha20-Poly1305
 func chainedDecrypt(isSender bool, epochCrypt uint64, sharedSecret []byte, header []byte, encData []byte) (
 	snConn uint64, currentEpochCrypt uint64, packetData []byte, err error) {
-	snConnBytes := make([]byte, SnSize)
+	a, err := newAeads(sharedSecret, &chachaSuite)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer a.zeroize()
+	return chainedDecryptTo(nil, isSender, epochCrypt, a, nil, header, encData)
+}
 
+// chainedDecryptTo is chainedDecrypt with the aeads of a connection, it appends the plaintext to dst, which
+// must not overlap encData. iv is the IV of the peer, nil for the split nonce.
+func chainedDecryptTo(dst []byte, isSender bool, epochCrypt uint64, a *aeads, iv []byte,
+	header []byte, encData []byte) (snConn uint64, currentEpochCrypt uint64, packetData []byte, err error) {
+	// the SN is decrypted into the space of the plaintext, which has room for it, a separate array would
+	// escape to the heap
+	dst = slices.Grow(dst, len(encData))
+	snConnBytes := dst[len(dst) : len(dst)+SnSize]
+
+	// the packet was sent by the peer
+	dir := &a.dirs[dirIndex(!isSender)]
 	encSn := encData[0:SnSize]
 	encData = encData[SnSize:]
 	nonceRand := encData[:24]
-	snConnBytes, err = openNoVerify(sharedSecret, nonceRand, encSn, snConnBytes)
-	if err != nil {
-		return 0, 0, nil, err
+	if err = dir.aead.XorSn(nonceRand, encSn, snConnBytes); err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: %w", ErrBadSequenceNumber, err)
 	}
 	snConn = Uint48(snConnBytes)
 
-	nonceDet := make([]byte, chacha20poly1305.NonceSize)
-
-	epochs := []uint64{epochCrypt}
+	var epochsArr [3]uint64
+	epochs := append(epochsArr[:0], epochCrypt)
 	// Only try previous epoch if > 0
 	if epochCrypt > 0 {
 		epochs = append(epochs, epochCrypt-1)
 	}
 	epochs = append(epochs, epochCrypt+1)
 
-	aead, err := chacha20poly1305.New(sharedSecret)
-	if err != nil {
-		return 0, 0, nil, err
-	}
-	PutUint48(nonceDet[6:], snConn)
-
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	for _, epochTry := range epochs {
-		PutUint48(nonceDet, epochTry)
-		if isSender {
-			// set first (highest) bit to 0
-			nonceDet[0] = nonceDet[0] &^ 0x80 // bit clear
-		} else {
-			// set first (highest) bit to 1
-			nonceDet[0] = nonceDet[0] | 0x80 // bit set
-		}
+		putNonceDet(a.nonce[:], iv, epochTry, snConn)
 
-		packetData, err = aead.Open(nil, nonceDet, encData, header)
+		packetData, err = dir.aead.Open(dst, a.nonce[:], encData, header)
 		if err == nil {
 			//TODO if we are at epochCrypt + 1 -> make this the new epochCrypt
 			return snConn, epochTry, packetData, nil
 		}
 	}
-	return 0, 0, nil, err
+	return 0, 0, nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
 }
 
+// xorSn encrypts or decrypts the SN with the keystream of XChaCha20-Poly1305 for nonce, the result is the
+// start of what Seal returns, without the tag, which is not sent.
 // inspired by: https://github.com/golang/crypto/blob/master/chacha20poly1305/chacha20poly1305_generic.go
-func openNoVerify(sharedSecret []byte, nonce []byte, encoded []byte, snSer []byte) ([]byte, error) {
-	s, err := chacha20.NewUnauthenticatedCipher(sharedSecret, nonce)
+func xorSn(snKey []byte, nonce []byte, src []byte, dst []byte) error {
+	s, err := chacha20.NewUnauthenticatedCipher(snKey, nonce)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	s.SetCounter(1) // Set the counter to 1, skipping 32 bytes
 
-	// Decrypt the ciphertext
-	s.XORKeyStream(snSer, encoded)
-
-	return snSer, nil
+	s.XORKeyStream(dst[:len(src)], src)
+	return nil
 }
 
 func decodeHexPubKey(pubKeyHex string) (pubKey *ecdh.PublicKey, err error) {
@@ -504,13 +945,66 @@ func decodeHexPubKey(pubKeyHex string) (pubKey *ecdh.PublicKey, err error) {
 		return nil, err
 	}
 
-	pubKey, err = ecdh.X25519().NewPublicKey(b)
+	pubKey, err = newPubKey(b)
 	if err != nil {
 		return nil, err
 	}
 	return pubKey, nil
 }
 
+// newPubKey parses a public key of the peer, points of small order are rejected with ErrLowOrderPoint
+func newPubKey(b []byte) (*ecdh.PublicKey, error) {
+	if isLowOrderPoint(b) {
+		return nil, fmt.Errorf("%w: public key 0x%x", ErrLowOrderPoint, b)
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+func isLowOrderPoint(b []byte) bool {
+	if len(b) != PubKeySize {
+		return false
+	}
+	var masked [PubKeySize]byte
+	copy(masked[:], b)
+	masked[PubKeySize-1] &= 0x7f
+
+	isLowOrder := 0
+	for _, point := range lowOrderPoints {
+		isLowOrder |= subtle.ConstantTimeCompare(masked[:], point[:])
+	}
+	return isLowOrder == 1
+}
+
+// sharedSecretECDH performs ECDH and rejects an all-zero shared secret, which would become the chacha20 key
+func sharedSecretECDH(prvKey *ecdh.PrivateKey, pubKey *ecdh.PublicKey) ([]byte, error) {
+	if isLowOrderPoint(pubKey.Bytes()) {
+		return nil, fmt.Errorf("%w: public key 0x%x", ErrLowOrderPoint, pubKey.Bytes())
+	}
+	sharedSecret, err := prvKey.ECDH(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(sharedSecret, make([]byte, len(sharedSecret))) == 1 {
+		return nil, fmt.Errorf("%w: all-zero shared secret", ErrLowOrderPoint)
+	}
+	return sharedSecret, nil
+}
+
+// zeroize overwrites key material, so it does not stay in memory until the GC reclaims it. The copies that
+// chacha20poly1305 makes of the key cannot be reached, they only live as long as a single encrypt or decrypt.
+func zeroize(b []byte) {
+	clear(b)
+}
+
+// fingerprint identifies a public key in logs, the first 8 bytes of its SHA-256 hash
+func fingerprint(pubKey *ecdh.PublicKey) string {
+	if pubKey == nil {
+		return "n/a"
+	}
+	sum := sha256.Sum256(pubKey.Bytes())
+	return hex.EncodeToString(sum[:8])
+}
+
 func generateKey() (*ecdh.PrivateKey, error) {
 	prvKey1, err := ecdh.X25519().GenerateKey(rand.Reader)
 	if err != nil {
@@ -519,21 +1013,108 @@ func generateKey() (*ecdh.PrivateKey, error) {
 	return prvKey1, nil
 }
 
+// resetToken derives the stateless reset token for a connection from the static identity key. After a
+// restart, the listener can derive the same token again without any connection state.
+func resetToken(prvKeyId *ecdh.PrivateKey, connId uint64) []byte {
+	return macToken(prvKeyId, "qotp stateless reset", connId)
+}
+
+// issuedResetToken is resetToken with issued connection IDs, it is derived from the seed of the IDs, which
+// the listener recovers from any ID it issued to the connection, see decryptConnId
+func issuedResetToken(prvKeyId *ecdh.PrivateKey, seed uint64) []byte {
+	return macToken(prvKeyId, "qotp stateless reset seed", seed)
+}
+
+func macToken(prvKeyId *ecdh.PrivateKey, label string, v uint64) []byte {
+	mac := hmac.New(sha256.New, prvKeyId.Bytes())
+	vBytes := make([]byte, 8)
+	PutUint64(vBytes, v)
+	mac.Write([]byte(label))
+	mac.Write(vBytes)
+	return mac.Sum(nil)[:ResetTokenSize]
+}
+
+// connIdKey derives the key of the issued connection IDs from the static identity key
+func connIdKey(prvKeyId *ecdh.PrivateKey) []byte {
+	mac := hmac.New(sha256.New, prvKeyId.Bytes())
+	mac.Write([]byte("qotp connection id"))
+	return mac.Sum(nil)
+}
+
+// encryptConnId maps the seed and the counter of an issued connection ID to the ID, with a 4 round Feistel
+// network over the two 32 bit halves. It is a keyed permutation, the IDs of a connection look random, but
+// decryptConnId recovers the seed without any connection state.
+func encryptConnId(key []byte, v uint64) uint64 {
+	l, r := uint32(v>>32), uint32(v)
+	for round := range byte(4) {
+		l, r = r, l^feistelRound(key, round, r)
+	}
+	return uint64(l)<<32 | uint64(r)
+}
+
+func decryptConnId(key []byte, connId uint64) uint64 {
+	l, r := uint32(connId>>32), uint32(connId)
+	for round := byte(4); round > 0; round-- {
+		l, r = r^feistelRound(key, round-1, l), l
+	}
+	return uint64(l)<<32 | uint64(r)
+}
+
+func feistelRound(key []byte, round byte, half uint32) uint32 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{round, byte(half >> 24), byte(half >> 16), byte(half >> 8), byte(half)})
+	return Uint32(mac.Sum(nil))
+}
+
+// encryptStatelessReset creates a packet that looks like a Data packet to third parties: Data header,
+// the connId of the unknown connection, random bytes, and the reset token in place of the MAC.
+func encryptStatelessReset(connId uint64, token []byte) ([]byte, error) {
+	encData := make([]byte, ResetPacketSize)
+	PutUint64(encData[HeaderSize:], connId)
+	_, err := rand.Read(encData[MinDataSizeHdr : ResetPacketSize-ResetTokenSize])
+	if err != nil {
+		return nil, err
+	}
+	// the header looks like a protected one, with a random mask
+	var mask [1]byte
+	if _, err = rand.Read(mask[:]); err != nil {
+		return nil, err
+	}
+	encData[0] = cryptoHeader(Data) ^ (mask[0] & headerProtectMask)
+	copy(encData[ResetPacketSize-ResetTokenSize:], token)
+	return encData, nil
+}
+
+func isStatelessReset(encData []byte, token []byte) bool {
+	if token == nil || len(encData) != ResetPacketSize {
+		return false
+	}
+	return subtle.ConstantTimeCompare(encData[ResetPacketSize-ResetTokenSize:], token) == 1
+}
+
 func calcCryptoOverheadWithData(msgType CryptoMsgType, ack *Ack, offset uint64) (overhead int) {
 	hasAck := ack != nil
 	needsExtension := (hasAck && ack.offset > 0xFFFFFF) || offset > 0xFFFFFF
 
 	overhead = calcProtoOverhead(hasAck, needsExtension, false)
+	if hasAck && ack.isStreamRcvWnd {
+		overhead += calcExtLen(ExtStreamRcvWnd) // the stream receive window is sent in the extension
+	}
+	if hasAck && ack.isEcn {
+		overhead += calcExtLen(ExtPath) // the ECN counts are sent in the path frame
+	}
 
 	switch msgType {
 	case InitSnd:
 		return -1 //we cannot send data, this is unencrypted
 	case InitRcv:
-		overhead += MinInitRcvSizeHdr + FooterDataSize
+		overhead += MinInitRcvSizeHdr + FooterDataSize + ResetTokenSize
 	case InitCryptoSnd:
 		overhead += MinInitCryptoSndSizeHdr + FooterDataSize + MsgInitFillLenSize
 	case InitCryptoRcv:
-		overhead += MinInitCryptoRcvSizeHdr + FooterDataSize
+		overhead += MinInitCryptoRcvSizeHdr + FooterDataSize + ResetTokenSize
+	case InitSignedSnd:
+		overhead += MinInitSignedSndSizeHdr + FooterDataSize + MsgInitFillLenSize
 	case Data:
 		overhead += MinDataSizeHdr + FooterDataSize
 	}
@@ -3,11 +3,17 @@ package qotp
 import (
 	"bytes"
 	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"slices"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
 )
 
 // Helper functions
@@ -34,7 +40,7 @@ func testDoubleEncryptDecrypt(t *testing.T, sn uint64, data []byte, additionalDa
 		t.Fatalf("Failed to generate shared secret: %v", err)
 	}
 
-	buf, err := chainedEncrypt(sn, 0, true, sharedSecret, additionalData, data)
+	buf, err := chainedEncrypt(sn, 0, true, sharedSecret, nil, additionalData, data)
 	// too short
 	if len(data) < MinProtoSize {
 		assert.NotNil(t, err)
@@ -143,8 +149,7 @@ func testEncodeDecodeInitCryptoSnd(t *testing.T, payload []byte) {
 
 	// If payload is too short (< 8 bytes), expect error
 	if len(payload) < 8 {
-		assert.NotNil(t, err)
-		assert.Contains(t, err.Error(), "too short")
+		assert.ErrorIs(t, err, ErrShortPayload)
 		return
 	}
 
@@ -197,8 +202,7 @@ func testEncodeDecodeInitCryptoRcv(t *testing.T, payload []byte) {
 
 	// If payload is too short (< 8 bytes), expect error
 	if len(payload) < 8 {
-		assert.NotNil(t, err)
-		assert.Contains(t, err.Error(), "too short")
+		assert.ErrorIs(t, err, ErrShortPayload)
 		return
 	}
 
@@ -235,9 +239,10 @@ func TestCryptoInitSndBasicFlow(t *testing.T) {
 	alicePrvKeyEp := generateKeys(t)
 
 	// Alice -> Bob: Encode InitHandshakeS0
-	_, buffer := encryptInitSnd(
+	_, buffer, err := encryptInitSnd(
 		alicePrvKeyId.PublicKey(),
 		alicePrvKeyEp.PublicKey(), 1400)
+	assert.Nil(t, err)
 
 	// Bob receives and decodes InitHandshakeS0
 	pubKeyIdSnd, pubKeyEpSnd, err := decryptInitSnd(buffer, 1400)
@@ -254,8 +259,7 @@ func TestCryptoInitSndInvalidSize(t *testing.T) {
 	// Test with buffer that's too small
 	buffer := make([]byte, 1399)
 	_, _, err := decryptInitSnd(buffer, 1400)
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "size is below minimum init")
+	assert.ErrorIs(t, err, ErrShortHeader)
 }
 
 // Corner case: Exactly minimum size buffer
@@ -263,14 +267,57 @@ func TestCryptoInitSndExactMinSize(t *testing.T) {
 	alicePrvKeyId := generateKeys(t)
 	alicePrvKeyEp := generateKeys(t)
 
-	_, buffer := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	_, buffer, err := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	assert.Nil(t, err)
 
 	// Verify the buffer is at least minimum size
 	assert.GreaterOrEqual(t, len(buffer), 1400)
 
 	// Should decode successfully
-	_, _, err := decryptInitSnd(buffer, 1400)
+	_, _, err = decryptInitSnd(buffer, 1400)
+	assert.NoError(t, err)
+}
+
+func TestCryptoInitSndCarriesNoData(t *testing.T) {
+	alicePrvKeyId := generateKeys(t)
+	alicePrvKeyEp := generateKeys(t)
+
+	_, buffer, err := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	assert.Nil(t, err)
+	assert.Len(t, buffer, 1400)
+
+	// the filler after the keys and the init params is random, there is no key to encrypt data with
+	fillerStart := HeaderSize + (2 * PubKeySize) + 2
+	assert.NotEqual(t, make([]byte, 1400-fillerStart), buffer[fillerStart:])
+	_, buffer2, err := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	assert.Nil(t, err)
+	assert.NotEqual(t, buffer[fillerStart:], buffer2[fillerStart:])
+
+	// whatever is in the filler, the receiver ignores it
+	copy(buffer[fillerStart:], "plain text anyone on the path can change")
+	pubKeyIdSnd, pubKeyEpSnd, err := decryptInitSnd(buffer, 1400)
 	assert.NoError(t, err)
+	assert.True(t, alicePrvKeyId.PublicKey().Equal(pubKeyIdSnd))
+	assert.True(t, alicePrvKeyEp.PublicKey().Equal(pubKeyEpSnd))
+}
+
+func TestCryptoInitFillerRandom(t *testing.T) {
+	padded, err := padInitData(MinInitCryptoSndSizeHdr, 1400, []byte("hallo"))
+	assert.Nil(t, err)
+	fillLen := int(Uint16(padded))
+	assert.Equal(t, 1400-MinInitCryptoSndSize-len("hallo"), fillLen)
+	assert.NotEqual(t, make([]byte, fillLen), padded[MsgInitFillLenSize:MsgInitFillLenSize+fillLen])
+
+	// the random filler does not change the decoded payload
+	alicePrvKeyId := generateKeys(t)
+	alicePrvKeyEp := generateKeys(t)
+	bobPrvKeyId := generateKeys(t)
+	_, encData, err := encryptInitCryptoSnd(bobPrvKeyId.PublicKey(), alicePrvKeyId.PublicKey(), alicePrvKeyEp, 0,
+		1400, []byte("hallo"))
+	assert.Nil(t, err)
+	_, _, m, err := decryptInitCryptoSnd(encData, bobPrvKeyId, 1400)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hallo"), m.PayloadRaw)
 }
 
 // Corner case: Empty buffer
@@ -314,8 +361,7 @@ func TestCryptoInitRcvInvalidSize(t *testing.T) {
 	// Test with buffer that's too small
 	buffer := make([]byte, MinInitRcvSizeHdr+FooterDataSize-1)
 	_, _, _, _, err := decryptInitRcv(buffer, generateKeys(t))
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "size is below minimum init reply")
+	assert.ErrorIs(t, err, ErrShortHeader)
 }
 
 // Corner case: 8 bytes payload for InitRcv
@@ -370,12 +416,13 @@ func TestCryptoFullHandshakeFlow(t *testing.T) {
 	bobPrvKeyEp := generateKeys(t)
 
 	// Step 1: Alice sends InitHandshakeS0
-	connId, bufferS0 := encryptInitSnd(
+	connId, bufferS0, err := encryptInitSnd(
 		alicePrvKeyId.PublicKey(),
 		alicePrvKeyEp.PublicKey(), 1400)
+	assert.Nil(t, err)
 
 	// Step 2: Bob receives and decodes InitHandshakeS0
-	_, _, err := decryptInitSnd(bufferS0, 1400)
+	_, _, err = decryptInitSnd(bufferS0, 1400)
 	assert.NoError(t, err)
 
 	// Step 3: Bob sends InitHandshakeR0
@@ -403,8 +450,9 @@ func TestCryptoMultipleHandshakes(t *testing.T) {
 	alicePrvKeyEp1 := generateKeys(t)
 	bobPrvKeyEp1 := generateKeys(t)
 
-	connId, buffer1S0 := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp1.PublicKey(), 1400)
-	_, _, err := decryptInitSnd(buffer1S0, 1400)
+	connId, buffer1S0, err := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp1.PublicKey(), 1400)
+	assert.Nil(t, err)
+	_, _, err = decryptInitSnd(buffer1S0, 1400)
 	assert.NoError(t, err)
 
 	buffer1R0, err := encryptInitRcv(
@@ -422,7 +470,8 @@ func TestCryptoMultipleHandshakes(t *testing.T) {
 	alicePrvKeyEp2 := generateKeys(t)
 	bobPrvKeyEp2 := generateKeys(t)
 
-	connId, buffer2S0 := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp2.PublicKey(), 1400)
+	connId, buffer2S0, err := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp2.PublicKey(), 1400)
+	assert.Nil(t, err)
 	_, _, err = decryptInitSnd(buffer2S0, 1400)
 	assert.NoError(t, err)
 
@@ -440,23 +489,55 @@ func TestCryptoMultipleHandshakes(t *testing.T) {
 }
 
 func TestCryptoNilKeyHandling(t *testing.T) {
-	// Test encoding with nil keys
-	assert.Panics(t, func() {
-		encryptInitSnd(nil, nil, 1400)
-	})
-
-	assert.Panics(t, func() {
-		encryptInitRcv(0, nil, nil, nil, 0, []byte("test"))
-	})
-
-	validBuffer := make([]byte, 1400)
-	_, _, err := decryptInitSnd(validBuffer, 1400)
+	prvKeyId := generateKeys(t)
+	prvKeyEp := generateKeys(t)
+	pubKeyId, pubKeyEp := prvKeyId.PublicKey(), prvKeyEp.PublicKey()
+	_, prvKeyEd, err := ed25519.GenerateKey(nil)
 	assert.Nil(t, err)
 
-	validBuffer = make([]byte, 1400)
-	assert.Panics(t, func() {
-		decryptInitRcv(validBuffer, nil)
-	})
+	// each key slot of each encoder, the encoders return ErrNilKey instead of panicking
+	_, _, err = encryptInitSnd(nil, pubKeyEp, 1400)
+	assert.ErrorIs(t, err, ErrNilKey)
+	_, _, err = encryptInitSnd(pubKeyId, nil, 1400)
+	assert.ErrorIs(t, err, ErrNilKey)
+
+	_, err = encryptInitRcv(0, nil, pubKeyEp, prvKeyEp, 0, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+	_, err = encryptInitRcv(0, pubKeyId, nil, prvKeyEp, 0, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+	_, err = encryptInitRcv(0, pubKeyId, pubKeyEp, nil, 0, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+
+	_, _, err = encryptInitCryptoSnd(nil, pubKeyId, prvKeyEp, 0, 1400, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+	_, _, err = encryptInitCryptoSnd(pubKeyId, nil, prvKeyEp, 0, 1400, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+	_, _, err = encryptInitCryptoSnd(pubKeyId, pubKeyId, nil, 0, 1400, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+
+	_, _, err = encryptInitSignedSnd(nil, prvKeyEd, prvKeyEp, 0, 1400, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+	_, _, err = encryptInitSignedSnd(pubKeyId, nil, prvKeyEp, 0, 1400, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+	_, _, err = encryptInitSignedSnd(pubKeyId, prvKeyEd, nil, 0, 1400, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+
+	_, err = encryptInitCryptoRcv(0, nil, prvKeyEp, 0, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+	_, err = encryptInitCryptoRcv(0, pubKeyEp, nil, 0, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+
+	_, err = encryptData(0, true, nil, nil, 0, 0, false, []byte("test"))
+	assert.ErrorIs(t, err, ErrNilKey)
+
+	// all-zero public keys are rejected before they are used
+	zeroBuffer := make([]byte, 1400)
+	_, _, err = decryptInitSnd(zeroBuffer, 1400)
+	assert.ErrorIs(t, err, ErrLowOrderPoint)
+
+	zeroBuffer = make([]byte, 1400)
+	_, _, _, _, err = decryptInitRcv(zeroBuffer, nil)
+	assert.ErrorIs(t, err, ErrLowOrderPoint)
 }
 
 // Corner case: Corrupted buffer data
@@ -465,7 +546,8 @@ func TestCryptoCorruptedBuffer(t *testing.T) {
 	alicePrvKeyEp := generateKeys(t)
 
 	// Create valid buffer
-	_, buffer := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	_, buffer, err := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	assert.Nil(t, err)
 
 	// Corrupt the buffer
 	if len(buffer) > 10 {
@@ -474,7 +556,7 @@ func TestCryptoCorruptedBuffer(t *testing.T) {
 	}
 
 	// Should fail to decode
-	_, _, err := decryptInitSnd(buffer, 1400)
+	_, _, err = decryptInitSnd(buffer, 1400)
 	// Note: Depending on where corruption occurs, this might succeed or fail
 	// The test verifies the function doesn't panic on corrupted data
 	_ = err // Explicitly acknowledge we're not checking the error
@@ -485,14 +567,15 @@ func TestCryptoVeryLargeBuffer(t *testing.T) {
 	alicePrvKeyId := generateKeys(t)
 	alicePrvKeyEp := generateKeys(t)
 
-	_, validBuffer := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	_, validBuffer, err := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	assert.Nil(t, err)
 
 	// Create oversized buffer by appending extra data
 	largeBuffer := make([]byte, len(validBuffer)+10000)
 	copy(largeBuffer, validBuffer)
 
 	// Should still decode the valid portion
-	_, _, err := decryptInitSnd(largeBuffer, 1400)
+	_, _, err = decryptInitSnd(largeBuffer, 1400)
 	assert.NoError(t, err)
 }
 
@@ -505,3 +588,456 @@ func TestCryptoRandomBuffer(t *testing.T) {
 	// This will likely fail, but shouldn't panic
 	_ = err
 }
+
+func TestCryptoResetToken(t *testing.T) {
+	token := resetToken(testPrvKey1, 1234)
+	assert.Equal(t, ResetTokenSize, len(token))
+
+	// Deterministic, so a restarted listener derives the same token
+	assert.Equal(t, token, resetToken(testPrvKey1, 1234))
+	assert.NotEqual(t, token, resetToken(testPrvKey1, 1235))
+	assert.NotEqual(t, token, resetToken(testPrvKey2, 1234))
+}
+
+func TestCryptoConnIdPermutation(t *testing.T) {
+	key := connIdKey(testPrvKey1)
+	seen := map[uint64]bool{}
+	for _, v := range []uint64{0, 1, 2, 1 << 16, 0xffff_ffff_ffff_ffff} {
+		connId := encryptConnId(key, v)
+		assert.Equal(t, v, decryptConnId(key, connId))
+		assert.False(t, seen[connId])
+		seen[connId] = true
+	}
+	// another identity key issues other IDs
+	assert.NotEqual(t, encryptConnId(key, 1), encryptConnId(connIdKey(testPrvKey2), 1))
+	assert.NotEqual(t, resetToken(testPrvKey1, 1234), issuedResetToken(testPrvKey1, 1234))
+}
+
+func TestCryptoStatelessReset(t *testing.T) {
+	encData, err := encryptStatelessReset(1234, resetToken(testPrvKey1, 1234))
+	assert.NoError(t, err)
+	assert.Equal(t, ResetPacketSize, len(encData))
+
+	assert.True(t, isStatelessReset(encData, resetToken(testPrvKey1, 1234)))
+	assert.False(t, isStatelessReset(encData, resetToken(testPrvKey1, 1235)))
+	assert.False(t, isStatelessReset(encData, nil))
+	assert.False(t, isStatelessReset(append(encData, 0), resetToken(testPrvKey1, 1234)))
+
+	// Random part differs for each reset
+	encData2, err := encryptStatelessReset(1234, resetToken(testPrvKey1, 1234))
+	assert.NoError(t, err)
+	assert.NotEqual(t, encData, encData2)
+}
+
+// lowOrderPointEncodings are the known small order X25519 points, including the non-canonical encodings with
+// the most significant bit set
+func lowOrderPointEncodings() map[string][]byte {
+	points := map[string][]byte{}
+	names := []string{"zero", "one", "order8a", "order8b", "p-1", "p", "p+1"}
+	for i, point := range lowOrderPoints {
+		points[names[i]] = append([]byte{}, point[:]...)
+		highBit := append([]byte{}, point[:]...)
+		highBit[PubKeySize-1] |= 0x80
+		points[names[i]+"/msb"] = highBit
+	}
+	return points
+}
+
+func TestCryptoLowOrderPoints(t *testing.T) {
+	scalar := randomBytes(32)
+	for name, point := range lowOrderPointEncodings() {
+		t.Run(name, func(t *testing.T) {
+			// X25519 with any scalar results in an all-zero shared secret
+			_, err := curve25519.X25519(scalar, point)
+			assert.Error(t, err)
+
+			_, err = newPubKey(point)
+			assert.ErrorIs(t, err, ErrLowOrderPoint)
+
+			_, err = decodeHexPubKey(hex.EncodeToString(point))
+			assert.ErrorIs(t, err, ErrLowOrderPoint)
+
+			pubKey, err := ecdh.X25519().NewPublicKey(point)
+			assert.Nil(t, err)
+			_, err = sharedSecretECDH(generateKeys(t), pubKey)
+			assert.ErrorIs(t, err, ErrLowOrderPoint)
+		})
+	}
+
+	pubKey, err := newPubKey(generateKeys(t).PublicKey().Bytes())
+	assert.Nil(t, err)
+	assert.NotNil(t, pubKey)
+}
+
+func TestCryptoDecodeRejectsLowOrderPoints(t *testing.T) {
+	alicePrvKeyId := generateKeys(t)
+	alicePrvKeyEp := generateKeys(t)
+	bobPrvKeyId := generateKeys(t)
+	bobPrvKeyEp := generateKeys(t)
+
+	_, initSnd, err := encryptInitSnd(alicePrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), 1400)
+	assert.Nil(t, err)
+	initRcv, err := encryptInitRcv(0, bobPrvKeyId.PublicKey(), alicePrvKeyEp.PublicKey(), bobPrvKeyEp, 0,
+		[]byte("test data"))
+	assert.Nil(t, err)
+	_, initCryptoSnd, err := encryptInitCryptoSnd(bobPrvKeyId.PublicKey(), alicePrvKeyId.PublicKey(), alicePrvKeyEp,
+		0, 1400, []byte("test data"))
+	assert.Nil(t, err)
+	initCryptoRcv, err := encryptInitCryptoRcv(0, alicePrvKeyEp.PublicKey(), bobPrvKeyEp, 0, []byte("test data"))
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		offset int
+		decode func(data []byte) error
+	}{
+		{"InitSnd/ephemeral", initSnd, HeaderSize, func(data []byte) error {
+			_, _, err := decryptInitSnd(data, 1400)
+			return err
+		}},
+		{"InitSnd/identity", initSnd, HeaderSize + PubKeySize, func(data []byte) error {
+			_, _, err := decryptInitSnd(data, 1400)
+			return err
+		}},
+		{"InitRcv/ephemeral", initRcv, HeaderSize + ConnIdSize, func(data []byte) error {
+			_, _, _, _, err := decryptInitRcv(data, alicePrvKeyEp)
+			return err
+		}},
+		{"InitRcv/identity", initRcv, HeaderSize + ConnIdSize + PubKeySize, func(data []byte) error {
+			_, _, _, _, err := decryptInitRcv(data, alicePrvKeyEp)
+			return err
+		}},
+		{"InitCryptoSnd/ephemeral", initCryptoSnd, HeaderSize, func(data []byte) error {
+			_, _, _, err := decryptInitCryptoSnd(data, bobPrvKeyId, 1400)
+			return err
+		}},
+		{"InitCryptoSnd/identity", initCryptoSnd, HeaderSize + PubKeySize, func(data []byte) error {
+			_, _, _, err := decryptInitCryptoSnd(data, bobPrvKeyId, 1400)
+			return err
+		}},
+		{"InitCryptoRcv/ephemeral", initCryptoRcv, HeaderSize + ConnIdSize, func(data []byte) error {
+			_, _, _, err := decryptInitCryptoRcv(data, alicePrvKeyEp)
+			return err
+		}},
+	}
+
+	for _, tc := range testCases {
+		// the unmodified packet decodes
+		assert.Nil(t, tc.decode(tc.data), tc.name)
+
+		for name, point := range lowOrderPointEncodings() {
+			t.Run(tc.name+"/"+name, func(t *testing.T) {
+				data := append([]byte{}, tc.data...)
+				copy(data[tc.offset:], point)
+				assert.ErrorIs(t, tc.decode(data), ErrLowOrderPoint)
+			})
+		}
+	}
+}
+
+func TestCryptoEncodeRejectsLowOrderPoints(t *testing.T) {
+	lowOrder, err := ecdh.X25519().NewPublicKey(lowOrderPoints[2][:])
+	assert.Nil(t, err)
+
+	_, err = encryptInitRcv(0, generateKeys(t).PublicKey(), lowOrder, generateKeys(t), 0, []byte("test data"))
+	assert.ErrorIs(t, err, ErrLowOrderPoint)
+	_, _, err = encryptInitCryptoSnd(lowOrder, generateKeys(t).PublicKey(), generateKeys(t), 0, 1400,
+		[]byte("test data"))
+	assert.ErrorIs(t, err, ErrLowOrderPoint)
+	_, err = encryptInitCryptoRcv(0, lowOrder, generateKeys(t), 0, []byte("test data"))
+	assert.ErrorIs(t, err, ErrLowOrderPoint)
+}
+
+func TestCryptoInitCryptoSndWrongIdentityKey(t *testing.T) {
+	alicePrvKeyId := generateKeys(t)
+	alicePrvKeyEp := generateKeys(t)
+	bobPrvKeyId := generateKeys(t)
+	stalePrvKeyId := generateKeys(t)
+
+	_, buffer, err := encryptInitCryptoSnd(stalePrvKeyId.PublicKey(), alicePrvKeyId.PublicKey(), alicePrvKeyEp, 0,
+		1400, []byte("test data"))
+	assert.Nil(t, err)
+
+	_, _, _, err = decryptInitCryptoSnd(buffer, bobPrvKeyId, 1400)
+	assert.ErrorIs(t, err, ErrWrongServerIdentityKey)
+
+	// the keys are still readable, as for InitSnd
+	pubKeyIdSnd, pubKeyEpSnd, err := decryptInitSnd(buffer, 1400)
+	assert.Nil(t, err)
+	assert.Equal(t, alicePrvKeyId.PublicKey().Bytes(), pubKeyIdSnd.Bytes())
+	assert.Equal(t, alicePrvKeyEp.PublicKey().Bytes(), pubKeyEpSnd.Bytes())
+}
+
+func TestCryptoInitSignedSnd(t *testing.T) {
+	pubKeyEd, prvKeyEd, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	alicePrvKeyEp := generateKeys(t)
+	bobPrvKeyId := generateKeys(t)
+
+	connId, buffer, err := encryptInitSignedSnd(bobPrvKeyId.PublicKey(), prvKeyEd, alicePrvKeyEp, 0, 1400,
+		[]byte("test data"))
+	assert.Nil(t, err)
+	assert.Len(t, buffer, 1400)
+	assert.Equal(t, InitSignedSnd, CryptoMsgType(buffer[0]>>5))
+	assert.Equal(t, Uint64(alicePrvKeyEp.PublicKey().Bytes()), connId)
+
+	pubKeyEdSnd, pubKeyEpSnd, m, err := decryptInitSignedSnd(buffer, bobPrvKeyId, 1400)
+	assert.Nil(t, err)
+	assert.Equal(t, pubKeyEd, pubKeyEdSnd)
+	assert.True(t, pubKeyEpSnd.Equal(alicePrvKeyEp.PublicKey()))
+	assert.Equal(t, []byte("test data"), m.PayloadRaw)
+}
+
+func TestCryptoInitSignedSndForged(t *testing.T) {
+	_, prvKeyEd, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	pubKeyEdOther, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	alicePrvKeyEp := generateKeys(t)
+	bobPrvKeyId := generateKeys(t)
+
+	_, buffer, err := encryptInitSignedSnd(bobPrvKeyId.PublicKey(), prvKeyEd, alicePrvKeyEp, 0, 1400,
+		[]byte("test data"))
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name  string
+		forge func(data []byte)
+	}{
+		{"signature", func(data []byte) { data[HeaderSize+(2*PubKeySize)] ^= 0x01 }},
+		// another identity claims the signature
+		{"identity", func(data []byte) { copy(data[HeaderSize+PubKeySize:], pubKeyEdOther) }},
+		// the signature is reused with the ephemeral key of an attacker
+		{"ephemeral", func(data []byte) { copy(data[HeaderSize:], generateKeys(t).PublicKey().Bytes()) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forged := bytes.Clone(buffer)
+			tt.forge(forged)
+			_, _, _, err := decryptInitSignedSnd(forged, bobPrvKeyId, 1400)
+			assert.ErrorIs(t, err, ErrInvalidSignature)
+		})
+	}
+
+	// signed for another receiver
+	_, _, _, err = decryptInitSignedSnd(buffer, generateKeys(t), 1400)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestCryptoNonceXorIVNoCollision(t *testing.T) {
+	sharedSecret := randomBytes(32)
+	ivSender, ivReceiver := deriveNonceIVs(sharedSecret)
+	assert.NotEqual(t, ivSender, ivReceiver)
+
+	// 2^20 packets per direction, the SN wraps around to the next epoch in the middle
+	const packets = 1 << 20
+	start := uint64(1<<48 - packets/2)
+	nonces := make([][12]byte, 0, 2*packets)
+	for i := uint64(0); i < packets; i++ {
+		sn := (start + i) & (1<<48 - 1)
+		epoch := (start + i) >> 48
+		var nonce [12]byte
+		putNonceDet(nonce[:], ivSender, epoch, sn)
+		nonces = append(nonces, nonce)
+		putNonceDet(nonce[:], ivReceiver, epoch, sn)
+		nonces = append(nonces, nonce)
+	}
+
+	slices.SortFunc(nonces, func(a, b [12]byte) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	for i := 1; i < len(nonces); i++ {
+		if nonces[i] == nonces[i-1] {
+			t.Fatalf("nonce collision: %x", nonces[i])
+		}
+	}
+}
+
+func TestCryptoDataNonceXorIV(t *testing.T) {
+	sharedSecret := randomBytes(32)
+	ivSender, ivReceiver := deriveNonceIVs(sharedSecret)
+	data := []byte("hello world")
+	a, err := newAeads(sharedSecret, &chachaSuite)
+	assert.NoError(t, err)
+
+	encData, err := encryptData(1234, true, a, ivSender, 5, 0, false, data)
+	assert.NoError(t, err)
+
+	m, err := decryptData(encData, false, 0, a, ivSender)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), m.SnConn)
+	assert.Equal(t, data, m.PayloadRaw)
+
+	// the other direction and the split nonce do not decrypt it
+	_, err = decryptData(encData, false, 0, a, ivReceiver)
+	assert.Error(t, err)
+	_, err = decryptData(encData, false, 0, a, nil)
+	assert.Error(t, err)
+}
+
+func TestCryptoEncryptDataTo(t *testing.T) {
+	a, err := newAeads(randomBytes(32), &chachaSuite)
+	assert.NoError(t, err)
+	data := []byte("hello world")
+
+	// appended after what dst holds, in its backing array
+	buf := make([]byte, 3, pooledBufferSize)
+	encData, err := encryptDataTo(buf, 1234, true, a, nil, 5, 0, false, data)
+	assert.NoError(t, err)
+	assert.Same(t, &buf[0], &encData[0])
+	m, err := decryptData(encData[3:], false, 0, a, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), m.SnConn)
+	assert.Equal(t, data, m.PayloadRaw)
+
+	// a buffer without room is grown
+	encData, err = encryptDataTo(make([]byte, 0, 4), 1234, true, a, nil, 6, 0, false, data)
+	assert.NoError(t, err)
+	m, err = decryptData(encData, false, 0, a, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), m.SnConn)
+	assert.Equal(t, data, m.PayloadRaw)
+}
+
+func TestCryptoKeySchedule(t *testing.T) {
+	sharedSecret := randomBytes(32)
+	a, err := newAeads(sharedSecret, &chachaSuite)
+	assert.NoError(t, err)
+
+	// the keys of the SN are derived per direction, they are not the shared secret
+	snKeys := [][]byte{a.dirs[0].snKey, a.dirs[1].snKey}
+	assert.NotEqual(t, snKeys[0], snKeys[1])
+	for _, k := range snKeys {
+		assert.Len(t, k, 32)
+		assert.NotEqual(t, sharedSecret, k)
+	}
+
+	// the payload key is HKDF of the shared secret, the raw shared secret does not open the packet
+	data := []byte("hello world")
+	encData, err := encryptData(1234, true, a, nil, 5, 0, false, data)
+	assert.NoError(t, err)
+	prk, err := hkdf.Extract(sha256.New, sharedSecret, hkdfSalt)
+	assert.NoError(t, err)
+	dataKey, err := hkdf.Expand(sha256.New, prk, "qotp dialer data", chacha20poly1305.KeySize)
+	assert.NoError(t, err)
+	for key, isOpened := range map[string]bool{string(dataKey): true, string(sharedSecret): false} {
+		aead, err := chacha20poly1305.New([]byte(key))
+		assert.NoError(t, err)
+		nonce := make([]byte, chacha20poly1305.NonceSize)
+		putNonceDet(nonce, nil, 0, 5)
+		header := append([]byte{unmaskedHeader(t, a, true, encData)}, encData[HeaderSize:MinDataSizeHdr]...)
+		_, err = aead.Open(nil, nonce, encData[MinDataSizeHdr+SnSize:], header)
+		assert.Equal(t, isOpened, err == nil)
+	}
+
+	// the split nonce has no direction bit, the same SN in both directions has the same nonce, but not the
+	// same key
+	encSnd, err := encryptData(1234, true, a, nil, 9, 0, false, data)
+	assert.NoError(t, err)
+	encRcv, err := encryptData(1234, false, a, nil, 9, 0, false, data)
+	assert.NoError(t, err)
+	assert.NotEqual(t, encSnd[MinDataSizeHdr+SnSize:], encRcv[MinDataSizeHdr+SnSize:])
+
+	// both directions round trip with the same shared secret, but not with the key of the other direction
+	for _, isSender := range []bool{true, false} {
+		encData, err := encryptData(1234, isSender, a, nil, 7, 0, false, data)
+		assert.NoError(t, err)
+		m, err := decryptData(encData, !isSender, 0, a, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, data, m.PayloadRaw)
+		assert.Equal(t, uint64(7), m.SnConn)
+		a.dirs[0], a.dirs[1] = a.dirs[1], a.dirs[0]
+		_, err = decryptData(encData, !isSender, 0, a, nil)
+		assert.Error(t, err)
+		a.dirs[0], a.dirs[1] = a.dirs[1], a.dirs[0]
+	}
+
+	// the same shared secret derives the same keys
+	b, err := newAeads(sharedSecret, &chachaSuite)
+	assert.NoError(t, err)
+	assert.Equal(t, snKeys[1], b.dirs[1].snKey)
+	a.zeroize()
+	assert.Equal(t, make([]byte, 32), snKeys[1])
+	assert.Nil(t, a.dirs[1].aead)
+}
+
+func BenchmarkCryptoEncryptData(b *testing.B) {
+	a, err := newAeads(randomBytes(32), &chachaSuite)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 1300)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encryptData(1234, true, a, nil, uint64(i), 0, false, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCryptoEncryptDataTo seals into one reused buffer, it does not allocate
+func BenchmarkCryptoEncryptDataTo(b *testing.B) {
+	a, err := newAeads(randomBytes(32), &chachaSuite)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 1300)
+	buf := make([]byte, 0, pooledBufferSize)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encryptDataTo(buf, 1234, true, a, nil, uint64(i), 0, false, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCryptoDecryptData(b *testing.B) {
+	a, err := newAeads(randomBytes(32), &chachaSuite)
+	if err != nil {
+		b.Fatal(err)
+	}
+	encData, err := encryptData(1234, true, a, nil, 5, 0, false, make([]byte, 1300))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(1300)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, err := decryptData(encData, false, 0, a, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.Release()
+	}
+}
+
+// BenchmarkCryptoDecryptDataUnreleased is BenchmarkCryptoDecryptData without Release, each payload allocates
+// like before the buffers were pooled
+func BenchmarkCryptoDecryptDataUnreleased(b *testing.B) {
+	a, err := newAeads(randomBytes(32), &chachaSuite)
+	if err != nil {
+		b.Fatal(err)
+	}
+	encData, err := encryptData(1234, true, a, nil, 5, 0, false, make([]byte, 1300))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(1300)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decryptData(encData, false, 0, a, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package qotp
+
+// CipherSuite is the key exchange and the AEAD of the inits, and of the Data packets unless WithPacketCipher
+// chose another one
+const CipherSuite = "X25519-ChaCha20-Poly1305"
+
+// CryptoParams are the crypto parameters of a connection, see Conn.CryptoParams
+type CryptoParams struct {
+	// CipherSuite is "X25519-" and the name of the packet cipher of the Data packets, CipherSuite if we dialed
+	// and the reply of the peer did not arrive yet
+	CipherSuite string
+	TagSize     int // bytes of the AEAD tag of every packet
+	SnBits      int // width of the sequence number, it is encrypted with XChaCha20-Poly1305
+	// NonceScheme of the Data packets, "split" or "xor-iv", see WithNonceXorIV. It is empty if we dialed and
+	// the reply of the peer did not arrive yet.
+	NonceScheme string
+	// IsForwardSecret is true once the packets are encrypted with the shared secret of both ephemeral keys.
+	// The early data of InitCryptoSnd is not, and a closed connection has no shared secret anymore.
+	IsForwardSecret bool
+}
+
+func (s nonceScheme) String() string {
+	if s == nonceXorIV {
+		return "xor-iv"
+	}
+	return "split"
+}
+
+// CryptoParams returns the crypto parameters the connection uses now, e.g., to report or log them
+func (c *Conn) CryptoParams() CryptoParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	params := CryptoParams{
+		CipherSuite:     CipherSuite,
+		TagSize:         MacSize,
+		SnBits:          SnSize * 8,
+		IsForwardSecret: c.sharedSecret != nil,
+	}
+	if !c.isSenderOnInit || c.isHandshakeDoneOnRcv {
+		params.NonceScheme = c.nonceScheme.String()
+		params.CipherSuite = "X25519-" + c.packetCipher().Name
+	}
+	return params
+}
@@ -0,0 +1,51 @@
+package qotp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCryptoParams(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		optionsA    []ListenFunc
+		optionsB    []ListenFunc
+		nonceScheme string
+	}{
+		{"split", nil, nil, "split"},
+		{"xor-iv", []ListenFunc{WithNonceXorIV()}, []ListenFunc{WithNonceXorIV()}, "xor-iv"},
+		{"xor-iv offered only", []ListenFunc{WithNonceXorIV()}, nil, "split"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			connPair := NewConnPair("alice", "bob")
+			listenerA, err := Listen(append(tt.optionsA, WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))...)
+			assert.Nil(t, err)
+			listenerB, err := Listen(append(tt.optionsB, WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))...)
+			assert.Nil(t, err)
+			connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+			assert.Nil(t, err)
+
+			// the early data is not forward secret, the nonce scheme is only offered
+			params := connA.CryptoParams()
+			assert.Equal(t, CipherSuite, params.CipherSuite)
+			assert.Equal(t, 16, params.TagSize)
+			assert.Equal(t, 48, params.SnBits)
+			assert.Empty(t, params.NonceScheme)
+			assert.False(t, params.IsForwardSecret)
+
+			_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+			connB := streamB.conn
+			for _, conn := range []*Conn{connA, connB} {
+				params = conn.CryptoParams()
+				assert.Equal(t, tt.nonceScheme, params.NonceScheme)
+				assert.True(t, params.IsForwardSecret)
+			}
+
+			// a closed connection has no keys anymore
+			connA.cleanupConn(nil, 0)
+			assert.False(t, connA.CryptoParams().IsForwardSecret)
+		})
+	}
+}
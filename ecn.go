@@ -0,0 +1,95 @@
+package qotp
+
+import (
+	"log/slog"
+	"net/netip"
+)
+
+// ECN, enabled with WithECN. The packets are sent marked ECT(0), a congested router may mark them CE instead of
+// dropping them. The receiver counts the marks of the packets it received and echoes the counts in its acks,
+// like the ECN counts of QUIC. New CE marks reduce the bandwidth estimate of the sender like a loss, at most
+// once per RTT, without the retransmission. The counts are sent in the path frame of an ack, as the marks are
+// a property of the path, an ack that goes out with a path challenge or response echoes them with the next
+// ack, they are cumulative.
+
+// ecnCodepoint is the ECN field of the IP header, the two low bits of the TOS or the traffic class
+type ecnCodepoint uint8
+
+const (
+	ecnNotECT ecnCodepoint = 0b00
+	ecnECT1   ecnCodepoint = 0b01
+	ecnECT0   ecnCodepoint = 0b10
+	ecnCE     ecnCodepoint = 0b11
+)
+
+// ecnCounts are the packets received with each mark. They wrap like their encoding, ect0 after 32 bits, ect1
+// and ce after 16 bits, the sender only uses the difference to the counts echoed before.
+type ecnCounts struct {
+	ect0 uint32
+	ect1 uint16
+	ce   uint16
+}
+
+// ecnConn is a NetworkConn that reports the ECN field of the received packets, see WithECN
+type ecnConn interface {
+	readFromUDPAddrPortECN(p []byte, timeoutNano uint64, nowNano uint64) (n int, remoteAddr netip.AddrPort,
+		ecn ecnCodepoint, err error)
+}
+
+func (e *ecnCounts) add(ecn ecnCodepoint) {
+	switch ecn {
+	case ecnECT0:
+		e.ect0++
+	case ecnECT1:
+		e.ect1++
+	case ecnCE:
+		e.ce++
+	}
+}
+
+func putEcnCounts(buf []byte, e ecnCounts) int {
+	n := PutUint32(buf, e.ect0)
+	n += PutUint16(buf[n:], e.ect1)
+	return n + PutUint16(buf[n:], e.ce)
+}
+
+func decodeEcnCounts(buf []byte) ecnCounts {
+	return ecnCounts{ect0: Uint32(buf), ect1: Uint16(buf[4:]), ce: Uint16(buf[6:])}
+}
+
+// readECN reads a packet, with its ECN field if WithECN is set and the network conn reports it
+func (l *Listener) readECN(p []byte, timeoutNano uint64, nowNano uint64) (n int, remoteAddr netip.AddrPort,
+	ecn ecnCodepoint, err error) {
+	if c, ok := l.localConn.(ecnConn); ok && l.isECN {
+		return c.readFromUDPAddrPortECN(p, timeoutNano, nowNano)
+	}
+	n, remoteAddr, err = l.localConn.ReadFromUDPAddrPort(p, timeoutNano, nowNano)
+	return n, remoteAddr, ecnNotECT, err
+}
+
+// putEcnAck echoes the counts in the ack, once a packet with a mark arrived. A peer without ECN, or a path
+// that clears the marks, never gets them.
+func (c *Conn) putEcnAck(ack *Ack) {
+	ack.ecn = c.ecnRcv
+	ack.isEcn = c.listener.isECN && c.ecnRcv != ecnCounts{}
+}
+
+// onEcnCounts is called with the counts the peer echoed, counts older than the ones before, of a reordered
+// ack, are ignored
+func (c *Conn) onEcnCounts(counts ecnCounts, nowNano uint64) {
+	ceDelta := int16(counts.ce - c.ecnAcked.ce)
+	if int32(counts.ect0-c.ecnAcked.ect0) < 0 || int16(counts.ect1-c.ecnAcked.ect1) < 0 || ceDelta < 0 {
+		return
+	}
+	c.ecnAcked = counts
+	if ceDelta == 0 {
+		return
+	}
+	c.ecnCE += uint64(ceDelta)
+	if c.ecnReducedNano != 0 && nowNano < c.ecnReducedNano+c.srtt {
+		return // once per RTT, the marks are of the same congestion
+	}
+	slog.Debug("ECN/CE", gId(), c.debug(), slog.Int("marks", int(ceDelta)), slog.Uint64("bwMax", c.bwMax))
+	c.ecnReducedNano = nowNano
+	c.onEcnCongestion()
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package qotp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ecnOobSize fits the control message of the TOS or the traffic class
+const ecnOobSize = 64
+
+// setECN sends the packets of the socket marked ECT(0) and enables the TOS or the traffic class of received
+// packets in the control messages. A dual stack socket needs both.
+func setECN(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errIPv4, errIPv6 error
+	if err := rawConn.Control(func(fd uintptr) {
+		errIPv4 = errors.Join(unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, int(ecnECT0)),
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1))
+		errIPv6 = errors.Join(unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, int(ecnECT0)),
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1))
+	}); err != nil {
+		return err
+	}
+	if errIPv4 != nil && errIPv6 != nil {
+		return fmt.Errorf("cannot enable ECN: %w", errors.Join(errIPv4, errIPv6))
+	}
+	return nil
+}
+
+// parseECN returns the ECN field of the TOS or the traffic class in the control messages of a packet
+func parseECN(oob []byte) ecnCodepoint {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return ecnNotECT
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS && len(m.Data) >= 1:
+			return ecnCodepoint(m.Data[0] & 0b11)
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_TCLASS && len(m.Data) >= 4:
+			return ecnCodepoint(binary.NativeEndian.Uint32(m.Data) & 0b11)
+		}
+	}
+	return ecnNotECT
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package qotp
+
+import (
+	"log/slog"
+	"net"
+)
+
+// ecnOobSize is 0, the marks are not read on this platform
+const ecnOobSize = 0
+
+// setECN is not implemented on this platform, the packets are not marked and the peer echoes no counts
+func setECN(_ *net.UDPConn) error {
+	slog.Warn("ECN is not supported on this platform")
+	return nil
+}
+
+func parseECN(_ []byte) ecnCodepoint {
+	return ecnNotECT
+}
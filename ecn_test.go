@@ -0,0 +1,106 @@
+package qotp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEcnCongestion(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connA.listener.isECN, listenerB.isECN = true, true
+	connA.isStartup, connA.bwMax = false, 10_000_000
+
+	nowNano := connPair.Conn1.localTime
+	send := func(ecn ecnCodepoint) {
+		connPair.Conn1.ecn = ecn
+		_, err := streamA.Write([]byte("hallo"))
+		assert.Nil(t, err)
+		nowNano += secondNano
+		connA.listener.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		data, err := streamB.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hallo"), data)
+
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+
+	// ECT(0) is echoed, it does not reduce the bandwidth
+	send(ecnECT0)
+	assert.Equal(t, uint32(1), streamB.conn.ecnRcv.ect0)
+	assert.Equal(t, ecnCounts{ect0: 1}, connA.ecnAcked)
+	bwMax := connA.bwMax
+	assert.NotZero(t, bwMax)
+
+	// a congested router marks CE
+	send(ecnCE)
+	assert.Equal(t, uint16(1), streamB.conn.ecnRcv.ce)
+	assert.Equal(t, ecnCounts{ect0: 1, ce: 1}, connA.ecnAcked)
+	assert.Equal(t, uint64(1), connA.ecnCE)
+	assert.Less(t, connA.bwMax, bwMax)
+}
+
+func TestEcnNotEchoedWithoutMarks(t *testing.T) {
+	connA, listenerB, _ := setupStreamTest(t)
+	listenerB.isECN = true
+	ack := &Ack{}
+	connA.putEcnAck(ack)
+	assert.False(t, ack.isEcn)
+
+	// only with WithECN
+	connA.ecnRcv.add(ecnCE)
+	connA.putEcnAck(ack)
+	assert.False(t, ack.isEcn)
+	connA.listener.isECN = true
+	connA.putEcnAck(ack)
+	assert.True(t, ack.isEcn)
+	assert.Equal(t, ecnCounts{ce: 1}, ack.ecn)
+}
+
+func TestEcnCountsOncePerRtt(t *testing.T) {
+	connA, _, _ := setupStreamTest(t)
+	connA.srtt, connA.bwMax = 100*msNano, 1_000_000
+
+	connA.onEcnCounts(ecnCounts{ect0: 10, ce: 2}, secondNano)
+	assert.Equal(t, uint64(2), connA.ecnCE)
+	assert.Equal(t, uint64(1_000_000*lossBwReduction/100), connA.bwMax)
+
+	// more marks within the RTT are counted, but of the same congestion
+	connA.onEcnCounts(ecnCounts{ect0: 10, ce: 3}, secondNano+50*msNano)
+	assert.Equal(t, uint64(3), connA.ecnCE)
+	assert.Equal(t, uint64(1_000_000*lossBwReduction/100), connA.bwMax)
+
+	// the counts of a reordered ack are older
+	connA.onEcnCounts(ecnCounts{ect0: 9, ce: 2}, secondNano+200*msNano)
+	assert.Equal(t, ecnCounts{ect0: 10, ce: 3}, connA.ecnAcked)
+	assert.Equal(t, uint64(3), connA.ecnCE)
+
+	// the counts wrap
+	connA.ecnAcked = ecnCounts{ect0: 10, ce: 0xffff}
+	connA.onEcnCounts(ecnCounts{ect0: 11, ce: 1}, secondNano+300*msNano)
+	assert.Equal(t, uint64(5), connA.ecnCE)
+	assert.Equal(t, uint64(1_000_000*lossBwReduction/100*lossBwReduction/100), connA.bwMax)
+}
+
+func TestEcnOption(t *testing.T) {
+	_, err := Listen(WithECN(), WithECN())
+	assert.Error(t, err)
+
+	listener, err := Listen(WithECN(), WithListenAddr("127.0.0.1:0"))
+	assert.Nil(t, err)
+	defer listener.Close()
+	assert.True(t, listener.isECN)
+}
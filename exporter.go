@@ -0,0 +1,46 @@
+package qotp
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// Keying material exporter, like RFC 5705 for TLS. The exporter secret is extracted from the shared secret of
+// the handshake, so it is the same on both peers and does not change with a rekey. The shared secret itself
+// cannot be derived from the exported material.
+
+// exporterSalt separates the exporter secret from the keys of the packets
+var exporterSalt = []byte("qotp exporter")
+
+// maxExportLength is the limit of HKDF-Expand with SHA-256
+const maxExportLength = 255 * sha256.Size
+
+// ErrNoKeyingMaterial is returned by ExportKeyingMaterial before the shared secret of the handshake is known
+var ErrNoKeyingMaterial = errors.New("no keying material before the handshake")
+
+// ExportKeyingMaterial derives length bytes for label from the shared secret of the handshake, e.g., to bind an
+// application token to this connection. Both peers get the same bytes for the same label.
+func (c *Conn) ExportKeyingMaterial(label string, length int) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if length <= 0 || length > maxExportLength {
+		return nil, errors.New("export length needs to be between 1 and 8160")
+	}
+	if c.isCloseConnRequested || c.closeErr != nil {
+		return nil, ErrConnectionClosed
+	}
+	if c.exporterSecret == nil {
+		return nil, ErrNoKeyingMaterial
+	}
+	return hkdf.Expand(sha256.New, c.exporterSecret, label, length)
+}
+
+// newExporterSecret extracts the exporter secret from the shared secret of the handshake, HKDF-Extract is
+// HMAC with the salt as key
+func newExporterSecret(sharedSecret []byte) []byte {
+	mac := hmac.New(sha256.New, exporterSalt)
+	mac.Write(sharedSecret)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,47 @@
+package qotp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportKeyingMaterial(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	_, err := connA.ExportKeyingMaterial("app", 32)
+	assert.ErrorIs(t, err, ErrNoKeyingMaterial)
+
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	// both peers derive the same bytes for a label, other labels and lengths get other bytes
+	a, err := connA.ExportKeyingMaterial("app", 32)
+	assert.Nil(t, err)
+	b, err := connB.ExportKeyingMaterial("app", 32)
+	assert.Nil(t, err)
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, connA.sharedSecret, a)
+	other, err := connA.ExportKeyingMaterial("other", 32)
+	assert.Nil(t, err)
+	assert.NotEqual(t, a, other)
+	long, err := connA.ExportKeyingMaterial("app", 64)
+	assert.Nil(t, err)
+	assert.Len(t, long, 64)
+
+	// a rekey does not change it
+	assert.Nil(t, connA.rekey())
+	afterRekey, err := connA.ExportKeyingMaterial("app", 32)
+	assert.Nil(t, err)
+	assert.Equal(t, a, afterRekey)
+
+	_, err = connA.ExportKeyingMaterial("app", 0)
+	assert.Error(t, err)
+	_, err = connA.ExportKeyingMaterial("app", maxExportLength+1)
+	assert.Error(t, err)
+
+	connA.closeErr = ErrConnectionClosed
+	_, err = connA.ExportKeyingMaterial("app", 32)
+	assert.ErrorIs(t, err, ErrConnectionClosed)
+	connB.zeroizeKeys()
+	assert.Nil(t, connB.exporterSecret)
+}
@@ -0,0 +1,58 @@
+package qotp
+
+import (
+	"errors"
+	"time"
+)
+
+// Event loop integration. Instead of Loop, an application with its own reactor registers the socket of the
+// listener, see FD, for readability, and arms a timer for NextFlushTime. Once the socket is readable, it calls
+// Listen with a timeout of 0 until no packet is returned, once the timer fires or after a Write, it calls
+// Flush and arms the timer again.
+
+var ErrNoFD = errors.New("network connection has no file descriptor")
+
+// fdConn is a NetworkConn with a socket that can be registered with epoll or kqueue
+type fdConn interface {
+	fd() (uintptr, error)
+}
+
+// FD returns the file descriptor of the socket of the listener, on Windows its handle, to register it with
+// epoll, kqueue or similar. It stays owned by the listener, it must not be read from or closed. ErrNoFD is
+// returned for a NetworkConn without a socket, e.g., of WithNetworkConn.
+func (l *Listener) FD() (uintptr, error) {
+	c, ok := l.localConn.(fdConn)
+	if !ok {
+		return 0, ErrNoFD
+	}
+	return c.fd()
+}
+
+func (c *UDPNetworkConn) fd() (fd uintptr, err error) {
+	rawConn, err := c.conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	if err = rawConn.Control(func(s uintptr) { fd = s }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// readDeadline is the deadline of a read. With a timeout of 0, the read does not wait: if no packet is queued,
+// isReady is false and the read returns a timeout right away. Go does not try a read once its deadline passed,
+// so a queued packet is read with a deadline ahead, it does not wait for it. Both deadlines are relative to
+// nowNano of the caller.
+func (c *UDPNetworkConn) readDeadline(timeoutNano uint64, nowNano uint64) (deadline time.Time, isReady bool,
+	err error) {
+	if timeoutNano > 0 {
+		return time.Unix(0, int64(nowNano+timeoutNano)), true, nil
+	}
+	isReady = c.batch != nil && c.batch.isBuffered()
+	if !isReady {
+		if isReady, err = isReadable(c.conn); err != nil || !isReady {
+			return time.Time{}, false, err
+		}
+	}
+	return time.Unix(0, int64(nowNano+MinDeadLine)), true, nil
+}
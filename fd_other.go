@@ -0,0 +1,10 @@
+//go:build !unix
+
+package qotp
+
+import "net"
+
+// isReadable cannot poll the socket on this platform, a read with a timeout of 0 returns right away
+func isReadable(_ *net.UDPConn) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,99 @@
+package qotp
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenerFD(t *testing.T) {
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"))
+	assert.Nil(t, err)
+	defer listener.Close()
+	fd, err := listener.FD()
+	assert.Nil(t, err)
+	assert.NotZero(t, fd)
+
+	connPair := NewConnPair("alice", "bob")
+	listener, err = Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	assert.Nil(t, err)
+	_, err = listener.FD()
+	assert.ErrorIs(t, err, ErrNoFD)
+}
+
+func TestListenerNonBlocking(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the socket cannot be polled")
+	}
+	listenerA, err := Listen(WithListenAddr("127.0.0.1:0"), WithSeed(testPrvSeed1))
+	assert.Nil(t, err)
+	defer listenerA.Close()
+	listenerB, err := Listen(WithListenAddr("127.0.0.1:0"), WithSeed(testPrvSeed2))
+	assert.Nil(t, err)
+	defer listenerB.Close()
+
+	// nothing is queued, Listen does not wait
+	start := time.Now()
+	s, err := listenerB.Listen(0, uint64(start.UnixNano()))
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+	assert.Less(t, time.Since(start), time.Duration(MinDeadLine))
+
+	// the loop of a reactor, Listen only reads what is queued
+	connA, err := listenerA.DialWithCryptoString(listenerB.localConn.LocalAddrString(), hexPubKey2)
+	assert.Nil(t, err)
+	_, err = connA.Stream(0).Write([]byte("ping"))
+	assert.Nil(t, err)
+	var streamB *Stream
+	for i := 0; i < 100 && streamB == nil; i++ {
+		listenerA.Flush(uint64(time.Now().UnixNano()))
+		time.Sleep(time.Millisecond) // until the socket is readable
+		for j := 0; j < 10 && streamB == nil; j++ {
+			streamB, err = listenerB.Listen(0, uint64(time.Now().UnixNano()))
+			assert.Nil(t, err)
+		}
+		listenerB.Flush(uint64(time.Now().UnixNano()))
+		time.Sleep(time.Millisecond)
+		_, err = listenerA.Listen(0, uint64(time.Now().UnixNano()))
+		assert.Nil(t, err)
+	}
+	if !assert.NotNil(t, streamB) {
+		return
+	}
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ping"), b)
+}
+
+func TestListenerReadDeadline(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the socket cannot be polled")
+	}
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"))
+	assert.Nil(t, err)
+	defer listener.Close()
+	conn := listener.localConn.(*UDPNetworkConn)
+
+	// the deadline is relative to the time of the caller, also for a packet that is already queued
+	nowNano := uint64(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	deadline, isReady, err := conn.readDeadline(msNano, nowNano)
+	assert.Nil(t, err)
+	assert.True(t, isReady)
+	assert.Equal(t, time.Unix(0, int64(nowNano+msNano)), deadline)
+
+	_, isReady, err = conn.readDeadline(0, nowNano)
+	assert.Nil(t, err)
+	assert.False(t, isReady)
+	addr := conn.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	assert.Nil(t, conn.WriteToUDPAddrPort([]byte("ping"), addr, nowNano))
+	for i := 0; i < 100 && !isReady; i++ {
+		time.Sleep(time.Millisecond)
+		deadline, isReady, err = conn.readDeadline(0, nowNano)
+		assert.Nil(t, err)
+	}
+	assert.True(t, isReady)
+	assert.Equal(t, time.Unix(0, int64(nowNano+MinDeadLine)), deadline)
+}
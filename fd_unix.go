@@ -0,0 +1,29 @@
+//go:build unix
+
+package qotp
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// isReadable polls the socket without waiting, it is true if a packet is queued
+func isReadable(conn *net.UDPConn) (bool, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var n int
+	var errPoll error
+	if err = rawConn.Control(func(fd uintptr) {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, errPoll = unix.Poll(fds, 0)
+	}); err != nil {
+		return false, err
+	}
+	if errPoll == unix.EINTR {
+		return false, nil
+	}
+	return n > 0, errPoll
+}
@@ -0,0 +1,88 @@
+package qotp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+)
+
+// Greasing sets reserved header values at random, so that peers and middleboxes do not ossify on them being
+// zero. A receiver ignores greased values. All of them are listed here, a future version can only claim a
+// value that is not.
+var (
+	// greaseCryptoVersions are versions of the crypto header that are read as CryptoVersion
+	greaseCryptoVersions = []uint8{0x0a, 0x1a}
+	// greaseProtoVersions are versions of the payload header that are read as ProtoVersion
+	greaseProtoVersions = []uint8{0x0a}
+)
+
+// ExtGrease is the reserved bit of the extension byte, it is only set if the extension byte is sent anyway, so
+// that greasing does not change the size of a packet
+const ExtGrease = 1 << 7
+
+// The greased fields, each uses one byte of a draw of greaseRand
+const (
+	greaseFieldCryptoVersion = iota
+	greaseFieldProtoVersion
+	greaseFieldExt
+)
+
+var (
+	// greaseRand chooses if and how a field is greased, the lowest bit of the byte of the field turns greasing
+	// on, the others choose the value. Tests replace it to go through all combinations, nil turns greasing off.
+	greaseRand = rand.Uint32
+	// isGreaseStrict makes DecodePayload check that the greased values do not change the decoded payload, for
+	// tests
+	isGreaseStrict = false
+)
+
+// grease returns value, or one of the greased values at random
+func grease(field int, value uint8, greased []uint8) uint8 {
+	if greaseRand == nil {
+		return value
+	}
+	b := uint8(greaseRand() >> (8 * field))
+	if b&1 == 0 {
+		return value
+	}
+	return greased[int(b>>1)%len(greased)]
+}
+
+// cryptoHeader returns the header byte of a packet, the version may be greased
+func cryptoHeader(msgType CryptoMsgType) uint8 {
+	return uint8(msgType)<<5 | grease(greaseFieldCryptoVersion, CryptoVersion, greaseCryptoVersions)
+}
+
+func isCryptoVersion(version uint8) bool {
+	return version == CryptoVersion || slices.Contains(greaseCryptoVersions, version)
+}
+
+func isProtoVersion(version uint8) bool {
+	return version == ProtoVersion || slices.Contains(greaseProtoVersions, version)
+}
+
+// greasePayload greases the version and the extension byte of an encoded payload in place
+func greasePayload(packetData []byte) []byte {
+	packetData[0] = packetData[0]&^0b1111 | grease(greaseFieldProtoVersion, ProtoVersion, greaseProtoVersions)
+	if packetData[0]&(1<<ExtFlag) != 0 {
+		packetData[1] |= grease(greaseFieldExt, 0, []uint8{ExtGrease})
+	}
+	return packetData
+}
+
+// checkGreaseIgnored decodes the payload again without the greased values, it has to be the same
+func checkGreaseIgnored(data []byte, payload *PayloadHeader, userData []byte) error {
+	plain := bytes.Clone(data)
+	plain[0] = plain[0]&^0b1111 | ProtoVersion
+	if plain[0]&(1<<ExtFlag) != 0 {
+		plain[1] &^= ExtGrease
+	}
+	plainPayload, plainUserData, err := decodePayload(plain)
+	if err != nil || !reflect.DeepEqual(payload, plainPayload) || !bytes.Equal(userData, plainUserData) ||
+		(userData == nil) != (plainUserData == nil) {
+		return fmt.Errorf("greased payload 0x%02x decoded differently: %v", data[:2], err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package qotp
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setGrease greases every packet with the draw r and checks that the receivers ignore the greased values
+func setGrease(t *testing.T, r uint32) {
+	oldRand, oldStrict := greaseRand, isGreaseStrict
+	greaseRand = func() uint32 { return r }
+	isGreaseStrict = true
+	t.Cleanup(func() {
+		greaseRand, isGreaseStrict = oldRand, oldStrict
+	})
+}
+
+func TestGreaseValues(t *testing.T) {
+	for _, v := range greaseCryptoVersions {
+		assert.NotEqual(t, uint8(CryptoVersion), v)
+		assert.Less(t, v, uint8(1<<5))
+		assert.True(t, isCryptoVersion(v))
+	}
+	for _, v := range greaseProtoVersions {
+		assert.NotEqual(t, uint8(ProtoVersion), v)
+		assert.Less(t, v, uint8(1<<4))
+		assert.True(t, isProtoVersion(v))
+	}
+	assert.Zero(t, extKnownFlags&ExtGrease)
+	assert.False(t, isCryptoVersion(0)) // the raw shared secret as key, before HKDF
+	assert.False(t, isCryptoVersion(1)) // the direction bit in the nonce
+	assert.False(t, isCryptoVersion(2)) // no packet cipher in the init parameters
+	assert.False(t, isCryptoVersion(3)) // no header protection
+	assert.False(t, isProtoVersion(1))
+}
+
+func TestGreasePayload(t *testing.T) {
+	setGrease(t, 1<<(8*greaseFieldProtoVersion)|1<<(8*greaseFieldExt))
+
+	// the extension byte is only greased if it is sent anyway
+	p := &PayloadHeader{StreamID: 1, StreamOffset: 10}
+	encoded := greasePayload(encodePayload(p, []byte("data")))
+	assert.Equal(t, greaseProtoVersions[0], encoded[0]&0b1111)
+	assert.Zero(t, encoded[0]&(1<<ExtFlag))
+	decoded, userData, err := DecodePayload(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, p, decoded)
+	assert.Equal(t, []byte("data"), userData)
+
+	p = &PayloadHeader{CloseWrite: true, StreamID: 1, StreamOffset: 10,
+		Ack: &Ack{streamID: 1, offset: 5, len: 5, rcvWnd: 1000, streamRcvWnd: 1000, isStreamRcvWnd: true}}
+	encoded = greasePayload(encodePayload(p, []byte{}))
+	assert.Equal(t, uint8(ExtGrease|ExtCloseWrite|ExtStreamRcvWnd), encoded[1])
+	decoded, userData, err = DecodePayload(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, p.CloseWrite, decoded.CloseWrite)
+	assert.Equal(t, p.Ack.isStreamRcvWnd, decoded.Ack.isStreamRcvWnd)
+	assert.Equal(t, []byte{}, userData)
+
+	// an unknown version is still rejected
+	encoded[0] = encoded[0]&^0b1111 | 1
+	_, _, err = DecodePayload(encoded)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+// TestGreaseTransfer runs a transfer through a connPair with all combinations of greased fields
+func TestGreaseTransfer(t *testing.T) {
+	for _, cryptoVersion := range []uint32{0, 1, 3} {
+		for _, protoVersion := range []uint32{0, 1} {
+			for _, ext := range []uint32{0, 1} {
+				r := cryptoVersion<<(8*greaseFieldCryptoVersion) | protoVersion<<(8*greaseFieldProtoVersion) |
+					ext<<(8*greaseFieldExt)
+				t.Run(fmt.Sprintf("%06x", r), func(t *testing.T) {
+					setGrease(t, r)
+					greaseTransfer(t, uint8(cryptoVersion))
+				})
+			}
+		}
+	}
+}
+
+func greaseTransfer(t *testing.T, cryptoVersion uint8) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	nowNano := connPair.Conn1.localTime
+	deliver := func(fromA bool) {
+		nowNano += secondNano
+		if fromA {
+			connA.listener.Flush(nowNano)
+			_, err := connPair.senderToRecipientAll()
+			assert.NoError(t, err)
+			for i := 0; i < 10 && len(connPair.Conn2.readQueue) > 0; i++ {
+				_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+				assert.NoError(t, err)
+			}
+		} else {
+			listenerB.Flush(nowNano)
+			_, err := connPair.recipientToSenderAll()
+			assert.NoError(t, err)
+			for i := 0; i < 10 && len(connPair.Conn1.readQueue) > 0; i++ {
+				_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+				assert.NoError(t, err)
+			}
+		}
+	}
+
+	// the version on the wire is greased
+	_, err := streamA.Write([]byte("data"))
+	assert.NoError(t, err)
+	nowNano += secondNano
+	connA.listener.Flush(nowNano)
+	header := unmaskedHeader(t, connA.aeads, connA.isSenderOnInit, connPair.Conn1.writeQueue[0].data)
+	assert.Equal(t, Data, CryptoMsgType(header>>5))
+	if cryptoVersion&1 == 0 {
+		assert.Equal(t, uint8(CryptoVersion), header&0x1f)
+	} else {
+		assert.Equal(t, greaseCryptoVersions[cryptoVersion>>1], header&0x1f)
+	}
+	deliver(true)
+	b, err := streamB.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), b)
+
+	_, err = streamB.Write([]byte("reply"))
+	assert.NoError(t, err)
+	deliver(false)
+	b, err = streamA.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("reply"), b)
+
+	// the half close is sent in the extension byte
+	assert.NoError(t, streamA.CloseWrite())
+	deliver(true)
+	_, err = streamB.Read()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+	assert.Zero(t, streamB.conn.droppedPackets)
+}
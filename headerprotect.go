@@ -0,0 +1,43 @@
+package qotp
+
+// Header protection. The header byte of a Data packet is authenticated as AD, but sent in clear, so that
+// middleboxes could ossify on the version, and an observer could tell DataPadded from Data. Like the header
+// protection of QUIC, the sender masks the header byte after the payload was sealed, with a mask of the header
+// key of the direction and a sample of the sealed payload, the receiver removes it before it opens the packet.
+// Bit 7 and bit 5 stay in clear, they tell a Data packet from an init. The inits are not protected, there is no
+// key yet, and the connection ID is not either, the receiver needs it to find the keys.
+
+// headerProtectMask are the masked bits of the header byte: bit 6 of the type, and the version
+const headerProtectMask = 0x5F
+
+// headerProtectSampleSize is the sample of the sealed payload that the mask is derived from, the same as for the
+// SN, see chainedEncryptTo
+const headerProtectSampleSize = 24
+
+// isHeaderProtected returns true for the header byte of a Data or DataPadded packet, masked or not
+func isHeaderProtected(header uint8) bool {
+	return header&^headerProtectMask == uint8(Data)<<5
+}
+
+// headerMask returns the mask of the header byte of encData, a Data packet of this direction
+func (d *aeadDir) headerMask(encData []byte) (uint8, error) {
+	start := HeaderSize + ConnIdSize + SnSize
+	if len(encData) < start+headerProtectSampleSize {
+		return 0, ErrShortHeader
+	}
+	var mask [1]byte
+	if err := xorSn(d.hpKey, encData[start:start+headerProtectSampleSize], mask[:], mask[:]); err != nil {
+		return 0, err
+	}
+	return mask[0] & headerProtectMask, nil
+}
+
+// protectHeader masks the header byte of a sealed Data packet in place
+func protectHeader(encData []byte, d *aeadDir) error {
+	mask, err := d.headerMask(encData)
+	if err != nil {
+		return err
+	}
+	encData[0] ^= mask
+	return nil
+}
@@ -0,0 +1,79 @@
+package qotp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unmaskedHeader returns the header byte of a Data packet sent by the dialer if isSender is true
+func unmaskedHeader(t *testing.T, a *aeads, isSender bool, encData []byte) uint8 {
+	mask, err := a.dirs[dirIndex(isSender)].headerMask(encData)
+	assert.NoError(t, err)
+	return encData[0] ^ mask
+}
+
+func TestHeaderProtectRoundTrip(t *testing.T) {
+	setVectorGrease(t) // the headers differ only by their mask
+	a, err := newAeads(bytes.Repeat([]byte{7}, 32), &chachaSuite)
+	assert.NoError(t, err)
+	data := []byte("hello world")
+
+	for _, msgType := range []CryptoMsgType{InitSnd, InitRcv, InitCryptoSnd, InitCryptoRcv, Data, InitSignedSnd,
+		DataPadded} {
+		// only Data packets have a key, the inits are sent in clear
+		isProtected := msgType == Data || msgType == DataPadded
+		assert.Equal(t, isProtected, isHeaderProtected(cryptoHeader(msgType)), "%v", msgType)
+		if !isProtected {
+			continue
+		}
+
+		headers := map[uint8]bool{}
+		for sn := range uint64(64) {
+			for _, isSender := range []bool{true, false} {
+				payload := data
+				if msgType == DataPadded {
+					payload = padData(5, data)
+				}
+				encData, err := encryptData(1234, isSender, a, nil, sn, 0, msgType == DataPadded, payload)
+				assert.NoError(t, err)
+				assert.True(t, isHeaderProtected(encData[0]))
+				assert.Contains(t, []CryptoMsgType{Data, DataPadded}, CryptoMsgType(encData[0]>>5))
+				assert.Equal(t, cryptoHeader(msgType), unmaskedHeader(t, a, isSender, encData))
+				headers[encData[0]] = true
+
+				// the receiver removes the mask and leaves the packet as it was
+				sent := bytes.Clone(encData)
+				m, err := decryptData(encData, !isSender, 0, a, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, data, m.PayloadRaw)
+				assert.Equal(t, sent, encData)
+				m.Release()
+			}
+		}
+		// an observer sees neither the version nor the padding
+		assert.Greater(t, len(headers), 1, "%v", msgType)
+	}
+}
+
+func TestHeaderProtectCorruptSample(t *testing.T) {
+	a, err := newAeads(bytes.Repeat([]byte{7}, 32), &chachaSuite)
+	assert.NoError(t, err)
+
+	for i := range headerProtectSampleSize {
+		encData, err := encryptData(1234, true, a, nil, 1, 0, false, []byte("hello world"))
+		assert.NoError(t, err)
+		encData[HeaderSize+ConnIdSize+SnSize+i] ^= 0x01
+
+		// the mask is wrong, the version does not match, or the header does not authenticate
+		corrupted := bytes.Clone(encData)
+		_, err = decryptData(encData, false, 0, a, nil)
+		assert.ErrorIs(t, err, ErrDecrypt)
+		assert.Equal(t, corrupted, encData)
+	}
+
+	// the sample is missing
+	_, err = a.dirs[0].headerMask(make([]byte, MinDataSizeHdr+SnSize))
+	assert.ErrorIs(t, err, ErrShortHeader)
+}
@@ -0,0 +1,121 @@
+package qotp
+
+import "fmt"
+
+// nonceScheme is the construction of the AEAD nonce of Data packets, see putNonceDet and WithNonceXorIV
+type nonceScheme uint8
+
+const (
+	nonceSplit nonceScheme = iota // epoch and SN
+	nonceXorIV                    // epoch and SN XORed with an IV per direction
+)
+
+// initParamsSize is the size of the initParams without the application protocol: the nonce scheme, the packet
+// cipher and the length of the application protocol
+const initParamsSize = 3
+
+// initParams are sent encrypted in front of the payload of InitCryptoSnd, InitSignedSnd, InitRcv and
+// InitCryptoRcv. The dialer offers, the receiver replies with what it chose. InitSnd is not encrypted, it
+// only carries the nonce scheme and the packet cipher after the keys.
+type initParams struct {
+	nonceScheme nonceScheme
+	cipherID    uint8 // see PacketCipherSuite
+	appProto    string
+}
+
+func putInitParams(params initParams, packetData []byte) []byte {
+	buf := make([]byte, 0, initParamsSize+len(params.appProto)+len(packetData))
+	buf = append(buf, byte(params.nonceScheme), params.cipherID, byte(len(params.appProto)))
+	buf = append(buf, params.appProto...)
+	return append(buf, packetData...)
+}
+
+func decodeInitParams(data []byte) (params initParams, packetData []byte, err error) {
+	if len(data) < initParamsSize || len(data) < initParamsSize+int(data[2]) {
+		return initParams{}, nil, fmt.Errorf("%w: init parameters are truncated", ErrShortPayload)
+	}
+	n := initParamsSize + int(data[2])
+	params.nonceScheme = nonceScheme(data[0])
+	params.cipherID = data[1]
+	params.appProto = string(data[initParamsSize:n])
+	return params, data[n:], nil
+}
+
+func (c *Conn) initParams() initParams {
+	return initParams{nonceScheme: c.nonceScheme, cipherID: c.packetCipher().ID, appProto: c.appProto}
+}
+
+// checkReplyParams checks the initParams of InitRcv or InitCryptoRcv against what we offered
+func (c *Conn) checkReplyParams(params initParams) error {
+	if params.appProto != c.appProto {
+		return fmt.Errorf("%w: offered %q, peer replied with %q", ErrProtocolMismatch, c.appProto, params.appProto)
+	}
+	if params.nonceScheme != nonceSplit && params.nonceScheme != c.nonceScheme {
+		return fmt.Errorf("peer replied with nonce scheme %d, offered %d", params.nonceScheme, c.nonceScheme)
+	}
+	if params.cipherID != chachaSuite.ID && params.cipherID != c.packetCipher().ID {
+		return fmt.Errorf("peer replied with packet cipher %d, offered %d", params.cipherID, c.packetCipher().ID)
+	}
+	if c.listener.isCipherRequired && params.cipherID != c.packetCipher().ID {
+		return fmt.Errorf("peer replied with packet cipher %d, %d is required", params.cipherID, c.packetCipher().ID)
+	}
+	return nil
+}
+
+// setNonceScheme sets the negotiated nonce scheme, the shared secret needs to be set already
+func (c *Conn) setNonceScheme(scheme nonceScheme) {
+	c.nonceScheme = scheme
+	c.ivSnd, c.ivRcv = nil, nil
+	if scheme != nonceXorIV {
+		return
+	}
+	ivSender, ivReceiver := deriveNonceIVs(c.sharedSecret)
+	if c.isSenderOnInit {
+		c.ivSnd, c.ivRcv = ivSender, ivReceiver
+	} else {
+		c.ivSnd, c.ivRcv = ivReceiver, ivSender
+	}
+}
+
+// chooseNonceScheme picks the nonce scheme for what the dialer offered, the XOR nonce needs both peers to
+// opt in
+func (l *Listener) chooseNonceScheme(offered nonceScheme) nonceScheme {
+	if l.isNonceXorIV && offered == nonceXorIV {
+		return nonceXorIV
+	}
+	return nonceSplit
+}
+
+// setPacketCipher sets the packet cipher of the reply, checkReplyParams accepted it already
+func (c *Conn) setPacketCipher(id uint8) {
+	if id != c.packetCipher().ID {
+		c.cipherSuite = nil
+	}
+}
+
+// packetCipher returns the packet cipher of the Data packets
+func (c *Conn) packetCipher() *PacketCipherSuite {
+	if c.cipherSuite == nil {
+		return &chachaSuite
+	}
+	return c.cipherSuite
+}
+
+// choosePacketCipher picks the packet cipher for what the dialer offered, another one than ChaCha20-Poly1305
+// needs both peers to opt in to the same one
+func (l *Listener) choosePacketCipher(offered uint8) *PacketCipherSuite {
+	if l.cipherSuite != nil && l.cipherSuite.ID == offered {
+		return l.cipherSuite
+	}
+	return nil
+}
+
+// payloadMtu is the MTU for the payload of msgType, the encrypted inits also carry the initParams and are
+// limited by the handshake MTU
+func (c *Conn) payloadMtu(msgType CryptoMsgType) int {
+	switch msgType {
+	case InitRcv, InitCryptoSnd, InitSignedSnd, InitCryptoRcv:
+		return c.listener.handshakeMtu - initParamsSize - len(c.appProto) - c.connIdFrameLen()
+	}
+	return c.dataMtu() - c.paddingOverhead() - c.connIdFrameLen()
+}
@@ -0,0 +1,43 @@
+package qotp
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Key log, see WithKeyLogWriter. Like SSLKEYLOGFILE of TLS, it lets an analysis tool decrypt a capture, one
+// line per secret, the fields are separated by a space and in lower case hex:
+//
+//	QOTP_SHARED_SECRET <connId> <secret>                 shared secret of the handshake, both sides
+//	QOTP_SHARED_SECRET_ID <connId> <secret>              key of InitCryptoSnd, only the dialer knows it
+//	QOTP_REKEY_SECRET <connId> <generation> <secret>     shared secret of a rekey, generation from 1
+//
+// connId is the one of the init, 16 digits, generation is a decimal number. The Data keys are derived from the
+// secret like newAeads does, DecryptDataForPcap does so for the default packet cipher.
+
+const (
+	keyLogSharedSecret   = "QOTP_SHARED_SECRET"
+	keyLogSharedSecretId = "QOTP_SHARED_SECRET_ID"
+	keyLogRekeySecret    = "QOTP_REKEY_SECRET"
+)
+
+// logKey writes a line to the key log, if there is one
+func (l *Listener) logKey(label string, connId uint64, secret []byte) {
+	if l == nil || l.keyLogWriter == nil || secret == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(l.keyLogWriter, "%s %016x %x\n", label, connId, secret); err != nil {
+		slog.Error("Failed to write to key log", "error", err)
+	}
+}
+
+// logRekey writes the shared secret of a rekey to the key log, if there is one
+func (l *Listener) logRekey(connId uint64, generation uint64, secret []byte) {
+	if l == nil || l.keyLogWriter == nil {
+		return
+	}
+	_, err := fmt.Fprintf(l.keyLogWriter, "%s %016x %d %x\n", keyLogRekeySecret, connId, generation, secret)
+	if err != nil {
+		slog.Error("Failed to write to key log", "error", err)
+	}
+}
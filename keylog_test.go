@@ -0,0 +1,125 @@
+package qotp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keyLogSecretTest returns the secret of the key log line with the label and the connection ID, rekey lines
+// also match the generation
+func keyLogSecretTest(t *testing.T, log string, label string, connId uint64, generation uint64) []byte {
+	prefix := fmt.Sprintf("%s %016x ", label, connId)
+	if label == keyLogRekeySecret {
+		prefix += fmt.Sprintf("%d ", generation)
+	}
+	for _, line := range strings.Split(log, "\n") {
+		if hexSecret, ok := strings.CutPrefix(line, prefix); ok {
+			secret, err := hex.DecodeString(hexSecret)
+			assert.Nil(t, err)
+			return secret
+		}
+	}
+	t.Fatalf("no %q in the key log:\n%s", prefix, log)
+	return nil
+}
+
+func TestKeyLog(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	var logA, logB bytes.Buffer
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithKeyLogWriter(&logA))
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2), WithKeyLogWriter(&logB))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// both sides log the same shared secret, only the dialer the key of InitCryptoSnd
+	secret := keyLogSecretTest(t, logA.String(), keyLogSharedSecret, connA.connId, 0)
+	assert.Equal(t, secret, keyLogSecretTest(t, logB.String(), keyLogSharedSecret, connA.connId, 0))
+	assert.Len(t, keyLogSecretTest(t, logA.String(), keyLogSharedSecretId, connA.connId, 0), 32)
+	assert.NotContains(t, logB.String(), keyLogSharedSecretId)
+
+	// a recorded Data packet decrypts offline with the secret of the log, also after a rekey
+	capture := func(data string) []byte {
+		_, err := streamA.Write([]byte(data))
+		assert.Nil(t, err)
+		nowNano := max(connPair.Conn1.localTime+secondNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+		assert.NotEmpty(t, connPair.Conn1.writeQueue)
+		encData := bytes.Clone(connPair.Conn1.writeQueue[len(connPair.Conn1.writeQueue)-1].data)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		b, err := streamB.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(data), b)
+
+		// the ack, so that nothing is retransmitted with the next data
+		nowNano = max(nowNano+msNano, streamB.conn.nextWriteTime)
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = listenerA.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		return encData
+	}
+	decrypt := func(encData []byte, secret []byte) []byte {
+		payload, err := DecryptDataForPcap(encData, false, 0, secret)
+		assert.Nil(t, err)
+		_, userData, err := DecodePayload(payload)
+		assert.Nil(t, err)
+		return userData
+	}
+	assert.Equal(t, []byte("before"), decrypt(capture("before"), secret))
+
+	assert.Nil(t, connA.Rekey())
+	encData := capture("after")
+	secretNext := keyLogSecretTest(t, logA.String(), keyLogRekeySecret, connA.connId, 1)
+	assert.Equal(t, secretNext, keyLogSecretTest(t, logB.String(), keyLogRekeySecret, connA.connId, 1))
+	assert.Equal(t, []byte("after"), decrypt(encData, secretNext))
+	_, err = DecryptDataForPcap(encData, false, 0, secret)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestKeyLogOption(t *testing.T) {
+	_, err := Listen(WithKeyLogWriter(nil))
+	assert.Error(t, err)
+	_, err = Listen(WithKeyLogWriter(&bytes.Buffer{}), WithKeyLogWriter(&bytes.Buffer{}))
+	assert.Error(t, err)
+
+	// without a writer nothing is logged
+	var l *Listener
+	l.logKey(keyLogSharedSecret, 1, []byte{1})
+	(&Listener{}).logRekey(1, 1, []byte{1})
+}
+
+func TestKeyLogLowOrderPoint(t *testing.T) {
+	// the dial fails in the key log, the connection is not counted and not kept
+	reg := newTestMetrics()
+	l, err := Listen(WithListenAddr("127.0.0.1:0"), WithKeyLogWriter(&bytes.Buffer{}), WithMetrics(reg))
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	lowOrder, err := ecdh.X25519().NewPublicKey(lowOrderPoints[2][:])
+	assert.Nil(t, err)
+	_, err = l.DialWithCrypto(netip.MustParseAddrPort("127.0.0.1:9"), lowOrder)
+	assert.ErrorIs(t, err, ErrLowOrderPoint)
+	assert.Zero(t, l.connMap.Size())
+	v, isFound := gatherMetric(t, reg, "qotp_connections_total", "127.0.0.1:0")
+	assert.True(t, isFound)
+	assert.Zero(t, v)
+}
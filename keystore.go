@@ -0,0 +1,184 @@
+package qotp
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrKeyMismatch is matched by a *KeyMismatchError
+var ErrKeyMismatch = errors.New("identity key mismatch")
+
+// KeyMismatchError is returned if a peer presents another identity key than the one pinned in the KeyStore,
+// it carries both fingerprints, so that the application can ask the user whether to trust the new key
+type KeyMismatchError struct {
+	Addr                 netip.AddrPort
+	KnownFingerprint     string
+	PresentedFingerprint string
+}
+
+func (e *KeyMismatchError) Error() string {
+	return fmt.Sprintf("identity key mismatch for %v, known %s, presented %s",
+		e.Addr, e.KnownFingerprint, e.PresentedFingerprint)
+}
+
+func (e *KeyMismatchError) Is(target error) bool {
+	return target == ErrKeyMismatch
+}
+
+// KeyStore pins the identity keys of peers by address, see WithKeyStore. Get returns nil if the address is
+// unknown.
+type KeyStore interface {
+	Get(addr netip.AddrPort) (*ecdh.PublicKey, error)
+	Put(addr netip.AddrPort, pubKey *ecdh.PublicKey) error
+}
+
+// MemoryKeyStore keeps the pinned keys in memory
+type MemoryKeyStore struct {
+	keys map[netip.AddrPort]*ecdh.PublicKey
+	mu   sync.Mutex
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: map[netip.AddrPort]*ecdh.PublicKey{}}
+}
+
+func (m *MemoryKeyStore) Get(addr netip.AddrPort) (*ecdh.PublicKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys[addr], nil
+}
+
+func (m *MemoryKeyStore) Put(addr netip.AddrPort, pubKey *ecdh.PublicKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[addr] = pubKey
+	return nil
+}
+
+// FileKeyStore keeps the pinned keys in a file like known_hosts of SSH, one line per peer with the address
+// and the hex encoded identity key. Empty lines and lines starting with # are ignored. The file is rewritten
+// with each Put, comments are not kept.
+type FileKeyStore struct {
+	path string
+	mem  *MemoryKeyStore
+	mu   sync.Mutex
+}
+
+// NewFileKeyStore loads the keys from path, a missing file is created with the first Put
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	f := &FileKeyStore{path: path, mem: NewMemoryKeyStore()}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNr := 1; scanner.Scan(); lineNr++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected address and key", path, lineNr)
+		}
+		addr, err := netip.ParseAddrPort(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNr, err)
+		}
+		pubKey, err := decodeHexPubKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNr, err)
+		}
+		f.mem.keys[addr] = pubKey
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileKeyStore) Get(addr netip.AddrPort) (*ecdh.PublicKey, error) {
+	return f.mem.Get(addr)
+}
+
+// Put pins the key and writes the file, it is replaced atomically, so a crash does not leave a partial file
+func (f *FileKeyStore) Put(addr netip.AddrPort, pubKey *ecdh.PublicKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.mem.mu.Lock()
+	old, isKnown := f.mem.keys[addr]
+	f.mem.keys[addr] = pubKey
+	lines := make([]string, 0, len(f.mem.keys))
+	for a, k := range f.mem.keys {
+		lines = append(lines, fmt.Sprintf("%s 0x%x\n", a, k.Bytes()))
+	}
+	f.mem.mu.Unlock()
+	slices.Sort(lines)
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err == nil {
+		_, err = tmp.WriteString(strings.Join(lines, ""))
+		err = errors.Join(err, tmp.Close())
+		if err == nil {
+			err = os.Rename(tmp.Name(), f.path)
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		// keep memory and file in sync
+		f.mem.mu.Lock()
+		if isKnown {
+			f.mem.keys[addr] = old
+		} else {
+			delete(f.mem.keys, addr)
+		}
+		f.mem.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// checkPinnedKey compares the identity key of a peer with the pinned one
+func (l *Listener) checkPinnedKey(addr netip.AddrPort, pubKeyIdRcv *ecdh.PublicKey) (isKnown bool, err error) {
+	if l.keyStore == nil {
+		return false, nil
+	}
+	known, err := l.keyStore.Get(addr)
+	if err != nil || known == nil {
+		return false, err
+	}
+	if !known.Equal(pubKeyIdRcv) {
+		return true, &KeyMismatchError{
+			Addr:                 addr,
+			KnownFingerprint:     fingerprint(known),
+			PresentedFingerprint: fingerprint(pubKeyIdRcv),
+		}
+	}
+	return true, nil
+}
+
+// pinKey checks the identity key the peer presented in its reply, on first contact the key is pinned
+func (l *Listener) pinKey(addr netip.AddrPort, pubKeyIdRcv *ecdh.PublicKey) error {
+	isKnown, err := l.checkPinnedKey(addr, pubKeyIdRcv)
+	if err != nil || isKnown || l.keyStore == nil {
+		return err
+	}
+	return l.keyStore.Put(addr, pubKeyIdRcv)
+}
@@ -0,0 +1,75 @@
+package qotp
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStoreMemory(t *testing.T) {
+	store := NewMemoryKeyStore()
+	addr := netip.MustParseAddrPort("127.0.0.1:8088")
+
+	key, err := store.Get(addr)
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	assert.NoError(t, store.Put(addr, testPrvKey1.PublicKey()))
+	key, err = store.Get(addr)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(testPrvKey1.PublicKey()))
+}
+
+func TestKeyStoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	addr1 := netip.MustParseAddrPort("127.0.0.1:8088")
+	addr2 := netip.MustParseAddrPort("[::1]:8089")
+
+	// a missing file is an empty store
+	store, err := NewFileKeyStore(path)
+	require.NoError(t, err)
+	key, err := store.Get(addr1)
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	assert.NoError(t, store.Put(addr1, testPrvKey1.PublicKey()))
+	assert.NoError(t, store.Put(addr2, testPrvKey2.PublicKey()))
+
+	// reloaded from the file
+	store, err = NewFileKeyStore(path)
+	require.NoError(t, err)
+	key, err = store.Get(addr1)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(testPrvKey1.PublicKey()))
+	key, err = store.Get(addr2)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(testPrvKey2.PublicKey()))
+
+	// replacing a key
+	assert.NoError(t, store.Put(addr1, testPrvKey2.PublicKey()))
+	store, err = NewFileKeyStore(path)
+	require.NoError(t, err)
+	key, err = store.Get(addr1)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(testPrvKey2.PublicKey()))
+}
+
+func TestKeyStoreFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+
+	require.NoError(t, os.WriteFile(path, []byte("# comment\n\n127.0.0.1:8088 "+hexPubKey1+"\n"), 0o600))
+	_, err := NewFileKeyStore(path)
+	assert.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("127.0.0.1:8088\n"), 0o600))
+	_, err = NewFileKeyStore(path)
+	assert.ErrorContains(t, err, ":1:")
+
+	require.NoError(t, os.WriteFile(path, []byte("# comment\nlocalhost "+hexPubKey1+"\n"), 0o600))
+	_, err = NewFileKeyStore(path)
+	assert.ErrorContains(t, err, ":2:")
+}
@@ -135,6 +135,22 @@ func (m *LinkedMap[K, V]) First() (K, V, bool) {
 	return zeroK, zeroV, false
 }
 
+// Last returns the last inserted key and value in the map.
+// Returns false if the map is empty.
+func (m *LinkedMap[K, V]) Last() (K, V, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.tail.prev != m.head {
+		node := m.tail.prev
+		return node.key, node.value, true
+	}
+
+	var zeroK K
+	var zeroV V
+	return zeroK, zeroV, false
+}
+
 // Next finds the next key in insertion order after the given key.
 // This is O(1) if the key exists in the map!
 // Returns the next key, its value, and true if a next element exists.
@@ -332,6 +332,29 @@ func TestLinkedMapFirstMultipleElements(t *testing.T) {
 	assert.Equal(t, 1, value)
 }
 
+func TestLinkedMapLastEmptyMap(t *testing.T) {
+	lm := NewLinkedMap[string, int]()
+	_, _, ok := lm.Last()
+	assert.False(t, ok)
+}
+
+func TestLinkedMapLastMultipleElements(t *testing.T) {
+	lm := NewLinkedMap[string, int]()
+	lm.Put("first", 1)
+	lm.Put("second", 2)
+	lm.Put("third", 3)
+
+	key, value, ok := lm.Last()
+	assert.True(t, ok)
+	assert.Equal(t, "third", key)
+	assert.Equal(t, 3, value)
+
+	lm.Remove("third")
+	key, _, ok = lm.Last()
+	assert.True(t, ok)
+	assert.Equal(t, "second", key)
+}
+
 func TestLinkedMapNextExistingKey(t *testing.T) {
 	lm := NewLinkedMap[string, int]()
 	a := "a"
@@ -1,9 +1,12 @@
 package qotp
 
 import (
+	"context"
 	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -11,30 +14,155 @@ import (
 	"log/slog"
 	"net"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// close reasons for the connection summary, they are not returned to the user
+var (
+	errIdleTimeout    = errors.New("idle timeout")
+	errForceClosed    = errors.New("force closed")
+	errListenerClosed = errors.New("listener closed")
 )
 
 type Listener struct {
 	// this is the port we are listening to
-	localConn       NetworkConn
-	prvKeyId        *ecdh.PrivateKey          //never nil
-	connMap         *LinkedMap[uint64, *Conn] // here we store the connection to remote peers, we can have up to
-	currentConnID   *uint64
-	currentStreamID *uint32
-	closed          bool
-	keyLogWriter    io.Writer
-	mtu             int
-	mu              sync.Mutex
+	localConn            NetworkConn
+	prvKeyId             *ecdh.PrivateKey          //never nil
+	connMap              *LinkedMap[uint64, *Conn] // here we store the connection to remote peers, we can have up to
+	currentConnID        *uint64
+	issuedConnIds        *LinkedMap[uint64, *Conn] // the connection IDs we issued to the peers, see connid.go
+	peerConnIds          *LinkedMap[uint64, *Conn] // the IDs of the peers in our Data packets, for a stateless reset
+	connIdKey            []byte                    // of the issued connection IDs, see encryptConnId
+	closed               bool
+	isLooping            bool          // Loop runs, it removes the connections after Close, guarded by mu
+	closeCh              chan struct{} // closed by Close, see Accept
+	acceptConnCh         chan *Conn    // connections of peers, see Accept
+	isAccepting          atomic.Bool   // Accept was called, the connections of peers are queued from then on
+	isStopping           atomic.Bool   // by GracefulStop, no new connection is accepted, see shutdown.go
+	packetsSent          atomic.Uint64
+	nextFlushNano        atomic.Uint64 // see NextFlushTime
+	keyLogWriter         io.Writer
+	mtu                  int
+	maxMtu               int    // path MTU discovery probes up to maxMtu, if it is larger than mtu
+	handshakeMtu         int    // size of the inits, the minimum size of an init we accept
+	maxStreams           uint32 // 0 means no limit
+	streamRcvWnd         int    // receive buffer capacity of a single stream
+	streamSndBuf         int    // send buffer capacity of a single stream, 0 means only the one of the connection
+	maxAckDelayNano      uint64 // 0 means acks are sent immediately
+	flowControlStallNano uint64 // 0 means a full window of the peer is not reported, see ErrPeerFlowControlStalled
+	summaryLogger        *slog.Logger
+	maxRtoNano           uint64 // 0 means maxRTO
+	maxHandshakeSize     int    // larger inits are dropped before they are decrypted, 0 means no limit
+	blackHoleThreshold   int    // 0 means no black hole detection, see blackhole.go
+	isECN                bool   // read and echo the ECN marks, see ecn.go
+	isIssuedConnIds      bool   // the peers send to random connection IDs we issued, see connid.go
+	maxConnIds           int    // the IDs issued to a peer at a time, 0 means 1, see WithMaxConnectionIDs
+	isRequireKnownPeer   bool   // only peers on the allow list or in the key store connect, see peers.go
+	isStatelessReset     bool   // reply to Data packets of unknown connections, see WithStatelessReset
+	amplificationLimit   int    // 0 means defaultAmplificationFactor, see amplification.go
+	reassemblyLimit      int    // how far out of order a stream buffers, 0 means up to its receive window
+	rateWindowNano       uint64 // 0 means defaultRateWindow, see rate.go
+	// inits per source address, nil means no limit, see ratelimit.go
+	handshakeRateLimiter  *handshakeRateLimiter
+	peers                 *peerList // allowed and denied identity keys, see peers.go
+	retransmitScheduler   RetransmitScheduler
+	acceptFilter          func(remotePub *ecdh.PublicKey, addr netip.AddrPort) error
+	acceptFilterEd25519   func(remotePub ed25519.PublicKey, addr netip.AddrPort) error
+	prvKeyEd              ed25519.PrivateKey // if set, DialWithCrypto signs the init with it
+	pathTimeoutNano       uint64             // 0 means defaultPathValidationTimeout
+	batchSize             int                // packets sent per flush, with one syscall if supported
+	keyStore              KeyStore
+	coalesceDelayNano     uint64 // 0 means Nagle is disabled
+	isImmediateFirstWrite bool   // the first write after idle is not coalesced
+	rekeyAfterBytes       uint64 // 0 means no rekey after bytes, see WithRekeyAfter
+	rekeyAfterPackets     uint64
+	appProtos             []string           // accepted application protocols, the first is offered when dialing
+	isNonceXorIV          bool               // offer and accept nonceXorIV
+	cipherSuite           *PacketCipherSuite // offer and accept it, nil means only ChaCha20-Poly1305
+	isCipherRequired      bool               // no fallback to ChaCha20-Poly1305, see WithRequirePacketCipher
+	mtuIncreasePolicy     func(current, proposed int) bool
+	replayWindowBits      int          // 0 means defaultReplayWindow
+	snWindowPackets       uint64       // 0 means defaultSnWindow
+	tracer                trace.Tracer // nil means no spans, see trace.go
+	paddingMode           PaddingMode  // default padding of Data packets, see padding.go
+	paddingBlock          int
+	clock                 Clock           // nil means the wall clock, see clock.go
+	metrics               *metrics        // nil without WithMetrics, see metrics.go
+	ctx                   context.Context // nil without WithContext, see context.go
+	stopCtxWake           func() bool     // stops waking up Listen once ctx is done
+	network               string          // the remote addresses of dial strings are resolved with it
+	// handshake retransmission, the timeout doubles with every retry until the handshake is given up after max
+	handshakeTimeoutNano    uint64
+	handshakeMaxTimeoutNano uint64
+	mu                      sync.Mutex
 }
 
 type ListenOption struct {
 	seed         *[32]byte
 	prvKeyId     *ecdh.PrivateKey
 	localConn    NetworkConn
-	listenAddr   *net.UDPAddr
+	listenAddr   string
+	network      string
 	mtu          int
+	maxMtu       int
+	handshakeMtu int
+	maxStreams   uint32
+	streamRcvWnd int
+	streamSndBuf int
 	keyLogWriter io.Writer
+
+	maxAckDelayNano      uint64
+	flowControlStallNano uint64
+	summaryLogger        *slog.Logger
+	maxRtoNano           uint64
+	maxHandshakeSize     int
+	dontFragment         *bool
+	blackHoleThreshold   int
+	isECN                bool
+	isIssuedConnIds      bool
+	maxConnIds           int
+	isRequireKnownPeer   bool
+	statelessReset       *bool
+	amplificationLimit   int
+	reassemblyLimit      int
+	rateWindowNano       uint64
+	retransmitScheduler  RetransmitScheduler
+	handshakeRateLimiter *handshakeRateLimiter
+	allowedPeers         [][]byte
+	deniedPeers          [][]byte
+	acceptFilter         func(remotePub *ecdh.PublicKey, addr netip.AddrPort) error
+	acceptFilterEd25519  func(remotePub ed25519.PublicKey, addr netip.AddrPort) error
+	prvKeyEd             ed25519.PrivateKey
+	pathTimeoutNano      uint64
+	batchSize            int
+	keyStore             KeyStore
+	coalesceDelayNano    uint64
+	isNagleDisabled      bool
+	immediateFirstWrite  *bool
+	rekeyAfterBytes      uint64
+	rekeyAfterPackets    uint64
+	appProtos            []string
+	isNonceXorIV         bool
+	cipherSuite          *PacketCipherSuite
+	isCipherRequired     bool
+	mtuIncreasePolicy    func(current, proposed int) bool
+	replayWindowBits     int
+	snWindowPackets      uint64
+	tracer               trace.Tracer
+	paddingMode          PaddingMode
+	paddingBlock         int
+	isPaddingSet         bool
+	clock                Clock
+	metricsReg           MetricsRegisterer
+	ctx                  context.Context
+
+	handshakeTimeoutNano    uint64
+	handshakeMaxTimeoutNano uint64
 }
 
 type ListenFunc func(*ListenOption) error
@@ -49,9 +177,674 @@ func WithMtu(mtu int) ListenFunc {
 	}
 }
 
-// WithKeyLogWriter sets a writer for logging session keys in SSLKEYLOGFILE format.
+// WithMaxMtu enables path MTU discovery, the MTU of Data packets is probed from the MTU of WithMtu up to
+// maxMtu. The peer needs the same max MTU, it cannot receive larger packets than its own max MTU.
+func WithMaxMtu(maxMtu int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.maxMtu != 0 {
+			return errors.New("max mtu already set")
+		}
+		o.maxMtu = maxMtu
+		return nil
+	}
+}
+
+// WithHandshakeMTU sets the size the inits are padded to, by default the MTU of WithMtu. A smaller size fits
+// the handshake on constrained links, a larger one needs a max MTU of at least this size. The inits of a peer
+// with another handshake MTU are accepted, down to the smallest init of the protocol, see WithMaxHandshakeSize
+// for the largest.
+func WithHandshakeMTU(handshakeMtu int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.handshakeMtu != 0 {
+			return errors.New("handshake mtu already set")
+		}
+		o.handshakeMtu = handshakeMtu
+		return nil
+	}
+}
+
+// WithMaxHandshakeSize sets the size of the largest init we accept, by default the max MTU, so that peers with
+// a larger handshake MTU can connect. A larger init is dropped before the ECDH and the decryption, so a flood
+// of them costs little. It cannot be below the handshake MTU, then a peer with our options could not connect.
+func WithMaxHandshakeSize(size int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.maxHandshakeSize != 0 {
+			return errors.New("max handshake size already set")
+		}
+		if size <= 0 {
+			return errors.New("max handshake size not set")
+		}
+		o.maxHandshakeSize = size
+		return nil
+	}
+}
+
+// WithHandshakeRateLimit limits the inits each source can make us process to perSecond, with bursts of up to
+// burst inits. A source is the /24 of an IPv4 and the /64 of an IPv6 address. Inits above the limit are dropped
+// before the ECDH, Data packets are not limited.
+func WithHandshakeRateLimit(perSecond int, burst int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.handshakeRateLimiter != nil {
+			return errors.New("handshake rate limit already set")
+		}
+		if perSecond < 1 || burst < 1 {
+			return errors.New("handshake rate limit needs perSecond and burst of at least 1")
+		}
+		o.handshakeRateLimiter = newHandshakeRateLimiter(perSecond, burst)
+		return nil
+	}
+}
+
+// WithAmplificationFactor limits what the receiver of an init sends until the address of the peer is verified,
+// to factor times the bytes it received, 3 by default. The inits are padded, so a reply fits even with 1.
+func WithAmplificationFactor(factor int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.amplificationLimit != 0 {
+			return errors.New("amplification factor already set")
+		}
+		if factor < 1 {
+			return errors.New("amplification factor must be at least 1")
+		}
+		o.amplificationLimit = factor
+		return nil
+	}
+}
+
+// WithDontFragment sets the don't fragment bit on the socket of the listener, the default, so that packets larger
+// than the path MTU are dropped instead of fragmented. A network conn of WithNetworkConn is not changed.
+func WithDontFragment(isEnabled bool) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.dontFragment != nil {
+			return errors.New("dont fragment already set")
+		}
+		o.dontFragment = &isEnabled
+		return nil
+	}
+}
+
+// WithECN sends the packets marked ECT(0) and echoes the ECN marks of the received packets in the acks, a CE
+// mark of a congested router reduces the bandwidth estimate like a loss. The marks are only read from the socket
+// of the listener, on Linux and without batching, not from a network conn of WithNetworkConn.
+func WithECN() ListenFunc {
+	return func(o *ListenOption) error {
+		if o.isECN {
+			return errors.New("ECN already set")
+		}
+		o.isECN = true
+		return nil
+	}
+}
+
+// WithIssuedConnIds issues random connection IDs to the peers, they are sent encrypted and the peers use them
+// instead of the connection ID of the init, which is derived from the ephemeral key. The packets of a connection
+// cannot be linked to its handshake anymore, see Conn.RotateConnId. Both sides need it for both directions.
+func WithIssuedConnIds() ListenFunc {
+	return func(o *ListenOption) error {
+		if o.isIssuedConnIds {
+			return errors.New("issued connection IDs already set")
+		}
+		o.isIssuedConnIds = true
+		return nil
+	}
+}
+
+// WithMaxConnectionIDs issues up to n connection IDs to a peer at a time, at most 8: the one in use
+// and n-1 spares. After a path change, the peer switches to a spare without a round trip, so the packets on the
+// new path cannot be linked to the old one. It needs WithIssuedConnIds, the default is 1, no spares.
+func WithMaxConnectionIDs(n int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.maxConnIds != 0 {
+			return errors.New("max connection IDs already set")
+		}
+		if n < 1 || n > maxConnIdPool {
+			return fmt.Errorf("max connection IDs %d, not within 1..%d", n, maxConnIdPool)
+		}
+		o.maxConnIds = n
+		return nil
+	}
+}
+
+// WithStatelessReset(true) replies to a Data packet of an unknown connection with a stateless reset, so that
+// the peer closes the connection instead of retransmitting until it times out, e.g., after a restart. By
+// default, such packets are dropped silently, a scanner gets no reply and another listener may have the
+// connection.
+func WithStatelessReset(isEnabled bool) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.statelessReset != nil {
+			return errors.New("stateless reset already set")
+		}
+		o.statelessReset = &isEnabled
+		return nil
+	}
+}
+
+// WithBlackHoleDetectionThreshold enables black hole detection, the MTU of a connection is halved once this many
+// large packets in a row had to be sent again, see Conn.IsBlackHoleDetected. 3 is a good start.
+func WithBlackHoleDetectionThreshold(packets int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.blackHoleThreshold != 0 {
+			return errors.New("black hole detection threshold already set")
+		}
+		if packets <= 0 {
+			return errors.New("black hole detection threshold not set")
+		}
+		o.blackHoleThreshold = packets
+		return nil
+	}
+}
+
+// WithMTUIncreasePolicy is called before path MTU discovery raises the MTU to a validated size. If it returns
+// false, the MTU stays and the discovery continues with smaller sizes, e.g., to cap the MTU or to raise it in
+// smaller steps on paths that drop large packets from time to time. By default, validated sizes are used.
+func WithMTUIncreasePolicy(policy func(current, proposed int) bool) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.mtuIncreasePolicy != nil {
+			return errors.New("MTU increase policy already set")
+		}
+		if policy == nil {
+			return errors.New("MTU increase policy not set")
+		}
+		o.mtuIncreasePolicy = policy
+		return nil
+	}
+}
+
+// WithMaxConcurrentStreams limits the number of streams a peer can open per connection. New streams
+// above the limit are rejected with a stream limit error. The default of 0 means no limit.
+func WithMaxConcurrentStreams(n uint32) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.maxStreams != 0 {
+			return errors.New("max concurrent streams already set")
+		}
+		o.maxStreams = n
+		return nil
+	}
+}
+
+// WithStreamRcvWindow limits how much data a single stream can buffer on receive. A stream that is not read
+// only blocks itself once its window is full, the other streams of the connection keep going.
+func WithStreamRcvWindow(n int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.streamRcvWnd != 0 {
+			return errors.New("stream receive window already set")
+		}
+		if n <= 0 || n > rcvBufferCapacity {
+			return fmt.Errorf("stream receive window needs 0 < n <= %d", rcvBufferCapacity)
+		}
+		o.streamRcvWnd = n
+		return nil
+	}
+}
+
+// WithReassemblyLimit limits how far out of order a stream buffers: a segment that ends more than n bytes
+// past the next byte to read is dropped without an ack, and sent again by the peer once the gap is filled.
+// By default, out of order data is buffered up to the receive window of the stream.
+func WithReassemblyLimit(n int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.reassemblyLimit != 0 {
+			return errors.New("reassembly limit already set")
+		}
+		if n <= 0 {
+			return errors.New("reassembly limit needs n > 0")
+		}
+		o.reassemblyLimit = n
+		return nil
+	}
+}
+
+// WithSendBuffer limits the data a single stream holds for sending, queued or not acked yet, so that a fast
+// writer does not buffer without bound even if the window of the peer is large. Write then returns the bytes
+// that fit, WriteContext waits until acks free space. By default, only the send buffer of the connection limits.
+func WithSendBuffer(n int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.streamSndBuf != 0 {
+			return errors.New("send buffer already set")
+		}
+		if n <= 0 || n > sndBufferCapacity {
+			return fmt.Errorf("send buffer needs 0 < n <= %d", sndBufferCapacity)
+		}
+		o.streamSndBuf = n
+		return nil
+	}
+}
+
+// WithHandshakeTimeout sets the initial retransmission timeout for handshake packets, it doubles with
+// every retry. If the handshake did not complete after maxNano, the connection fails with ErrHandshakeTimeout.
+func WithHandshakeTimeout(initialNano uint64, maxNano uint64) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.handshakeTimeoutNano != 0 {
+			return errors.New("handshake timeout already set")
+		}
+		if initialNano == 0 || maxNano < initialNano {
+			return errors.New("handshake timeout needs 0 < initial <= max")
+		}
+		o.handshakeTimeoutNano = initialNano
+		o.handshakeMaxTimeoutNano = maxNano
+		return nil
+	}
+}
+
+// WithMaxRTO sets the maximum of the retransmission timeout and of the probe timeout backoff, the default is
+// 2s. It cannot be lower than the minimum RTO of 100ms.
+func WithMaxRTO(d time.Duration) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.maxRtoNano != 0 {
+			return errors.New("max RTO already set")
+		}
+		if uint64(d) < minRTO {
+			return fmt.Errorf("max RTO needs to be at least %v", time.Duration(minRTO))
+		}
+		o.maxRtoNano = uint64(d)
+		return nil
+	}
+}
+
+// WithFlowControlStallTimeout makes Write return ErrPeerFlowControlStalled once the receive window of the peer
+// blocked the data of a stream for longer than d, while the peer still acked. By default, the data waits until
+// the peer reads.
+func WithFlowControlStallTimeout(d time.Duration) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.flowControlStallNano != 0 {
+			return errors.New("flow control stall timeout already set")
+		}
+		if d <= 0 {
+			return errors.New("flow control stall timeout needs d > 0")
+		}
+		o.flowControlStallNano = uint64(d)
+		return nil
+	}
+}
+
+// WithMaxAckDelay holds back ack-only packets for up to d, so that acks can be sent together with data or
+// the next ack. The delay is sent with the ack, so that the peer does not count it as RTT. The default of 0
+// sends acks immediately.
+func WithMaxAckDelay(d time.Duration) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.maxAckDelayNano != 0 {
+			return errors.New("max ack delay already set")
+		}
+		if d <= 0 || uint64(d) > MaxAckDelay {
+			return fmt.Errorf("max ack delay needs 0 < d <= %v", time.Duration(MaxAckDelay))
+		}
+		o.maxAckDelayNano = uint64(d)
+		return nil
+	}
+}
+
+// WithCoalesceDelay sets how long a write smaller than a packet is held back at most, so that the next writes
+// are sent in the same packet. Like Nagle, it is only held back while data of the stream is in flight, the
+// default is 10ms. Stream.Flush sends it right away.
+func WithCoalesceDelay(d time.Duration) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.coalesceDelayNano != 0 {
+			return errors.New("coalesce delay already set")
+		}
+		if d <= 0 {
+			return errors.New("coalesce delay needs d > 0")
+		}
+		o.coalesceDelayNano = uint64(d)
+		return nil
+	}
+}
+
+// WithNagleDisabled sends each write right away, even if the packet is not full, for latency sensitive
+// applications
+func WithNagleDisabled() ListenFunc {
+	return func(o *ListenOption) error {
+		if o.isNagleDisabled {
+			return errors.New("Nagle already disabled")
+		}
+		o.isNagleDisabled = true
+		return nil
+	}
+}
+
+// WithImmediateFirstWrite sends the first write after the connection was idle right away, for low first byte
+// latency of request/response traffic. Idle means no data was sent for longer than the coalesce delay, the
+// writes that follow it are coalesced again. It is disabled by default.
+func WithImmediateFirstWrite(isEnabled bool) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.immediateFirstWrite != nil {
+			return errors.New("immediate first write already set")
+		}
+		o.immediateFirstWrite = &isEnabled
+		return nil
+	}
+}
+
+// WithRekeyAfter rekeys a connection once it sent bytes or packets of Data with the current shared secret,
+// 0 means no limit, see Conn.Rekey. By default, a connection is only rekeyed on request.
+func WithRekeyAfter(bytes uint64, packets uint64) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.rekeyAfterBytes != 0 || o.rekeyAfterPackets != 0 {
+			return errors.New("rekey after already set")
+		}
+		if bytes == 0 && packets == 0 {
+			return errors.New("rekey after needs bytes > 0 or packets > 0")
+		}
+		o.rekeyAfterBytes = bytes
+		o.rekeyAfterPackets = packets
+		return nil
+	}
+}
+
+// WithConnectionSummaryLog logs a single line to logger when a connection ends, with its duration, bytes
+// in and out, the fingerprint of the peer identity key, retransmissions and the close reason.
+func WithConnectionSummaryLog(logger *slog.Logger) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.summaryLogger != nil {
+			return errors.New("connection summary log already set")
+		}
+		if logger == nil {
+			return errors.New("connection summary logger not set")
+		}
+		o.summaryLogger = logger
+		return nil
+	}
+}
+
+// WithAcceptFilter is called with the identity key and the address of the peer before a new connection is
+// created. If it returns an error, the init is dropped without a reply and no connection state is kept.
+func WithAcceptFilter(filter func(remotePub *ecdh.PublicKey, addr netip.AddrPort) error) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.acceptFilter != nil {
+			return errors.New("accept filter already set")
+		}
+		if filter == nil {
+			return errors.New("accept filter not set")
+		}
+		o.acceptFilter = filter
+		return nil
+	}
+}
+
+// WithEd25519AcceptFilter is WithAcceptFilter for peers that sign their init with an Ed25519 identity key, see
+// WithEd25519Identity. If only WithAcceptFilter is set, these peers are rejected.
+func WithEd25519AcceptFilter(filter func(remotePub ed25519.PublicKey, addr netip.AddrPort) error) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.acceptFilterEd25519 != nil {
+			return errors.New("Ed25519 accept filter already set")
+		}
+		if filter == nil {
+			return errors.New("Ed25519 accept filter not set")
+		}
+		o.acceptFilterEd25519 = filter
+		return nil
+	}
+}
+
+// WithPublicKeyFilter is WithAcceptFilter for a filter that only needs the identity key, false drops the init
+// without a reply. It cannot be combined with WithAcceptFilter.
+func WithPublicKeyFilter(filter func(remotePub *ecdh.PublicKey) bool) ListenFunc {
+	if filter == nil {
+		return func(o *ListenOption) error {
+			return errors.New("public key filter not set")
+		}
+	}
+	return WithAcceptFilter(func(remotePub *ecdh.PublicKey, _ netip.AddrPort) error {
+		if !filter(remotePub) {
+			return errors.New("public key not accepted")
+		}
+		return nil
+	})
+}
+
+// WithPublicKeyAllowList accepts only peers with one of these identity keys, it is WithAllowedPeers for a list
+// that cannot be empty. The keys are checked before the ECDH, in constant time, and every key is compared, so
+// the time does not tell how far the key of a peer matched.
+func WithPublicKeyAllowList(keys []*ecdh.PublicKey) ListenFunc {
+	if len(keys) == 0 {
+		return func(o *ListenOption) error {
+			return errors.New("public key allow list is empty")
+		}
+	}
+	return WithAllowedPeers(keys)
+}
+
+// isKeyAllowed compares key with all allowed keys in constant time
+func isKeyAllowed(allowed [][]byte, key []byte) bool {
+	found := 0
+	for _, a := range allowed {
+		found |= subtle.ConstantTimeCompare(a, key)
+	}
+	return found == 1
+}
+
+// WithEd25519Identity lets DialWithCrypto authenticate with an Ed25519 key, e.g. an existing SSH key, instead
+// of the X25519 identity key. The init carries the Ed25519 key and a signature of our ephemeral key, the
+// session secret is derived from the ephemeral keys only. The peer still needs an X25519 identity key.
+func WithEd25519Identity(prvKeyEd ed25519.PrivateKey) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.prvKeyEd != nil {
+			return errors.New("Ed25519 identity already set")
+		}
+		if len(prvKeyEd) != ed25519.PrivateKeySize {
+			return errors.New("Ed25519 identity not set")
+		}
+		o.prvKeyEd = prvKeyEd
+		return nil
+	}
+}
+
+// WithPathValidationTimeout sets how long the peer has to answer the path challenge to a new address, the
+// default is 3s. Until the new address is validated, we keep sending to the old one.
+func WithPathValidationTimeout(d time.Duration) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.pathTimeoutNano != 0 {
+			return errors.New("path validation timeout already set")
+		}
+		if d <= 0 {
+			return errors.New("path validation timeout needs to be positive")
+		}
+		o.pathTimeoutNano = uint64(d)
+		return nil
+	}
+}
+
+// WithBatchSize lets Flush send up to n packets of different connections, the pacing of each connection still
+// applies. On Linux, the packets are sent with one sendmmsg and received with recvmmsg, elsewhere one by one.
+// The default of 1 sends a single packet per flush. Batching only applies to the UDP socket of the listener,
+// not to a connection set with WithNetworkConn.
+func WithBatchSize(n int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.batchSize != 0 {
+			return errors.New("batch size already set")
+		}
+		if n < 1 || n > maxBatchSize {
+			return fmt.Errorf("batch size needs 1 <= n <= %d", maxBatchSize)
+		}
+		o.batchSize = n
+		return nil
+	}
+}
+
+// WithKeyStore pins the identity keys of the peers we dial, trust on first use. On first contact, the key the
+// peer presents is stored for its address. Afterwards, a peer with another key fails with a *KeyMismatchError,
+// which matches ErrKeyMismatch, DialWithCrypto with another key fails right away.
+func WithKeyStore(store KeyStore) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.keyStore != nil {
+			return errors.New("key store already set")
+		}
+		if store == nil {
+			return errors.New("key store not set")
+		}
+		o.keyStore = store
+		return nil
+	}
+}
+
+// WithApplicationProtocols sets the application protocols we accept, like ALPN of TLS. A dial with crypto
+// offers the first one in its init, the peer echoes it in its reply. Inits with another or without a protocol
+// are dropped with ErrProtocolMismatch. Without this option, any protocol is accepted and echoed.
+func WithApplicationProtocols(protos []string) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.appProtos != nil {
+			return errors.New("application protocols already set")
+		}
+		if len(protos) == 0 {
+			return errors.New("application protocols not set")
+		}
+		for _, proto := range protos {
+			if len(proto) == 0 || len(proto) > maxAppProtoSize {
+				return fmt.Errorf("application protocol needs 1 to %d bytes", maxAppProtoSize)
+			}
+		}
+		o.appProtos = slices.Clone(protos)
+		return nil
+	}
+}
+
+// WithNonceXorIV offers and accepts a nonce for Data packets that XORs the epoch and the SN with a random IV
+// per direction, derived from the shared secret, instead of the split nonce of the plain epoch and SN. It is
+// only used if both peers set it, otherwise the split nonce is used.
+func WithNonceXorIV() ListenFunc {
+	return func(o *ListenOption) error {
+		if o.isNonceXorIV {
+			return errors.New("XOR nonce already set")
+		}
+		o.isNonceXorIV = true
+		return nil
+	}
+}
+
+// WithPacketCipher offers the packet cipher of the Data packets by its name, e.g., "AES-256-GCM", and accepts
+// it. It is used if the peer opted in to the same one, otherwise ChaCha20-Poly1305. See RegisterPacketCipher
+// for other ciphers.
+func WithPacketCipher(name string) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.cipherSuite != nil {
+			return errors.New("packet cipher already set")
+		}
+		suite := packetCipherByName(name)
+		if suite == nil {
+			return fmt.Errorf("packet cipher %q is not registered", name)
+		}
+		o.cipherSuite = suite
+		return nil
+	}
+}
+
+// WithReplayWindow sets how many Data packets below the highest received one are still accepted, each once.
+// Older packets and packets received before are dropped as replays. The default of 64 is the window of IPsec,
+// a larger window allows for more reordering.
+func WithReplayWindow(bits int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.replayWindowBits != 0 {
+			return errors.New("replay window already set")
+		}
+		if bits < 64 || bits > maxReplayWindow || bits%64 != 0 {
+			return fmt.Errorf("replay window needs a multiple of 64 bits, up to %d", maxReplayWindow)
+		}
+		o.replayWindowBits = bits
+		return nil
+	}
+}
+
+// WithSequenceWindow sets how many packets a Data packet may be ahead of the highest received one, the
+// default is 2^20. A packet further ahead is authentic, but was not sent in this connection for a long time
+// or at all, e.g., injected by someone who got hold of old keys, it is dropped and counted. The window
+// behind is the replay window, see WithReplayWindow.
+func WithSequenceWindow(packets uint64) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.snWindowPackets != 0 {
+			return errors.New("sequence window already set")
+		}
+		if packets < maxReplayWindow {
+			return fmt.Errorf("sequence window needs at least %d packets", maxReplayWindow)
+		}
+		o.snWindowPackets = packets
+		return nil
+	}
+}
+
+// WithTracer creates OpenTelemetry spans for connections, their handshake phases and streams, with Write and
+// Read as child spans of their stream. Without a tracer, no spans are created.
+func WithTracer(tracer trace.Tracer) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.tracer != nil {
+			return errors.New("tracer already set")
+		}
+		if tracer == nil {
+			return errors.New("tracer not set")
+		}
+		o.tracer = tracer
+		return nil
+	}
+}
+
+// WithPadding pads Data packets, so that their size does not reveal the size of the writes. PaddingBlock
+// pads to a multiple of blockSize, PaddingMtu every packet to the MTU, the other modes take a blockSize of 0.
+// Conn.SetPadding overrides it for a single connection.
+func WithPadding(mode PaddingMode, blockSize int) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.isPaddingSet {
+			return errors.New("padding already set")
+		}
+		o.paddingMode = mode
+		o.paddingBlock = blockSize
+		o.isPaddingSet = true
+		return nil
+	}
+}
+
+// WithClock sets the time source of the listener, by default the wall clock. Loop, Close and ForceClose take
+// their time from it, as do the stream deadlines, e.g., to test retransmissions without sleeping.
+func WithClock(clock Clock) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.clock != nil {
+			return errors.New("clock already set")
+		}
+		if clock == nil {
+			return errors.New("clock not set")
+		}
+		o.clock = clock
+		return nil
+	}
+}
+
+// WithContext sets the context of the listener. Once it is done, Listen, Stream.Read and Stream.Write return
+// its error and Flush does not send anymore, Loop closes the connections and the listener. The contexts of
+// the connections, see Conn.Context, are its children.
+func WithContext(ctx context.Context) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.ctx != nil {
+			return errors.New("context already set")
+		}
+		if ctx == nil {
+			return errors.New("context not set")
+		}
+		o.ctx = ctx
+		return nil
+	}
+}
+
+// WithMetrics creates the metrics of the listener and its connections with reg, labeled with the address of
+// WithListenAddr, e.g., with qotpprom.New for Prometheus. Listeners can share a registerer, the gauges of a
+// listener are removed on Close.
+func WithMetrics(reg MetricsRegisterer) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.metricsReg != nil {
+			return errors.New("metrics already set")
+		}
+		if reg == nil {
+			return errors.New("metrics registerer not set")
+		}
+		o.metricsReg = reg
+		return nil
+	}
+}
+
+// WithKeyLogWriter writes the secrets of each connection and of each rekey to w, like SSLKEYLOGFILE of TLS,
+// so that captures can be decrypted, see keylog.go for the format. Anyone with the log can read the traffic.
 func WithKeyLogWriter(w io.Writer) ListenFunc {
 	return func(o *ListenOption) error {
+		if o.keyLogWriter != nil {
+			return errors.New("key log writer already set")
+		}
+		if w == nil {
+			return errors.New("key log writer not set")
+		}
 		o.keyLogWriter = w
 		return nil
 	}
@@ -118,22 +911,52 @@ func WithSeedStr(seedStr string) ListenFunc {
 	}
 }
 
+// WithListenAddr sets the address we listen on, e.g., "127.0.0.1:8080" or "[::1]:8080". It is resolved with
+// the network of WithNetwork, a wildcard address like ":8080" or "[::]:8080" is dual stack by default.
 func WithListenAddr(addr string) ListenFunc {
 	return func(o *ListenOption) error {
-		if o.listenAddr != nil {
+		if o.listenAddr != "" {
 			return errors.New("listenAddr already set")
 		}
-
-		listenAddr, err := net.ResolveUDPAddr("udp", addr)
-		if err != nil {
-			return err
+		if addr == "" {
+			return errors.New("listenAddr not set")
 		}
+		o.listenAddr = addr
+		return nil
+	}
+}
 
-		o.listenAddr = listenAddr
+// WithNetwork forces the address family, "udp4" for IPv4 or "udp6" for IPv6 only. The default "udp" listens
+// dual stack on a wildcard address, the family of a specific address otherwise. Dial strings are resolved
+// with the family of the socket.
+func WithNetwork(network string) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.network != "" {
+			return errors.New("network already set")
+		}
+		switch network {
+		case "udp", "udp4", "udp6":
+		default:
+			return fmt.Errorf("unknown network %q, needs to be udp, udp4 or udp6", network)
+		}
+		o.network = network
 		return nil
 	}
 }
 
+// minHandshakeMtu is the size of an init with the init params, the application protocol we offer and the
+// smallest payload
+func minHandshakeMtu(lOpts *ListenOption) int {
+	size := minInitSize
+	if lOpts.prvKeyEd != nil {
+		size = minInitSignedSize
+	}
+	if len(lOpts.appProtos) > 0 {
+		size += len(lOpts.appProtos[0])
+	}
+	return size
+}
+
 func fillListenOpts(options ...ListenFunc) (*ListenOption, error) {
 	lOpts := &ListenOption{}
 
@@ -147,6 +970,67 @@ func fillListenOpts(options ...ListenFunc) (*ListenOption, error) {
 	if lOpts.mtu == 0 {
 		lOpts.mtu = 1400 //default MTU
 	}
+	if lOpts.maxMtu == 0 {
+		lOpts.maxMtu = lOpts.mtu // no path MTU discovery
+	}
+	if lOpts.maxMtu < lOpts.mtu {
+		return nil, fmt.Errorf("max mtu %d is below the mtu %d", lOpts.maxMtu, lOpts.mtu)
+	}
+	if lOpts.handshakeMtu == 0 {
+		lOpts.handshakeMtu = lOpts.mtu
+	}
+	if minSize := minHandshakeMtu(lOpts); lOpts.handshakeMtu < minSize {
+		return nil, fmt.Errorf("handshake mtu %d is below the smallest init of %d bytes", lOpts.handshakeMtu, minSize)
+	}
+	if lOpts.handshakeMtu > lOpts.maxMtu {
+		// we could not receive an init of this size from a peer with the same options
+		return nil, fmt.Errorf("handshake mtu %d exceeds the max mtu %d", lOpts.handshakeMtu, lOpts.maxMtu)
+	}
+	if lOpts.dontFragment != nil && lOpts.localConn != nil {
+		return nil, errors.New("dont fragment needs the socket of the listener, not a network conn")
+	}
+	if lOpts.maxHandshakeSize == 0 {
+		lOpts.maxHandshakeSize = lOpts.maxMtu
+	}
+	if lOpts.maxHandshakeSize < lOpts.handshakeMtu {
+		return nil, fmt.Errorf("max handshake size %d is below the handshake mtu %d", lOpts.maxHandshakeSize,
+			lOpts.handshakeMtu)
+	}
+	if lOpts.maxHandshakeSize > lOpts.maxMtu {
+		// a larger packet is cut at the max mtu when it is read
+		return nil, fmt.Errorf("max handshake size %d exceeds the max mtu %d", lOpts.maxHandshakeSize, lOpts.maxMtu)
+	}
+	if err := checkPadding(lOpts.paddingMode, lOpts.paddingBlock, lOpts.mtu); err != nil {
+		return nil, err
+	}
+	if lOpts.streamRcvWnd == 0 {
+		lOpts.streamRcvWnd = defaultStreamRcvWindow
+	}
+	if lOpts.batchSize == 0 {
+		lOpts.batchSize = 1
+	}
+	if lOpts.isCipherRequired && lOpts.cipherSuite == nil {
+		return nil, errors.New("require packet cipher set, but no packet cipher")
+	}
+	if lOpts.maxConnIds != 0 && !lOpts.isIssuedConnIds {
+		return nil, errors.New("max connection IDs set, but no issued connection IDs")
+	}
+	if lOpts.isRequireKnownPeer && lOpts.allowedPeers == nil {
+		lOpts.allowedPeers = [][]byte{}
+	}
+	if lOpts.isNagleDisabled && lOpts.coalesceDelayNano != 0 {
+		return nil, errors.New("coalesce delay set, but Nagle disabled")
+	}
+	if !lOpts.isNagleDisabled && lOpts.coalesceDelayNano == 0 {
+		lOpts.coalesceDelayNano = defaultCoalesceDelay
+	}
+	if lOpts.isNagleDisabled && lOpts.immediateFirstWrite != nil && *lOpts.immediateFirstWrite {
+		return nil, errors.New("immediate first write set, but Nagle disabled")
+	}
+	if lOpts.handshakeTimeoutNano == 0 {
+		lOpts.handshakeTimeoutNano = defaultHandshakeTimeout
+		lOpts.handshakeMaxTimeoutNano = defaultHandshakeMaxTimeout
+	}
 	if lOpts.seed != nil {
 		prvKeyId, err := ecdh.X25519().NewPrivateKey(lOpts.seed[:])
 		if err != nil {
@@ -161,18 +1045,42 @@ func fillListenOpts(options ...ListenFunc) (*ListenOption, error) {
 		}
 		lOpts.prvKeyId = prvKeyId
 	}
+	if lOpts.network == "" {
+		lOpts.network = "udp"
+	}
 	if lOpts.localConn == nil {
-		conn, err := net.ListenUDP("udp", lOpts.listenAddr)
+		var listenAddr *net.UDPAddr
+		if lOpts.listenAddr != "" {
+			var err error
+			if listenAddr, err = net.ResolveUDPAddr(lOpts.network, lOpts.listenAddr); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := net.ListenUDP(lOpts.network, listenAddr)
 		if err != nil {
 			return nil, err
 		}
+		lOpts.network = socketNetwork(lOpts.network, conn.LocalAddr())
 
-		err = setDontFragment(conn)
+		if lOpts.dontFragment == nil || *lOpts.dontFragment {
+			err = setDontFragment(conn)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if lOpts.isECN {
+			err = setECN(conn)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		lOpts.localConn, err = newUDPNetworkConnBatch(conn, lOpts.batchSize)
 		if err != nil {
 			return nil, err
 		}
-
-		lOpts.localConn = NewUDPNetworkConn(conn)
+		lOpts.localConn.(*UDPNetworkConn).isECN = lOpts.isECN
 	}
 
 	return lOpts, nil
@@ -188,9 +1096,80 @@ func Listen(options ...ListenFunc) (*Listener, error) {
 		localConn:    lOpts.localConn,
 		prvKeyId:     lOpts.prvKeyId,
 		mtu:          lOpts.mtu,
+		maxMtu:       lOpts.maxMtu,
+		handshakeMtu: lOpts.handshakeMtu,
+		maxStreams:   lOpts.maxStreams,
+		streamRcvWnd: lOpts.streamRcvWnd,
+		streamSndBuf: lOpts.streamSndBuf,
 		keyLogWriter: lOpts.keyLogWriter,
 		connMap:      NewLinkedMap[uint64, *Conn](),
+		closeCh:      make(chan struct{}),
+		acceptConnCh: make(chan *Conn, acceptQueueSize),
 		mu:           sync.Mutex{},
+
+		handshakeTimeoutNano:    lOpts.handshakeTimeoutNano,
+		handshakeMaxTimeoutNano: lOpts.handshakeMaxTimeoutNano,
+		maxHandshakeSize:        lOpts.maxHandshakeSize,
+		blackHoleThreshold:      lOpts.blackHoleThreshold,
+		isECN:                   lOpts.isECN,
+		isIssuedConnIds:         lOpts.isIssuedConnIds,
+		maxConnIds:              lOpts.maxConnIds,
+		isRequireKnownPeer:      lOpts.isRequireKnownPeer,
+		isStatelessReset:        lOpts.statelessReset != nil && *lOpts.statelessReset,
+		amplificationLimit:      lOpts.amplificationLimit,
+		reassemblyLimit:         lOpts.reassemblyLimit,
+		rateWindowNano:          lOpts.rateWindowNano,
+		retransmitScheduler:     lOpts.retransmitScheduler,
+		handshakeRateLimiter:    lOpts.handshakeRateLimiter,
+		peers:                   &peerList{allowed: lOpts.allowedPeers, denied: lOpts.deniedPeers},
+		issuedConnIds:           NewLinkedMap[uint64, *Conn](),
+		peerConnIds:             NewLinkedMap[uint64, *Conn](),
+		connIdKey:               connIdKey(lOpts.prvKeyId),
+		maxAckDelayNano:         lOpts.maxAckDelayNano,
+		flowControlStallNano:    lOpts.flowControlStallNano,
+		summaryLogger:           lOpts.summaryLogger,
+		maxRtoNano:              lOpts.maxRtoNano,
+		acceptFilter:            lOpts.acceptFilter,
+		acceptFilterEd25519:     lOpts.acceptFilterEd25519,
+		prvKeyEd:                lOpts.prvKeyEd,
+		pathTimeoutNano:         lOpts.pathTimeoutNano,
+		batchSize:               lOpts.batchSize,
+		keyStore:                lOpts.keyStore,
+		coalesceDelayNano:       lOpts.coalesceDelayNano,
+		isImmediateFirstWrite:   lOpts.immediateFirstWrite != nil && *lOpts.immediateFirstWrite,
+		rekeyAfterBytes:         lOpts.rekeyAfterBytes,
+		rekeyAfterPackets:       lOpts.rekeyAfterPackets,
+		appProtos:               lOpts.appProtos,
+		isNonceXorIV:            lOpts.isNonceXorIV,
+		cipherSuite:             lOpts.cipherSuite,
+		isCipherRequired:        lOpts.isCipherRequired,
+		mtuIncreasePolicy:       lOpts.mtuIncreasePolicy,
+		replayWindowBits:        lOpts.replayWindowBits,
+		snWindowPackets:         lOpts.snWindowPackets,
+		tracer:                  lOpts.tracer,
+		paddingMode:             lOpts.paddingMode,
+		paddingBlock:            lOpts.paddingBlock,
+		clock:                   lOpts.clock,
+		network:                 lOpts.network,
+		ctx:                     lOpts.ctx,
+	}
+	if l.ctx != nil {
+		// wake up a Listen that waits for packets, like a stream deadline
+		l.stopCtxWake = context.AfterFunc(l.ctx, func() {
+			if err := l.localConn.TimeoutReadNow(); err != nil {
+				slog.Debug("context done, wake up", slog.Any("error", err))
+			}
+		})
+	}
+	if lOpts.metricsReg != nil {
+		label := lOpts.localConn.LocalAddrString()
+		if lOpts.listenAddr != "" {
+			label = lOpts.listenAddr
+		}
+		l.metrics, err = newMetrics(lOpts.metricsReg, l, label)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	slog.Info(
@@ -205,17 +1184,28 @@ func (l *Listener) PubKey() *ecdh.PublicKey {
 	return l.prvKeyId.PublicKey()
 }
 
+// Close closes the connections and the socket. With a running Loop, the Loop closes the connections once the
+// closed socket wakes it up, in its own goroutine, as Listen and Flush may still use them and their keys.
 func (l *Listener) Close() error {
 	slog.Debug("ListenerClose", gId())
 	l.mu.Lock()
-	defer l.mu.Unlock()
-
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	if l.closeCh != nil {
+		close(l.closeCh)
+	}
 	l.closed = true
-
-	for _, conn := range l.connMap.items {
-		conn.value.Close()
+	if l.stopCtxWake != nil {
+		l.stopCtxWake()
 	}
+	isLooping := l.isLooping
+	l.mu.Unlock()
 
+	if !isLooping {
+		l.closeConns()
+	}
 	err := l.localConn.TimeoutReadNow()
 	if err != nil {
 		return err
@@ -223,9 +1213,38 @@ func (l *Listener) Close() error {
 	return l.localConn.Close()
 }
 
+// closeConns removes the connections after Close, in the goroutine of Listen and Flush
+func (l *Listener) closeConns() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	nowNano := l.nowNano()
+	for _, conn := range l.connMap.items {
+		conn.value.Close()
+		conn.value.cleanupConn(errListenerClosed, nowNano)
+	}
+	l.metrics.unregister()
+}
+
+// isClosing is true once Close was called
+func (l *Listener) isClosing() bool {
+	select {
+	case <-l.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Listen reads and decodes a packet, it waits up to timeoutNano for it. With a timeout of 0, only a packet that
+// is already queued is read, on Unix, see FD. The stream of the packet is returned, if it carried one.
 func (l *Listener) Listen(timeoutNano uint64, nowNano uint64) (s *Stream, err error) {
-	data := make([]byte, l.mtu)
-	n, remoteAddr, err := l.localConn.ReadFromUDPAddrPort(data, timeoutNano, nowNano)
+	if err := l.ctxErr(); err != nil {
+		return nil, err
+	}
+	buf := getBuffer(l.maxPmtu())
+	defer putBuffer(buf)
+	n, remoteAddr, ecn, err := l.readECN(*buf, timeoutNano, nowNano)
 
 	if err != nil {
 		var netErr net.Error
@@ -245,120 +1264,308 @@ func (l *Listener) Listen(timeoutNano uint64, nowNano uint64) (s *Stream, err er
 
 	slog.Debug("   Listen/Data", gId(), l.debug(), slog.Any("len(data)", n), slog.Uint64("now:ms", nowNano/msNano))
 
-	conn, payload, msgType, err := l.decode(data[:n], remoteAddr)
+	conn, m, msgType, err := l.decode((*buf)[:n], remoteAddr, nowNano)
+	defer m.Release()
+	if errors.Is(err, ErrWrongServerIdentityKey) && conn != nil {
+		// the peer cannot decrypt our InitCryptoSnd, retransmissions would not help
+		slog.Info("wrong identity key of peer", conn.debug())
+		conn.closeErr = ErrWrongServerIdentityKey
+		conn.cleanupConn(nil, nowNano)
+		return nil, nil
+	}
+	if errors.Is(err, ErrKeyMismatch) && conn != nil {
+		// the peer is not who we talked to before, do not send it any data
+		slog.Warn("identity key mismatch", conn.debug(), slog.Any("error", err))
+		conn.closeErr = err
+		conn.cleanupConn(nil, nowNano)
+		return nil, nil
+	}
+	if errors.Is(err, ErrProtocolMismatch) {
+		slog.Info("application protocol mismatch", l.debug(), slog.Any("error", err))
+		if conn != nil {
+			// the peer chose another protocol than we offered
+			conn.closeErr = err
+			conn.cleanupConn(nil, nowNano)
+		} else {
+			l.metrics.onDrop(dropRejected)
+		}
+		return nil, nil
+	}
+	if errors.Is(err, ErrInvalidSignature) {
+		// forged or corrupted init, no state was created
+		slog.Info("invalid signature", l.debug(), slog.Any("error", err))
+		l.metrics.onDrop(dropInvalidSignature)
+		return nil, nil
+	}
+	if errors.Is(err, ErrUnsupportedVersion) {
+		// a peer of another version, e.g., while the peers are updated, it cannot be decrypted
+		slog.Info("unsupported crypto version", l.debug(), slog.String("remote", remoteAddr.String()),
+			slog.Any("error", err))
+		l.metrics.onDrop(dropVersion)
+		return nil, nil
+	}
+	if errors.Is(err, errOversizedInit) {
+		// dropped before the ECDH and the decryption, a flood of large inits only costs the read
+		slog.Debug("oversized init dropped", l.debug(), slog.Any("error", err))
+		l.metrics.onDrop(dropOversizedInit)
+		return nil, nil
+	}
+	if errors.Is(err, errHandshakeRateLimited) {
+		// dropped before the ECDH, the source sent more inits than WithHandshakeRateLimit allows
+		l.metrics.onDrop(dropRateLimited)
+		return nil, nil
+	}
+	if errors.Is(err, ErrConnectionRejected) {
+		// drop the init silently, the peer cannot tell a rejection from a lost packet
+		slog.Info("connection rejected", l.debug(), slog.Any("error", err))
+		l.metrics.onDrop(dropRejected)
+		return nil, nil
+	}
+	if errors.Is(err, errDuplicateInit) {
+		// the peer did not get our reply, send it again, the keys of the connection stay as they are
+		slog.Debug("duplicate init", conn.debug())
+		conn.isInitReplyPending = conn.isInitSentOnSnd
+		conn.bytesReceived += uint64(n) // credit for the reply, see isAmplificationLimited
+		return nil, nil
+	}
+	if errors.Is(err, errReplayedPacket) {
+		// a replay, or a packet that arrived too late for the window, the connection continues
+		slog.Debug("replayed packet dropped", conn.debug(), slog.Any("error", err))
+		conn.onDrop(dropReplay)
+		return nil, nil
+	}
+	if errors.Is(err, errSnOutOfWindow) {
+		// authentic, but far ahead of what the peer sent, the connection continues
+		slog.Debug("packet out of sequence window dropped", conn.debug(), slog.Any("error", err))
+		conn.onDrop(dropSnWindow)
+		return nil, nil
+	}
+	if errors.Is(err, errUnexpectedMsgType) {
+		// not fatal, the packet could be a late retransmission or forged, the connection continues
+		slog.Debug("message type not valid, packet dropped", conn.debug(), slog.Any("error", err))
+		conn.onDrop(dropMsgType)
+		return nil, nil
+	}
+	if errors.Is(err, ErrConnectionReset) {
+		// the peer lost the state of this connection, no need to wait for timeouts
+		slog.Info("connection reset by peer", conn.debug())
+		conn.closeErr = ErrConnectionReset
+		conn.cleanupConn(nil, nowNano)
+		return nil, nil
+	}
+	if errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrInvalidSequence) || errors.Is(err, ErrKeyInvalid) {
+		// forged, or a probe for keys, the source pays with its handshake rate limit. ErrPacketTooShort and the
+		// other decode errors are only dropped, a truncated packet is rather a broken path than an attack.
+		l.handshakeRateLimiter.penalize(remoteAddr.Addr().Unmap(), nowNano)
+	}
 	if err != nil {
+		err = newDecodeError((*buf)[:n], err)
+		if _, ok := err.(*DecodeError); ok {
+			l.metrics.onDrop(dropReason(err))
+		}
 		return nil, err
 	}
 
 	if nowNano > conn.lastReadTimeNano {
 		conn.lastReadTimeNano = nowNano
 	}
+	if conn.startNano == 0 {
+		conn.startNano = nowNano
+	}
+	conn.bytesReceived += uint64(n)
+	l.metrics.onReceived(n)
+	conn.packetsReceived++
+	conn.ecnRcv.add(ecn)
 
 	var p *PayloadHeader
-	if len(payload) == 0 && msgType == InitSnd { //InitSnd is the only message without any payload
+	var data []byte
+	if msgType == InitSnd { //InitSnd is the only message without any payload
 		p = &PayloadHeader{}
 		data = []byte{}
 	} else {
-		p, data, err = DecodePayload(payload)
+		p, data, err = DecodePayload(m.PayloadRaw)
 		if err != nil {
 			slog.Info("error in decoding payload from new connection", slog.Any("error", err))
-			return nil, err
+			conn.onDrop(dropReason(err))
+			return nil, &DecodeError{MsgType: msgType, Err: err}
 		}
 	}
 
+	conn.decodeConnId(p)
+	if msgType == Data {
+		conn.decodePath(p, remoteAddr, nowNano)
+	}
+
 	s, err = conn.decode(p, data, n, nowNano)
 	if err != nil {
 		return nil, err
 	}
+	conn.onReceived()
 
 	//Set state
 	if !conn.isHandshakeDoneOnRcv {
 		if conn.isSenderOnInit {
 			if msgType == InitRcv || msgType == InitCryptoRcv {
-				conn.isHandshakeDoneOnRcv = true
+				conn.onHandshakeDone(nowNano)
 			}
 		} else {
 			if msgType == Data {
-				conn.isHandshakeDoneOnRcv = true
+				conn.onHandshakeDone(nowNano)
 			}
 		}
+	} else if conn.state == connRotating {
+		conn.state = connEstablished
 	}
 
 	return s, nil
 }
 
-// Flush sends pending data for all connections using round-robin
+// Flush sends pending data for all connections, handshake replies first, see flushOrder. The streams of a
+// connection are ordered by the weighted scheduler, see Conn.scheduleStreams. Up to batchSize connections
+// send a data packet, see WithBatchSize. Nothing is sent once the context of WithContext is done.
+//
+// It returns the nanoseconds until it should be called again: 0 if a data packet was sent and more may follow
+// right away, the pacing of the next packet, or MinDeadLine if nothing waits. Call it again then, after Listen
+// returned, or after a Write, see FlushWithResult and NextFlushTime for an event loop.
 func (l *Listener) Flush(nowNano uint64) (minPacing uint64) {
+	if l.ctxErr() != nil {
+		minPacing = MinDeadLine
+	} else {
+		minPacing = l.flush(nowNano)
+	}
+	l.nextFlushNano.Store(nowNano + minPacing)
+	return minPacing
+}
+
+// FlushResult is the result of FlushWithResult
+type FlushResult struct {
+	IsSent bool          // at least one packet was sent
+	Wait   time.Duration // until the next Flush, see Flush
+}
+
+// FlushWithResult is Flush for an event loop, e.g., with epoll or select: arm a timer with Wait and flush again
+// once it fires, a packet arrived, or the application wrote
+func (l *Listener) FlushWithResult(nowNano uint64) FlushResult {
+	packetsSent := l.packetsSent.Load()
+	waitNano := l.Flush(nowNano)
+	return FlushResult{IsSent: l.packetsSent.Load() > packetsSent, Wait: time.Duration(waitNano)}
+}
+
+// NextFlushTime is when the last Flush wants to be called again, on the clock of the listener, see WithClock.
+// It is the zero time before the first Flush.
+func (l *Listener) NextFlushTime() time.Time {
+	nextNano := l.nextFlushNano.Load()
+	if nextNano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(nextNano))
+}
 
+func (l *Listener) flush(nowNano uint64) (minPacing uint64) {
 	minPacing = MinDeadLine
+	l.drainConns()
 	if l.connMap.Size() == 0 {
 		//if we do not have at least one connection, exit
 		return minPacing
 	}
 
-	closeConn := []*Conn{}
-	closeStream := map[*Conn]uint32{}
+	if b, ok := l.localConn.(batchConn); ok {
+		b.beginBatch()
+		defer func() {
+			if err := b.endBatch(); err != nil {
+				slog.Info("batch not fully sent", l.debug(), slog.Any("err", err))
+			}
+		}()
+	}
 
-	iter := NestedIterator(l.connMap, func(conn *Conn) *LinkedMap[uint32, *Stream] {
-		return conn.streams
-	}, l.currentConnID, l.currentStreamID)
+	for _, conn := range l.connMap.Iterator(nil) {
+		conn.sampleRates(nowNano)
+	}
 
-	for conn, stream := range iter {
-		dataSent, pacingNano, err := conn.Flush(stream, nowNano)
-		if err != nil {
-			slog.Info("closing connection, err", conn.debug(), slog.Any("err", err))
-			closeConn = append(closeConn, conn)
-			break
-		}
+	closeConn := map[*Conn]error{}
+	closeStream := map[*Conn]uint32{}
+	nrSent := 0
+
+flush:
+	for _, conn := range l.flushOrder() {
+		for _, stream := range conn.scheduleStreams() {
+			dataSent, pacingNano, err := conn.Flush(stream, nowNano)
+			if err != nil {
+				slog.Info("closing connection, err", conn.debug(), slog.Any("err", err))
+				closeConn[conn] = err
+				break flush
+			}
 
-		if stream.closedAtNano != 0 {
-			if conn.isSenderOnInit {
-				// stream closed on sender, mark for cleaning up, do not clean up yet, otherwise the iterator will become
-				// much more complex
-				closeStream[conn] = stream.streamID
-				continue
-			} else {
-				// stream closed on receiver, wait for 30sec timeout before cleanup
-				if stream.closedAtNano+ReadDeadLine > nowNano {
+			if closedAtNano := stream.closedAtNano.Load(); closedAtNano != 0 {
+				if conn.isSenderOnInit {
+					// stream closed on sender, mark for cleaning up, do not clean up yet, otherwise the iterator will become
+					// much more complex
 					closeStream[conn] = stream.streamID
 					continue
+				} else {
+					// stream closed on receiver, wait for 30sec timeout before cleanup
+					if closedAtNano+ReadDeadLine > nowNano {
+						closeStream[conn] = stream.streamID
+						continue
+					}
 				}
 			}
-		}
 
-		if dataSent > 0 {
-			// data sent, returning early
-			minPacing = 0
-			l.currentConnID = &conn.connId
-			l.currentStreamID = &stream.streamID
-			break
-		}
+			if dataSent > 0 {
+				// data sent, continue with the next connection until the batch is full, the pacing of this
+				// connection applies to its next packet
+				conn.onStreamSent(stream, dataSent)
+				minPacing = 0
+				l.currentConnID = &conn.connId
+				nrSent++
+				if nrSent >= l.batchSize {
+					break flush
+				}
+				continue flush
+			}
 
-		//no data sent, check if we reached the timeout for the activity
-		if conn.lastReadTimeNano != 0 && nowNano > conn.lastReadTimeNano+ReadDeadLine {
-			slog.Info("close connection, timeout", conn.debug(), slog.Uint64("now", nowNano),
-				slog.Uint64("last", conn.lastReadTimeNano))
-			closeConn = append(closeConn, conn)
-			break
-		}
+			//no data sent, check if we reached the timeout for the activity
+			if conn.lastReadTimeNano != 0 && nowNano > conn.lastReadTimeNano+ReadDeadLine {
+				slog.Info("close connection, timeout", conn.debug(), slog.Uint64("now", nowNano),
+					slog.Uint64("last", conn.lastReadTimeNano))
+				closeConn[conn] = errIdleTimeout
+				break flush
+			}
 
-		if pacingNano < minPacing {
-			minPacing = pacingNano
+			if pacingNano < minPacing {
+				minPacing = pacingNano
+			}
 		}
 	}
 
-	for _, closeConn := range closeConn {
-		closeConn.cleanupConn()
+	for closeConn, reason := range closeConn {
+		closeConn.cleanupConn(reason, nowNano)
 	}
 
 	for conn, stream := range closeStream {
 		conn.cleanupStream(stream)
 	}
 	l.currentConnID = nil
-	l.currentStreamID = nil
 	return minPacing
 }
 
+// flushOrder returns the connections in the order they are flushed. Connections that owe the peer a
+// handshake reply go first, so that a new connection does not wait behind the data of existing ones.
+func (l *Listener) flushOrder() []*Conn {
+	conns := make([]*Conn, 0, l.connMap.Size())
+	for _, conn := range l.connMap.Iterator(l.currentConnID) {
+		if conn.isHandshakeReplyPending() {
+			conns = append(conns, conn)
+		}
+	}
+	for _, conn := range l.connMap.Iterator(l.currentConnID) {
+		if !conn.isHandshakeReplyPending() {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
 func (l *Listener) newConn(
 	connId uint64,
 	remoteAddr netip.AddrPort,
@@ -391,30 +1598,81 @@ func (l *Listener) newConn(
 		snd:                NewSendBuffer(sndBufferCapacity),
 		rcv:                NewReceiveBuffer(rcvBufferCapacity),
 		Measurements:       NewMeasurements(),
+		loss:               NewLossRecovery(l.maxRto()),
 		rcvWndSize:         rcvBufferCapacity, //initially our capacity, correct value will be sent to us when we need it
+		pmtuSearchHigh:     l.maxPmtu(),
+		paddingMode:        l.paddingMode,
+		paddingBlock:       l.paddingBlock,
+		acceptCh:           make(chan *Stream, acceptQueueSize),
 	}
-
-	// Derive and log the shared secret for decryption in Wireshark
-	if l.keyLogWriter != nil {
-		sharedSecret, err := conn.prvKeyEpSnd.ECDH(conn.pubKeyEpRcv)
-		if err != nil {
-			return nil, err
-		}
-		sharedSecretId, err := conn.prvKeyEpSnd.ECDH(conn.pubKeyIdRcv)
+	if l.streamRcvWnd > 0 {
+		conn.rcv.streamCapacity = l.streamRcvWnd
+	}
+	conn.rcv.reassemblyLimit = l.reassemblyLimit
+	conn.snd.streamCapacity = l.streamSndBuf
+	conn.snd.coalesceDelayNano = l.coalesceDelayNano
+	conn.snd.isImmediateFirstWrite = l.isImmediateFirstWrite
+	if isSender && l.isNonceXorIV {
+		conn.nonceScheme = nonceXorIV // offered, the reply tells if the peer accepts it
+	}
+	if isSender {
+		conn.cipherSuite = l.cipherSuite // offered as well
+	}
+	// the key of InitCryptoSnd, the shared secret is logged once it is known, see setSharedSecret
+	if l.keyLogWriter != nil && isSender && withCrypto && pubKeyIdRcv != nil {
+		sharedSecretId, err := sharedSecretECDH(prvKeyEpSnd, pubKeyIdRcv)
 		if err != nil {
 			return nil, err
 		}
-		logKey(l.keyLogWriter, conn.connId, sharedSecret, sharedSecretId)
+		l.logKey(keyLogSharedSecretId, connId, sharedSecretId)
+		zeroize(sharedSecretId)
 	}
 
 	l.connMap.Put(connId, conn)
+	if l.isIssuedConnIds {
+		if err := conn.issueConnId(false); err != nil {
+			l.connMap.Remove(connId)
+			return nil, err
+		}
+	}
+	// after the last step that can fail, cleanupConn ends the span, the gauge, and the context
+	conn.ctx, conn.cancelCtx = context.WithCancel(l.context())
+	conn.traceConnStart()
+	l.metrics.onConnOpen()
+	if !isSender {
+		l.onConnAccepted(conn)
+	}
 	return conn, nil
 }
 
 func (l *Listener) Loop(callback func(s *Stream) (bool, error)) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.isLooping = true
+	l.mu.Unlock()
+	defer l.endLoop()
+
 	waitNextNano := MinDeadLine
 	for {
-		s, err := l.Listen(waitNextNano, uint64(time.Now().UnixNano()))
+		s, err := l.Listen(waitNextNano, l.nowNano())
+		if err != nil && l.isClosing() {
+			break
+		}
+		if err != nil && l.ctxErr() != nil {
+			if err := l.closeOnDone(); err != nil {
+				slog.Error("Error in loop close", slog.Any("error", err))
+			}
+			break
+		}
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			// a packet was dropped, the other packets are not affected
+			slog.Debug("packet dropped in loop", slog.Any("error", err))
+			s, err = nil, nil
+		}
 		if err != nil {
 			slog.Error("Error in loop listen", slog.Any("error", err))
 			break
@@ -426,7 +1684,7 @@ func (l *Listener) Loop(callback func(s *Stream) (bool, error)) {
 			slog.Error("Error in loop callback", slog.Any("error", err))
 			break
 		}
-		waitNextNano = l.Flush(uint64(time.Now().UnixNano()))
+		waitNextNano = l.Flush(l.nowNano())
 
 		if !cont {
 			break
@@ -434,6 +1692,17 @@ func (l *Listener) Loop(callback func(s *Stream) (bool, error)) {
 	}
 }
 
+// endLoop closes the connections if the listener was closed while the Loop ran
+func (l *Listener) endLoop() {
+	l.mu.Lock()
+	l.isLooping = false
+	isClosed := l.closed
+	l.mu.Unlock()
+	if isClosed {
+		l.closeConns()
+	}
+}
+
 func (l *Listener) debug() slog.Attr {
 	if l.localConn == nil {
 		return slog.String("net", "n/a")
@@ -442,26 +1711,21 @@ func (l *Listener) debug() slog.Attr {
 }
 
 func (l *Listener) ForceClose(c *Conn) {
-	c.cleanupConn()
+	c.cleanupConn(errForceClosed, l.nowNano())
 }
 
-// logKey writes the session key to the key log in a format Wireshark can understand.
-// The format is `QOTP_SHARED_SECRET <connId_hex> <secret_hex>`.
-func logKey(w io.Writer, connId uint64, secret []byte, secretId []byte) {
-	line := fmt.Sprintf("QOTP_SHARED_SECRET %x %x\n", connId, secret)
-	_, err := w.Write([]byte(line))
+func (l *Listener) sendStatelessReset(connId uint64, remoteAddr netip.AddrPort, nowNano uint64) error {
+	encData, err := encryptStatelessReset(connId, l.statelessResetToken(connId))
 	if err != nil {
-		slog.Error("Failed to write to key log", "error", err)
-	}
-	line = fmt.Sprintf("QOTP_SHARED_SECRET_ID %x %x\n", connId, secretId)
-	_, err = w.Write([]byte(line))
-	if err != nil {
-		slog.Error("Failed to write to key log", "error", err)
+		return err
 	}
+	slog.Debug("   Listen/StatelessReset", gId(), l.debug(), slog.Uint64("connId", connId))
+	return l.localConn.WriteToUDPAddrPort(encData, remoteAddr, nowNano)
 }
 
+// DialString resolves remoteAddrString, a host name or an address literal, with the family of our socket
 func (l *Listener) DialString(remoteAddrString string) (*Conn, error) {
-	remoteAddr, err := netip.ParseAddrPort(remoteAddrString)
+	remoteAddr, err := l.resolveAddr(remoteAddrString)
 	if err != nil {
 		return nil, err
 	}
@@ -469,8 +1733,9 @@ func (l *Listener) DialString(remoteAddrString string) (*Conn, error) {
 	return l.Dial(remoteAddr)
 }
 
+// DialWithCryptoString resolves remoteAddrString like DialString
 func (l *Listener) DialWithCryptoString(remoteAddrString string, pubKeyIdRcvHex string) (*Conn, error) {
-	remoteAddr, err := netip.ParseAddrPort(remoteAddrString)
+	remoteAddr, err := l.resolveAddr(remoteAddrString)
 	if err != nil {
 		return nil, err
 	}
@@ -484,13 +1749,24 @@ func (l *Listener) DialWithCryptoString(remoteAddrString string, pubKeyIdRcvHex
 }
 
 func (l *Listener) DialWithCrypto(remoteAddr netip.AddrPort, pubKeyIdRcv *ecdh.PublicKey) (*Conn, error) {
+	if _, err := l.checkPinnedKey(remoteAddr, pubKeyIdRcv); err != nil {
+		return nil, err
+	}
+
 	prvKeyEp, err := generateKey()
 	if err != nil {
 		return nil, err
 	}
 
 	connId := Uint64(prvKeyEp.PublicKey().Bytes())
-	return l.newConn(connId, remoteAddr, prvKeyEp, pubKeyIdRcv, nil, true, true)
+	conn, err := l.newConn(connId, remoteAddr, prvKeyEp, pubKeyIdRcv, nil, true, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.appProtos) > 0 {
+		conn.appProto = l.appProtos[0]
+	}
+	return conn, nil
 }
 
 func (l *Listener) Dial(remoteAddr netip.AddrPort) (*Conn, error) {
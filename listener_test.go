@@ -1,10 +1,19 @@
 package qotp
 
 import (
+	"bytes"
 	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -40,6 +49,60 @@ func TestListenerNewListener(t *testing.T) {
 	}
 }
 
+func TestListenerMaxConcurrentStreams(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	defer connPair.Conn1.Close()
+
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithMaxConcurrentStreams(4))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), listener.maxStreams)
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithMaxConcurrentStreams(4), WithMaxConcurrentStreams(8))
+	assert.Error(t, err)
+}
+
+func TestListenerStreamRcvWindow(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	defer connPair.Conn1.Close()
+
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultStreamRcvWindow, listener.streamRcvWnd)
+
+	listener, err = Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithStreamRcvWindow(64*1024))
+	assert.Nil(t, err)
+	conn, err := listener.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+	assert.Nil(t, err)
+	assert.Equal(t, 64*1024, conn.rcv.streamCapacity)
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithStreamRcvWindow(0))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithStreamRcvWindow(rcvBufferCapacity+1))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithStreamRcvWindow(1024), WithStreamRcvWindow(2048))
+	assert.Error(t, err)
+}
+
+func TestListenerMaxAckDelay(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	defer connPair.Conn1.Close()
+
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	assert.Nil(t, err)
+	assert.Zero(t, listener.maxAckDelayNano)
+
+	listener, err = Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithMaxAckDelay(25*time.Millisecond))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(25*msNano), listener.maxAckDelayNano)
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithMaxAckDelay(0))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithMaxAckDelay(time.Second))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithMaxAckDelay(time.Millisecond), WithMaxAckDelay(time.Millisecond))
+	assert.Error(t, err)
+}
+
 func TestListenerNewStream(t *testing.T) {
 	// Test case 1: Create a new multi-stream with a valid remote address
 	listener, err := Listen(WithListenAddr("127.0.0.1:9080"), WithSeed(testPrvSeed1))
@@ -458,10 +521,12 @@ func TestListenerStreamWithExtremeConditions(t *testing.T) {
 	// Test with very small MTU-sized chunks and high loss
 	maxRetry=20
 	ReadDeadLine = uint64(300 * secondNano)
+	defaultHandshakeMaxTimeout = uint64(300 * secondNano)
 	
 	defer func(){
 		maxRetry=5
 		ReadDeadLine = uint64(30 * secondNano)
+		defaultHandshakeMaxTimeout = uint64(10 * secondNano)
 	}()
 	
 	runDataTransferTest(t, 2*1024, 2000, // Small data, many iterations
@@ -475,4 +540,1250 @@ func TestListenerStreamWithExtremeConditions(t *testing.T) {
 		},
 		100*msNano,
 		"Extreme Conditions")
-}
\ No newline at end of file
+}
+func TestListenerStatelessReset(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.isStatelessReset = true // as with WithStatelessReset(true)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.NotNil(t, connA.resetToken)
+
+	// Receiver restarts and forgets the connection
+	listenerB.connMap.Remove(connA.connId)
+
+	_, err := streamA.Write([]byte("anyone there?"))
+	assert.NoError(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + 100*msNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+
+	// Unknown connection, reply with a stateless reset that looks like a short Data packet
+	for i := 0; i < 100 && connPair.nrOutgoingPacketsReceiver() == 0; i++ {
+		_, _ = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	}
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+	reset := connPair.Conn2.writeQueue[0].data
+	assert.Equal(t, ResetPacketSize, len(reset))
+	assert.True(t, isHeaderProtected(reset[0]))
+	assert.Equal(t, connA.connId, Uint64(reset[HeaderSize:]))
+
+	_, err = connPair.recipientToSenderAll()
+	assert.NoError(t, err)
+	for i := 0; i < 100 && connA.listener.connMap.Size() > 0; i++ {
+		_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.NoError(t, err)
+	}
+
+	// Sender tears down the connection immediately
+	assert.Equal(t, 0, connA.listener.connMap.Size())
+	_, err = streamA.Write([]byte("hallo"))
+	assert.ErrorIs(t, err, ErrConnectionReset)
+	_, err = streamA.Read()
+	assert.ErrorIs(t, err, ErrConnectionReset)
+}
+
+func TestListenerStatelessResetOption(t *testing.T) {
+	_, err := Listen(WithStatelessReset(false), WithStatelessReset(true))
+	assert.Error(t, err)
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"), WithStatelessReset(true))
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	assert.True(t, listener.isStatelessReset)
+
+	// the default drops the Data packets of unknown connections
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.False(t, listenerB.isStatelessReset)
+	listenerB.connMap.Remove(connA.connId)
+
+	// the Data packet of the unknown connection is dropped without a reply
+	_, err = streamA.Write([]byte("anyone there?"))
+	assert.NoError(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + 100*msNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	for connPair.nrIncomingPacketsRecipient() > 0 {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.ErrorIs(t, err, errConnNotFound)
+	}
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+	assert.Equal(t, 1, connA.listener.connMap.Size())
+}
+
+func TestListenerStatelessResetNotForSmallPackets(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))
+	assert.NoError(t, err)
+
+	// A reset itself must not trigger another reset
+	encData, err := encryptStatelessReset(1234, resetToken(testPrvKey1, 1234))
+	assert.NoError(t, err)
+	_, _, _, err = listenerB.decode(encData, netip.AddrPort{}, 0)
+	assert.Error(t, err)
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+}
+
+func TestListenerConnectionSummaryLog(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	var buf bytes.Buffer
+	connA.listener.summaryLogger = slog.New(slog.NewTextHandler(&buf, nil))
+
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	_, err := streamA.Write([]byte("hallo"))
+	assert.NoError(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+
+	connA.listener.ForceClose(connA)
+	connA.listener.ForceClose(connA)
+	assert.Nil(t, connA.listener.Close())
+
+	line := buf.String()
+	assert.Equal(t, 1, strings.Count(line, "connection summary"))
+	assert.Contains(t, line, fmt.Sprintf("connId=%016x", connA.connId))
+	assert.Contains(t, line, "peerKey="+fingerprint(testPrvKey2.PublicKey()))
+	assert.Contains(t, line, fmt.Sprintf("bytesOut=%d", connA.bytesSent))
+	assert.Contains(t, line, fmt.Sprintf("bytesIn=%d", connA.bytesReceived))
+	assert.Contains(t, line, "retransmits=0")
+	assert.Contains(t, line, "duration=")
+	assert.Contains(t, line, `reason="force closed"`)
+	assert.NotZero(t, connA.bytesSent)
+	assert.NotZero(t, connA.bytesReceived)
+}
+
+func TestListenerConnectionSummaryLogOption(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	defer connPair.Conn1.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithConnectionSummaryLog(logger))
+	assert.Nil(t, err)
+	assert.Equal(t, logger, listener.summaryLogger)
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithConnectionSummaryLog(logger), WithConnectionSummaryLog(logger))
+	assert.Error(t, err)
+}
+
+func TestListenerMaxRTO(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	defer connPair.Conn1.Close()
+
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	assert.Nil(t, err)
+	assert.Equal(t, maxRTO, listener.maxRto())
+
+	listener, err = Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithMaxRTO(5*time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5*secondNano), listener.maxRto())
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithMaxRTO(time.Millisecond))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithMaxRTO(time.Second), WithMaxRTO(time.Second))
+	assert.Error(t, err)
+}
+
+func TestListenerAcceptFilter(t *testing.T) {
+	allowed := testPrvKey1.PublicKey()
+	var seen []*ecdh.PublicKey
+	filter := func(remotePub *ecdh.PublicKey, addr netip.AddrPort) error {
+		seen = append(seen, remotePub)
+		if !remotePub.Equal(allowed) {
+			return errors.New("unknown identity")
+		}
+		return nil
+	}
+
+	dial := func(prvKeyId *ecdh.PrivateKey) (listenerB *Listener, connPair *ConnPair) {
+		connPair = NewConnPair("alice", "bob")
+		t.Cleanup(func() {
+			connPair.Conn1.Close()
+			connPair.Conn2.Close()
+		})
+		listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(prvKeyId))
+		assert.NoError(t, err)
+		listenerB, err = Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2), WithAcceptFilter(filter))
+		assert.NoError(t, err)
+		connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+		assert.NoError(t, err)
+
+		_, err = connA.Stream(0).Write([]byte("hallo"))
+		assert.NoError(t, err)
+		listenerA.Flush(connPair.Conn1.localTime)
+		_, err = connPair.senderToRecipientAll()
+		assert.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.NoError(t, err)
+		}
+		listenerB.Flush(connPair.Conn2.localTime)
+		return listenerB, connPair
+	}
+
+	// rejected: no state and no reply
+	otherSeed := [32]byte{3}
+	otherPrvKey, err := ecdh.X25519().NewPrivateKey(otherSeed[:])
+	assert.NoError(t, err)
+	listenerB, connPair := dial(otherPrvKey)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+
+	// accepted
+	listenerB, connPair = dial(testPrvKey1)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+
+	assert.Len(t, seen, 2)
+	assert.True(t, seen[0].Equal(otherPrvKey.PublicKey()))
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithAcceptFilter(filter), WithAcceptFilter(filter))
+	assert.Error(t, err)
+}
+
+func TestListenerPublicKeyAllowList(t *testing.T) {
+	otherSeed, rejectedSeed := [32]byte{3}, [32]byte{3, 4}
+	otherPrvKey, err := ecdh.X25519().NewPrivateKey(otherSeed[:])
+	assert.NoError(t, err)
+	rejectedPrvKey, err := ecdh.X25519().NewPrivateKey(rejectedSeed[:])
+	assert.NoError(t, err)
+
+	dial := func(prvKeyId *ecdh.PrivateKey) (listenerB *Listener, connPair *ConnPair) {
+		connPair = NewConnPair("alice", "bob")
+		t.Cleanup(func() {
+			connPair.Conn1.Close()
+			connPair.Conn2.Close()
+		})
+		listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(prvKeyId))
+		assert.NoError(t, err)
+		listenerB, err = Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2),
+			WithPublicKeyAllowList([]*ecdh.PublicKey{otherPrvKey.PublicKey(), testPrvKey1.PublicKey()}))
+		assert.NoError(t, err)
+		connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+		assert.NoError(t, err)
+
+		_, err = connA.Stream(0).Write([]byte("hallo"))
+		assert.NoError(t, err)
+		listenerA.Flush(connPair.Conn1.localTime)
+		_, err = connPair.senderToRecipientAll()
+		assert.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.NoError(t, err)
+		}
+		listenerB.Flush(connPair.Conn2.localTime)
+		return listenerB, connPair
+	}
+
+	// the second key of the list is accepted
+	listenerB, connPair := dial(testPrvKey1)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+
+	// rejected: no state and no reply
+	listenerB, connPair = dial(rejectedPrvKey)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+
+	assert.True(t, isKeyAllowed([][]byte{{1, 2}, {3, 4}}, []byte{3, 4}))
+	assert.False(t, isKeyAllowed([][]byte{{1, 2}, {3, 4}}, []byte{3}))
+
+	_, err = Listen(WithPublicKeyAllowList(nil))
+	assert.Error(t, err)
+	_, err = Listen(WithPublicKeyAllowList([]*ecdh.PublicKey{nil}))
+	assert.Error(t, err)
+	_, err = Listen(WithPublicKeyFilter(nil))
+	assert.Error(t, err)
+	_, err = Listen(WithPublicKeyFilter(func(*ecdh.PublicKey) bool { return true }),
+		WithAcceptFilter(func(*ecdh.PublicKey, netip.AddrPort) error { return nil }))
+	assert.Error(t, err)
+}
+
+func TestListenerHandshakeReplyFirst(t *testing.T) {
+	connA1, listenerB, connPair := setupStreamTest(t)
+	streamA1, streamB1 := handshakeStreamTest(t, connA1, listenerB, connPair)
+
+	// the first Data packet completes the handshake on B
+	_, err := streamA1.Write([]byte("data"))
+	assert.NoError(t, err)
+	connA1.listener.Flush(connPair.Conn1.localTime + secondNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	connB1 := streamB1.conn
+	for i := 0; i < 10 && !connB1.isHandshakeDoneOnRcv; i++ {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.NoError(t, err)
+	}
+	assert.True(t, connB1.isHandshakeDoneOnRcv)
+
+	// B is busy with bulk data on the first connection
+	_, err = streamB1.Write(createTestData(100000))
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		listenerB.Flush(connPair.Conn2.localTime)
+		connPair.Conn2.localTime += 200 * msNano
+	}
+	assert.Greater(t, connPair.nrOutgoingPacketsReceiver(), 5)
+	assert.NoError(t, connPair.Conn2.dropData())
+
+	// a second connection starts its handshake
+	connA2, err := connA1.listener.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+	assert.NoError(t, err)
+	_, err = connA2.Stream(0).Write([]byte("hallo"))
+	assert.NoError(t, err)
+	for i := 0; i < 10 && !connA2.isInitSentOnSnd; i++ {
+		connA1.listener.Flush(connPair.Conn1.localTime)
+		connPair.Conn1.localTime += 10 * msNano
+	}
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	for i := 0; i < 10 && listenerB.connMap.Size() < 2; i++ {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, listenerB.connMap.Size())
+
+	// the reply goes out first, even though the first connection could send data
+	connB1.nextWriteTime = 0
+	listenerB.Flush(connPair.Conn2.localTime)
+	assert.GreaterOrEqual(t, connPair.nrOutgoingPacketsReceiver(), 1)
+	reply := connPair.Conn2.writeQueue[0].data
+	assert.Equal(t, InitCryptoRcv, CryptoMsgType(reply[0]>>5))
+	assert.Equal(t, connA2.connId, Uint64(reply[HeaderSize:]))
+
+	// the reply does not carry data, so the bulk data continues in the same flush
+	assert.Equal(t, 2, connPair.nrOutgoingPacketsReceiver())
+	assert.True(t, isHeaderProtected(connPair.Conn2.writeQueue[1].data[0]))
+}
+
+func TestListenerPathValidation(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := listenerB.connMap.Get(connA.connId)
+
+	var oldAddr, newAddr net.Addr
+	connB.OnMigration(func(o, n net.Addr) {
+		oldAddr, newAddr = o, n
+	})
+
+	// NAT rebinding of A, the data from the new address is still processed
+	rebound := netip.MustParseAddrPort("192.0.2.1:4242")
+	connPair.Conn1.srcAddr = rebound
+	_, err := streamA.Write([]byte("moved"))
+	assert.NoError(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	var streamB *Stream
+	for i := 0; i < 10 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.NoError(t, err)
+	}
+	b, err := streamB.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("moved"), b)
+	assert.Equal(t, netip.AddrPort{}, connB.RemoteAddr())
+
+	// B challenges the new address right away
+	listenerB.Flush(connPair.Conn2.localTime)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+	assert.Equal(t, rebound.String(), connPair.Conn2.writeQueue[0].remoteAddr)
+
+	// A echoes the nonce
+	_, err = connPair.recipientToSenderAll()
+	assert.NoError(t, err)
+	_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+	assert.NoError(t, err)
+	assert.True(t, connA.isPathResponsePending)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	assert.False(t, connA.isPathResponsePending)
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	for i := 0; i < 10 && newAddr == nil; i++ {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.NoError(t, err)
+	}
+
+	// the new path is validated, B sends there
+	assert.Equal(t, rebound, connB.RemoteAddr())
+	assert.Equal(t, rebound.String(), newAddr.String())
+	assert.NotNil(t, oldAddr)
+	assert.False(t, connB.isPathChallengePending)
+}
+
+func TestListenerPathHistory(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := listenerB.connMap.Get(connA.connId)
+
+	// before a migration, the history is the current address
+	history := connB.PathHistory()
+	assert.Len(t, history, 1)
+	assert.Equal(t, netip.AddrPort{}, history[0].Addr)
+	assert.True(t, history[0].End.IsZero())
+
+	// A moves, B validates the new address
+	rebound := netip.MustParseAddrPort("192.0.2.1:4242")
+	connPair.Conn1.srcAddr = rebound
+	_, err := streamA.Write([]byte("moved"))
+	assert.NoError(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	for connPair.nrIncomingPacketsRecipient() > 0 {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.NoError(t, err)
+	}
+	listenerB.Flush(connPair.Conn2.localTime)
+	_, err = connPair.recipientToSenderAll()
+	assert.NoError(t, err)
+	_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+	assert.NoError(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	migratedNano := connPair.Conn2.localTime + secondNano
+	for connPair.nrIncomingPacketsRecipient() > 0 {
+		_, err = listenerB.Listen(MinDeadLine, migratedNano)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, rebound, connB.RemoteAddr())
+
+	// both addresses, the old one ended when the new one started
+	history = connB.PathHistory()
+	assert.Len(t, history, 2)
+	assert.Equal(t, netip.AddrPort{}, history[0].Addr)
+	assert.Equal(t, rebound, history[1].Addr)
+	assert.Equal(t, time.Unix(0, int64(migratedNano)), history[0].End)
+	assert.Equal(t, history[0].End, history[1].Start)
+	assert.True(t, history[0].Start.Before(history[0].End))
+	assert.True(t, history[1].End.IsZero())
+
+	// the history is a copy
+	history[0].Addr = rebound
+	assert.Equal(t, netip.AddrPort{}, connB.PathHistory()[0].Addr)
+}
+
+func TestListenerPathValidationTimeout(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := listenerB.connMap.Get(connA.connId)
+	listenerB.pathTimeoutNano = uint64(time.Second)
+
+	connPair.Conn1.srcAddr = netip.MustParseAddrPort("192.0.2.1:4242")
+	_, err := streamA.Write([]byte("moved"))
+	assert.NoError(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	for i := 0; i < 10 && !connB.isPathChallengePending; i++ {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.NoError(t, err)
+	}
+	assert.True(t, connB.isPathChallengePending)
+
+	// the challenge is lost and sent again after the RTO
+	listenerB.Flush(connPair.Conn2.localTime)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+	assert.NoError(t, connPair.dropReceiver())
+	connPair.Conn2.localTime += connB.rtoNano()
+	listenerB.Flush(connPair.Conn2.localTime)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+	assert.NoError(t, connPair.dropReceiver())
+
+	// no response within the timeout, B stays on the old address
+	connPair.Conn2.localTime += uint64(time.Second)
+	listenerB.Flush(connPair.Conn2.localTime)
+	assert.False(t, connB.isPathChallengePending)
+	assert.Equal(t, netip.AddrPort{}, connB.RemoteAddr())
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithPathValidationTimeout(0))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithPathValidationTimeout(time.Second),
+		WithPathValidationTimeout(time.Second))
+	assert.Error(t, err)
+}
+
+func TestListenerBatchSize(t *testing.T) {
+	connA1, _, connPair := setupStreamTest(t)
+	listenerA := connA1.listener
+	connA2, err := listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+	assert.NoError(t, err)
+	_, err = connA1.Stream(0).Write(createTestData(5000))
+	assert.NoError(t, err)
+	_, err = connA2.Stream(0).Write(createTestData(5000))
+	assert.NoError(t, err)
+
+	// by default, one packet per flush, with a batch, the other connection sends in the same flush
+	assert.Equal(t, 1, listenerA.batchSize)
+	listenerA.batchSize = 2
+	listenerA.Flush(connPair.Conn1.localTime)
+	assert.Equal(t, 2, connPair.nrOutgoingPacketsSender())
+	assert.True(t, connA1.isInitSentOnSnd)
+	assert.True(t, connA2.isInitSentOnSnd)
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithBatchSize(0))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithBatchSize(maxBatchSize+1))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithBatchSize(8), WithBatchSize(8))
+	assert.Error(t, err)
+}
+
+func TestListenerKeyStore(t *testing.T) {
+	store := NewMemoryKeyStore()
+	otherSeed := [32]byte{3}
+	otherPrvKey, err := ecdh.X25519().NewPrivateKey(otherSeed[:])
+	assert.NoError(t, err)
+
+	// dial returns the connection once B replied
+	dial := func(prvKeyIdB *ecdh.PrivateKey) *Conn {
+		connPair := NewConnPair("alice", "bob")
+		t.Cleanup(func() {
+			connPair.Conn1.Close()
+			connPair.Conn2.Close()
+		})
+		listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithKeyStore(store))
+		assert.NoError(t, err)
+		listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(prvKeyIdB))
+		assert.NoError(t, err)
+		connA, err := listenerA.Dial(netip.AddrPort{})
+		assert.NoError(t, err)
+
+		_, err = connA.Stream(0).Write([]byte("hallo"))
+		assert.NoError(t, err)
+		listenerA.Flush(connPair.Conn1.localTime)
+		_, err = connPair.senderToRecipientAll()
+		assert.NoError(t, err)
+		for i := 0; i < 10 && listenerB.connMap.Size() == 0; i++ {
+			_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.NoError(t, err)
+		}
+		listenerB.Flush(connPair.Conn2.localTime)
+		_, err = connPair.recipientToSenderAll()
+		assert.NoError(t, err)
+		for i := 0; i < 10 && connA.pubKeyIdRcv == nil && connA.closeErr == nil; i++ {
+			_, err = listenerA.Listen(MinDeadLine, connPair.Conn1.localTime)
+			assert.NoError(t, err)
+		}
+		return connA
+	}
+
+	// trust on first use
+	connA := dial(testPrvKey2)
+	assert.NoError(t, connA.closeErr)
+	pinned, err := store.Get(netip.AddrPort{})
+	assert.NoError(t, err)
+	assert.True(t, pinned.Equal(testPrvKey2.PublicKey()))
+
+	// same key again
+	connA = dial(testPrvKey2)
+	assert.NoError(t, connA.closeErr)
+
+	// another key at the same address, the connection is closed and the key stays pinned
+	connA = dial(otherPrvKey)
+	assert.ErrorIs(t, connA.closeErr, ErrKeyMismatch)
+	var mismatch *KeyMismatchError
+	assert.ErrorAs(t, connA.closeErr, &mismatch)
+	assert.Equal(t, fingerprint(testPrvKey2.PublicKey()), mismatch.KnownFingerprint)
+	assert.Equal(t, fingerprint(otherPrvKey.PublicKey()), mismatch.PresentedFingerprint)
+	assert.Contains(t, connA.closeErr.Error(), mismatch.KnownFingerprint)
+	assert.Contains(t, connA.closeErr.Error(), mismatch.PresentedFingerprint)
+	assert.Equal(t, 0, connA.listener.connMap.Size())
+	pinned, err = store.Get(netip.AddrPort{})
+	assert.NoError(t, err)
+	assert.True(t, pinned.Equal(testPrvKey2.PublicKey()))
+
+	// dialing with another key fails right away
+	_, err = connA.listener.DialWithCrypto(netip.AddrPort{}, otherPrvKey.PublicKey())
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	_, err = Listen(WithNetworkConn(NewConnPair("a", "b").Conn1), WithKeyStore(store), WithKeyStore(store))
+	assert.Error(t, err)
+}
+
+func TestListenerEd25519Identity(t *testing.T) {
+	pubKeyEd, prvKeyEd, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	// dial returns the stream B received, or nil
+	dial := func(options ...ListenFunc) (*Listener, *Stream) {
+		connPair := NewConnPair("alice", "bob")
+		t.Cleanup(func() {
+			connPair.Conn1.Close()
+			connPair.Conn2.Close()
+		})
+		listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1),
+			WithEd25519Identity(prvKeyEd))
+		assert.NoError(t, err)
+		listenerB, err := Listen(append(options, WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))...)
+		assert.NoError(t, err)
+		connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+		assert.NoError(t, err)
+		assert.Equal(t, InitSignedSnd, connA.msgType())
+
+		_, err = connA.Stream(0).Write([]byte("hallo"))
+		assert.NoError(t, err)
+		listenerA.Flush(connPair.Conn1.localTime)
+		_, err = connPair.senderToRecipientAll()
+		assert.NoError(t, err)
+		var s *Stream
+		for i := 0; i < 10 && s == nil; i++ {
+			s, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.NoError(t, err)
+		}
+		return listenerB, s
+	}
+
+	// the early data arrives, the peer is known by its Ed25519 key
+	listenerB, streamB := dial()
+	assert.NotNil(t, streamB)
+	data, err := streamB.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hallo"), data)
+	assert.Equal(t, pubKeyEd, streamB.conn.PeerEd25519Key())
+	assert.Nil(t, streamB.conn.pubKeyIdRcv)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+
+	// the X25519 accept filter cannot check the key
+	listenerB, _ = dial(WithAcceptFilter(func(*ecdh.PublicKey, netip.AddrPort) error { return nil }))
+	assert.Equal(t, 0, listenerB.connMap.Size())
+
+	var seen ed25519.PublicKey
+	listenerB, streamB = dial(WithEd25519AcceptFilter(func(remotePub ed25519.PublicKey, _ netip.AddrPort) error {
+		seen = remotePub
+		return errors.New("unknown identity")
+	}))
+	assert.Nil(t, streamB)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+	assert.Equal(t, pubKeyEd, seen)
+
+	_, err = Listen(WithEd25519Identity(prvKeyEd), WithEd25519Identity(prvKeyEd))
+	assert.Error(t, err)
+	_, err = Listen(WithEd25519Identity(nil))
+	assert.Error(t, err)
+}
+
+func TestListenerApplicationProtocols(t *testing.T) {
+	// dial returns the stream B received, or nil
+	dial := func(protosA []string, protosB []string, withCrypto bool) (*Conn, *Listener, *Stream, *ConnPair) {
+		connPair := NewConnPair("alice", "bob")
+		t.Cleanup(func() {
+			connPair.Conn1.Close()
+			connPair.Conn2.Close()
+		})
+		optionsA := []ListenFunc{WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1)}
+		if protosA != nil {
+			optionsA = append(optionsA, WithApplicationProtocols(protosA))
+		}
+		optionsB := []ListenFunc{WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2)}
+		if protosB != nil {
+			optionsB = append(optionsB, WithApplicationProtocols(protosB))
+		}
+		listenerA, err := Listen(optionsA...)
+		assert.NoError(t, err)
+		listenerB, err := Listen(optionsB...)
+		assert.NoError(t, err)
+
+		var connA *Conn
+		if withCrypto {
+			connA, err = listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+		} else {
+			connA, err = listenerA.Dial(netip.AddrPort{})
+		}
+		assert.NoError(t, err)
+
+		_, err = connA.Stream(0).Write([]byte("hallo"))
+		assert.NoError(t, err)
+		listenerA.Flush(connPair.Conn1.localTime)
+		_, err = connPair.senderToRecipientAll()
+		assert.NoError(t, err)
+		var s *Stream
+		for i := 0; i < 10 && s == nil; i++ {
+			s, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.NoError(t, err)
+		}
+		return connA, listenerB, s, connPair
+	}
+
+	// reply returns the reply of B to A
+	reply := func(connA *Conn, listenerB *Listener, connPair *ConnPair) {
+		listenerB.Flush(connPair.Conn2.localTime)
+		_, err := connPair.recipientToSenderAll()
+		assert.NoError(t, err)
+		for i := 0; i < 10 && !connA.isHandshakeDoneOnRcv && connA.closeErr == nil; i++ {
+			_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+			assert.NoError(t, err)
+		}
+	}
+
+	// the first protocol of A is offered and echoed
+	connA, listenerB, streamB, connPair := dial([]string{"h3", "h2"}, []string{"h2", "h3"}, true)
+	assert.NotNil(t, streamB)
+	assert.Equal(t, "h3", streamB.conn.NegotiatedProtocol())
+	assert.Equal(t, "", connA.NegotiatedProtocol())
+	reply(connA, listenerB, connPair)
+	assert.Equal(t, "h3", connA.NegotiatedProtocol())
+
+	// without a list, any protocol is accepted
+	connA, listenerB, streamB, connPair = dial([]string{"h3"}, nil, true)
+	assert.NotNil(t, streamB)
+	reply(connA, listenerB, connPair)
+	assert.Equal(t, "h3", connA.NegotiatedProtocol())
+
+	// not accepted: no state and no reply
+	_, listenerB, streamB, connPair = dial([]string{"h1"}, []string{"h3"}, true)
+	assert.Nil(t, streamB)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+
+	// without crypto, no protocol can be offered
+	_, listenerB, streamB, _ = dial([]string{"h3"}, []string{"h3"}, false)
+	assert.Nil(t, streamB)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+
+	// the reply carries another protocol than A offered
+	connA, listenerB, streamB, connPair = dial([]string{"h3"}, nil, true)
+	assert.NotNil(t, streamB)
+	streamB.conn.appProto = "h2"
+	reply(connA, listenerB, connPair)
+	assert.ErrorIs(t, connA.closeErr, ErrProtocolMismatch)
+	assert.Equal(t, 0, connA.listener.connMap.Size())
+
+	_, err := Listen(WithApplicationProtocols([]string{"h3"}), WithApplicationProtocols([]string{"h3"}))
+	assert.Error(t, err)
+	_, err = Listen(WithApplicationProtocols(nil))
+	assert.Error(t, err)
+	_, err = Listen(WithApplicationProtocols([]string{""}))
+	assert.Error(t, err)
+}
+
+func TestListenerNonceXorIV(t *testing.T) {
+	handshake := func(optionsA []ListenFunc, optionsB []ListenFunc) (streamA *Stream, streamB *Stream, connPair *ConnPair) {
+		connPair = NewConnPair("alice", "bob")
+		t.Cleanup(func() {
+			connPair.Conn1.Close()
+			connPair.Conn2.Close()
+		})
+		listenerA, err := Listen(append(optionsA, WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))...)
+		assert.NoError(t, err)
+		listenerB, err := Listen(append(optionsB, WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))...)
+		assert.NoError(t, err)
+		connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+		assert.NoError(t, err)
+		streamA, streamB = handshakeStreamTest(t, connA, listenerB, connPair)
+		return streamA, streamB, connPair
+	}
+
+	// a Data packet from A to B and back, B only sends Data once it received Data
+	exchange := func(streamA *Stream, streamB *Stream, connPair *ConnPair) {
+		send := func(from *Stream, fromNet *PairedConn, to *Stream, toNet *PairedConn, msg string) {
+			_, err := from.Write([]byte(msg))
+			assert.NoError(t, err)
+			from.conn.listener.Flush(fromNet.localTime + secondNano)
+			_, err = fromNet.copyData()
+			assert.NoError(t, err)
+			var data []byte
+			for i := 0; i < 10 && data == nil; i++ {
+				_, err = to.conn.listener.Listen(MinDeadLine, toNet.localTime)
+				assert.NoError(t, err)
+				data, err = to.Read()
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, []byte(msg), data)
+		}
+		send(streamA, connPair.Conn1, streamB, connPair.Conn2, "from a")
+		send(streamB, connPair.Conn2, streamA, connPair.Conn1, "from b")
+	}
+
+	// both opt in
+	streamA, streamB, connPair := handshake([]ListenFunc{WithNonceXorIV()}, []ListenFunc{WithNonceXorIV()})
+	assert.Equal(t, nonceXorIV, streamA.conn.nonceScheme)
+	assert.Equal(t, nonceXorIV, streamB.conn.nonceScheme)
+	assert.Equal(t, streamA.conn.ivSnd, streamB.conn.ivRcv)
+	assert.Equal(t, streamA.conn.ivRcv, streamB.conn.ivSnd)
+	exchange(streamA, streamB, connPair)
+
+	// only one side opts in, the split nonce is used
+	streamA, streamB, connPair = handshake([]ListenFunc{WithNonceXorIV()}, nil)
+	assert.Equal(t, nonceSplit, streamA.conn.nonceScheme)
+	assert.Equal(t, nonceSplit, streamB.conn.nonceScheme)
+	assert.Nil(t, streamA.conn.ivSnd)
+	exchange(streamA, streamB, connPair)
+
+	streamA, streamB, connPair = handshake(nil, []ListenFunc{WithNonceXorIV()})
+	assert.Equal(t, nonceSplit, streamA.conn.nonceScheme)
+	assert.Equal(t, nonceSplit, streamB.conn.nonceScheme)
+	exchange(streamA, streamB, connPair)
+
+	_, err := Listen(WithNonceXorIV(), WithNonceXorIV())
+	assert.Error(t, err)
+}
+
+func TestListenerCoalesceDelay(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	t.Cleanup(func() {
+		connPair.Conn1.Close()
+		connPair.Conn2.Close()
+	})
+
+	listener, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultCoalesceDelay, listener.coalesceDelayNano)
+
+	listener, err = Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1),
+		WithCoalesceDelay(5*time.Millisecond))
+	assert.NoError(t, err)
+	conn, err := listener.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5*msNano), conn.snd.coalesceDelayNano)
+
+	listener, err = Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithNagleDisabled())
+	assert.NoError(t, err)
+	assert.Zero(t, listener.coalesceDelayNano)
+
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithCoalesceDelay(0))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithCoalesceDelay(time.Millisecond), WithNagleDisabled())
+	assert.Error(t, err)
+
+	listener, err = Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithImmediateFirstWrite(true))
+	assert.NoError(t, err)
+	conn, err = listener.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+	assert.NoError(t, err)
+	assert.True(t, conn.snd.isImmediateFirstWrite)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithImmediateFirstWrite(true), WithImmediateFirstWrite(false))
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithImmediateFirstWrite(true), WithNagleDisabled())
+	assert.Error(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithImmediateFirstWrite(false), WithNagleDisabled())
+	assert.NoError(t, err)
+}
+
+func TestListenerHandshakeMtu(t *testing.T) {
+	for _, handshakeMtu := range []int{576, 1200, 1500} {
+		t.Run(fmt.Sprint(handshakeMtu), func(t *testing.T) {
+			connPair := NewConnPair("alice", "bob")
+			maxMtu := max(1400, handshakeMtu)
+			listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1),
+				WithHandshakeMTU(handshakeMtu), WithMaxMtu(maxMtu))
+			assert.Nil(t, err)
+			listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2),
+				WithHandshakeMTU(handshakeMtu), WithMaxMtu(maxMtu))
+			assert.Nil(t, err)
+			pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+			assert.Nil(t, err)
+			connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+			assert.Nil(t, err)
+
+			// the init is padded to the handshake MTU, the reply is not larger
+			_, err = connA.Stream(0).Write([]byte("hallo"))
+			assert.Nil(t, err)
+			listenerA.Flush(0)
+			assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+			assert.Len(t, connPair.Conn1.writeQueue[0].data, handshakeMtu)
+			_, err = connPair.senderToRecipientAll()
+			assert.Nil(t, err)
+			var streamB *Stream
+			for i := 0; i < 100 && streamB == nil; i++ {
+				streamB, err = listenerB.Listen(MinDeadLine, 0)
+				assert.Nil(t, err)
+			}
+			assert.NotNil(t, streamB)
+			b, err := streamB.Read()
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("hallo"), b)
+
+			_, err = streamB.Write(bytes.Repeat([]byte{'x'}, 2000))
+			assert.Nil(t, err)
+			listenerB.Flush(0)
+			assert.Equal(t, 1, connPair.nrOutgoingPacketsReceiver())
+			assert.LessOrEqual(t, len(connPair.Conn2.writeQueue[0].data), handshakeMtu)
+			_, err = connPair.recipientToSenderAll()
+			assert.Nil(t, err)
+			for i := 0; i < 100 && !connA.isHandshakeDoneOnRcv; i++ {
+				_, err = listenerA.Listen(MinDeadLine, 0)
+				assert.Nil(t, err)
+			}
+			assert.True(t, connA.isHandshakeDoneOnRcv)
+		})
+	}
+}
+
+func TestListenerHandshakeMtuMismatch(t *testing.T) {
+	// an init smaller than our handshake MTU is accepted
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithHandshakeMTU(576))
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+	_, err = connA.Stream(0).Write([]byte("hallo"))
+	assert.Nil(t, err)
+	listenerA.Flush(0)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	streamB, err := listenerB.Listen(MinDeadLine, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, streamB)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hallo"), b)
+
+	// the reply of B, with a handshake MTU of 1400, completes the handshake of A
+	listenerB.Flush(0)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && !connA.isHandshakeDoneOnRcv; i++ {
+		_, err = listenerA.Listen(MinDeadLine, 0)
+		assert.Nil(t, err)
+	}
+	assert.True(t, connA.isHandshakeDoneOnRcv)
+
+	// and the other way round, A with 576 accepts the InitSnd of 1400 bytes of B
+	connB, err := listenerB.Dial(netip.AddrPort{})
+	assert.Nil(t, err)
+	_, err = connB.Stream(0).Write([]byte("hallo"))
+	assert.Nil(t, err)
+	listenerB.Flush(0)
+	assert.Len(t, connPair.Conn2.writeQueue[0].data, 1400)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && connPair.nrIncomingPacketsSender() > 0; i++ {
+		_, err = listenerA.Listen(MinDeadLine, 0)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, listenerA.connMap.Size())
+}
+
+func TestListenerHandshakeMtuOption(t *testing.T) {
+	_, err := Listen(WithHandshakeMTU(576), WithHandshakeMTU(576))
+	assert.Error(t, err)
+	_, err = Listen(WithHandshakeMTU(MinInitCryptoSndSize))
+	assert.Error(t, err)
+	_, err = Listen(WithHandshakeMTU(1500))
+	assert.Error(t, err)
+
+	connPair := NewConnPair("alice", "bob")
+	l, err := Listen(WithNetworkConn(connPair.Conn1), WithMtu(1200))
+	assert.Nil(t, err)
+	assert.Equal(t, 1200, l.handshakeMtu)
+}
+
+func TestListenerMaxHandshakeSize(t *testing.T) {
+	for _, maxHandshakeSize := range []int{0, 1400} {
+		t.Run(fmt.Sprint(maxHandshakeSize), func(t *testing.T) {
+			connPair := NewConnPair("alice", "bob")
+			listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1),
+				WithHandshakeMTU(1500), WithMaxMtu(1500))
+			assert.Nil(t, err)
+			reg := newTestMetrics()
+			opts := []ListenFunc{WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2), WithMaxMtu(1500),
+				WithListenAddr("127.0.0.1:9002"), WithMetrics(reg)}
+			if maxHandshakeSize > 0 {
+				opts = append(opts, WithMaxHandshakeSize(maxHandshakeSize))
+			}
+			listenerB, err := Listen(opts...)
+			assert.Nil(t, err)
+			pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+			assert.Nil(t, err)
+			connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+			assert.Nil(t, err)
+			_, err = connA.Stream(0).Write([]byte("hallo"))
+			assert.Nil(t, err)
+			listenerA.Flush(0)
+			_, err = connPair.senderToRecipientAll()
+			assert.Nil(t, err)
+
+			var streamB *Stream
+			for i := 0; i < 10 && streamB == nil; i++ {
+				streamB, err = listenerB.Listen(MinDeadLine, 0)
+				assert.Nil(t, err)
+			}
+			if maxHandshakeSize > 0 {
+				// the init of 1500 bytes is dropped
+				assert.Nil(t, streamB)
+				assert.Zero(t, listenerB.connMap.Size())
+				v, _ := gatherMetric(t, reg, "qotp_packets_dropped_total", "127.0.0.1:9002", "reason",
+					dropOversizedInit)
+				assert.Equal(t, 1.0, v)
+			} else {
+				// the default is the max MTU of 1500
+				assert.NotNil(t, streamB)
+				v, _ := gatherMetric(t, reg, "qotp_packets_dropped_total", "127.0.0.1:9002", "reason",
+					dropOversizedInit)
+				assert.Zero(t, v)
+			}
+		})
+	}
+}
+
+func TestListenerMaxHandshakeSizeBeforeDecrypt(t *testing.T) {
+	// the size is checked before the ECDH and the decryption, garbage gets the size error
+	l := &Listener{prvKeyId: testPrvKey2, mtu: 1400, handshakeMtu: 1400, maxHandshakeSize: 1400,
+		connMap: NewLinkedMap[uint64, *Conn]()}
+	encData := make([]byte, 1500)
+	encData[0] = byte(InitCryptoSnd)<<5 | CryptoVersion
+	_, _, _, err := l.decode(encData, netip.AddrPort{}, 0)
+	assert.ErrorIs(t, err, errOversizedInit)
+	_, _, _, err = l.decode(encData[:1400], netip.AddrPort{}, 0)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errOversizedInit)
+}
+
+func TestListenerUnsupportedVersion(t *testing.T) {
+	// an init of a peer with the direction bit in the nonce, CryptoVersion 1, is dropped and counted
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	assert.Nil(t, err)
+	reg := newTestMetrics()
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2),
+		WithListenAddr("127.0.0.1:9002"), WithMetrics(reg))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+	_, err = connA.Stream(0).Write([]byte("hallo"))
+	assert.Nil(t, err)
+	listenerA.Flush(0)
+	encData := connPair.Conn1.writeQueue[0].data
+	encData[0] = encData[0]&^0x1f | 1
+
+	_, _, _, err = listenerB.decode(encData, netip.AddrPort{}, 0)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		s, err := listenerB.Listen(MinDeadLine, 0)
+		assert.Nil(t, err)
+		assert.Nil(t, s)
+	}
+	assert.Zero(t, listenerB.connMap.Size())
+	v, _ := gatherMetric(t, reg, "qotp_packets_dropped_total", "127.0.0.1:9002", "reason", dropVersion)
+	assert.Equal(t, 1.0, v)
+}
+
+func TestListenerDecodeError(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// a corrupted Data packet is dropped with a DecodeError, the connection continues
+	_, err := streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + secondNano)
+	data := connPair.Conn1.writeQueue[0].data
+	data[len(data)-1] ^= 0xff
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	}
+	var decodeErr *DecodeError
+	assert.ErrorAs(t, err, &decodeErr)
+	assert.Equal(t, Data, decodeErr.MsgType)
+	assert.ErrorIs(t, err, ErrDecrypt)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+
+	// an InitSnd too short for the offered parameters is not read past its end
+	encData := make([]byte, MinPacketSize+1)
+	encData[0] = byte(InitSnd)<<5 | CryptoVersion
+	_, _, _, err = listenerB.decode(encData, netip.AddrPort{}, 0)
+	assert.ErrorIs(t, err, ErrShortHeader)
+	_, _, _, err = listenerB.decode(encData[:MinPacketSize-1], netip.AddrPort{}, 0)
+	assert.ErrorIs(t, err, ErrShortHeader)
+
+	// an undefined message type is a DecodeError too, not a fatal error of Listen
+	encData[0] = 0b111<<5 | CryptoVersion
+	_, _, _, err = listenerB.decode(encData, netip.AddrPort{}, 0)
+	assert.ErrorIs(t, err, ErrUnknownMsgType)
+	assert.ErrorAs(t, newDecodeError(encData, err), &decodeErr)
+
+	// the drop reason tells a packet that does not authenticate from a truncated one
+	assert.Equal(t, dropAuth, dropReason(newDecodeError(encData, fmt.Errorf("%w: mac", ErrDecrypt))))
+	assert.Equal(t, dropAuth, dropReason(ErrBadSequenceNumber))
+	assert.Equal(t, dropShort, dropReason(ErrShortPayload))
+	assert.Equal(t, dropDecode, dropReason(ErrUnknownMsgType))
+
+	// errors that no packet caused are not wrapped
+	err = errors.New("socket closed")
+	assert.Same(t, err, newDecodeError(encData, err))
+}
+
+func TestListenerMaxHandshakeSizeOption(t *testing.T) {
+	_, err := Listen(WithMaxHandshakeSize(1400), WithMaxHandshakeSize(1400))
+	assert.Error(t, err)
+	_, err = Listen(WithMaxHandshakeSize(0))
+	assert.Error(t, err)
+	_, err = Listen(WithHandshakeMTU(1200), WithMaxHandshakeSize(1000))
+	assert.Error(t, err)
+	_, err = Listen(WithMaxHandshakeSize(1500))
+	assert.Error(t, err)
+
+	connPair := NewConnPair("alice", "bob")
+	l, err := Listen(WithNetworkConn(connPair.Conn1), WithMtu(1200))
+	assert.Nil(t, err)
+	assert.Equal(t, 1200, l.maxHandshakeSize)
+}
+
+// exchangeUDPTest sends a message from A to B and a reply back over real sockets
+func exchangeUDPTest(t *testing.T, listenerA *Listener, listenerB *Listener, connA *Conn) {
+	_, err := connA.Stream(0).Write([]byte("ping"))
+	assert.Nil(t, err)
+	var streamB *Stream
+	for i := 0; i < 50 && streamB == nil; i++ {
+		listenerA.Flush(uint64(time.Now().UnixNano()))
+		streamB, err = listenerB.Listen(100*msNano, uint64(time.Now().UnixNano()))
+		assert.Nil(t, err)
+	}
+	if !assert.NotNil(t, streamB) {
+		return
+	}
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ping"), b)
+
+	_, err = streamB.Write([]byte("pong"))
+	assert.Nil(t, err)
+	var received []byte
+	for i := 0; i < 50 && len(received) == 0; i++ {
+		listenerB.Flush(uint64(time.Now().UnixNano()))
+		_, err = listenerA.Listen(100*msNano, uint64(time.Now().UnixNano()))
+		assert.Nil(t, err)
+		received, err = connA.Stream(0).Read()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []byte("pong"), received)
+}
+
+func TestListenerIPv6(t *testing.T) {
+	listenerA, err := Listen(WithListenAddr("[::1]:0"), WithSeed(testPrvSeed1))
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer listenerA.Close()
+	listenerB, err := Listen(WithListenAddr("[::1]:0"), WithSeed(testPrvSeed2))
+	assert.Nil(t, err)
+	defer listenerB.Close()
+	assert.Equal(t, "udp6", listenerA.network)
+
+	connA, err := listenerA.DialWithCryptoString(listenerB.localConn.LocalAddrString(), hexPubKey2)
+	assert.Nil(t, err)
+	assert.True(t, connA.remoteAddr.Addr().Is6())
+	exchangeUDPTest(t, listenerA, listenerB, connA)
+}
+
+func TestListenerDualStack(t *testing.T) {
+	// B listens on the IPv6 wildcard address, A reaches it over IPv4
+	listenerB, err := Listen(WithListenAddr("[::]:0"), WithSeed(testPrvSeed2))
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer listenerB.Close()
+	assert.Equal(t, "udp", listenerB.network)
+	listenerA, err := Listen(WithListenAddr("127.0.0.1:0"), WithSeed(testPrvSeed1))
+	assert.Nil(t, err)
+	defer listenerA.Close()
+	assert.Equal(t, "udp4", listenerA.network)
+
+	_, port, err := net.SplitHostPort(listenerB.localConn.LocalAddrString())
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCryptoString(net.JoinHostPort("127.0.0.1", port), hexPubKey2)
+	assert.Nil(t, err)
+	exchangeUDPTest(t, listenerA, listenerB, connA)
+
+	// and B reaches A over IPv4 from its dual stack socket, with an address that is not mapped
+	_, port, err = net.SplitHostPort(listenerA.localConn.LocalAddrString())
+	assert.Nil(t, err)
+	connB, err := listenerB.DialWithCryptoString(net.JoinHostPort("127.0.0.1", port), hexPubKey1)
+	assert.Nil(t, err)
+	assert.True(t, connB.remoteAddr.Addr().Is4())
+	exchangeUDPTest(t, listenerB, listenerA, connB)
+}
+
+func TestListenerNetwork(t *testing.T) {
+	listener, err := Listen(WithNetwork("udp4"), WithListenAddr(":0"), WithSeed(testPrvSeed1))
+	assert.Nil(t, err)
+	defer listener.Close()
+	assert.Equal(t, "udp4", listener.network)
+	// an IPv6 address cannot be reached from an IPv4 socket
+	_, err = listener.DialString("[::1]:8080")
+	assert.Error(t, err)
+	_, err = listener.DialString(":8080")
+	assert.Error(t, err)
+
+	_, err = Listen(WithNetwork("udp4"), WithListenAddr("[::1]:0"))
+	assert.Error(t, err)
+	_, err = Listen(WithNetwork("tcp"))
+	assert.Error(t, err)
+	_, err = Listen(WithNetwork("udp"), WithNetwork("udp6"))
+	assert.Error(t, err)
+	_, err = Listen(WithListenAddr(""))
+	assert.Error(t, err)
+}
+
+func TestListenerDialDNS(t *testing.T) {
+	listener, err := Listen(WithNetwork("udp4"), WithListenAddr("127.0.0.1:0"), WithSeed(testPrvSeed1))
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	conn, err := listener.DialWithCryptoString("localhost:8080", hexPubKey2)
+	assert.Nil(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("127.0.0.1:8080"), conn.remoteAddr)
+
+	// a name that does not resolve is not a bad key, a bad key is not a resolve error
+	_, err = listener.DialWithCryptoString("nonexistent.invalid:8080", hexPubKey2)
+	assert.ErrorIs(t, err, ErrResolve)
+	_, err = listener.DialWithCryptoString("localhost:8080", "nokey")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrResolve)
+	_, err = listener.DialString("localhost")
+	assert.ErrorIs(t, err, ErrResolve)
+	_, err = listener.DialString("localhost:noport")
+	assert.ErrorIs(t, err, ErrResolve)
+}
+
+func TestFirstReachable(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.1")
+	v6 := netip.MustParseAddr("2001:db8::1")
+	mapped := netip.MustParseAddr("::ffff:192.0.2.1")
+	tests := []struct {
+		network string
+		ips     []netip.Addr
+		want    netip.Addr
+		ok      bool
+	}{
+		{"udp", []netip.Addr{v6, v4}, v6, true},
+		{"udp", []netip.Addr{v4, v6}, v4, true},
+		{"udp4", []netip.Addr{v6, v4}, v4, true},
+		{"udp4", []netip.Addr{mapped}, v4, true},
+		{"udp6", []netip.Addr{v4, v6}, v6, true},
+		{"udp6", []netip.Addr{v4}, netip.Addr{}, false},
+		{"udp", []netip.Addr{netip.IPv4Unspecified()}, netip.Addr{}, false},
+		{"udp", nil, netip.Addr{}, false},
+	}
+	for _, tt := range tests {
+		ip, ok := firstReachable(tt.network, tt.ips)
+		assert.Equal(t, tt.ok, ok, "%s %v", tt.network, tt.ips)
+		assert.Equal(t, tt.want, ip, "%s %v", tt.network, tt.ips)
+	}
+}
+
+func TestListenerFlushWithResult(t *testing.T) {
+	connA, _, connPair := setupStreamTest(t)
+	listenerA := connA.listener
+	assert.True(t, listenerA.NextFlushTime().IsZero())
+
+	_, err := connA.Stream(0).Write([]byte("hallo"))
+	assert.NoError(t, err)
+	nowNano := connPair.Conn1.localTime + secondNano
+	result := listenerA.FlushWithResult(nowNano)
+	assert.True(t, result.IsSent)
+	assert.Equal(t, time.Duration(0), result.Wait)
+	assert.Equal(t, time.Unix(0, int64(nowNano)), listenerA.NextFlushTime())
+
+	// nothing more to send, the next flush is due later
+	result = listenerA.FlushWithResult(nowNano)
+	assert.False(t, result.IsSent)
+	assert.Greater(t, result.Wait, time.Duration(0))
+	assert.Equal(t, time.Unix(0, int64(nowNano)).Add(result.Wait), listenerA.NextFlushTime())
+}
@@ -0,0 +1,210 @@
+package qotp
+
+const (
+	// ptoGranularity is the timer granularity of RFC 9002, the variance part of the PTO is never below it
+	ptoGranularity = uint64(1 * msNano)
+	// minTlp is the minimum tail loss probe timeout
+	minTlp = uint64(10 * msNano)
+	// dupAckThreshold is the number of acks of later packets of a stream after which its oldest packet in
+	// flight is sent again, like the three duplicate acks of TCP
+	dupAckThreshold = 3
+)
+
+type sentPacketKey struct {
+	streamID uint32
+	key      packetKey
+}
+
+type sentPacket struct {
+	sentTimeNano uint64
+	size         int
+}
+
+// fastRetransmit is the state of a stream whose oldest packet in flight is not acked, but later ones are
+type fastRetransmit struct {
+	dupAcks    int       // acks of later packets, the duplicate acks of TCP
+	key        packetKey // the oldest packet, once dupAcks reached dupAckThreshold
+	isDue      bool      // key is sent again with the next flush of the stream
+	isRecovery bool      // key was sent again, until it is acked
+}
+
+// LossRecovery tracks the packets in flight of a connection, in the order they were sent, and runs the probe
+// timeout (PTO) of RFC 9002, section 6.2. If no ack arrives within the PTO after the last packet was sent,
+// the oldest packet in flight is sent again as a probe. The first two PTOs use the same interval, afterwards
+// the interval doubles with each PTO until maxRtoNano. Any ack resets the backoff. The RTO of the
+// SendBuffer still applies on top, LossRecovery only decides when a probe is due.
+//
+// Acks are selective, a gap does not repeat the same ack like in TCP. Instead, an ack of a later packet of a
+// stream while its oldest packet is still in flight counts as a duplicate ack. After dupAckThreshold of them,
+// the oldest packet is sent again without waiting for the RTO, the fast retransmit. Until it is acked, the
+// stream is in recovery and the acks of later packets do not send it again.
+type LossRecovery struct {
+	inFlight        *LinkedMap[sentPacketKey, sentPacket]
+	lastSentNano    uint64 // the PTO is armed from the last packet sent
+	ptoCount        int    // consecutive PTO expirations without an ack
+	isTlpSent       bool   // only one tail loss probe until the next ack
+	maxRtoNano      uint64
+	fastRetransmits map[uint32]*fastRetransmit // streams with a gap
+}
+
+func NewLossRecovery(maxRtoNano uint64) *LossRecovery {
+	return &LossRecovery{
+		inFlight:        NewLinkedMap[sentPacketKey, sentPacket](),
+		maxRtoNano:      maxRtoNano,
+		fastRetransmits: make(map[uint32]*fastRetransmit),
+	}
+}
+
+// onPacketSent tracks a sent packet, a retransmission moves the packet to the end
+func (l *LossRecovery) onPacketSent(streamID uint32, offset uint64, size int, nowNano uint64) {
+	key := sentPacketKey{streamID: streamID, key: createPacketKey(offset, uint16(size))}
+	l.inFlight.Remove(key)
+	l.inFlight.Put(key, sentPacket{sentTimeNano: nowNano, size: size})
+	l.lastSentNano = nowNano
+}
+
+// onAck removes an acked packet, an ack is progress and resets the backoff
+func (l *LossRecovery) onAck(ack *Ack) {
+	key := sentPacketKey{streamID: ack.streamID, key: createPacketKey(ack.offset, ack.len)}
+	if _, ok := l.inFlight.Remove(key); ok {
+		l.ptoCount = 0
+		l.isTlpSent = false
+	}
+}
+
+// removeStream drops the packets of a stream that is gone, e.g., reset, they are never acked. Without packets
+// in flight, the PTO backoff and the tail loss probe are reset like with an ack.
+func (l *LossRecovery) removeStream(streamID uint32) {
+	var keys []sentPacketKey
+	for k := range l.inFlight.Iterator(nil) {
+		if k.streamID == streamID {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		l.inFlight.Remove(k)
+	}
+	delete(l.fastRetransmits, streamID)
+	if l.inFlight.Size() == 0 {
+		l.ptoCount = 0
+		l.isTlpSent = false
+	}
+}
+
+// ptoNano is srtt + max(4*rttvar, granularity) + max ack delay, with backoff after the second PTO
+func (l *LossRecovery) ptoNano(srtt uint64, rttvar uint64, maxAckDelayNano uint64) uint64 {
+	ptoNano := defaultRTO
+	if srtt > 0 {
+		ptoNano = srtt + max(4*rttvar, ptoGranularity) + maxAckDelayNano
+	}
+	for i := 1; i < l.ptoCount && ptoNano < l.maxRtoNano; i++ {
+		ptoNano *= 2
+	}
+	return min(ptoNano, l.maxRtoNano)
+}
+
+// probe returns the oldest packet in flight if the PTO expired. Packets that are not in flight anymore, e.g.,
+// of a reset stream or split for a retransmission, are dropped on the way.
+func (l *LossRecovery) probe(nowNano uint64, ptoNano uint64, isInFlight func(sentPacketKey) bool) (
+	key sentPacketKey, isProbe bool) {
+	for {
+		k, _, ok := l.inFlight.First()
+		if !ok {
+			return sentPacketKey{}, false
+		}
+		if isInFlight(k) {
+			key = k
+			break
+		}
+		l.inFlight.Remove(k)
+	}
+	if nowNano < l.lastSentNano+ptoNano {
+		return sentPacketKey{}, false
+	}
+	return key, true
+}
+
+// tlpNano is the tail loss probe timeout, max(2*srtt, 10ms), with a single packet in flight the peer may hold
+// back its ack, then at least 1.5*srtt + max ack delay. It is never longer than the PTO.
+func (l *LossRecovery) tlpNano(srtt uint64, ptoNano uint64, maxAckDelayNano uint64) uint64 {
+	tlpNano := max(2*srtt, minTlp)
+	if l.inFlight.Size() == 1 {
+		tlpNano = max(tlpNano, srtt*3/2+maxAckDelayNano)
+	}
+	return min(tlpNano, ptoNano)
+}
+
+// tailProbe returns the last packet in flight if the tail loss probe timeout expired. This is for the case
+// when the last packets of a burst are lost, there is nothing sent afterwards whose ack would show the loss.
+// The caller checks that no more data is queued. Only one tail loss probe is sent until the next ack and
+// none once the PTO expired, then the PTO applies.
+func (l *LossRecovery) tailProbe(nowNano uint64, tlpNano uint64, isInFlight func(sentPacketKey) bool) (
+	key sentPacketKey, isProbe bool) {
+	if l.isTlpSent || l.ptoCount > 0 {
+		return sentPacketKey{}, false
+	}
+	for {
+		k, _, ok := l.inFlight.Last()
+		if !ok {
+			return sentPacketKey{}, false
+		}
+		if isInFlight(k) {
+			key = k
+			break
+		}
+		l.inFlight.Remove(k)
+	}
+	if nowNano < l.lastSentNano+tlpNano {
+		return sentPacketKey{}, false
+	}
+	return key, true
+}
+
+// onTailProbeSent marks the tail loss probe as sent
+func (l *LossRecovery) onTailProbeSent() {
+	l.isTlpSent = true
+}
+
+// onProbeSent counts the PTO expiration
+func (l *LossRecovery) onProbeSent() {
+	l.ptoCount++
+}
+
+// onStreamAck counts an ack of key, oldest is the packet of the stream in flight with the lowest offset before
+// the ack. An ack of the oldest packet closes the gap and ends the recovery.
+func (l *LossRecovery) onStreamAck(streamID uint32, key packetKey, oldest packetKey) {
+	if key == oldest {
+		delete(l.fastRetransmits, streamID)
+		return
+	}
+	f := l.fastRetransmits[streamID]
+	if f == nil {
+		f = &fastRetransmit{}
+		l.fastRetransmits[streamID] = f
+	}
+	f.dupAcks++
+	if f.dupAcks >= dupAckThreshold && !f.isDue && !(f.isRecovery && f.key == oldest) {
+		// a new gap, or the first one, the packet sent again during a recovery may have been split
+		f.key, f.isDue, f.isRecovery = oldest, true, false
+	}
+}
+
+// fastRetransmitDue returns the oldest packet of a stream if enough duplicate acks arrived
+func (l *LossRecovery) fastRetransmitDue(streamID uint32) (key packetKey, isDue bool) {
+	f := l.fastRetransmits[streamID]
+	if f == nil || !f.isDue {
+		return 0, false
+	}
+	return f.key, true
+}
+
+// onFastRetransmitSent starts the recovery of a stream
+func (l *LossRecovery) onFastRetransmitSent(streamID uint32) {
+	if f := l.fastRetransmits[streamID]; f != nil {
+		f.isDue, f.isRecovery = false, true
+	}
+}
+
+func (l *LossRecovery) size() int {
+	return l.inFlight.Size()
+}
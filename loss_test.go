@@ -0,0 +1,144 @@
+package qotp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLossRecoveryPto(t *testing.T) {
+	l := NewLossRecovery(maxRTO)
+
+	// no RTT sample yet
+	assert.Equal(t, defaultRTO, l.ptoNano(0, 0, 0))
+	// srtt + 4*rttvar + max ack delay
+	assert.Equal(t, uint64(10*msNano+4*2*msNano+5*msNano), l.ptoNano(10*msNano, 2*msNano, 5*msNano))
+	// the variance part is at least the granularity
+	assert.Equal(t, uint64(10*msNano+ptoGranularity), l.ptoNano(10*msNano, 0, 0))
+}
+
+func TestLossRecoveryPtoBackoff(t *testing.T) {
+	l := NewLossRecovery(uint64(500 * msNano))
+	srtt := uint64(99 * msNano)
+	pto := srtt + ptoGranularity
+
+	// the first two PTOs use the same interval, then it doubles
+	expected := []uint64{pto, pto, 2 * pto, 4 * pto, 500 * msNano, 500 * msNano}
+	for _, e := range expected {
+		assert.Equal(t, e, l.ptoNano(srtt, 0, 0))
+		l.onProbeSent()
+	}
+
+	// an ack is progress and resets the backoff
+	l.onPacketSent(1, 0, 10, 0)
+	l.onAck(&Ack{streamID: 1, offset: 0, len: 10})
+	assert.Equal(t, pto, l.ptoNano(srtt, 0, 0))
+	assert.Equal(t, 0, l.size())
+}
+
+func TestLossRecoveryProbe(t *testing.T) {
+	l := NewLossRecovery(maxRTO)
+	inFlight := map[sentPacketKey]bool{}
+	isInFlight := func(k sentPacketKey) bool { return inFlight[k] }
+
+	_, isProbe := l.probe(0, 10*msNano, isInFlight)
+	assert.False(t, isProbe)
+
+	l.onPacketSent(1, 0, 100, 0)
+	l.onPacketSent(2, 0, 100, 5*msNano)
+	inFlight[sentPacketKey{streamID: 1, key: createPacketKey(0, 100)}] = true
+	inFlight[sentPacketKey{streamID: 2, key: createPacketKey(0, 100)}] = true
+
+	// the PTO is armed from the last packet sent
+	_, isProbe = l.probe(14*msNano, 10*msNano, isInFlight)
+	assert.False(t, isProbe)
+	key, isProbe := l.probe(15*msNano, 10*msNano, isInFlight)
+	assert.True(t, isProbe)
+	assert.Equal(t, uint32(1), key.streamID)
+
+	// the packet of stream 1 is gone without an ack, e.g., the stream was reset
+	delete(inFlight, sentPacketKey{streamID: 1, key: createPacketKey(0, 100)})
+	key, isProbe = l.probe(15*msNano, 10*msNano, isInFlight)
+	assert.True(t, isProbe)
+	assert.Equal(t, uint32(2), key.streamID)
+	assert.Equal(t, 1, l.size())
+
+	// a retransmission moves the packet to the end and rearms the PTO
+	l.onPacketSent(2, 0, 100, 20*msNano)
+	_, isProbe = l.probe(25*msNano, 10*msNano, isInFlight)
+	assert.False(t, isProbe)
+}
+
+func TestLossRecoveryTailProbe(t *testing.T) {
+	l := NewLossRecovery(maxRTO)
+	isInFlight := func(k sentPacketKey) bool { return true }
+	srtt := uint64(20 * msNano)
+	pto := l.ptoNano(srtt, 10*msNano, 0)
+
+	l.onPacketSent(1, 0, 100, 0)
+	// single packet, the peer may delay its ack
+	assert.Equal(t, uint64(40*msNano), l.tlpNano(srtt, pto, 0))
+	assert.Equal(t, uint64(55*msNano), l.tlpNano(srtt, pto, 25*msNano))
+	// at least 10ms, never longer than the PTO
+	assert.Equal(t, minTlp, l.tlpNano(msNano, pto, 0))
+	assert.Equal(t, uint64(30*msNano), l.tlpNano(srtt, 30*msNano, 0))
+
+	// the last packet is probed
+	l.onPacketSent(1, 100, 100, 5*msNano)
+	tlp := l.tlpNano(srtt, pto, 0)
+	_, isProbe := l.tailProbe(5*msNano+tlp-1, tlp, isInFlight)
+	assert.False(t, isProbe)
+	key, isProbe := l.tailProbe(5*msNano+tlp, tlp, isInFlight)
+	assert.True(t, isProbe)
+	assert.Equal(t, createPacketKey(100, 100), key.key)
+
+	// only one tail loss probe until the next ack
+	l.onTailProbeSent()
+	_, isProbe = l.tailProbe(secondNano, tlp, isInFlight)
+	assert.False(t, isProbe)
+	l.onAck(&Ack{streamID: 1, offset: 0, len: 100})
+	_, isProbe = l.tailProbe(secondNano, tlp, isInFlight)
+	assert.True(t, isProbe)
+
+	// none once the PTO expired
+	l.onProbeSent()
+	_, isProbe = l.tailProbe(secondNano, tlp, isInFlight)
+	assert.False(t, isProbe)
+}
+
+func TestLossRecoveryFastRetransmit(t *testing.T) {
+	l := NewLossRecovery(maxRTO)
+	keys := []packetKey{createPacketKey(0, 100), createPacketKey(100, 100), createPacketKey(200, 100),
+		createPacketKey(300, 100), createPacketKey(400, 100)}
+
+	// the first packet is lost, the acks of the next three leave the gap
+	for _, k := range keys[1:3] {
+		l.onStreamAck(1, k, keys[0])
+		_, isDue := l.fastRetransmitDue(1)
+		assert.False(t, isDue)
+	}
+	l.onStreamAck(1, keys[3], keys[0])
+	key, isDue := l.fastRetransmitDue(1)
+	assert.True(t, isDue)
+	assert.Equal(t, keys[0], key)
+	_, isDue = l.fastRetransmitDue(2)
+	assert.False(t, isDue)
+
+	// sent again once, more acks while it is in flight do not send it again
+	l.onFastRetransmitSent(1)
+	l.onStreamAck(1, keys[4], keys[0])
+	_, isDue = l.fastRetransmitDue(1)
+	assert.False(t, isDue)
+
+	// its ack ends the recovery
+	l.onStreamAck(1, keys[0], keys[0])
+	assert.Empty(t, l.fastRetransmits)
+
+	// a removed stream has no gap anymore
+	for _, k := range keys[2:] {
+		l.onStreamAck(1, k, keys[1])
+	}
+	l.removeStream(1)
+	_, isDue = l.fastRetransmitDue(1)
+	assert.False(t, isDue)
+}
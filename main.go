@@ -19,6 +19,10 @@ const (
 	msNano            = 1_000_000
 )
 
+// a single stream can use a quarter of the receive buffer, so that a stream that is not read does not stall
+// the other streams of the connection
+const defaultStreamRcvWindow = rcvBufferCapacity / 4
+
 func init() {
 	levelStr := strings.ToLower(os.Getenv("LOG_LEVEL"))
 	var slogLevel slog.Level
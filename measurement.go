@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"math"
+	"time"
 )
 
 const ()
@@ -35,8 +36,12 @@ var (
 	rttInflationHigh     = uint64(150)
 	rttInflationModerate = uint64(125)
 
-	MinDeadLine  = uint64(100 * msNano)
-	ReadDeadLine = uint64(30 * secondNano) // 30 seconds
+	MinDeadLine   = uint64(100 * msNano)
+	ReadDeadLine  = uint64(30 * secondNano) // 30 seconds
+	CloseDeadLine = uint64(3 * secondNano)  // 3 seconds
+
+	defaultHandshakeTimeout    = defaultRTO
+	defaultHandshakeMaxTimeout = uint64(10 * secondNano)
 
 	//backoff
 	maxRetry      = 5
@@ -46,8 +51,9 @@ var (
 // Combined measurement state - both RTT and BBR in one struct
 type Measurements struct {
 	// RTT fields
-	srtt   uint64 // Smoothed RTT
-	rttvar uint64 // RTT variation
+	srtt    uint64 // Smoothed RTT
+	rttvar  uint64 // RTT variation
+	rttLast uint64 // Latest RTT sample
 
 	// BBR fields
 	isStartup         bool   // true = startup, false = normal
@@ -90,6 +96,7 @@ func (c *Conn) updateMeasurements(rttMeasurementNano uint64, bytesAcked uint64,
 	}
 
 	// Update RTT (smoothed RTT and variation)
+	c.rttLast = rttMeasurementNano
 	if c.srtt == 0 {
 		// First measurement
 		c.srtt = rttMeasurementNano
@@ -164,13 +171,72 @@ func (c *Conn) rtoNano() uint64 {
 		return defaultRTO
 	case rto < minRTO:
 		return minRTO
-	case rto > maxRTO:
-		return maxRTO
+	case rto > c.listener.maxRto():
+		return c.listener.maxRto()
 	default:
 		return rto
 	}
 }
 
+func (l *Listener) maxRto() uint64 {
+	if l.maxRtoNano == 0 {
+		return maxRTO
+	}
+	return l.maxRtoNano
+}
+
+// ptoNano is the probe timeout of the connection, see LossRecovery
+func (c *Conn) ptoNano() uint64 {
+	return c.loss.ptoNano(c.srtt, c.rttvar, c.listener.maxAckDelayNano)
+}
+
+// tlpNano is the tail loss probe timeout of the connection, see LossRecovery
+func (c *Conn) tlpNano() uint64 {
+	return c.loss.tlpNano(c.srtt, c.ptoNano(), c.listener.maxAckDelayNano)
+}
+
+// RTT returns the latest RTT sample, 0 if there is none yet
+func (c *Conn) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rttLast)
+}
+
+// SRTT returns the smoothed RTT, 0 if there is no RTT sample yet
+func (c *Conn) SRTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.srtt)
+}
+
+// RTTVar returns the RTT variation, 0 if there is no RTT sample yet
+func (c *Conn) RTTVar() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rttvar)
+}
+
+// handshakeRtoNano is used instead of the RTO until the handshake is done, as we do not have an RTT sample yet
+func (c *Conn) handshakeRtoNano() uint64 {
+	if c.listener.handshakeTimeoutNano == 0 {
+		return defaultHandshakeTimeout
+	}
+	return c.listener.handshakeTimeoutNano
+}
+
+// isHandshakeTimeout checks if the initiator gave up on the handshake. The receiver cannot tell if the
+// handshake failed, as the initiator may have nothing to send after the init, it relies on ReadDeadLine.
+func (c *Conn) isHandshakeTimeout(nowNano uint64) bool {
+	if !c.isSenderOnInit || c.isHandshakeDoneOnRcv || !c.isInitSentOnSnd {
+		return false
+	}
+	maxNano := c.listener.handshakeMaxTimeoutNano
+	if maxNano == 0 {
+		maxNano = defaultHandshakeMaxTimeout
+	}
+	return nowNano > c.handshakeStartNano+maxNano
+}
+
 func (c *Conn) onDuplicateAck() {
 	c.bwMax = c.bwMax * dupAckBwReduction / 100
 	c.pacingGainPct = dupAckGain
@@ -193,6 +259,13 @@ func (c *Conn) onPacketLoss() {
 	c.isStartup = false
 }
 
+// onEcnCongestion reduces the bandwidth like a loss, after new CE marks, see ecn.go
+func (c *Conn) onEcnCongestion() {
+	c.bwMax = c.bwMax * lossBwReduction / 100
+	c.pacingGainPct = normalGain
+	c.isStartup = false
+}
+
 func (c *Conn) calcPacing(packetSize uint64) uint64 {
 	if c.bwMax == 0 {
 		if c.srtt > 0 {
@@ -13,6 +13,7 @@ import (
 func newTestConnection() *Conn {
 	return &Conn{
 		Measurements: NewMeasurements(),
+		listener:     &Listener{},
 	}
 }
 
@@ -610,4 +611,17 @@ func TestMeasurementsIntegration(t *testing.T) {
 	// Verify pacing calculation works
 	interval := conn.calcPacing(1000)
 	assert.Greater(t, interval, uint64(0), "Should calculate valid pacing interval")
-}
\ No newline at end of file
+}
+func TestMeasurementsRTTGetters(t *testing.T) {
+	conn := newTestConnection()
+	assert.Zero(t, conn.RTT())
+	assert.Zero(t, conn.SRTT())
+	assert.Zero(t, conn.RTTVar())
+
+	conn.updateMeasurements(100*msNano, 1000, 1)
+	conn.updateMeasurements(50*msNano, 1000, 2)
+	assert.Equal(t, 50*time.Millisecond, conn.RTT())
+	assert.Equal(t, time.Duration(conn.srtt), conn.SRTT())
+	assert.Equal(t, time.Duration(conn.rttvar), conn.RTTVar())
+	assert.Less(t, conn.SRTT(), 100*time.Millisecond)
+}
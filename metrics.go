@@ -0,0 +1,211 @@
+package qotp
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Metrics of the listener and its connections, enabled with WithMetrics. qotp does not depend on a metrics
+// library, it creates its metrics with a MetricsRegisterer, the package qotpprom adapts a Prometheus registerer.
+// Every metric has the label listener, the listeners that share a registerer can share the counters and
+// histograms. The active connections and streams are read from the state of the listener when they are
+// scraped, a listener removes them on Close.
+
+// MetricsRegisterer creates the metrics of a listener, labels are constant for the metric. A registerer that
+// several listeners share is asked for the same name with other labels. GaugeFunc fails if the gauge with
+// these labels exists already, the returned function removes it again.
+type MetricsRegisterer interface {
+	Counter(name string, help string, labels map[string]string) (Counter, error)
+	Histogram(name string, help string, buckets []float64, labels map[string]string) (Observer, error)
+	GaugeFunc(name string, help string, labels map[string]string, f func() float64) (func(), error)
+}
+
+// Counter only goes up, v is never negative
+type Counter interface {
+	Add(v float64)
+}
+
+// Observer adds a sample to a histogram
+type Observer interface {
+	Observe(v float64)
+}
+
+// metricsLabel is the label that tells the listeners apart, the address of WithListenAddr
+const metricsLabel = "listener"
+
+// Reasons of qotp_packets_dropped_total, the label reason
+const (
+	dropOversizedInit    = "oversized_init"    // init above WithMaxHandshakeSize, not decrypted
+	dropRateLimited      = "rate_limited"      // init of a source above WithHandshakeRateLimit, not decrypted
+	dropRejected         = "rejected"          // init refused by the accept filter or the application protocol
+	dropInvalidSignature = "invalid_signature" // signed init with a signature that does not verify
+	dropReplay           = "replay"            // Data packet seen before, or too old for the replay window
+	dropSnWindow         = "sn_window"         // Data packet too far ahead, see WithSequenceWindow
+	dropMsgType          = "message_type"      // message type not valid in the state of the connection
+	dropVersion          = "version"           // another CryptoVersion, see ErrUnsupportedVersion
+	dropAuth             = "auth"              // does not authenticate, ErrDecrypt or ErrBadSequenceNumber, may be forged
+	dropShort            = "short"             // truncated, ErrShortHeader or ErrShortPayload
+	dropDecode           = "decode"            // any other packet that could not be decoded, see DecodeError
+)
+
+// dropReason is the reason of a packet that could not be decoded, a packet that does not authenticate can be
+// an attack, a truncated one is rather a broken path
+func dropReason(err error) string {
+	switch {
+	case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrInvalidSequence):
+		return dropAuth
+	case errors.Is(err, ErrPacketTooShort), errors.Is(err, ErrShortPayload):
+		return dropShort
+	}
+	return dropDecode
+}
+
+// dropReasons are all values of the label reason, each has its counter from the start
+var dropReasons = []string{dropOversizedInit, dropRateLimited, dropRejected, dropInvalidSignature, dropReplay,
+	dropSnWindow, dropMsgType, dropVersion, dropAuth, dropShort, dropDecode}
+
+type metrics struct {
+	connsTotal        Counter
+	bytesSent         Counter
+	bytesReceived     Counter
+	packetsLost       Counter
+	packetsDropped    map[string]Counter // by reason
+	rtt               Observer
+	handshakeDuration Observer
+	unregisterGauges  []func() // of this listener only, called on Close
+}
+
+// newMetrics creates the metrics of l with reg
+func newMetrics(reg MetricsRegisterer, l *Listener, listener string) (m *metrics, err error) {
+	labels := map[string]string{metricsLabel: listener}
+	m = &metrics{packetsDropped: make(map[string]Counter, len(dropReasons))}
+	if m.connsTotal, err = reg.Counter("qotp_connections_total",
+		"Connections created, dialed or accepted.", labels); err != nil {
+		return nil, err
+	}
+	if m.bytesSent, err = reg.Counter("qotp_bytes_sent_total",
+		"Encrypted bytes sent, including headers and padding.", labels); err != nil {
+		return nil, err
+	}
+	if m.bytesReceived, err = reg.Counter("qotp_bytes_received_total",
+		"Encrypted bytes received, including headers and padding.", labels); err != nil {
+		return nil, err
+	}
+	if m.packetsLost, err = reg.Counter("qotp_packets_lost_total",
+		"Packets retransmitted after the RTO.", labels); err != nil {
+		return nil, err
+	}
+	for _, reason := range dropReasons {
+		m.packetsDropped[reason], err = reg.Counter("qotp_packets_dropped_total",
+			"Packets dropped by the listener or a connection, by reason.",
+			map[string]string{metricsLabel: listener, "reason": reason})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.rtt, err = reg.Histogram("qotp_rtt_seconds",
+		"Round-trip time samples of the acks, without the ack delay of the peer.",
+		exponentialBuckets(0.0005, 14), labels); err != nil { // 0.5ms to 4s
+		return nil, err
+	}
+	if m.handshakeDuration, err = reg.Histogram("qotp_handshake_duration_seconds",
+		"Time from the first handshake packet until the handshake is done.",
+		exponentialBuckets(0.001, 15), labels); err != nil { // 1ms to 16s
+		return nil, err
+	}
+
+	for _, g := range []struct {
+		name string
+		help string
+		f    func() float64
+	}{
+		{"qotp_connections_active", "Connections that are open.",
+			func() float64 { return float64(l.connMap.Size()) }},
+		{"qotp_streams_active", "Streams of the open connections that are not cleaned up yet.",
+			func() float64 { return float64(l.streamCount()) }},
+	} {
+		unregister, err := reg.GaugeFunc(g.name, g.help, labels, g.f)
+		if err != nil {
+			m.unregister()
+			return nil, err
+		}
+		m.unregisterGauges = append(m.unregisterGauges, unregister)
+	}
+	return m, nil
+}
+
+// exponentialBuckets are n upper bounds of histogram buckets, from start on, each twice the one before
+func exponentialBuckets(start float64, n int) []float64 {
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = start * math.Pow(2, float64(i))
+	}
+	return buckets
+}
+
+// streamCount sums the streams of all connections
+func (l *Listener) streamCount() (n int) {
+	for _, conn := range l.connMap.Iterator(nil) {
+		n += conn.streams.Size()
+	}
+	return n
+}
+
+func (m *metrics) unregister() {
+	if m == nil {
+		return
+	}
+	for _, unregister := range m.unregisterGauges {
+		unregister()
+	}
+}
+
+func (m *metrics) onConnOpen() {
+	if m == nil {
+		return
+	}
+	m.connsTotal.Add(1)
+}
+
+func (m *metrics) onSent(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesSent.Add(float64(n))
+}
+
+func (m *metrics) onReceived(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesReceived.Add(float64(n))
+}
+
+func (m *metrics) onPacketLost() {
+	if m == nil {
+		return
+	}
+	m.packetsLost.Add(1)
+}
+
+func (m *metrics) onDrop(reason string) {
+	if m == nil {
+		return
+	}
+	m.packetsDropped[reason].Add(1)
+}
+
+func (m *metrics) onRtt(rttNano uint64) {
+	if m == nil {
+		return
+	}
+	m.rtt.Observe(time.Duration(rttNano).Seconds())
+}
+
+func (m *metrics) onHandshakeDone(durationNano uint64) {
+	if m == nil {
+		return
+	}
+	m.handshakeDuration.Observe(time.Duration(durationNano).Seconds())
+}
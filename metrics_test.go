@@ -0,0 +1,230 @@
+package qotp
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testMetrics is a MetricsRegisterer that keeps the values in memory, a counter and a histogram with the same
+// name and labels are shared like in Prometheus
+type testMetrics struct {
+	mu     sync.Mutex
+	values map[string]*testMetric // by the key of metricKey
+	names  []string               // in the order they were first registered
+}
+
+// testMetric is a counter, the sample count of a histogram, or a gauge if f is set
+type testMetric struct {
+	mu sync.Mutex
+	v  float64
+	f  func() float64
+}
+
+func (m *testMetric) Add(v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.v += v
+}
+
+func (m *testMetric) Observe(float64) {
+	m.Add(1)
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{values: map[string]*testMetric{}}
+}
+
+// metricKey is the name and the labels, sorted by the label name
+func metricKey(name string, labels map[string]string) string {
+	names := slices.Sorted(maps.Keys(labels))
+	var b strings.Builder
+	b.WriteString(name)
+	for _, n := range names {
+		fmt.Fprintf(&b, ",%s=%s", n, labels[n])
+	}
+	return b.String()
+}
+
+func (r *testMetrics) metric(name string, labels map[string]string, f func() float64) (*testMetric, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Contains(r.names, name) {
+		r.names = append(r.names, name)
+	}
+	key := metricKey(name, labels)
+	if m := r.values[key]; m != nil {
+		if f != nil {
+			return nil, fmt.Errorf("%s already registered", key)
+		}
+		return m, nil
+	}
+	m := &testMetric{f: f}
+	r.values[key] = m
+	return m, nil
+}
+
+func (r *testMetrics) Counter(name string, _ string, labels map[string]string) (Counter, error) {
+	return r.metric(name, labels, nil)
+}
+
+func (r *testMetrics) Histogram(name string, _ string, _ []float64, labels map[string]string) (Observer, error) {
+	return r.metric(name, labels, nil)
+}
+
+func (r *testMetrics) GaugeFunc(name string, _ string, labels map[string]string, f func() float64) (func(), error) {
+	if _, err := r.metric(name, labels, f); err != nil {
+		return nil, err
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.values, metricKey(name, labels))
+	}, nil
+}
+
+// gatherMetric returns the value of a counter or gauge, or the sample count of a histogram, of a listener.
+// labels are more name and value pairs the metric needs to have. isFound is false if the listener has no
+// such metric.
+func gatherMetric(t *testing.T, reg *testMetrics, name string, listener string, labels ...string) (
+	v float64, isFound bool) {
+	t.Helper()
+	want := map[string]string{metricsLabel: listener}
+	for i := 0; i+1 < len(labels); i += 2 {
+		want[labels[i]] = labels[i+1]
+	}
+	reg.mu.Lock()
+	m := reg.values[metricKey(name, want)]
+	reg.mu.Unlock()
+	if m == nil {
+		return 0, false
+	}
+	if m.f != nil {
+		return m.f(), true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.v, true
+}
+
+func TestMetricsRoundTrip(t *testing.T) {
+	reg := newTestMetrics()
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1),
+		WithListenAddr("127.0.0.1:9001"), WithMetrics(reg))
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2),
+		WithListenAddr("127.0.0.1:9002"), WithMetrics(reg))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	// data and the ack of it, B is done with the handshake once the data arrives
+	_, err = streamA.Write([]byte("round trip"))
+	assert.Nil(t, err)
+	listenerA.Flush(connPair.Conn1.localTime + secondNano)
+	captured := bytes.Clone(connPair.Conn1.writeQueue[0].data)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("round trip"), b)
+	listenerB.Flush(connPair.Conn2.localTime + secondNano)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	_, err = listenerA.Listen(MinDeadLine, connPair.Conn1.localTime)
+	assert.Nil(t, err)
+
+	for _, tt := range []struct {
+		name     string
+		listener string
+		want     float64
+	}{
+		{"qotp_connections_total", "127.0.0.1:9001", 1},
+		{"qotp_connections_total", "127.0.0.1:9002", 1},
+		{"qotp_connections_active", "127.0.0.1:9001", 1},
+		{"qotp_connections_active", "127.0.0.1:9002", 1},
+		{"qotp_streams_active", "127.0.0.1:9001", 1},
+		{"qotp_streams_active", "127.0.0.1:9002", 1},
+		{"qotp_bytes_sent_total", "127.0.0.1:9001", float64(connA.bytesSent)},
+		{"qotp_bytes_sent_total", "127.0.0.1:9002", float64(connB.bytesSent)},
+		{"qotp_bytes_received_total", "127.0.0.1:9001", float64(connB.bytesSent)},
+		{"qotp_bytes_received_total", "127.0.0.1:9002", float64(connA.bytesSent)},
+		{"qotp_packets_lost_total", "127.0.0.1:9001", 0},
+		{"qotp_handshake_duration_seconds", "127.0.0.1:9001", 1},
+		{"qotp_handshake_duration_seconds", "127.0.0.1:9002", 1},
+	} {
+		v, isFound := gatherMetric(t, reg, tt.name, tt.listener)
+		assert.True(t, isFound, "%s %s", tt.name, tt.listener)
+		assert.Equal(t, tt.want, v, "%s %s", tt.name, tt.listener)
+	}
+	assert.Greater(t, connA.bytesSent, uint64(1400))
+	v, _ := gatherMetric(t, reg, "qotp_rtt_seconds", "127.0.0.1:9001")
+	assert.GreaterOrEqual(t, v, 1.0)
+
+	// a replayed packet is dropped and counted with its reason
+	connPair.Conn1.writeQueue = append(connPair.Conn1.writeQueue, packetData{data: captured})
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	v, _ = gatherMetric(t, reg, "qotp_packets_dropped_total", "127.0.0.1:9002", "reason", dropReplay)
+	assert.Equal(t, 1.0, v)
+
+	// the gauges of a closed listener are gone, the counters stay, the other listener is not affected
+	assert.Nil(t, listenerA.Close())
+	_, isFound := gatherMetric(t, reg, "qotp_connections_active", "127.0.0.1:9001")
+	assert.False(t, isFound)
+	_, isFound = gatherMetric(t, reg, "qotp_connections_total", "127.0.0.1:9001")
+	assert.True(t, isFound)
+	v, _ = gatherMetric(t, reg, "qotp_connections_active", "127.0.0.1:9002")
+	assert.Equal(t, 1.0, v)
+}
+
+func TestMetricsFamilies(t *testing.T) {
+	reg := newTestMetrics()
+	connPair := NewConnPair("alice", "bob")
+	l, err := Listen(WithNetworkConn(connPair.Conn1), WithListenAddr("127.0.0.1:9001"), WithMetrics(reg))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		"qotp_connections_total",
+		"qotp_bytes_sent_total",
+		"qotp_bytes_received_total",
+		"qotp_packets_lost_total",
+		"qotp_packets_dropped_total",
+		"qotp_rtt_seconds",
+		"qotp_handshake_duration_seconds",
+		"qotp_connections_active",
+		"qotp_streams_active",
+	}, reg.names)
+	assert.Nil(t, l.Close())
+}
+
+func TestMetricsOption(t *testing.T) {
+	_, err := Listen(WithMetrics(nil))
+	assert.Error(t, err)
+	reg := newTestMetrics()
+	_, err = Listen(WithMetrics(reg), WithMetrics(reg))
+	assert.Error(t, err)
+
+	// two listeners with the same label would report the same series
+	connPair := NewConnPair("alice", "bob")
+	_, err = Listen(WithNetworkConn(connPair.Conn1), WithListenAddr("127.0.0.1:9001"), WithMetrics(reg))
+	assert.Nil(t, err)
+	_, err = Listen(WithNetworkConn(connPair.Conn2), WithListenAddr("127.0.0.1:9001"), WithMetrics(reg))
+	assert.Error(t, err)
+}
@@ -2,8 +2,10 @@ package qotp
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
+	"os"
 	"sync"
 	"time"
 )
@@ -11,14 +13,29 @@ import (
 type NetworkConn interface {
 	ReadFromUDPAddrPort(p []byte, timeoutNano uint64, nowNano uint64) (n int, remoteAddr netip.AddrPort, err error)
 	TimeoutReadNow() error
+	// WriteToUDPAddrPort must not keep p after it returned, qotp reuses it for the next packet
 	WriteToUDPAddrPort(p []byte, remoteAddr netip.AddrPort, nowNano uint64) (err error)
 	Close() error
 	LocalAddrString() string
 }
 
+// maxBatchSize is the maximum number of packets sent or received with one syscall
+const maxBatchSize = 64
+
+// batchConn is a NetworkConn that queues the writes of a flush and sends them together, see WithBatchSize
+type batchConn interface {
+	beginBatch()
+	endBatch() error
+}
+
 type UDPNetworkConn struct {
 	conn *net.UDPConn
 	mu   sync.Mutex
+
+	batch      *udpBatch // nil if packets are sent and received one by one
+	isECN      bool      // the ECN field of received packets is read, see setECN
+	sndMu      sync.Mutex
+	isBatching bool // writes are queued between beginBatch and endBatch
 }
 
 func NewUDPNetworkConn(conn *net.UDPConn) NetworkConn {
@@ -28,27 +45,84 @@ func NewUDPNetworkConn(conn *net.UDPConn) NetworkConn {
 	}
 }
 
+// newUDPNetworkConnBatch sends and receives up to batchSize packets with one syscall, where supported
+func newUDPNetworkConnBatch(conn *net.UDPConn, batchSize int) (NetworkConn, error) {
+	c := &UDPNetworkConn{conn: conn}
+	if batchSize > 1 {
+		batch, err := newUDPBatch(conn, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		c.batch = batch
+	}
+	return c, nil
+}
+
 func (c *UDPNetworkConn) ReadFromUDPAddrPort(p []byte, timeoutNano uint64, nowNano uint64) (
 	n int, sourceAddress netip.AddrPort, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	readDeadline := time.Unix(0, int64(nowNano + timeoutNano))
+	readDeadline, isReady, err := c.readDeadline(timeoutNano, nowNano)
+	if err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	if !isReady {
+		return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+	}
 	err = c.conn.SetReadDeadline(readDeadline)
 	if err != nil {
 		return 0, netip.AddrPort{}, err
 	}
 
-	n, sourceAddress, err = c.conn.ReadFromUDPAddrPort(p)
+	if c.batch != nil {
+		n, sourceAddress, err = c.batch.read(p)
+	} else {
+		n, sourceAddress, err = c.conn.ReadFromUDPAddrPort(p)
+	}
 
 	return n, sourceAddress, err
 }
 
+// readFromUDPAddrPortECN reads the ECN field of the packet from the control messages, without batching
+func (c *UDPNetworkConn) readFromUDPAddrPortECN(p []byte, timeoutNano uint64, nowNano uint64) (
+	n int, sourceAddress netip.AddrPort, ecn ecnCodepoint, err error) {
+	if !c.isECN || c.batch != nil {
+		n, sourceAddress, err = c.ReadFromUDPAddrPort(p, timeoutNano, nowNano)
+		return n, sourceAddress, ecnNotECT, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	readDeadline, isReady, err := c.readDeadline(timeoutNano, nowNano)
+	if err != nil {
+		return 0, netip.AddrPort{}, ecnNotECT, err
+	}
+	if !isReady {
+		return 0, netip.AddrPort{}, ecnNotECT, os.ErrDeadlineExceeded
+	}
+	err = c.conn.SetReadDeadline(readDeadline)
+	if err != nil {
+		return 0, netip.AddrPort{}, ecnNotECT, err
+	}
+
+	var oob [ecnOobSize]byte
+	n, oobn, _, sourceAddress, err := c.conn.ReadMsgUDPAddrPort(p, oob[:])
+	return n, sourceAddress, parseECN(oob[:oobn]), err
+}
+
 func (c *UDPNetworkConn) TimeoutReadNow() error {
 	return c.conn.SetReadDeadline(time.Time{})
 }
 
 func (c *UDPNetworkConn) WriteToUDPAddrPort(b []byte, remoteAddr netip.AddrPort, _ uint64) error {
+	if c.batch != nil {
+		c.sndMu.Lock()
+		defer c.sndMu.Unlock()
+		if c.isBatching {
+			return c.batch.queue(b, remoteAddr)
+		}
+	}
 	n, err := c.conn.WriteToUDPAddrPort(b, remoteAddr)
 	if n != len(b) {
 		return errors.New("could not send all data. This should not happen")
@@ -56,10 +130,92 @@ func (c *UDPNetworkConn) WriteToUDPAddrPort(b []byte, remoteAddr netip.AddrPort,
 	return err
 }
 
+func (c *UDPNetworkConn) beginBatch() {
+	if c.batch == nil {
+		return
+	}
+	c.sndMu.Lock()
+	defer c.sndMu.Unlock()
+	c.isBatching = true
+}
+
+// endBatch sends the queued packets, a packet that cannot be sent is dropped and the first error is returned
+func (c *UDPNetworkConn) endBatch() error {
+	if c.batch == nil {
+		return nil
+	}
+	c.sndMu.Lock()
+	defer c.sndMu.Unlock()
+	c.isBatching = false
+	return c.batch.send()
+}
+
 func (c *UDPNetworkConn) Close() error {
 	return c.conn.Close()
 }
 
+// socketNetwork is the network that reaches the families of a socket. A "udp" socket on a wildcard address
+// is dual stack, on a specific address it has the family of the address.
+func socketNetwork(network string, localAddr net.Addr) string {
+	udpAddr, ok := localAddr.(*net.UDPAddr)
+	if network != "udp" || !ok || udpAddr.IP == nil || udpAddr.IP.IsUnspecified() {
+		return network
+	}
+	if udpAddr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// ErrResolve is returned by DialString and DialWithCryptoString if the address cannot be resolved to an
+// address our socket can reach
+var ErrResolve = errors.New("cannot resolve address")
+
+// resolveAddr resolves a host:port with a DNS name or an address literal. Of the addresses of a name, in the
+// order of the resolver, the first with a family of our socket is used. UDP has no connect, so whether the
+// peer answers only shows with the handshake. An IPv4 address is not mapped to IPv6, a dual stack socket maps
+// it when sending.
+func (l *Listener) resolveAddr(addr string) (netip.AddrPort, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w %q: %w", ErrResolve, addr, err)
+	}
+	port, err := net.LookupPort("udp", portString)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w %q: %w", ErrResolve, addr, err)
+	}
+
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else if host != "" {
+		ips, err = net.DefaultResolver.LookupNetIP(l.context(), "ip", host)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("%w %q: %w", ErrResolve, addr, err)
+		}
+	}
+	ip, ok := firstReachable(l.network, ips)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("%w %q: no address for %s", ErrResolve, addr, l.network)
+	}
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+// firstReachable returns the first address a socket of network can send to, unmapped
+func firstReachable(network string, ips []netip.Addr) (netip.Addr, bool) {
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		switch {
+		case !ip.IsValid() || ip.IsUnspecified():
+		case network == "udp4" && !ip.Is4():
+		case network == "udp6" && !ip.Is6():
+		default:
+			return ip, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
 func (c *UDPNetworkConn) LocalAddrString() string {
 	return c.conn.LocalAddr().String()
 }
@@ -0,0 +1,237 @@
+//go:build linux
+
+package qotp
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr of sendmmsg(2) and recvmmsg(2), x/sys/unix does not define it
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// udpBatch sends and receives up to size packets with one sendmmsg or recvmmsg syscall. The buffers are
+// allocated once and reused.
+type udpBatch struct {
+	rawConn syscall.RawConn
+	isIPv6  bool // an IPv6 socket needs IPv4 addresses mapped to IPv6
+
+	sndMsgs  []mmsghdr
+	sndIovs  []unix.Iovec
+	sndAddrs []unix.RawSockaddrInet6 // large enough for IPv4 and IPv6
+	sndBufs  [][]byte
+	sndCount int
+
+	rcvMsgs  []mmsghdr
+	rcvIovs  []unix.Iovec
+	rcvAddrs []unix.RawSockaddrAny
+	rcvBufs  [][]byte
+	rcvCount int
+	rcvPos   int // the next received packet to return
+}
+
+func newUDPBatch(conn *net.UDPConn, size int) (*udpBatch, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var domain int
+	var errDomain error
+	if err = rawConn.Control(func(fd uintptr) {
+		domain, errDomain = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+	}); err != nil {
+		return nil, err
+	}
+	if errDomain != nil {
+		return nil, errDomain
+	}
+
+	return &udpBatch{
+		rawConn:  rawConn,
+		isIPv6:   domain == unix.AF_INET6,
+		sndMsgs:  make([]mmsghdr, size),
+		sndIovs:  make([]unix.Iovec, size),
+		sndAddrs: make([]unix.RawSockaddrInet6, size),
+		sndBufs:  make([][]byte, size),
+		rcvMsgs:  make([]mmsghdr, size),
+		rcvIovs:  make([]unix.Iovec, size),
+		rcvAddrs: make([]unix.RawSockaddrAny, size),
+		rcvBufs:  make([][]byte, size),
+	}, nil
+}
+
+// queue copies the packet into the batch, a full batch is sent right away. Its error does not belong to this
+// packet, so it is only logged.
+func (b *udpBatch) queue(p []byte, remoteAddr netip.AddrPort) error {
+	if len(p) == 0 {
+		return errors.New("empty packet")
+	}
+
+	i := b.sndCount
+	nameLen, err := b.putSockaddr(i, remoteAddr)
+	if err != nil {
+		return err
+	}
+	b.sndBufs[i] = append(b.sndBufs[i][:0], p...)
+	b.sndIovs[i].Base = &b.sndBufs[i][0]
+	b.sndIovs[i].SetLen(len(p))
+	b.sndMsgs[i].hdr = unix.Msghdr{
+		Name:    (*byte)(unsafe.Pointer(&b.sndAddrs[i])),
+		Namelen: nameLen,
+		Iov:     &b.sndIovs[i],
+	}
+	b.sndMsgs[i].hdr.SetIovlen(1)
+	b.sndCount++
+
+	if b.sndCount == len(b.sndMsgs) {
+		if err = b.send(); err != nil {
+			slog.Info("batch not fully sent", slog.Any("err", err))
+		}
+	}
+	return nil
+}
+
+// send sends the queued packets. sendmmsg stops at the first packet that fails, this packet is dropped like a
+// lost packet and the rest is sent. The first error is returned.
+func (b *udpBatch) send() (err error) {
+	for sent := 0; sent < b.sndCount; {
+		var n int
+		var errno syscall.Errno
+		errRaw := b.rawConn.Write(func(fd uintptr) bool {
+			r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&b.sndMsgs[sent])),
+				uintptr(b.sndCount-sent), 0, 0, 0)
+			if e == unix.EAGAIN {
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		})
+		if errRaw != nil {
+			b.sndCount = 0
+			return errRaw
+		}
+		if errno != 0 {
+			if err == nil {
+				err = errno
+			}
+			n = 1
+		}
+		sent += n
+	}
+	b.sndCount = 0
+	return err
+}
+
+// read returns the next received packet, if all are returned, it receives the next batch
+func (b *udpBatch) read(p []byte) (n int, remoteAddr netip.AddrPort, err error) {
+	if b.rcvPos == b.rcvCount {
+		if err = b.receive(len(p)); err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+	}
+
+	i := b.rcvPos
+	b.rcvPos++
+	n = copy(p, b.rcvBufs[i][:b.rcvMsgs[i].len])
+	return n, sockaddrToAddrPort(&b.rcvAddrs[i]), nil
+}
+
+// isBuffered returns true if a received packet was not returned yet
+func (b *udpBatch) isBuffered() bool {
+	return b.rcvPos < b.rcvCount
+}
+
+// receive waits for at least one packet and receives up to the batch size without waiting for more. The read
+// deadline of the socket applies.
+func (b *udpBatch) receive(bufLen int) error {
+	for i := range b.rcvMsgs {
+		if len(b.rcvBufs[i]) != bufLen {
+			b.rcvBufs[i] = make([]byte, bufLen)
+		}
+		b.rcvIovs[i].Base = &b.rcvBufs[i][0]
+		b.rcvIovs[i].SetLen(bufLen)
+		b.rcvMsgs[i].hdr = unix.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&b.rcvAddrs[i])),
+			Namelen: unix.SizeofSockaddrAny,
+			Iov:     &b.rcvIovs[i],
+		}
+		b.rcvMsgs[i].hdr.SetIovlen(1)
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := b.rawConn.Read(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&b.rcvMsgs[0])),
+			uintptr(len(b.rcvMsgs)), unix.MSG_DONTWAIT, 0, 0)
+		if e == unix.EAGAIN {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+
+	b.rcvCount = n
+	b.rcvPos = 0
+	return nil
+}
+
+func (b *udpBatch) putSockaddr(i int, remoteAddr netip.AddrPort) (nameLen uint32, err error) {
+	addr := remoteAddr.Addr()
+	if b.isIPv6 {
+		sa := &b.sndAddrs[i]
+		*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6, Addr: addr.As16()}
+		putSockaddrPort(&sa.Port, remoteAddr.Port())
+		return unix.SizeofSockaddrInet6, nil
+	}
+
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return 0, errors.New("IPv6 address on an IPv4 socket")
+	}
+	sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&b.sndAddrs[i]))
+	*sa = unix.RawSockaddrInet4{Family: unix.AF_INET, Addr: addr.As4()}
+	putSockaddrPort(&sa.Port, remoteAddr.Port())
+	return unix.SizeofSockaddrInet4, nil
+}
+
+// sockaddrToAddrPort converts the address of a received packet, like net.UDPConn, an IPv4 address on an
+// IPv6 socket stays mapped to IPv6
+func sockaddrToAddrPort(rsa *unix.RawSockaddrAny) netip.AddrPort {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), sockaddrPort(sa.Port))
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), sockaddrPort(sa.Port))
+	}
+	return netip.AddrPort{}
+}
+
+// the port of a sockaddr is in network byte order
+func putSockaddrPort(dst *uint16, p uint16) {
+	b := (*[2]byte)(unsafe.Pointer(dst))
+	b[0] = byte(p >> 8)
+	b[1] = byte(p)
+}
+
+func sockaddrPort(src uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&src))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
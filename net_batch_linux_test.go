@@ -0,0 +1,118 @@
+//go:build linux
+
+package qotp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestUDPConn(t testing.TB, addr string, batchSize int) (*UDPNetworkConn, netip.AddrPort) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	require.NoError(t, err)
+	conn, err := net.ListenUDP("udp", udpAddr)
+	require.NoError(t, err)
+	nc, err := newUDPNetworkConnBatch(conn, batchSize)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = nc.Close()
+	})
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	return nc.(*UDPNetworkConn), netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+}
+
+func TestNetUDPBatchSendReceive(t *testing.T) {
+	// the sender is an IPv6 socket, it sends to an IPv4 socket
+	sender, senderAddr := newTestUDPConn(t, ":0", 8)
+	receiver, receiverAddr := newTestUDPConn(t, "127.0.0.1:0", 8)
+	require.NotNil(t, sender.batch)
+	assert.True(t, sender.batch.isIPv6)
+	assert.False(t, receiver.batch.isIPv6)
+
+	// 10 packets, the first 8 are sent when the batch is full, the rest with endBatch
+	sender.beginBatch()
+	for i := 0; i < 10; i++ {
+		err := sender.WriteToUDPAddrPort([]byte(fmt.Sprintf("packet-%d", i)), receiverAddr, 0)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, sender.batch.sndCount)
+	assert.NoError(t, sender.endBatch())
+	assert.Equal(t, 0, sender.batch.sndCount)
+
+	buf := make([]byte, 1400)
+	for i := 0; i < 10; i++ {
+		n, addr, err := receiver.ReadFromUDPAddrPort(buf, uint64(time.Second), uint64(time.Now().UnixNano()))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("packet-%d", i), string(buf[:n]))
+		assert.Equal(t, senderAddr.Port(), addr.Port())
+	}
+
+	// without beginBatch, a packet is sent right away
+	err := receiver.WriteToUDPAddrPort([]byte("reply"), senderAddr, 0)
+	assert.NoError(t, err)
+	n, addr, err := sender.ReadFromUDPAddrPort(buf, uint64(time.Second), uint64(time.Now().UnixNano()))
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(buf[:n]))
+	assert.Equal(t, receiverAddr, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+}
+
+func TestNetUDPBatchReadTimeout(t *testing.T) {
+	receiver, _ := newTestUDPConn(t, "127.0.0.1:0", 8)
+
+	buf := make([]byte, 1400)
+	_, _, err := receiver.ReadFromUDPAddrPort(buf, uint64(10*time.Millisecond), uint64(time.Now().UnixNano()))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestNetUDPBatchIPv6OnIPv4Socket(t *testing.T) {
+	sender, _ := newTestUDPConn(t, "127.0.0.1:0", 8)
+
+	sender.beginBatch()
+	err := sender.WriteToUDPAddrPort([]byte("data"), netip.MustParseAddrPort("[2001:db8::1]:4242"), 0)
+	assert.Error(t, err)
+	assert.NoError(t, sender.endBatch())
+}
+
+// benchmarkUDP sends and receives 32 packets of 1400 bytes per iteration over loopback
+func benchmarkUDP(b *testing.B, batchSize int) {
+	sender, _ := newTestUDPConn(b, "127.0.0.1:0", batchSize)
+	receiver, receiverAddr := newTestUDPConn(b, "127.0.0.1:0", batchSize)
+	const packets = 32
+	data := make([]byte, 1400)
+	buf := make([]byte, 1400)
+
+	b.SetBytes(packets * int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sender.beginBatch()
+		for j := 0; j < packets; j++ {
+			if err := sender.WriteToUDPAddrPort(data, receiverAddr, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := sender.endBatch(); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < packets; j++ {
+			if _, _, err := receiver.ReadFromUDPAddrPort(buf, uint64(time.Second), uint64(time.Now().UnixNano())); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkUDPSingle(b *testing.B) {
+	benchmarkUDP(b, 1)
+}
+
+func BenchmarkUDPBatch(b *testing.B) {
+	benchmarkUDP(b, 32)
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package qotp
+
+import (
+	"net"
+	"net/netip"
+)
+
+// udpBatch is only available on Linux, elsewhere the packets are sent and received one by one
+type udpBatch struct{}
+
+func newUDPBatch(_ *net.UDPConn, _ int) (*udpBatch, error) {
+	return nil, nil
+}
+
+func (b *udpBatch) queue(_ []byte, _ netip.AddrPort) error {
+	return nil
+}
+
+func (b *udpBatch) send() error {
+	return nil
+}
+
+func (b *udpBatch) isBuffered() bool {
+	return false
+}
+
+func (b *udpBatch) read(_ []byte) (int, netip.AddrPort, error) {
+	return 0, netip.AddrPort{}, nil
+}
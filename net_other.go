@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+
+package qotp
+
+import (
+	"log/slog"
+	"net"
+)
+
+// setDontFragment is not implemented on this platform, the kernel may fragment packets larger than the path MTU
+func setDontFragment(_ *net.UDPConn) error {
+	slog.Warn("setting DF is not supported on this platform, packets may be fragmented")
+	return nil
+}
@@ -3,6 +3,7 @@ package qotp
 import (
 	"errors"
 	"log/slog"
+	"net"
 	"net/netip"
 	"os"
 	"sync"
@@ -26,6 +27,7 @@ type ConnPair struct {
 type PairedConn struct {
 	localAddr string
 	partner   *PairedConn
+	srcAddr   netip.AddrPort // the source address the partner reads, e.g., to simulate a NAT rebinding
 
 	// Write buffer
 	writeQueue   []packetData
@@ -36,8 +38,10 @@ type PairedConn struct {
 	readQueueMu sync.Mutex
 
 	latencyNano uint64 // One-way latency in nanoseconds
+	pathMtu     int    // larger packets are dropped, like on a path with a smaller MTU (0 = unlimited)
 	bandwidth   uint64 // Bandwidth in bits per second (0 = unlimited)
 	localTime   uint64
+	ecn         ecnCodepoint // the ECN field of the written packets, e.g., ecnCE for a congested router
 
 	closed bool
 }
@@ -45,8 +49,10 @@ type PairedConn struct {
 // packetData represents a UDP packet
 type packetData struct {
 	data        []byte
+	srcAddr     netip.AddrPort
 	remoteAddr  string
 	arrivalTime uint64
+	ecn         ecnCodepoint
 }
 
 // NewConnPair creates a pair of connected NetworkConn implementations
@@ -118,8 +124,14 @@ func newPairedConn(localAddr string) *PairedConn {
 
 // ReadFromUDPAddrPort reads data from the read queue
 func (p *PairedConn) ReadFromUDPAddrPort(buf []byte, timeoutNano uint64, nowNano uint64) (int, netip.AddrPort, error) {
+	n, srcAddr, _, err := p.readFromUDPAddrPortECN(buf, timeoutNano, nowNano)
+	return n, srcAddr, err
+}
+
+// readFromUDPAddrPortECN reads data from the read queue, with the ECN field the partner wrote it with
+func (p *PairedConn) readFromUDPAddrPortECN(buf []byte, timeoutNano uint64, nowNano uint64) (int, netip.AddrPort, ecnCodepoint, error) {
 	if p.isClosed() {
-		return 0, netip.AddrPort{}, errors.New("connection closed")
+		return 0, netip.AddrPort{}, ecnNotECT, errors.New("connection closed")
 	}
 
 	p.readQueueMu.Lock()
@@ -128,7 +140,7 @@ func (p *PairedConn) ReadFromUDPAddrPort(buf []byte, timeoutNano uint64, nowNano
 	if len(p.readQueue) == 0 {
 		p.localTime += timeoutNano
 		slog.Debug("    ReadUDP/no data/no queue", slog.Uint64("localTime", p.localTime))
-		return 0, netip.AddrPort{}, nil
+		return 0, netip.AddrPort{}, ecnNotECT, nil
 	}
 
 	packet := p.readQueue[0]
@@ -139,11 +151,11 @@ func (p *PairedConn) ReadFromUDPAddrPort(buf []byte, timeoutNano uint64, nowNano
 		p.readQueue = p.readQueue[1:]
 		n := copy(buf, packet.data)
 		slog.Debug("    ReadUDP", slog.Int("len(data)", len(buf)))
-		return n, netip.AddrPort{}, nil
+		return n, packet.srcAddr, packet.ecn, nil
 	} else {
 		p.localTime += timeoutNano
 		slog.Debug("    ReadUDP/no data/in queue", slog.Uint64("localTime", p.localTime))
-		return 0, netip.AddrPort{}, nil
+		return 0, netip.AddrPort{}, ecnNotECT, nil
 	}
 }
 
@@ -165,6 +177,10 @@ func (p *PairedConn) WriteToUDPAddrPort(b []byte, remoteAddr netip.AddrPort, now
 	if n != len(b) {
 		return errors.New("could not send all data. This should not happen")
 	}
+	if p.pathMtu > 0 && n > p.pathMtu {
+		slog.Debug("    WriteUDP/dropped, larger than path MTU", slog.Int("len(data)", n))
+		return nil
+	}
 
 	// Calculate transmission time based on bandwidth
 	// bandwidth is in bits per second, data is in bytes
@@ -182,8 +198,10 @@ func (p *PairedConn) WriteToUDPAddrPort(b []byte, remoteAddr netip.AddrPort, now
 	p.writeQueueMu.Lock()
 	p.writeQueue = append(p.writeQueue, packetData{
 		data:        dataCopy,
+		srcAddr:     p.srcAddr,
 		remoteAddr:  remoteAddr.String(),
 		arrivalTime: p.localTime + p.latencyNano + transmissionNano,
+		ecn:         p.ecn,
 	})
 	p.writeQueueMu.Unlock()
 
@@ -679,4 +697,16 @@ func TestNetCopyDataWithAbsoluteIndices(t *testing.T) {
 		n, _, _ = connPair5.Conn2.ReadFromUDPAddrPort(buffer, MinDeadLine, 0)
 		assert.Equal(t, 0, n)
 	})
-}
\ No newline at end of file
+}
+
+func TestNetSetDontFragment(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			t.Logf("no %s socket: %v", network, err)
+			continue
+		}
+		assert.NoError(t, setDontFragment(conn))
+		assert.NoError(t, conn.Close())
+	}
+}
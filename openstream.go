@@ -0,0 +1,105 @@
+package qotp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Opening streams. Stream(id) uses any stream ID, both sides have to agree on them. OpenBidiStream and
+// OpenUniStream pick the next free ID instead, and signal the new stream to the peer with an empty frame, so
+// that it is returned by its AcceptStream before any data is written. The lowest bit of these IDs is the side
+// that opened the stream, 0 for the dialer and 1 for the receiver, so that both sides can open streams at the
+// same time. The highest bit marks a unidirectional stream, only the side that opened it writes.
+
+// uniStreamBit is set in the ID of a unidirectional stream
+const uniStreamBit uint32 = 1 << 31
+
+var ErrStreamUnidirectional = errors.New("stream is unidirectional")
+
+// OpenBidiStream opens a new stream that both sides can read and write, the peer can accept it right away.
+// ErrStreamLimitReached is returned if WithMaxConcurrentStreams is reached.
+func (c *Conn) OpenBidiStream() (*Stream, error) {
+	return c.openStream(false, nil)
+}
+
+// OpenUniStream opens a new stream that only we write to, the peer can only read from it. Read returns
+// ErrStreamUnidirectional, as does Write of the peer. ErrStreamLimitReached is returned if
+// WithMaxConcurrentStreams is reached.
+func (c *Conn) OpenUniStream() (*Stream, error) {
+	return c.openStream(true, nil)
+}
+
+// OpenStreamWithData opens a new stream like OpenBidiStream, with data as its first frame instead of an empty
+// one, e.g., a request. On a new connection of DialWithCrypto, the data goes with InitCryptoSnd, the peer gets
+// it with the first packet. The data has to fit into the send buffer, otherwise no stream is opened.
+func (c *Conn) OpenStreamWithData(data []byte) (*Stream, error) {
+	if len(data) == 0 {
+		return c.openStream(false, nil)
+	}
+	if available := c.snd.available(); len(data) > available {
+		return nil, fmt.Errorf("data of %d bytes exceeds the %d bytes left in the send buffer", len(data), available)
+	}
+	return c.openStream(false, data)
+}
+
+// openStream opens the next stream, data is its first frame, without data the peer gets an empty frame. The ID
+// is picked and the stream is added under the lock of the connection, so that concurrent calls, and streams of
+// the peer that arrive meanwhile, never get the same ID.
+func (c *Conn) openStream(isUni bool, data []byte) (*Stream, error) {
+	c.mu.Lock()
+	if c.isCloseConnRequested || c.closeErr != nil {
+		c.mu.Unlock()
+		return nil, ErrConnectionClosed
+	}
+
+	streamID := c.streamIDNext
+	if isUni {
+		streamID = max(c.streamIDNextUni, uniStreamBit)
+	}
+	if streamID&1 != c.streamIDSide() {
+		streamID++
+	}
+	if isUniStream(streamID) != isUni {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: no stream ID left", ErrStreamLimitReached)
+	}
+	if c.isStreamLimitReached(streamID) {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: %d streams open", ErrStreamLimitReached, c.streams.Size())
+	}
+	s := c.Stream(streamID)
+	c.mu.Unlock()
+
+	slog.Debug("Stream/Open", gId(), s.debug(), slog.Bool("isUni", isUni), slog.Int("len(data)", len(data)))
+	if len(data) == 0 {
+		s.Ping()
+		return s, s.NotifyDataAvailable()
+	}
+	if _, err := s.Write(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// streamIDSide is the lowest bit of the IDs of the streams we open
+func (c *Conn) streamIDSide() uint32 {
+	if c.isSenderOnInit {
+		return 0
+	}
+	return 1
+}
+
+func isUniStream(streamID uint32) bool {
+	return streamID&uniStreamBit != 0
+}
+
+// isSendOnly returns true for a unidirectional stream we opened
+func (s *Stream) isSendOnly() bool {
+	return isUniStream(s.streamID) && s.streamID&1 == s.conn.streamIDSide()
+}
+
+// isReceiveOnly returns true for a unidirectional stream the peer opened
+func (s *Stream) isReceiveOnly() bool {
+	return isUniStream(s.streamID) && s.streamID&1 != s.conn.streamIDSide()
+}
@@ -0,0 +1,180 @@
+package qotp
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// deliverOpenStreamTest flushes a few times and delivers the packets of conn to peer, the ping that opens a
+// stream and its data are sent one after the other
+func deliverOpenStreamTest(t *testing.T, conn *Conn, peer *Listener, connPair *ConnPair, nowNano uint64) uint64 {
+	for range 3 {
+		nowNano = max(nowNano+secondNano, conn.nextWriteTime)
+		conn.listener.Flush(nowNano)
+		if conn.isSenderOnInit {
+			_, err := connPair.senderToRecipientAll()
+			assert.Nil(t, err)
+		} else {
+			_, err := connPair.recipientToSenderAll()
+			assert.Nil(t, err)
+		}
+		for connPair.nrIncomingPacketsRecipient()+connPair.nrIncomingPacketsSender() > 0 {
+			_, err := peer.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+	return nowNano
+}
+
+func TestOpenStream(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.isAccepting.Store(true) // as after Accept
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	s, err := connB.AcceptStream()
+	assert.Nil(t, err)
+	assert.Same(t, streamB, s)
+
+	// the dialer opens even streams, the receiver odd ones
+	openedA, err := connA.OpenBidiStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), openedA.streamID)
+	openedB, err := connB.OpenBidiStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), openedB.streamID)
+
+	// the peer accepts the stream before any data was written
+	nowNano := deliverOpenStreamTest(t, connA, listenerB, connPair, connPair.Conn1.localTime)
+	s, err = connB.AcceptStream()
+	assert.Nil(t, err)
+	assert.Equal(t, openedA.streamID, s.streamID)
+
+	// both sides write to it
+	_, err = s.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	deliverOpenStreamTest(t, connB, connA.listener, connPair, nowNano)
+	b, err := openedA.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hallo"), b)
+
+	// the next stream skips the IDs of the peer and of Stream
+	connA.Stream(7)
+	openedA, err = connA.OpenBidiStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(8), openedA.streamID)
+}
+
+func TestOpenUniStream(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.isAccepting.Store(true) // as after Accept
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	_, err := connB.AcceptStream()
+	assert.Nil(t, err)
+
+	uni, err := connA.OpenUniStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uniStreamBit, uni.streamID)
+	assert.Equal(t, uint32(1), connA.streamIDNext) // the bidirectional IDs are not used up
+	_, err = uni.Read()
+	assert.ErrorIs(t, err, ErrStreamUnidirectional)
+
+	_, err = uni.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	deliverOpenStreamTest(t, connA, listenerB, connPair, connPair.Conn1.localTime)
+	s, err := connB.AcceptStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uni.streamID, s.streamID)
+	b, err := s.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hallo"), b)
+	_, err = s.Write([]byte("back"))
+	assert.ErrorIs(t, err, ErrStreamUnidirectional)
+
+	uniB, err := connB.OpenUniStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uniStreamBit|1, uniB.streamID)
+	uni, err = connA.OpenUniStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uniStreamBit|2, uni.streamID)
+}
+
+func TestOpenStreamLimit(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	handshakeStreamTest(t, connA, listenerB, connPair)
+
+	connA.listener.maxStreams = 2
+	_, err := connA.OpenBidiStream()
+	assert.Nil(t, err)
+	_, err = connA.OpenBidiStream()
+	assert.ErrorIs(t, err, ErrStreamLimitReached)
+	_, err = connA.OpenUniStream()
+	assert.ErrorIs(t, err, ErrStreamLimitReached)
+
+	connA.streamIDNext = uniStreamBit - 1
+	connA.listener.maxStreams = 0
+	_, err = connA.OpenBidiStream()
+	assert.ErrorIs(t, err, ErrStreamLimitReached)
+
+	assert.Nil(t, connA.CloseConnection())
+	_, err = connA.OpenUniStream()
+	assert.ErrorIs(t, err, ErrConnectionClosed)
+}
+
+func TestOpenStreamConcurrent(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// streams opened at the same time get an ID each
+	var wg sync.WaitGroup
+	ids := make([]uint32, 20)
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := connA.OpenBidiStream()
+			assert.Nil(t, err)
+			ids[i] = s.streamID
+		}()
+	}
+	wg.Wait()
+	seen := map[uint32]bool{}
+	for _, id := range ids {
+		assert.False(t, seen[id], "stream ID %d used twice", id)
+		seen[id] = true
+	}
+	assert.Equal(t, len(ids)+1, connA.streams.Size())
+}
+
+func TestOpenStreamWithData(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+
+	_, err := connA.OpenStreamWithData(make([]byte, connA.snd.available()+1))
+	assert.Error(t, err)
+	assert.Zero(t, connA.streams.Size())
+
+	// the request goes with the init of the new connection
+	streamA, err := connA.OpenStreamWithData([]byte("GET /"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), streamA.streamID)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	assert.Equal(t, InitCryptoSnd, CryptoMsgType(connPair.Conn1.writeQueue[0].data[0]>>5))
+
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	var streamB *Stream
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+	}
+	if !assert.NotNil(t, streamB) {
+		return
+	}
+	assert.Equal(t, streamA.streamID, streamB.streamID)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("GET /"), b)
+}
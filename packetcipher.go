@@ -0,0 +1,164 @@
+package qotp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Packet ciphers protect the Data packets, see WithPacketCipher. The dialer offers one in its init, the
+// receiver replies with it if it accepts it, otherwise with ChaCha20-Poly1305, which every peer supports. The
+// inits are always sealed with ChaCha20-Poly1305, they are sent before anything is negotiated.
+
+// PacketCipher seals and opens the packets of one direction. The nonce needs to be 12 bytes and the tag 16
+// bytes, the sizes of the packets depend on it.
+type PacketCipher interface {
+	cipher.AEAD
+	// XorSn encrypts or decrypts the SN in src into dst, sample is the first 24 bytes of the sealed payload
+	XorSn(sample []byte, src []byte, dst []byte) error
+}
+
+// PacketCipherSuite creates the PacketCipher of a direction from the keys qotp derives with HKDF. New needs to
+// copy dataKey, it is zeroized afterwards, snKey is zeroized once the keys are dropped.
+type PacketCipherSuite struct {
+	ID      uint8 // sent in the init, 0 is ChaCha20-Poly1305
+	Name    string
+	KeySize int // of the payload key and of the SN key
+	New     func(dataKey []byte, snKey []byte) (PacketCipher, error)
+}
+
+// The built-in suites
+var (
+	chachaSuite = PacketCipherSuite{
+		ID:      0,
+		Name:    "ChaCha20-Poly1305",
+		KeySize: chacha20poly1305.KeySize,
+		New:     newChachaCipher,
+	}
+	aesGcmSuite = PacketCipherSuite{
+		ID:      1,
+		Name:    "AES-256-GCM",
+		KeySize: 32,
+		New:     newAesGcmCipher,
+	}
+)
+
+var (
+	packetCiphersMu sync.RWMutex
+	packetCiphers   = map[uint8]*PacketCipherSuite{chachaSuite.ID: &chachaSuite, aesGcmSuite.ID: &aesGcmSuite}
+)
+
+// RegisterPacketCipher adds a suite that WithPacketCipher can choose by its name, e.g., for hardware offload.
+// The ID and the name need to be unique, both peers need the same suite with the same ID.
+func RegisterPacketCipher(suite PacketCipherSuite) error {
+	if suite.Name == "" || suite.KeySize <= 0 || suite.New == nil {
+		return errors.New("packet cipher needs a name, a key size and New")
+	}
+	packetCiphersMu.Lock()
+	defer packetCiphersMu.Unlock()
+	for id, s := range packetCiphers {
+		if id == suite.ID || s.Name == suite.Name {
+			return fmt.Errorf("packet cipher %q with id %d is registered already", s.Name, id)
+		}
+	}
+	packetCiphers[suite.ID] = &suite
+	return nil
+}
+
+// WithRequirePacketCipher accepts only the packet cipher of WithPacketCipher, there is no fallback to
+// ChaCha20-Poly1305. The offer of InitSnd is not encrypted, so anyone on the path can change it and downgrade the
+// cipher. With this option, the dialer fails the handshake if the reply has another cipher, and the receiver
+// drops the inits that offer another one.
+func WithRequirePacketCipher() ListenFunc {
+	return func(o *ListenOption) error {
+		if o.isCipherRequired {
+			return errors.New("require packet cipher already set")
+		}
+		o.isCipherRequired = true
+		return nil
+	}
+}
+
+// acceptPacketCipher rejects the offer of another packet cipher, if one is required
+func (l *Listener) acceptPacketCipher(offered uint8) error {
+	if !l.isCipherRequired || offered == l.cipherSuite.ID {
+		return nil
+	}
+	return fmt.Errorf("%w: packet cipher %d offered, %q required", ErrConnectionRejected, offered, l.cipherSuite.Name)
+}
+
+// packetCipherByID returns the registered suite, nil if there is none
+func packetCipherByID(id uint8) *PacketCipherSuite {
+	packetCiphersMu.RLock()
+	defer packetCiphersMu.RUnlock()
+	return packetCiphers[id]
+}
+
+// packetCipherByName returns the registered suite, nil if there is none
+func packetCipherByName(name string) *PacketCipherSuite {
+	packetCiphersMu.RLock()
+	defer packetCiphersMu.RUnlock()
+	for _, s := range packetCiphers {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// chachaCipher is ChaCha20-Poly1305, the SN is encrypted with the keystream of XChaCha20, see xorSn
+type chachaCipher struct {
+	cipher.AEAD
+	snKey []byte
+}
+
+func newChachaCipher(dataKey []byte, snKey []byte) (PacketCipher, error) {
+	aead, err := chacha20poly1305.New(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(snKey) != chacha20.KeySize {
+		return nil, errors.New("SN key needs 32 bytes")
+	}
+	return &chachaCipher{AEAD: aead, snKey: snKey}, nil
+}
+
+func (c *chachaCipher) XorSn(sample []byte, src []byte, dst []byte) error {
+	return xorSn(c.snKey, sample, src, dst)
+}
+
+// aesGcmCipher is AES-256-GCM, the SN is encrypted with AES of the first 16 bytes of the sample, like the
+// header protection of QUIC
+type aesGcmCipher struct {
+	cipher.AEAD
+	sn cipher.Block
+}
+
+func newAesGcmCipher(dataKey []byte, snKey []byte) (PacketCipher, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sn, err := aes.NewCipher(snKey)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGcmCipher{AEAD: aead, sn: sn}, nil
+}
+
+func (c *aesGcmCipher) XorSn(sample []byte, src []byte, dst []byte) error {
+	var mask [aes.BlockSize]byte
+	c.sn.Encrypt(mask[:], sample[:aes.BlockSize])
+	subtle.XORBytes(dst[:len(src)], src, mask[:len(src)])
+	return nil
+}
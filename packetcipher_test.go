@@ -0,0 +1,149 @@
+package qotp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestPacketCipherRoundTrip(t *testing.T) {
+	for _, suite := range []*PacketCipherSuite{&chachaSuite, &aesGcmSuite} {
+		t.Run(suite.Name, func(t *testing.T) {
+			sharedSecret := randomBytes(32)
+			a, err := newAeads(sharedSecret, suite)
+			assert.Nil(t, err)
+			b, err := newAeads(sharedSecret, suite)
+			assert.Nil(t, err)
+
+			header := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+			encData, err := chainedEncryptAeads(1234, 5, true, a, nil, header, []byte("hello packet cipher"))
+			assert.Nil(t, err)
+			sn, epoch, packetData, err := chainedDecryptTo(nil, false, 5, b, nil, header, encData[len(header):])
+			assert.Nil(t, err)
+			assert.Equal(t, uint64(1234), sn)
+			assert.Equal(t, uint64(5), epoch)
+			assert.Equal(t, []byte("hello packet cipher"), packetData)
+		})
+	}
+
+	// the suites derive other keys from the same secret
+	sharedSecret := randomBytes(32)
+	chacha, err := newAeads(sharedSecret, &chachaSuite)
+	assert.Nil(t, err)
+	aesGcm, err := newAeads(sharedSecret, &aesGcmSuite)
+	assert.Nil(t, err)
+	assert.NotEqual(t, chacha.dirs[0].snKey, aesGcm.dirs[0].snKey)
+}
+
+func TestRegisterPacketCipher(t *testing.T) {
+	assert.Error(t, RegisterPacketCipher(PacketCipherSuite{ID: 200, Name: "test"}))
+	assert.Error(t, RegisterPacketCipher(PacketCipherSuite{ID: aesGcmSuite.ID, Name: "test", KeySize: 32,
+		New: newAesGcmCipher}))
+	assert.Error(t, RegisterPacketCipher(PacketCipherSuite{ID: 200, Name: aesGcmSuite.Name, KeySize: 32,
+		New: newAesGcmCipher}))
+	assert.Nil(t, packetCipherByName("test"))
+
+	assert.Nil(t, RegisterPacketCipher(PacketCipherSuite{ID: 200, Name: "AES-256-GCM test", KeySize: 32,
+		New: newAesGcmCipher}))
+	t.Cleanup(func() {
+		packetCiphersMu.Lock()
+		delete(packetCiphers, 200)
+		packetCiphersMu.Unlock()
+	})
+	assert.Equal(t, uint8(200), packetCipherByName("AES-256-GCM test").ID)
+	assert.Equal(t, "AES-256-GCM test", packetCipherByID(200).Name)
+
+	_, err := Listen(WithPacketCipher("unknown"))
+	assert.Error(t, err)
+	_, err = Listen(WithPacketCipher(aesGcmSuite.Name), WithPacketCipher(aesGcmSuite.Name))
+	assert.Error(t, err)
+	_, err = Listen(WithRequirePacketCipher())
+	assert.Error(t, err)
+	_, err = Listen(WithPacketCipher(aesGcmSuite.Name), WithRequirePacketCipher(), WithRequirePacketCipher())
+	assert.Error(t, err)
+}
+
+func TestPacketCipherSizes(t *testing.T) {
+	// XChaCha20-Poly1305 has a nonce of 24 bytes
+	xchacha := PacketCipherSuite{ID: 201, Name: "XChaCha20-Poly1305", KeySize: chacha20poly1305.KeySize,
+		New: func(dataKey []byte, snKey []byte) (PacketCipher, error) {
+			aead, err := chacha20poly1305.NewX(dataKey)
+			if err != nil {
+				return nil, err
+			}
+			return &chachaCipher{AEAD: aead, snKey: snKey}, nil
+		}}
+	_, err := newAeads(randomBytes(32), &xchacha)
+	assert.Error(t, err)
+}
+
+func TestPacketCipherNegotiation(t *testing.T) {
+	handshake := func(optionsA []ListenFunc, optionsB []ListenFunc) (streamA *Stream, streamB *Stream) {
+		connPair := NewConnPair("alice", "bob")
+		t.Cleanup(func() {
+			connPair.Conn1.Close()
+			connPair.Conn2.Close()
+		})
+		listenerA, err := Listen(append(optionsA, WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))...)
+		assert.Nil(t, err)
+		listenerB, err := Listen(append(optionsB, WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))...)
+		assert.Nil(t, err)
+		connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+		assert.Nil(t, err)
+		streamA, streamB = handshakeStreamTest(t, connA, listenerB, connPair)
+
+		// Data packets in both directions, sealed with the negotiated cipher, B only sends Data once it
+		// received Data
+		send := func(from *Stream, fromNet *PairedConn, to *Stream, toNet *PairedConn, msg string) {
+			_, err := from.Write([]byte(msg))
+			assert.Nil(t, err)
+			from.conn.listener.Flush(fromNet.localTime + secondNano)
+			_, err = fromNet.copyData()
+			assert.Nil(t, err)
+			var data []byte
+			for i := 0; i < 10 && data == nil; i++ {
+				_, err = to.conn.listener.Listen(MinDeadLine, toNet.localTime)
+				assert.Nil(t, err)
+				data, err = to.Read()
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, []byte(msg), data)
+		}
+		send(streamA, connPair.Conn1, streamB, connPair.Conn2, "from a")
+		send(streamB, connPair.Conn2, streamA, connPair.Conn1, "from b")
+		return streamA, streamB
+	}
+
+	// both opt in
+	streamA, streamB := handshake([]ListenFunc{WithPacketCipher("AES-256-GCM")},
+		[]ListenFunc{WithPacketCipher("AES-256-GCM")})
+	assert.Equal(t, &aesGcmSuite, streamA.conn.packetCipher())
+	assert.Equal(t, &aesGcmSuite, streamB.conn.packetCipher())
+	assert.Equal(t, "X25519-AES-256-GCM", streamA.conn.CryptoParams().CipherSuite)
+
+	// only one side opts in, ChaCha20-Poly1305 is used
+	streamA, streamB = handshake([]ListenFunc{WithPacketCipher("AES-256-GCM")}, nil)
+	assert.Equal(t, &chachaSuite, streamA.conn.packetCipher())
+	assert.Equal(t, &chachaSuite, streamB.conn.packetCipher())
+	assert.Equal(t, CipherSuite, streamB.conn.CryptoParams().CipherSuite)
+
+	streamA, streamB = handshake(nil, []ListenFunc{WithPacketCipher("AES-256-GCM")})
+	assert.Equal(t, &chachaSuite, streamA.conn.packetCipher())
+	assert.Equal(t, &chachaSuite, streamB.conn.packetCipher())
+
+	// a reply with a cipher that was not offered fails the handshake
+	assert.Error(t, streamA.conn.checkReplyParams(initParams{cipherID: aesGcmSuite.ID}))
+
+	// both require it
+	required := []ListenFunc{WithPacketCipher("AES-256-GCM"), WithRequirePacketCipher()}
+	streamA, streamB = handshake(required, required)
+	assert.Equal(t, &aesGcmSuite, streamA.conn.packetCipher())
+	assert.Equal(t, &aesGcmSuite, streamB.conn.packetCipher())
+	// a reply downgraded to ChaCha20-Poly1305 fails the handshake
+	assert.Error(t, streamA.conn.checkReplyParams(initParams{cipherID: chachaSuite.ID}))
+	// an offer of ChaCha20-Poly1305 is dropped
+	assert.ErrorIs(t, streamB.conn.listener.acceptPacketCipher(chachaSuite.ID), ErrConnectionRejected)
+	assert.Nil(t, streamB.conn.listener.acceptPacketCipher(aesGcmSuite.ID))
+}
@@ -0,0 +1,105 @@
+package qotp
+
+import "fmt"
+
+// Padding of Data packets, so that their size does not leak the size of the writes. A padded packet is sent
+// as DataPadded, the payload is prefixed with the filler length and the filler, like InitCryptoSnd. Both are
+// encrypted, the receiver strips them before the payload is decoded. Flow control and the in flight data
+// only count the user data, the padding only shows in the bytes sent and in the pacing.
+
+// PaddingMode sets which size Data packets are padded to
+type PaddingMode uint8
+
+const (
+	PaddingNone  PaddingMode = iota // the packet size follows the payload
+	PaddingBlock                    // padded to a multiple of the block size, at most to the MTU
+	PaddingMtu                      // every packet is padded to the MTU
+)
+
+func (m PaddingMode) String() string {
+	switch m {
+	case PaddingNone:
+		return "none"
+	case PaddingBlock:
+		return "block"
+	case PaddingMtu:
+		return "mtu"
+	}
+	return fmt.Sprintf("PaddingMode(%d)", uint8(m))
+}
+
+// checkPadding validates a padding mode, only PaddingBlock has a block size, it cannot exceed the MTU
+func checkPadding(mode PaddingMode, blockSize int, mtu int) error {
+	switch mode {
+	case PaddingNone, PaddingMtu:
+		if blockSize != 0 {
+			return fmt.Errorf("block size is only used with %v padding", PaddingBlock)
+		}
+	case PaddingBlock:
+		if blockSize <= 0 || blockSize > mtu {
+			return fmt.Errorf("block size %d needs to be between 1 and the mtu %d", blockSize, mtu)
+		}
+	default:
+		return fmt.Errorf("unknown padding mode %v", mode)
+	}
+	return nil
+}
+
+// SetPadding sets the padding of the Data packets of this connection, overriding WithPadding. It applies to
+// the packets sent from now on, also to retransmissions.
+func (c *Conn) SetPadding(mode PaddingMode, blockSize int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := checkPadding(mode, blockSize, c.listener.mtu); err != nil {
+		return err
+	}
+	c.paddingMode = mode
+	c.paddingBlock = blockSize
+	return nil
+}
+
+// paddingOverhead is the space of the filler length, a full packet still fits into the MTU with it
+func (c *Conn) paddingOverhead() int {
+	if c.paddingMode == PaddingNone {
+		return 0
+	}
+	return MsgInitFillLenSize
+}
+
+// paddingLen returns the filler length for a Data packet with packetLen bytes of payload. If isPadded is
+// false, the packet is sent as it is, a path MTU probe is larger than the MTU and has its size already.
+func (c *Conn) paddingLen(packetLen int) (fillLen int, isPadded bool) {
+	if c.paddingMode == PaddingNone {
+		return 0, false
+	}
+	size := MinDataSizeHdr + FooterDataSize + MsgInitFillLenSize + packetLen
+	mtu := c.dataMtu()
+	if size > mtu {
+		return 0, false
+	}
+	target := mtu
+	if c.paddingMode == PaddingBlock {
+		target = min(mtu, (size+c.paddingBlock-1)/c.paddingBlock*c.paddingBlock)
+	}
+	return target - size, true
+}
+
+// padData prepends the filler length and fillLen bytes of filler to packetData
+func padData(fillLen int, packetData []byte) []byte {
+	paddedPacketData := make([]byte, MsgInitFillLenSize+fillLen+len(packetData))
+	PutUint16(paddedPacketData, uint16(fillLen))
+	copy(paddedPacketData[MsgInitFillLenSize+fillLen:], packetData)
+	return paddedPacketData
+}
+
+// unpadData removes the filler length and the filler of padData
+func unpadData(packetData []byte) ([]byte, error) {
+	if len(packetData) < MsgInitFillLenSize {
+		return nil, fmt.Errorf("%w: padded packet is missing the filler length", ErrShortPayload)
+	}
+	start := MsgInitFillLenSize + int(Uint16(packetData))
+	if start > len(packetData) {
+		return nil, fmt.Errorf("%w: filler of %d bytes exceeds the packet", ErrShortPayload, start-MsgInitFillLenSize)
+	}
+	return packetData[start:], nil
+}
@@ -0,0 +1,140 @@
+package qotp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sendPaddingTest writes data on streamA, delivers it and returns the sizes of the packets on the wire
+func sendPaddingTest(t *testing.T, connPair *ConnPair, streamA *Stream, streamB *Stream, data []byte) (
+	sizes []int) {
+	_, err := streamA.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, streamA.Flush())
+	connA := streamA.conn
+	// no bandwidth estimate for a short pacing, all packets go out before the RTO
+	connA.srtt = 10 * msNano
+	connA.bwMax = 0
+	nowNano := connPair.Conn1.localTime + secondNano
+	for i := 0; i < 6; i++ {
+		nowNano = max(nowNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+	}
+	for _, p := range connPair.Conn1.writeQueue {
+		sizes = append(sizes, len(p.data))
+	}
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	var received []byte
+	for i := 0; i < 100 && len(received) < len(data); i++ {
+		_, err = streamB.conn.listener.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+		b, err := streamB.Read()
+		assert.Nil(t, err)
+		received = append(received, b...)
+	}
+	assert.Equal(t, data, received)
+	return sizes
+}
+
+func TestPaddingWireSize(t *testing.T) {
+	overhead := calcCryptoOverheadWithData(Data, nil, 0)
+	tests := []struct {
+		name      string
+		mode      PaddingMode
+		blockSize int
+		dataLen   int
+		sizes     []int
+	}{
+		{"none", PaddingNone, 0, 10, []int{overhead + 10}},
+		{"block small", PaddingBlock, 128, 10, []int{128}},
+		{"block exact", PaddingBlock, 128, 128 - overhead - MsgInitFillLenSize, []int{128}},
+		{"block next", PaddingBlock, 128, 200, []int{256}},
+		{"block capped at mtu", PaddingBlock, 1000, 1200, []int{1400}},
+		{"mtu", PaddingMtu, 0, 10, []int{1400}},
+		{"mtu full packets", PaddingMtu, 0, 3000, []int{1400, 1400, 1400}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connA, listenerB, connPair := setupStreamTest(t)
+			streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+			_, err := connPair.senderToRecipientAll()
+			assert.Nil(t, err)
+			// only the sender needs the padding, the receiver strips it from any DataPadded packet
+			assert.Nil(t, connA.SetPadding(tt.mode, tt.blockSize))
+
+			data := bytes.Repeat([]byte{'x'}, tt.dataLen)
+			sizes := sendPaddingTest(t, connPair, streamA, streamB, data)
+			assert.Equal(t, tt.sizes, sizes)
+		})
+	}
+}
+
+func TestPaddingFlowControl(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	_, err := connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	assert.Nil(t, connA.SetPadding(PaddingMtu, 0))
+	bytesSent := connA.bytesSent
+
+	// the padding shows on the wire, but not in the data in flight and not in the receive buffer of the peer
+	_, err = streamA.Write([]byte("small"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + secondNano)
+	assert.Equal(t, uint64(1400), connA.bytesSent-bytesSent)
+	assert.Equal(t, 5, connA.snd.InFlight(streamA.streamID))
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && streamB.conn.rcv.streamSize(streamB.streamID) == 0; i++ {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 5, streamB.conn.rcv.streamSize(streamB.streamID))
+}
+
+func TestPaddingOption(t *testing.T) {
+	_, err := Listen(WithPadding(PaddingBlock, 0))
+	assert.Error(t, err)
+	_, err = Listen(WithPadding(PaddingBlock, 2000))
+	assert.Error(t, err)
+	_, err = Listen(WithPadding(PaddingMtu, 128))
+	assert.Error(t, err)
+	_, err = Listen(WithPadding(PaddingMode(7), 0))
+	assert.Error(t, err)
+	_, err = Listen(WithPadding(PaddingMtu, 0), WithPadding(PaddingNone, 0))
+	assert.Error(t, err)
+
+	connPair := NewConnPair("alice", "bob")
+	l, err := Listen(WithNetworkConn(connPair.Conn1), WithPadding(PaddingBlock, 256))
+	assert.Nil(t, err)
+	assert.Equal(t, PaddingBlock, l.paddingMode)
+	assert.Equal(t, 256, l.paddingBlock)
+
+	// connections start with the padding of the listener, it can be changed per connection
+	conn, err := l.Dial(netip.AddrPort{})
+	assert.Nil(t, err)
+	assert.Equal(t, PaddingBlock, conn.paddingMode)
+	assert.Equal(t, 256, conn.paddingBlock)
+	assert.Error(t, conn.SetPadding(PaddingBlock, 0))
+	assert.Equal(t, PaddingBlock, conn.paddingMode)
+	assert.Nil(t, conn.SetPadding(PaddingNone, 0))
+	assert.Equal(t, PaddingNone, conn.paddingMode)
+}
+
+func TestUnpadData(t *testing.T) {
+	padded := padData(3, []byte("payload"))
+	assert.Equal(t, []byte{3, 0, 0, 0, 0}, padded[:5])
+	b, err := unpadData(padded)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("payload"), b)
+
+	_, err = unpadData([]byte{1})
+	assert.Error(t, err)
+	_, err = unpadData([]byte{10, 0, 0})
+	assert.Error(t, err)
+}
@@ -0,0 +1,158 @@
+package qotp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Parallel writes are an optimization for bulk transfers on paths with a large bandwidth-delay product, they
+// are not part of the protocol. WriteParallel shards the data round-robin in chunks across new streams, each
+// stream has its own loss recovery, so a lost packet does not hold back the other shards. Every shard starts
+// with a header, ParallelReader uses it to reassemble the data in order on the receiver:
+//
+//	Bytes 0-1:  shard index, the stream ID of the shard minus the stream ID of shard 0
+//	Bytes 2-3:  number of shards
+//	Bytes 4-7:  chunk size
+const (
+	parallelHdrSize   = 8
+	parallelChunkSize = 16 * 1024
+	maxParallelShards = 1<<16 - 1
+)
+
+var ErrParallelShard = errors.New("invalid parallel shard")
+
+// WriteParallel writes data across nStreams new streams and closes them, the receiver reads it with a
+// ParallelReader. The streams are the next stream IDs above all streams used so far. The data and the headers
+// need to fit into the send buffer, as a shard that is only written in part cannot be reassembled.
+func (c *Conn) WriteParallel(data []byte, nStreams int) (int, error) {
+	if nStreams < 1 || nStreams > maxParallelShards {
+		return 0, fmt.Errorf("number of streams %d needs to be between 1 and %d", nStreams, maxParallelShards)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if size, available := len(data)+nStreams*parallelHdrSize, c.snd.available(); size > available {
+		return 0, fmt.Errorf("parallel write of %d bytes exceeds the %d bytes left in the send buffer", size,
+			available)
+	}
+
+	firstID := c.streamIDNext
+	for i := 0; i < nStreams; i++ {
+		shard := make([]byte, parallelHdrSize, parallelHdrSize+len(data)/nStreams+parallelChunkSize)
+		PutUint16(shard, uint16(i))
+		PutUint16(shard[2:], uint16(nStreams))
+		PutUint32(shard[4:], parallelChunkSize)
+		for offset := i * parallelChunkSize; offset < len(data); offset += nStreams * parallelChunkSize {
+			shard = append(shard, data[offset:min(offset+parallelChunkSize, len(data))]...)
+		}
+
+		s := c.Stream(firstID + uint32(i))
+		n, err := s.Write(shard)
+		if err != nil {
+			return 0, err
+		}
+		if n < len(shard) {
+			return 0, fmt.Errorf("parallel shard %d written with %d of %d bytes", i, n, len(shard))
+		}
+		s.Close()
+	}
+	return len(data), nil
+}
+
+// ParallelReader reassembles the data of WriteParallel. It keeps the data of a shard until its stream ended,
+// and the shards of a transfer until all of them ended.
+type ParallelReader struct {
+	streams   map[uint32][]byte            // data of the shards, with the header, until their stream ended
+	transfers map[uint32]*parallelTransfer // by the stream ID of shard 0
+}
+
+type parallelTransfer struct {
+	chunkSize int
+	shards    [][]byte // nil until the stream of the shard ended
+	doneCount int
+}
+
+func NewParallelReader() *ParallelReader {
+	return &ParallelReader{
+		streams:   make(map[uint32][]byte),
+		transfers: make(map[uint32]*parallelTransfer),
+	}
+}
+
+// Read reads what arrived on s, the stream of a shard. Once all shards of its transfer ended, it returns the
+// data of the transfer, otherwise nil.
+func (r *ParallelReader) Read(s *Stream) ([]byte, error) {
+	streamID := s.StreamID()
+	for {
+		b, err := s.Read()
+		r.streams[streamID] = append(r.streams[streamID], b...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			delete(r.streams, streamID)
+			return nil, err
+		}
+		if len(b) == 0 {
+			return nil, nil
+		}
+	}
+
+	shard := r.streams[streamID]
+	delete(r.streams, streamID)
+	if len(shard) == 0 {
+		return nil, nil // the stream ended before
+	}
+	return r.onShardDone(streamID, shard)
+}
+
+// onShardDone adds the shard of a stream that ended to its transfer
+func (r *ParallelReader) onShardDone(streamID uint32, shard []byte) ([]byte, error) {
+	if len(shard) < parallelHdrSize {
+		return nil, fmt.Errorf("%w: stream %d ended before its header", ErrParallelShard, streamID)
+	}
+	index := uint32(Uint16(shard))
+	total := int(Uint16(shard[2:]))
+	chunkSize := int(Uint32(shard[4:]))
+	if index > streamID || int(index) >= total || chunkSize == 0 {
+		return nil, fmt.Errorf("%w: shard %d of %d on stream %d", ErrParallelShard, index, total, streamID)
+	}
+
+	firstID := streamID - index
+	t := r.transfers[firstID]
+	if t == nil {
+		t = &parallelTransfer{chunkSize: chunkSize, shards: make([][]byte, total)}
+		r.transfers[firstID] = t
+	}
+	if len(t.shards) != total || t.chunkSize != chunkSize || t.shards[index] != nil {
+		return nil, fmt.Errorf("%w: shard %d on stream %d does not match its transfer", ErrParallelShard, index,
+			streamID)
+	}
+	t.shards[index] = shard[parallelHdrSize:]
+	t.doneCount++
+	if t.doneCount < total {
+		return nil, nil
+	}
+
+	delete(r.transfers, firstID)
+	return t.reassemble(), nil
+}
+
+// reassemble takes the chunks round-robin from the shards, the data ends with the first shard that has no
+// chunk left
+func (t *parallelTransfer) reassemble() []byte {
+	size := 0
+	for _, shard := range t.shards {
+		size += len(shard)
+	}
+	data := make([]byte, 0, size)
+	for k := 0; ; k++ {
+		shard := t.shards[k%len(t.shards)]
+		offset := k / len(t.shards) * t.chunkSize
+		if offset >= len(shard) {
+			return data
+		}
+		data = append(data, shard[offset:min(offset+t.chunkSize, len(shard))]...)
+	}
+}
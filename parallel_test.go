@@ -0,0 +1,102 @@
+package qotp
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelWriteRead(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	_, err := connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	data := make([]byte, 5*parallelChunkSize+1000)
+	_, err = rand.Read(data)
+	assert.Nil(t, err)
+	n, err := connA.WriteParallel(data, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+	// the shards use the streams after stream 0 of the handshake
+	for i := uint32(1); i <= 4; i++ {
+		assert.NotNil(t, connA.streams.Get(i))
+	}
+	assert.Equal(t, uint32(5), connA.streamIDNext)
+
+	r := NewParallelReader()
+	var received []byte
+	for i := 0; i < 2000 && received == nil; i++ {
+		connA.srtt, connA.rttvar, connA.bwMax = 10*msNano, 1*msNano, 0
+		nowNano := max(connPair.Conn1.localTime, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+		connPair.Conn1.localTime = nowNano + msNano
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.Nil(t, err)
+		}
+		for id, s := range connB.streams.Iterator(nil) {
+			if id == 0 {
+				continue
+			}
+			b, err := r.Read(s)
+			assert.Nil(t, err)
+			if b != nil {
+				received = b
+			}
+		}
+		listenerB.Flush(connPair.Conn2.localTime)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, data, received)
+	assert.Empty(t, r.transfers)
+	assert.Empty(t, r.streams)
+}
+
+func TestParallelReassemble(t *testing.T) {
+	// 3 shards with a chunk size of 2, the last chunk is short
+	r := NewParallelReader()
+	shard := func(index uint16, payload string) []byte {
+		b := make([]byte, parallelHdrSize)
+		PutUint16(b, index)
+		PutUint16(b[2:], 3)
+		PutUint32(b[4:], 2)
+		return append(b, payload...)
+	}
+	b, err := r.onShardDone(12, shard(2, "ef"))
+	assert.Nil(t, err)
+	assert.Nil(t, b)
+	b, err = r.onShardDone(10, shard(0, "abg"))
+	assert.Nil(t, err)
+	assert.Nil(t, b)
+	_, err = r.onShardDone(12, shard(2, "ef"))
+	assert.ErrorIs(t, err, ErrParallelShard)
+	b, err = r.onShardDone(11, shard(1, "cd"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abcdefg"), b)
+
+	_, err = r.onShardDone(1, shard(2, "xx"))
+	assert.ErrorIs(t, err, ErrParallelShard)
+	_, err = r.onShardDone(1, []byte{0, 0})
+	assert.ErrorIs(t, err, ErrParallelShard)
+}
+
+func TestParallelWriteErrors(t *testing.T) {
+	connA, _, _ := setupStreamTest(t)
+	_, err := connA.WriteParallel([]byte("data"), 0)
+	assert.Error(t, err)
+	_, err = connA.WriteParallel(make([]byte, sndBufferCapacity), 2)
+	assert.Error(t, err)
+	n, err := connA.WriteParallel(nil, 2)
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+}
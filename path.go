@@ -0,0 +1,223 @@
+package qotp
+
+import (
+	"crypto/rand"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// defaultPathValidationTimeout is how long we wait for the path response of a new address of the peer
+const defaultPathValidationTimeout = uint64(3 * secondNano)
+
+// maxPathHistory is the number of addresses kept in the path history, see PathHistory
+const maxPathHistory = 16
+
+// PathInfo is an address of the peer the connection used, End is zero while it is the current one
+type PathInfo struct {
+	Addr  netip.AddrPort
+	Start time.Time
+	End   time.Time
+}
+
+// Path validation, e.g., after a NAT rebinding of the peer. Data packets from a new address are authenticated
+// and processed, but we keep sending to the old address. A path challenge with a random nonce is sent to the
+// new address, and only if the peer echoes the nonce in a path response within the path validation timeout,
+// the connection moves to the new address. The challenge is sent again each RTO until then.
+
+// OnMigration sets a callback that is called when the peer moved to a new, validated address
+func (c *Conn) OnMigration(cb func(oldAddr, newAddr net.Addr)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onMigration = cb
+}
+
+// RemoteAddr returns the validated address of the peer, where we send to
+func (c *Conn) RemoteAddr() netip.AddrPort {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remoteAddr
+}
+
+// PathHistory returns the addresses of the peer the connection sent to, the oldest first, with the time range
+// each was used. The current address has no end. Only the last maxPathHistory addresses are kept.
+func (c *Conn) PathHistory() []PathInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pathHistory) == 0 {
+		return []PathInfo{{Addr: c.remoteAddr, Start: c.pathStart()}}
+	}
+	return slices.Clone(c.pathHistory)
+}
+
+// onPathHistory ends the current address in the path history and starts the new one
+func (c *Conn) onPathHistory(newAddr netip.AddrPort, nowNano uint64) {
+	if len(c.pathHistory) == 0 {
+		c.pathHistory = append(c.pathHistory, PathInfo{Addr: c.remoteAddr, Start: c.pathStart()})
+	}
+	now := time.Unix(0, int64(nowNano))
+	c.pathHistory[len(c.pathHistory)-1].End = now
+	c.pathHistory = append(c.pathHistory, PathInfo{Addr: newAddr, Start: now})
+	if len(c.pathHistory) > maxPathHistory {
+		c.pathHistory = slices.Delete(c.pathHistory, 0, len(c.pathHistory)-maxPathHistory)
+	}
+}
+
+// pathStart is when the first address was used, the start of the connection
+func (c *Conn) pathStart() time.Time {
+	if c.startNano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(c.startNano))
+}
+
+// decodePath checks the source address of a data packet and handles its path frame
+func (c *Conn) decodePath(p *PayloadHeader, rAddr netip.AddrPort, nowNano uint64) {
+	c.mu.Lock()
+	oldAddr := c.remoteAddr
+	isMigrated := c.onPathFrame(p, rAddr, nowNano)
+	if !isSameAddr(rAddr, c.remoteAddr) {
+		c.onPathChange(rAddr, nowNano)
+	}
+	newAddr := c.remoteAddr
+	cb := c.onMigration
+	c.mu.Unlock()
+
+	// without the lock, the callback may use the connection
+	if isMigrated && cb != nil {
+		cb(net.UDPAddrFromAddrPort(oldAddr), net.UDPAddrFromAddrPort(newAddr))
+	}
+}
+
+func (c *Conn) onPathFrame(p *PayloadHeader, rAddr netip.AddrPort, nowNano uint64) (isMigrated bool) {
+	switch p.PathMsgType {
+	case PathChallenge:
+		// the peer sees a new address of ours, a new challenge moves us to a spare connection ID, see connid.go
+		if p.PathNonce != c.pathResponseNonce {
+			c.switchConnIdSpare()
+		}
+		// the response goes back on the path the challenge came from
+		c.pathResponseAddr = rAddr
+		c.pathResponseNonce = p.PathNonce
+		c.isPathResponsePending = true
+	case PathProbe:
+		// answered like a challenge, only the nonce is echoed, not the padding
+		c.pathResponseAddr = rAddr
+		c.pathResponseNonce = p.PathNonce
+		c.isPathResponsePending = true
+	case PathResponse:
+		if c.pmtuProbeSize != 0 && p.PathNonce == c.pmtuProbeNonce {
+			c.onPmtuProbeAcked()
+			return false
+		}
+		if !c.isPathValidating(nowNano) || p.PathNonce != c.pathChallengeNonce {
+			slog.Debug("PathResponse/Ignored", gId(), c.debug(), slog.String("addr", rAddr.String()))
+			return false
+		}
+		slog.Info("connection migrated", c.debug(), slog.String("old", c.remoteAddr.String()),
+			slog.String("new", c.pathChallengeAddr.String()))
+		c.onPathHistory(c.pathChallengeAddr, nowNano)
+		c.remoteAddr = c.pathChallengeAddr
+		c.isPathChallengePending = false
+		return true
+	}
+	return false
+}
+
+// onPathChange starts the validation of a new address of the peer
+func (c *Conn) onPathChange(rAddr netip.AddrPort, nowNano uint64) {
+	if c.isPathValidating(nowNano) && isSameAddr(rAddr, c.pathChallengeAddr) {
+		return
+	}
+
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		slog.Warn("no nonce for path challenge", c.debug(), slog.Any("error", err))
+		return
+	}
+	slog.Debug("PathChange", gId(), c.debug(), slog.String("old", c.remoteAddr.String()),
+		slog.String("new", rAddr.String()))
+	c.switchConnIdSpare()
+	c.pathChallengeAddr = rAddr
+	c.pathChallengeNonce = Uint64(nonce[:])
+	c.isPathChallengePending = true
+	c.pathChallengeStartNano = nowNano
+	c.isPathChallengeSent = false
+}
+
+// isSameAddr compares two addresses, an IPv4 address received on a dual stack socket is mapped to IPv6
+func isSameAddr(a netip.AddrPort, b netip.AddrPort) bool {
+	return a.Addr().Unmap() == b.Addr().Unmap() && a.Port() == b.Port()
+}
+
+func (l *Listener) pathValidationTimeout() uint64 {
+	if l.pathTimeoutNano == 0 {
+		return defaultPathValidationTimeout
+	}
+	return l.pathTimeoutNano
+}
+
+func (c *Conn) isPathValidating(nowNano uint64) bool {
+	return c.isPathChallengePending && nowNano < c.pathChallengeStartNano+c.listener.pathValidationTimeout()
+}
+
+// flushPath sends a pending path response or path challenge, both are small and do not wait for pacing. If
+// isSent is false, the stream continues with the regular flush.
+func (c *Conn) flushPath(s *Stream, ack *Ack, nowNano uint64) (
+	data int, pacingNano uint64, isSent bool, err error) {
+	if c.isPathResponsePending {
+		c.isPathResponsePending = false
+		data, pacingNano, err = c.writePathFrame(s, ack, PathResponse, c.pathResponseNonce, c.pathResponseAddr, nowNano)
+		return data, pacingNano, true, err
+	}
+
+	if !c.isPathChallengePending {
+		return 0, 0, false, nil
+	}
+	if !c.isPathValidating(nowNano) {
+		slog.Info("path validation failed, staying on the old address", c.debug(),
+			slog.String("addr", c.pathChallengeAddr.String()))
+		c.isPathChallengePending = false
+		return 0, 0, false, nil
+	}
+	if c.isPathChallengeSent && nowNano < c.pathChallengeSentNano+c.rtoNano() {
+		return 0, 0, false, nil
+	}
+
+	c.isPathChallengeSent = true
+	c.pathChallengeSentNano = nowNano
+	data, pacingNano, err = c.writePathFrame(s, ack, PathChallenge, c.pathChallengeNonce, c.pathChallengeAddr, nowNano)
+	return data, pacingNano, true, err
+}
+
+// writePathFrame sends a path frame on its own, with the ack if there is one, otherwise with an empty data header
+func (c *Conn) writePathFrame(s *Stream, ack *Ack, msgType PathMsgType, nonce uint64, addr netip.AddrPort,
+	nowNano uint64) (data int, pacingNano uint64, err error) {
+	p := &PayloadHeader{
+		PathMsgType: msgType,
+		PathNonce:   nonce,
+		Ack:         ack,
+		StreamID:    s.streamID,
+	}
+	var userData []byte
+	if ack == nil {
+		userData = []byte{}
+	}
+
+	encData, err := c.encode(p, userData, c.msgType())
+	if err != nil {
+		return 0, 0, err
+	}
+	err = c.listener.localConn.WriteToUDPAddrPort(encData, addr, nowNano)
+	if err != nil {
+		return 0, 0, err
+	}
+	slog.Debug(" Flush/Path", gId(), s.debug(), c.debug(), slog.Any("type", msgType),
+		slog.String("addr", addr.String()))
+
+	pacingNano = c.calcPacing(uint64(len(encData)))
+	c.nextWriteTime = nowNano + pacingNano
+	return 0, pacingNano, nil
+}
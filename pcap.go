@@ -2,12 +2,18 @@ package qotp
 
 import (
 	"crypto/ecdh"
+	"fmt"
 )
 
 // DecryptDataForPcap decrypts a QOTP Data packet for Wireshark/pcap analysis.
-// This uses sharedSecret which is the ephemeral shared secret (PFS).
+// This uses sharedSecret which is the ephemeral shared secret (PFS). Only the split nonce and
+// ChaCha20-Poly1305 are supported, not WithNonceXorIV or WithPacketCipher.
 func DecryptDataForPcap(encData []byte, isSenderOnInit bool, epoch uint64, sharedSecret []byte) ([]byte, error) {
-	msg, err := decryptData(encData, isSenderOnInit, epoch, sharedSecret)
+	a, err := newAeads(sharedSecret, &chachaSuite)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := decryptData(encData, isSenderOnInit, epoch, a, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -16,31 +22,42 @@ func DecryptDataForPcap(encData []byte, isSenderOnInit bool, epoch uint64, share
 
 // DecryptInitCryptoSndForPcap decrypts InitCryptoSnd packets using the identity shared secret (non-PFS).
 // This uses sharedSecretId which is computed as ECDH(prvKeyEpSnd, pubKeyIdRcv).
-// Note: This requires the receiver's private identity key to decrypt.
+// Note: This requires the receiver's private identity key to decrypt. The init parameters are stripped.
 func DecryptInitCryptoSndForPcap(encData []byte, prvKeyIdRcv *ecdh.PrivateKey, mtu int) ([]byte, error) {
 	_, _, msg, err := decryptInitCryptoSnd(encData, prvKeyIdRcv, mtu)
 	if err != nil {
 		return nil, err
 	}
-	return msg.PayloadRaw, nil
+	_, packetData, err := decodeInitParams(msg.PayloadRaw)
+	return packetData, err
 }
 
 // DecryptInitRcvForPcap decrypts InitRcv packets using the ephemeral shared secret (PFS).
-// This requires the sender's ephemeral private key.
+// This requires the sender's ephemeral private key. The stateless reset token and the init parameters are
+// stripped.
 func DecryptInitRcvForPcap(encData []byte, prvKeyEpSnd *ecdh.PrivateKey) ([]byte, error) {
 	_, _, _, msg, err := decryptInitRcv(encData, prvKeyEpSnd)
 	if err != nil {
 		return nil, err
 	}
-	return msg.PayloadRaw, nil
+	if len(msg.PayloadRaw) < ResetTokenSize {
+		return nil, fmt.Errorf("%w: InitRcv is missing the reset token", ErrShortPayload)
+	}
+	_, packetData, err := decodeInitParams(msg.PayloadRaw[ResetTokenSize:])
+	return packetData, err
 }
 
 // DecryptInitCryptoRcvForPcap decrypts InitCryptoRcv packets using the ephemeral shared secret (PFS).
-// This requires the sender's ephemeral private key.
+// This requires the sender's ephemeral private key. The stateless reset token and the init parameters are
+// stripped.
 func DecryptInitCryptoRcvForPcap(encData []byte, prvKeyEpSnd *ecdh.PrivateKey) ([]byte, error) {
 	_, _, msg, err := decryptInitCryptoRcv(encData, prvKeyEpSnd)
 	if err != nil {
 		return nil, err
 	}
-	return msg.PayloadRaw, nil
+	if len(msg.PayloadRaw) < ResetTokenSize {
+		return nil, fmt.Errorf("%w: InitCryptoRcv is missing the reset token", ErrShortPayload)
+	}
+	_, packetData, err := decodeInitParams(msg.PayloadRaw[ResetTokenSize:])
+	return packetData, err
 }
\ No newline at end of file
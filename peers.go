@@ -0,0 +1,205 @@
+package qotp
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+)
+
+var (
+	errPeerDenied     = errors.New("identity key is denied")
+	errPeerNotAllowed = errors.New("identity key is not allowed")
+	errPeerUnknown    = errors.New("identity key is not known")
+)
+
+// Allow and deny lists of identity keys, see WithAllowedPeers and WithDeniedPeers. Unlike the accept filter,
+// the lists are checked as soon as the init arrives: the identity key of the peer is in clear in InitSnd and
+// InitCryptoSnd, so a rejected init costs neither an ECDH nor any connection state. The lists can be changed
+// while the listener runs, a change applies to the next init. The keys are compared in constant time, see
+// isKeyAllowed. Peers with an Ed25519 identity are rejected if there is an allow list. With WithRequireKnownPeer,
+// a key pinned for the address of the peer in the key store is known as well, and there is always an allow list,
+// empty if none is set.
+
+// peerList holds the allowed and the denied identity keys, nil allowed means every key that is not denied
+type peerList struct {
+	mu      sync.Mutex
+	allowed [][]byte
+	denied  [][]byte
+}
+
+// check returns an error if the key is denied, or if there is an allow list without it
+func (p *peerList) check(key []byte) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if isKeyAllowed(p.denied, key) {
+		return errPeerDenied
+	}
+	if p.allowed != nil && !isKeyAllowed(p.allowed, key) {
+		return errPeerNotAllowed
+	}
+	return nil
+}
+
+func (p *peerList) isAllowed(key []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return isKeyAllowed(p.allowed, key)
+}
+
+func (p *peerList) hasAllowList() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.allowed != nil
+}
+
+// WithAllowedPeers accepts only peers with one of these identity keys, see AllowPeer and DenyPeer to change the
+// list later. An empty list accepts no peer until one is allowed. WithPublicKeyAllowList sets the same list.
+func WithAllowedPeers(keys []*ecdh.PublicKey) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.allowedPeers != nil {
+			return errors.New("allowed peers already set")
+		}
+		allowed, err := peerKeys(keys)
+		if err != nil {
+			return fmt.Errorf("allowed peers: %w", err)
+		}
+		o.allowedPeers = allowed
+		return nil
+	}
+}
+
+// WithDeniedPeers drops the inits of peers with one of these identity keys, a denied key is dropped even if it
+// is allowed
+func WithDeniedPeers(keys []*ecdh.PublicKey) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.deniedPeers != nil {
+			return errors.New("denied peers already set")
+		}
+		denied, err := peerKeys(keys)
+		if err != nil {
+			return fmt.Errorf("denied peers: %w", err)
+		}
+		o.deniedPeers = denied
+		return nil
+	}
+}
+
+func peerKeys(keys []*ecdh.PublicKey) ([][]byte, error) {
+	if keys == nil {
+		return nil, errors.New("not set")
+	}
+	b := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if key == nil {
+			return nil, errors.New("nil key")
+		}
+		b = append(b, key.Bytes())
+	}
+	return b, nil
+}
+
+// WithRequireKnownPeer accepts only peers with an identity key on the allow list, see WithAllowedPeers, or with
+// the key pinned for their address in the key store, see WithKeyStore. Without an allow list, it starts empty,
+// see AllowPeer. The inits of other peers are dropped without a reply, so a scanner cannot tell that we listen.
+func WithRequireKnownPeer() ListenFunc {
+	return func(o *ListenOption) error {
+		if o.isRequireKnownPeer {
+			return errors.New("require known peer already set")
+		}
+		o.isRequireKnownPeer = true
+		return nil
+	}
+}
+
+// AllowPeer removes the key from the deny list and adds it to the allow list, if there is one. It applies to
+// the next init of the peer.
+func (l *Listener) AllowPeer(pubKey *ecdh.PublicKey) {
+	key := pubKey.Bytes()
+	l.peers.mu.Lock()
+	l.peers.denied = removeKey(l.peers.denied, key)
+	if l.peers.allowed != nil && !isKeyAllowed(l.peers.allowed, key) {
+		l.peers.allowed = append(l.peers.allowed, key)
+	}
+	l.peers.mu.Unlock()
+	slog.Debug("Peers/Allow", gId(), l.debug(), slog.Any("pubKey", pubKey))
+}
+
+// DenyPeer adds the key to the deny list and removes it from the allow list. The inits of the peer are dropped
+// from now on, with isCloseConns its connections to us are closed as well.
+func (l *Listener) DenyPeer(pubKey *ecdh.PublicKey, isCloseConns bool) {
+	key := pubKey.Bytes()
+	l.peers.mu.Lock()
+	l.peers.allowed = removeKey(l.peers.allowed, key)
+	if !isKeyAllowed(l.peers.denied, key) {
+		l.peers.denied = append(l.peers.denied, key)
+	}
+	l.peers.mu.Unlock()
+	slog.Debug("Peers/Deny", gId(), l.debug(), slog.Any("pubKey", pubKey), slog.Bool("closeConns", isCloseConns))
+
+	if !isCloseConns {
+		return
+	}
+	for _, conn := range l.connMap.Iterator(nil) {
+		if conn.isSenderOnInit || conn.pubKeyIdRcv == nil || !conn.pubKeyIdRcv.Equal(pubKey) {
+			continue
+		}
+		if err := conn.CloseConnection(); err != nil {
+			slog.Info("close of denied peer", conn.debug(), slog.Any("error", err))
+		}
+	}
+}
+
+// removeKey returns the keys without key, it keeps a nil or an empty list as it is
+func removeKey(keys [][]byte, key []byte) [][]byte {
+	kept := keys[:0]
+	for _, k := range keys {
+		if !isKeyAllowed([][]byte{k}, key) {
+			kept = append(kept, k)
+		}
+	}
+	return kept
+}
+
+// acceptPeer checks the identity key of an InitSnd or InitCryptoSnd before it is decrypted
+func (l *Listener) acceptPeer(msgType CryptoMsgType, encData []byte, rAddr netip.AddrPort) error {
+	if msgType != InitSnd && msgType != InitCryptoSnd {
+		return nil
+	}
+	if len(encData) < HeaderSize+(2*PubKeySize) {
+		return fmt.Errorf("%w: %v of %d bytes", ErrShortHeader, msgType, len(encData))
+	}
+	key := encData[HeaderSize+PubKeySize : HeaderSize+(2*PubKeySize)]
+	err := l.peers.check(key)
+	if l.isRequireKnownPeer && !errors.Is(err, errPeerDenied) {
+		err = nil
+		if !l.peers.isAllowed(key) && !l.isPinnedPeer(rAddr, key) {
+			err = errPeerUnknown
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConnectionRejected, err)
+	}
+	return nil
+}
+
+// isPinnedPeer is true if the key store has the key for the address
+func (l *Listener) isPinnedPeer(rAddr netip.AddrPort, key []byte) bool {
+	if l.keyStore == nil {
+		return false
+	}
+	pinned, err := l.keyStore.Get(rAddr)
+	if err != nil {
+		slog.Info("key store", l.debug(), slog.Any("error", err))
+		return false
+	}
+	return pinned != nil && isKeyAllowed([][]byte{pinned.Bytes()}, key)
+}
@@ -0,0 +1,148 @@
+package qotp
+
+import (
+	"crypto/ecdh"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sendInitPeersTest sends the init of A to B, it returns the error of the peer check of B for the init
+func sendInitPeersTest(t *testing.T, connA *Conn, listenerB *Listener, connPair *ConnPair) error {
+	_, err := connA.Stream(0).Write([]byte("hallo"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	assert.NotEmpty(t, connPair.Conn1.writeQueue)
+	init := connPair.Conn1.writeQueue[0].data
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	listenerB.Flush(connPair.Conn2.localTime)
+	return listenerB.acceptPeer(InitCryptoSnd, init, connA.remoteAddr)
+}
+
+func TestPeersDenied(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.DenyPeer(testPrvKey1.PublicKey(), false)
+
+	// dropped before the ECDH: no state and no reply
+	assert.ErrorIs(t, sendInitPeersTest(t, connA, listenerB, connPair), errPeerDenied)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+
+	// allowed again, the next init is accepted
+	connA, listenerB, connPair = setupStreamTest(t)
+	listenerB.DenyPeer(testPrvKey1.PublicKey(), false)
+	listenerB.AllowPeer(testPrvKey1.PublicKey())
+	handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+}
+
+func TestPeersAllowed(t *testing.T) {
+	// an empty allow list accepts no peer
+	connA, listenerB, connPair := setupStreamTest(t)
+	listenerB.peers.allowed = [][]byte{}
+	err := sendInitPeersTest(t, connA, listenerB, connPair)
+	assert.ErrorIs(t, err, ErrConnectionRejected)
+	assert.ErrorIs(t, err, errPeerNotAllowed)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+	assert.ErrorIs(t, listenerB.acceptConnEd25519(nil, connA.remoteAddr), errPeerNotAllowed)
+
+	connA, listenerB, connPair = setupStreamTest(t)
+	listenerB.peers.allowed = [][]byte{}
+	listenerB.AllowPeer(testPrvKey1.PublicKey())
+	listenerB.AllowPeer(testPrvKey1.PublicKey())
+	assert.Len(t, listenerB.peers.allowed, 1)
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// denied with isCloseConns, the connection is closed as well
+	listenerB.DenyPeer(testPrvKey1.PublicKey(), true)
+	assert.Empty(t, listenerB.peers.allowed)
+	assert.NotNil(t, listenerB.peers.allowed)
+	assert.True(t, streamB.conn.isCloseConnRequested)
+}
+
+func TestPeersOption(t *testing.T) {
+	keys := []*ecdh.PublicKey{testPrvKey1.PublicKey()}
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"), WithAllowedPeers(keys), WithDeniedPeers(keys))
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	assert.ErrorIs(t, listener.peers.check(testPrvKey1.PublicKey().Bytes()), errPeerDenied)
+	assert.ErrorIs(t, listener.peers.check(testPrvKey2.PublicKey().Bytes()), errPeerNotAllowed)
+
+	_, err = Listen(WithAllowedPeers(nil))
+	assert.Error(t, err)
+	_, err = Listen(WithDeniedPeers([]*ecdh.PublicKey{nil}))
+	assert.Error(t, err)
+	_, err = Listen(WithAllowedPeers(keys), WithAllowedPeers(keys))
+	assert.Error(t, err)
+	_, err = Listen(WithDeniedPeers(keys), WithDeniedPeers(keys))
+	assert.Error(t, err)
+}
+
+func TestPeersRequireKnown(t *testing.T) {
+	// setupRequireKnown is B as with WithRequireKnownPeer
+	setupRequireKnown := func() (*Conn, *Listener, *ConnPair) {
+		connA, listenerB, connPair := setupStreamTest(t)
+		listenerB.isRequireKnownPeer = true
+		listenerB.peers.allowed = [][]byte{}
+		return connA, listenerB, connPair
+	}
+
+	// an unknown key gets no reply
+	connA, listenerB, connPair := setupRequireKnown()
+	assert.ErrorIs(t, sendInitPeersTest(t, connA, listenerB, connPair), errPeerUnknown)
+	assert.Equal(t, 0, listenerB.connMap.Size())
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsReceiver())
+
+	// known from the allow list
+	connA, listenerB, connPair = setupRequireKnown()
+	listenerB.AllowPeer(testPrvKey1.PublicKey())
+	handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+
+	// known from the key store, for the address of A
+	connA, listenerB, connPair = setupRequireKnown()
+	keyStore := NewMemoryKeyStore()
+	assert.Nil(t, keyStore.Put(netip.AddrPort{}, testPrvKey1.PublicKey()))
+	listenerB.keyStore = keyStore
+	handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.Equal(t, 1, listenerB.connMap.Size())
+
+	// a pinned key that is denied stays denied
+	init := make([]byte, HeaderSize+(2*PubKeySize))
+	copy(init[HeaderSize+PubKeySize:], testPrvKey1.PublicKey().Bytes())
+	assert.Nil(t, listenerB.acceptPeer(InitSnd, init, netip.AddrPort{}))
+	listenerB.DenyPeer(testPrvKey1.PublicKey(), false)
+	assert.ErrorIs(t, listenerB.acceptPeer(InitSnd, init, netip.AddrPort{}), errPeerDenied)
+
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"), WithRequireKnownPeer())
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	assert.NotNil(t, listener.peers.allowed)
+	_, err = Listen(WithRequireKnownPeer(), WithRequireKnownPeer())
+	assert.Error(t, err)
+}
+
+func TestPeersPublicKeyAllowList(t *testing.T) {
+	// the allow list of WithPublicKeyAllowList is the one of the peers, also for WithRequireKnownPeer
+	keys := []*ecdh.PublicKey{testPrvKey1.PublicKey()}
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"), WithRequireKnownPeer(), WithPublicKeyAllowList(keys))
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	init := make([]byte, HeaderSize+(2*PubKeySize))
+	copy(init[HeaderSize+PubKeySize:], testPrvKey1.PublicKey().Bytes())
+	assert.Nil(t, listener.acceptPeer(InitSnd, init, netip.AddrPort{}))
+	copy(init[HeaderSize+PubKeySize:], testPrvKey2.PublicKey().Bytes())
+	assert.ErrorIs(t, listener.acceptPeer(InitSnd, init, netip.AddrPort{}), errPeerUnknown)
+
+	// the list can be changed at runtime
+	listener.AllowPeer(testPrvKey2.PublicKey())
+	assert.Nil(t, listener.acceptPeer(InitSnd, init, netip.AddrPort{}))
+
+	_, err = Listen(WithPublicKeyAllowList(keys), WithAllowedPeers(keys))
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package qotp
+
+import (
+	"crypto/rand"
+	"log/slog"
+)
+
+// Path MTU discovery, enabled with WithMaxMtu. Once the handshake is done, a path probe padded to the probed
+// size is sent, the peer echoes its nonce in a path response. The search is binary, between the validated
+// MTU, which starts with the MTU of WithMtu, and the max MTU. A probe that is not answered after
+// pmtuProbeMaxAttempts, or a validated size the MTU increase policy vetoes, lowers the upper bound. The MTU
+// only goes below the MTU of WithMtu, the base that always has to work, for a black hole, see blackhole.go.
+const (
+	// pmtuSearchGranularity ends the search once the bounds are this close
+	pmtuSearchGranularity = 16
+	// pmtuProbeMaxAttempts is how often a probe of the same size is sent, a probe can also be lost by chance
+	pmtuProbeMaxAttempts = 3
+)
+
+// maxPmtu is the largest packet we send or receive, the MTU if path MTU discovery is disabled
+func (l *Listener) maxPmtu() int {
+	return max(l.mtu, l.maxMtu)
+}
+
+// Mtu returns the size of the Data packets of the connection, it grows with path MTU discovery
+func (c *Conn) Mtu() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dataMtu()
+}
+
+// dataMtu is the size of Data packets, the MTU of the listener until path MTU discovery validated a larger one,
+// or the halved size of a black hole
+func (c *Conn) dataMtu() int {
+	if c.blackHoleMtu != 0 {
+		return c.blackHoleMtu
+	}
+	return max(c.pmtu, c.listener.mtu)
+}
+
+// isPmtuSearching is true while there is a size between the validated MTU and the upper bound left to probe
+func (c *Conn) isPmtuSearching() bool {
+	return c.blackHoleMtu == 0 && c.pmtuSearchHigh-c.dataMtu() >= pmtuSearchGranularity
+}
+
+// onPmtuProbeAcked is called with the path response to our probe. The validated size is only used if the
+// MTU increase policy accepts it, otherwise the search continues below it.
+func (c *Conn) onPmtuProbeAcked() {
+	size := c.pmtuProbeSize
+	c.pmtuProbeSize = 0
+	if policy := c.listener.mtuIncreasePolicy; policy != nil && !policy(c.dataMtu(), size) {
+		slog.Debug("PmtuProbe/Vetoed", gId(), c.debug(), slog.Int("size", size))
+		c.pmtuSearchHigh = size - 1
+		return
+	}
+	slog.Debug("PmtuProbe/Acked", gId(), c.debug(), slog.Int("old", c.dataMtu()), slog.Int("new", size))
+	c.pmtu = size
+}
+
+// flushPmtuProbe sends the next probe, or the same again after an RTO without response. Like data, a probe
+// waits for pacing. The ack is kept for the next packet, as the probe is padded to its size already. If isSent
+// is false, the stream continues with the regular flush.
+func (c *Conn) flushPmtuProbe(s *Stream, ack *Ack, nowNano uint64) (
+	data int, pacingNano uint64, isSent bool, err error) {
+	if c.pmtuProbeSize != 0 && nowNano < c.pmtuProbeSentNano+c.rtoNano() {
+		return 0, 0, false, nil
+	}
+	if c.pmtuProbeSize != 0 && c.pmtuProbeAttempts >= pmtuProbeMaxAttempts {
+		// the path drops packets of this size
+		slog.Debug("PmtuProbe/Lost", gId(), c.debug(), slog.Int("size", c.pmtuProbeSize))
+		c.pmtuSearchHigh = c.pmtuProbeSize - 1
+		c.pmtuProbeSize = 0
+	}
+	if c.pmtuProbeSize == 0 {
+		if !c.isPmtuSearching() {
+			return 0, 0, false, nil
+		}
+		var nonce [8]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			slog.Warn("no nonce for path MTU probe", c.debug(), slog.Any("error", err))
+			return 0, 0, false, nil
+		}
+		c.pmtuProbeSize = c.dataMtu() + (c.pmtuSearchHigh-c.dataMtu()+1)/2
+		c.pmtuProbeNonce = Uint64(nonce[:])
+		c.pmtuProbeAttempts = 0
+	}
+
+	c.pmtuProbeAttempts++
+	c.pmtuProbeSentNano = nowNano
+	c.pendingAck = ack
+	data, pacingNano, err = c.writePmtuProbe(s, nowNano)
+	return data, pacingNano, true, err
+}
+
+// writePmtuProbe sends a path probe on its own, padded to pmtuProbeSize. The padding is sent as user data, the
+// peer does not read the user data of path frames.
+func (c *Conn) writePmtuProbe(s *Stream, nowNano uint64) (data int, pacingNano uint64, err error) {
+	p := &PayloadHeader{
+		PathMsgType: PathProbe,
+		PathNonce:   c.pmtuProbeNonce,
+		StreamID:    s.streamID,
+	}
+	overhead := calcCryptoOverheadWithData(Data, nil, 0) + calcExtLen(ExtPath)
+	padding := make([]byte, c.pmtuProbeSize-overhead)
+
+	encData, err := c.encode(p, padding, Data)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = c.listener.localConn.WriteToUDPAddrPort(encData, c.remoteAddr, nowNano)
+	if err != nil {
+		return 0, 0, err
+	}
+	slog.Debug(" Flush/PmtuProbe", gId(), s.debug(), c.debug(), slog.Int("size", len(encData)),
+		slog.Int("attempt", c.pmtuProbeAttempts))
+
+	pacingNano = c.calcPacing(uint64(len(encData)))
+	c.nextWriteTime = nowNano + pacingNano
+	return 0, pacingNano, nil
+}
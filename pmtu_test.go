@@ -0,0 +1,92 @@
+package qotp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupPmtuTest connects A and B over a path that drops packets larger than pathMtu, both probe up to 1500
+func setupPmtuTest(t *testing.T, pathMtu int, options ...ListenFunc) (connA *Conn, connB *Conn, connPair *ConnPair) {
+	connPair = NewConnPair("alice", "bob")
+	connPair.Conn1.bandwidth, connPair.Conn2.bandwidth = 0, 0
+	connPair.Conn1.pathMtu, connPair.Conn2.pathMtu = pathMtu, pathMtu
+	listenerA, err := Listen(append(options, WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1),
+		WithMaxMtu(1500))...)
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2), WithMaxMtu(1500))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err = listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.NotNil(t, streamA)
+	return connA, streamB.conn, connPair
+}
+
+// exchangePmtuTest flushes and delivers packets in both directions until A stopped probing
+func exchangePmtuTest(t *testing.T, connA *Conn, connB *Conn, connPair *ConnPair) {
+	nowNano := connPair.Conn1.localTime
+	for i := 0; i < 50 && (connA.isPmtuSearching() || connA.pmtuProbeSize != 0); i++ {
+		nowNano += secondNano // past the pacing and the RTO of both
+		connA.listener.Flush(nowNano)
+		_, err := connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = connB.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		connB.listener.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+	assert.False(t, connA.isPmtuSearching())
+	assert.Zero(t, connA.pmtuProbeSize)
+}
+
+func TestPmtuDiscovery(t *testing.T) {
+	connA, connB, connPair := setupPmtuTest(t, 1480)
+	assert.Equal(t, 1400, connA.Mtu())
+
+	exchangePmtuTest(t, connA, connB, connPair)
+	assert.Greater(t, connA.Mtu(), 1480-pmtuSearchGranularity)
+	assert.LessOrEqual(t, connA.Mtu(), 1480)
+
+	// data is sent in packets of the new MTU
+	streamA := connA.Stream(0)
+	_, err := streamA.Write(make([]byte, 4000))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + 10*secondNano)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	assert.Equal(t, connA.Mtu(), len(connPair.Conn1.writeQueue[0].data))
+}
+
+func TestPmtuIncreasePolicy(t *testing.T) {
+	var proposals []int
+	policy := func(current, proposed int) bool {
+		proposals = append(proposals, proposed)
+		return proposed <= 1450
+	}
+	connA, connB, connPair := setupPmtuTest(t, 1480, WithMTUIncreasePolicy(policy))
+
+	exchangePmtuTest(t, connA, connB, connPair)
+	assert.Equal(t, 1450, connA.Mtu())
+	// the probes above the cap made it through the path, but were vetoed
+	assert.Equal(t, []int{1450, 1475, 1462}, proposals)
+}
+
+func TestPmtuDisabled(t *testing.T) {
+	connA, _, _ := setupStreamTest(t)
+	assert.False(t, connA.isPmtuSearching())
+	assert.Equal(t, connA.listener.mtu, connA.Mtu())
+
+	_, err := Listen(WithMtu(1400), WithMaxMtu(1300))
+	assert.Error(t, err)
+}
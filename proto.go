@@ -2,31 +2,89 @@ package qotp
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"math/bits"
 )
 
 const (
 	ProtoVersion     = 0
+	ExtFlag          = 4
 	TypeFlag         = 5
 	Offset24or48Flag = 7
 	MinProtoSize     = 8
 )
 
+// Extension flags, sent in an additional byte after the header byte if ExtFlag is set
+const (
+	ExtCloseConn = 1 << iota
+	ExtLimitError
+	ExtReset // followed by a 4 byte error code
+	ExtCloseWrite
+	ExtCloseRead
+	ExtStreamRcvWnd // followed by 1 byte, the receive window of the acked stream
+	ExtPath         // followed by 1 byte PathMsgType and an 8 byte nonce
+
+	extKnownFlags = ExtCloseConn | ExtLimitError | ExtReset | ExtCloseWrite | ExtCloseRead | ExtStreamRcvWnd |
+		ExtPath
+	// extAckFlags are the flags that refer to the ack, they are allowed on ACK-only packets
+	extAckFlags = ExtStreamRcvWnd
+	// extConnFlags refer to the connection, not to a stream, they are allowed on any packet
+	extConnFlags = ExtPath
+)
+
+// PathMsgType is the type of a path validation frame, see path.go
+type PathMsgType uint8
+
+const (
+	PathNone PathMsgType = iota
+	PathChallenge
+	PathResponse
+	PathProbe       // path MTU probe, padded to the probed size, answered with a path response, see pmtu.go
+	PathEcn         // the ECN counts of the ack instead of the nonce, only on an ack, see ecn.go
+	PathConnId      // a connection ID the sender issued instead of the nonce, see connid.go
+	PathConnIdSpare // a spare connection ID for a path change instead of the nonce
+	PathConnIdAck   // the spare connection ID of the peer that arrived instead of the nonce
+)
+
+var ErrUnknownPayloadType = errors.New("unknown payload type")
+
+// ErrShortPayload is returned for a decrypted payload that is shorter than its headers say
+var ErrShortPayload = errors.New("payload too short")
+
 type PayloadHeader struct {
 	IsClose      bool
+	IsCloseConn  bool
+	CloseCode    uint64 // of CloseWithError, sent with the reason instead of data on a connection close
+	CloseReason  string
+	LimitError   bool
+	IsReset      bool
+	ResetCode    uint32
+	CloseWrite   bool // half close, the sender will not write after this offset
+	CloseRead    bool // stop sending, the sender does not read anymore
+	PathMsgType  PathMsgType
+	PathNonce    uint64 // the nonce of the path challenge, echoed in the path response
 	Ack          *Ack
 	StreamID     uint32
 	StreamOffset uint64
 }
 
 type Ack struct {
-	streamID uint32
-	offset   uint64
-	len      uint16
-	rcvWnd   uint64
+	streamID       uint32
+	offset         uint64
+	len            uint16
+	rcvWnd         uint64
+	streamRcvWnd   uint64 // only sent if isStreamRcvWnd is set
+	isStreamRcvWnd bool
+	delayNano      uint64    // how long the ack was held back by the receiver, sent in ms
+	ecn            ecnCounts // only sent if isEcn is set, in the path frame of a packet without one
+	isEcn          bool
+	rcvTimeNano    uint64 // not sent, when the acked packet arrived
 }
 
+// MaxAckDelay is the largest ack delay that can be encoded, 1 byte in ms
+const MaxAckDelay = uint64(255 * msNano)
+
 /*
 encoded | capacity
 --------|----------
@@ -83,7 +141,19 @@ func DecodeRcvWindow(encoded uint8) uint64 {
 	return base + uint64(subStep)*increment
 }
 
+// EncodeAckDelay encodes the ack delay in ms, longer delays are capped at MaxAckDelay
+func EncodeAckDelay(delayNano uint64) uint8 {
+	return uint8(min(delayNano, MaxAckDelay) / msNano)
+}
+
+func DecodeAckDelay(encoded uint8) uint64 {
+	return uint64(encoded) * msNano
+}
+
 func EncodePayload(p *PayloadHeader, userData []byte) (encoded []byte, offset int) {
+	if p.IsCloseConn && (p.CloseCode != 0 || p.CloseReason != "") {
+		userData = putCloseReason(p.CloseCode, p.CloseReason)
+	}
 	isAck := p.Ack != nil
 	isEmptyDataHeader := !p.IsClose && isAck && userData == nil
 
@@ -106,8 +176,14 @@ func EncodePayload(p *PayloadHeader, userData []byte) (encoded []byte, offset in
 		header |= 1 << Offset24or48Flag
 	}
 
+	// Extension byte only if any extension flag is set
+	ext := encodeExt(p)
+	if ext != 0 {
+		header |= 1 << ExtFlag
+	}
+
 	// Allocate buffer
-	overhead := calcProtoOverhead(isAck, isExtend, isEmptyDataHeader)
+	overhead := calcProtoOverhead(isAck, isExtend, isEmptyDataHeader) + calcExtLen(ext)
 	userDataLen := len(userData)
 	encoded = make([]byte, overhead+userDataLen)
 
@@ -115,6 +191,27 @@ func EncodePayload(p *PayloadHeader, userData []byte) (encoded []byte, offset in
 	encoded[offset] = header
 	offset++
 
+	if ext != 0 {
+		encoded[offset] = ext
+		offset++
+		if p.IsReset {
+			offset += PutUint32(encoded[offset:], p.ResetCode)
+		}
+		if ext&ExtPath != 0 && p.PathMsgType != PathNone {
+			encoded[offset] = uint8(p.PathMsgType)
+			offset++
+			offset += PutUint64(encoded[offset:], p.PathNonce)
+		} else if ext&ExtPath != 0 {
+			encoded[offset] = uint8(PathEcn)
+			offset++
+			offset += putEcnCounts(encoded[offset:], p.Ack.ecn)
+		}
+		if ext&ExtStreamRcvWnd != 0 {
+			encoded[offset] = EncodeRcvWindow(p.Ack.streamRcvWnd)
+			offset++
+		}
+	}
+
 	// Write ACK section if present
 	if isAck {
 		offset += PutUint32(encoded[offset:], p.Ack.streamID)
@@ -122,6 +219,8 @@ func EncodePayload(p *PayloadHeader, userData []byte) (encoded []byte, offset in
 		offset += PutUint16(encoded[offset:], p.Ack.len)
 		encoded[offset] = EncodeRcvWindow(p.Ack.rcvWnd)
 		offset++
+		encoded[offset] = EncodeAckDelay(p.Ack.delayNano)
+		offset++
 	}
 
 	if isEmptyDataHeader {
@@ -139,37 +238,90 @@ func EncodePayload(p *PayloadHeader, userData []byte) (encoded []byte, offset in
 	return encoded, offset
 }
 
+// DecodePayload decodes a payload, greased values are ignored
 func DecodePayload(data []byte) (payload *PayloadHeader, userData []byte, err error) {
+	payload, userData, err = decodePayload(data)
+	if err == nil && isGreaseStrict {
+		err = checkGreaseIgnored(data, payload, userData)
+	}
+	return payload, userData, err
+}
+
+func decodePayload(data []byte) (payload *PayloadHeader, userData []byte, err error) {
 	dataLen := len(data)
 	if dataLen < MinProtoSize {
 		slog.Error("payload size too low", "dataLen", dataLen, "MinProtoSize", MinProtoSize)
-		return nil, nil, errors.New("payload Size below minimum of 8 bytes")
+		return nil, nil, fmt.Errorf("%w: %d bytes, at least %d", ErrShortPayload, dataLen, MinProtoSize)
 	}
 
 	payload = &PayloadHeader{}
 
 	// Decode header byte
 	header := data[0]
-	version := header & 0b11111
+	version := header & 0b1111
+	isExt := (header & (1 << ExtFlag)) != 0
 	typeFlag := (header >> TypeFlag) & 0b11
 	isExtend := (header & (1 << Offset24or48Flag)) != 0
 
 	// Validate version
-	if version != ProtoVersion {
-		return nil, nil, errors.New("unsupported protocol version")
+	if !isProtoVersion(version) {
+		return nil, nil, fmt.Errorf("%w: protocol %d", ErrUnsupportedVersion, version)
 	}
 
 	// Decode type flags
 	isAck := typeFlag == 0b00 || typeFlag == 0b10
 	payload.IsClose = typeFlag == 0b10 || typeFlag == 0b11
-	isEmptyDataHeader := isAck && dataLen < 18
+	var ext uint8
+	if isExt {
+		ext = data[1]
+	}
+	extLen := calcExtLen(ext)
+	isEmptyDataHeader := isAck && dataLen < calcProtoOverhead(isAck, isExtend, false)+extLen
 
 	offset := 1
+	var ecn ecnCounts
+	var isEcn bool
 
 	// Check overhead
-	overhead := calcProtoOverhead(isAck, isExtend, isEmptyDataHeader)
+	overhead := calcProtoOverhead(isAck, isExtend, isEmptyDataHeader) + extLen
 	if dataLen < overhead {
-		return nil, nil, errors.New("payload size below minimum")
+		return nil, nil, fmt.Errorf("%w: %d bytes, the headers need %d", ErrShortPayload, dataLen, overhead)
+	}
+
+	// Decode extension byte if present, extensions refer to a stream, so they need a data header, except
+	// the ones that refer to the ack
+	if isExt {
+		if ext == 0 || ext&^(extKnownFlags|ExtGrease) != 0 ||
+			(isEmptyDataHeader && ext&^(extAckFlags|extConnFlags|ExtGrease) != 0) ||
+			(!isAck && ext&extAckFlags != 0) {
+			return nil, nil, fmt.Errorf("%w: header 0x%02x, ext 0x%02x", ErrUnknownPayloadType, header, ext)
+		}
+		decodeExt(payload, ext)
+		offset++
+		if payload.IsReset {
+			payload.ResetCode = Uint32(data[offset:])
+			offset += 4
+		}
+		if ext&ExtPath != 0 && PathMsgType(data[offset]) == PathEcn {
+			if !isAck {
+				return nil, nil, fmt.Errorf("%w: ECN counts without ack", ErrUnknownPayloadType)
+			}
+			ecn, isEcn = decodeEcnCounts(data[offset+1:]), true
+			offset += 9
+		} else if ext&ExtPath != 0 {
+			payload.PathMsgType = PathMsgType(data[offset])
+			if (payload.PathMsgType < PathChallenge || payload.PathMsgType > PathProbe) &&
+				!isConnIdFrame(payload.PathMsgType) {
+				return nil, nil, fmt.Errorf("%w: path type 0x%02x", ErrUnknownPayloadType, data[offset])
+			}
+			payload.PathNonce = Uint64(data[offset+1:])
+			offset += 9
+		}
+	}
+	var streamRcvWnd uint8
+	if ext&ExtStreamRcvWnd != 0 {
+		streamRcvWnd = data[offset]
+		offset++
 	}
 
 	// Decode ACK if present
@@ -183,6 +335,13 @@ func DecodePayload(data []byte) (payload *PayloadHeader, userData []byte, err er
 		offset += 2
 		payload.Ack.rcvWnd = DecodeRcvWindow(data[offset])
 		offset++
+		payload.Ack.delayNano = DecodeAckDelay(data[offset])
+		offset++
+		if ext&ExtStreamRcvWnd != 0 {
+			payload.Ack.streamRcvWnd = DecodeRcvWindow(streamRcvWnd)
+			payload.Ack.isStreamRcvWnd = true
+		}
+		payload.Ack.ecn, payload.Ack.isEcn = ecn, isEcn
 	}
 
 	// Decode Data
@@ -201,9 +360,69 @@ func DecodePayload(data []byte) (payload *PayloadHeader, userData []byte, err er
 		userData = nil
 	}
 
+	if payload.IsCloseConn && len(userData) > 0 {
+		// the data of a connection close is the code and the reason, the close itself is empty
+		payload.CloseCode, payload.CloseReason, err = decodeCloseReason(userData)
+		if err != nil {
+			return nil, nil, err
+		}
+		userData = make([]byte, 0)
+	}
+
 	return payload, userData, nil
 }
 
+func encodeExt(p *PayloadHeader) (ext uint8) {
+	if p.IsCloseConn {
+		ext |= ExtCloseConn
+	}
+	if p.LimitError {
+		ext |= ExtLimitError
+	}
+	if p.IsReset {
+		ext |= ExtReset
+	}
+	if p.CloseWrite {
+		ext |= ExtCloseWrite
+	}
+	if p.CloseRead {
+		ext |= ExtCloseRead
+	}
+	if p.Ack != nil && p.Ack.isStreamRcvWnd {
+		ext |= ExtStreamRcvWnd
+	}
+	if p.PathMsgType != PathNone || (p.Ack != nil && p.Ack.isEcn) {
+		ext |= ExtPath
+	}
+	return ext
+}
+
+func decodeExt(p *PayloadHeader, ext uint8) {
+	p.IsCloseConn = ext&ExtCloseConn != 0
+	p.LimitError = ext&ExtLimitError != 0
+	p.IsReset = ext&ExtReset != 0
+	p.CloseWrite = ext&ExtCloseWrite != 0
+	p.CloseRead = ext&ExtCloseRead != 0
+}
+
+// calcExtLen returns the size of the extension byte and the extension fields that follow it
+func calcExtLen(ext uint8) int {
+	if ext == 0 {
+		return 0
+	}
+	extLen := 1
+	if ext&ExtReset != 0 {
+		extLen += 4
+	}
+	if ext&ExtStreamRcvWnd != 0 {
+		extLen++
+	}
+	if ext&ExtPath != 0 {
+		extLen += 9
+	}
+	return extLen
+}
+
 func calcProtoOverhead(isAck bool, isExtend bool, isEmptyDataHeader bool) int {
 	overhead := 1 // 1 byte header, always
 
@@ -217,7 +436,7 @@ func calcProtoOverhead(isAck bool, isExtend bool, isEmptyDataHeader bool) int {
 	}
 
 	if isAck {
-		overhead += 4 + extBytes + 2 + 1 // streamID + offset + len + rcvWnd
+		overhead += 4 + extBytes + 2 + 1 + 1 // streamID + offset + len + rcvWnd + delay
 	}
 
 	return overhead
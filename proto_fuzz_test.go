@@ -55,6 +55,62 @@ func FuzzPayload(f *testing.F) {
 			},
 			data: nil,
 		},
+		{
+			// Connection close, extension byte
+			header: &PayloadHeader{
+				IsCloseConn: true,
+				StreamID:    3,
+				Ack:         &Ack{streamID: 3, offset: 30, len: 5, rcvWnd: 1000},
+			},
+			data: []byte{},
+		},
+		{
+			// Stream limit error, extension byte
+			header: &PayloadHeader{
+				LimitError: true,
+				StreamID:   8,
+			},
+			data: []byte{},
+		},
+		{
+			// Stream reset with error code, extension byte
+			header: &PayloadHeader{
+				IsReset:      true,
+				ResetCode:    42,
+				StreamID:     9,
+				StreamOffset: 900,
+				Ack:          &Ack{streamID: 9, offset: 90, len: 9, rcvWnd: 1000},
+			},
+			data: []byte{},
+		},
+		{
+			// Half close with data and stop sending, extension byte
+			header: &PayloadHeader{
+				CloseWrite:   true,
+				CloseRead:    true,
+				StreamID:     11,
+				StreamOffset: 1100,
+			},
+			data: []byte("fin"),
+		},
+		{
+			// Ack with stream receive window, extension byte
+			header: &PayloadHeader{
+				Ack:          &Ack{streamID: 12, offset: 120, len: 12, rcvWnd: 1000, streamRcvWnd: 500, isStreamRcvWnd: true},
+				StreamID:     12,
+				StreamOffset: 1200,
+			},
+			data: []byte("wnd"),
+		},
+		{
+			// Path challenge with ack, extension byte
+			header: &PayloadHeader{
+				PathMsgType: PathChallenge,
+				PathNonce:   13,
+				Ack:         &Ack{streamID: 13, offset: 130, len: 13, rcvWnd: 1000},
+			},
+			data: nil,
+		},
 		{
 			// Max values
 			header: &PayloadHeader{
@@ -92,6 +148,21 @@ func FuzzPayload(f *testing.F) {
 		if decoded.IsClose != reDecoded.IsClose {
 			t.Fatal("IsClose mismatch")
 		}
+		if decoded.IsCloseConn != reDecoded.IsCloseConn {
+			t.Fatal("IsCloseConn mismatch")
+		}
+		if decoded.LimitError != reDecoded.LimitError {
+			t.Fatal("LimitError mismatch")
+		}
+		if decoded.IsReset != reDecoded.IsReset || decoded.ResetCode != reDecoded.ResetCode {
+			t.Fatal("Reset mismatch")
+		}
+		if decoded.CloseWrite != reDecoded.CloseWrite || decoded.CloseRead != reDecoded.CloseRead {
+			t.Fatal("Half close mismatch")
+		}
+		if decoded.PathMsgType != reDecoded.PathMsgType || decoded.PathNonce != reDecoded.PathNonce {
+			t.Fatal("Path frame mismatch")
+		}
 		if decoded.StreamID != reDecoded.StreamID {
 			t.Fatal("StreamID mismatch")
 		}
@@ -114,6 +185,13 @@ func FuzzPayload(f *testing.F) {
 				t.Fatal("Ack.len mismatch")
 			}
 			// rcvWnd has lossy encoding - verify both encode to same value
+			if decoded.Ack.isStreamRcvWnd != reDecoded.Ack.isStreamRcvWnd ||
+				decoded.Ack.streamRcvWnd != reDecoded.Ack.streamRcvWnd {
+				t.Fatal("Stream receive window mismatch")
+			}
+			if decoded.Ack.delayNano != reDecoded.Ack.delayNano {
+				t.Fatal("Ack delay mismatch")
+			}
 			enc1 := EncodeRcvWindow(decoded.Ack.rcvWnd)
 			enc2 := EncodeRcvWindow(reDecoded.Ack.rcvWnd)
 			if enc1 != enc2 {
@@ -27,6 +27,14 @@ func assertPayloadEqual(t *testing.T, expected, actual *PayloadHeader) {
 	assert.Equal(t, expected.StreamID, actual.StreamID)
 	assert.Equal(t, expected.StreamOffset, actual.StreamOffset)
 	assert.Equal(t, expected.IsClose, actual.IsClose)
+	assert.Equal(t, expected.IsCloseConn, actual.IsCloseConn)
+	assert.Equal(t, expected.LimitError, actual.LimitError)
+	assert.Equal(t, expected.IsReset, actual.IsReset)
+	assert.Equal(t, expected.ResetCode, actual.ResetCode)
+	assert.Equal(t, expected.CloseWrite, actual.CloseWrite)
+	assert.Equal(t, expected.CloseRead, actual.CloseRead)
+	assert.Equal(t, expected.PathMsgType, actual.PathMsgType)
+	assert.Equal(t, expected.PathNonce, actual.PathNonce)
 
 	if expected.Ack == nil {
 		assert.Nil(t, actual.Ack)
@@ -39,6 +47,13 @@ func assertPayloadEqual(t *testing.T, expected, actual *PayloadHeader) {
 		encoded := EncodeRcvWindow(expected.Ack.rcvWnd)
 		expectedDecoded := DecodeRcvWindow(encoded)
 		assert.Equal(t, expectedDecoded, actual.Ack.rcvWnd)
+		assert.Equal(t, expected.Ack.isStreamRcvWnd, actual.Ack.isStreamRcvWnd)
+		assert.Equal(t, DecodeRcvWindow(EncodeRcvWindow(expected.Ack.streamRcvWnd)), actual.Ack.streamRcvWnd)
+		assert.Equal(t, DecodeAckDelay(EncodeAckDelay(expected.Ack.delayNano)), actual.Ack.delayNano)
+		assert.Equal(t, expected.Ack.isEcn, actual.Ack.isEcn)
+		if expected.Ack.isEcn {
+			assert.Equal(t, expected.Ack.ecn, actual.Ack.ecn)
+		}
 	}
 }
 
@@ -151,6 +166,211 @@ func TestCloseNoAck(t *testing.T) {
 	assertPayloadEqual(t, original, decoded)
 }
 
+// =============================================================================
+// Extension byte
+// =============================================================================
+
+func TestCloseConnWithAck(t *testing.T) {
+	original := &PayloadHeader{
+		IsCloseConn: true,
+		StreamID:    1,
+		Ack:         &Ack{streamID: 1, offset: 100, len: 10, rcvWnd: 1000},
+	}
+
+	encoded := encodePayload(original, []byte{})
+	assert.Equal(t, calcProtoOverhead(true, false, false)+1, len(encoded))
+
+	decoded, decodedData := mustDecodePayload(t, encoded)
+	assertPayloadEqual(t, original, decoded)
+	assert.NotNil(t, decodedData)
+	assert.Empty(t, decodedData)
+}
+
+func TestCloseConnNoAck(t *testing.T) {
+	original := &PayloadHeader{
+		IsCloseConn:  true,
+		StreamID:     1,
+		StreamOffset: 0x1000000,
+	}
+
+	decoded, _ := roundTrip(t, original, []byte{})
+	assertPayloadEqual(t, original, decoded)
+}
+
+func TestLimitErrorWithAck(t *testing.T) {
+	original := &PayloadHeader{
+		LimitError: true,
+		StreamID:   7,
+		Ack:        &Ack{streamID: 7, offset: 0, len: 5, rcvWnd: 1000},
+	}
+
+	decoded, decodedData := roundTrip(t, original, []byte{})
+	assertPayloadEqual(t, original, decoded)
+	assert.False(t, decoded.IsCloseConn)
+	assert.Empty(t, decodedData)
+}
+
+func TestLimitErrorAndCloseConn(t *testing.T) {
+	original := &PayloadHeader{
+		IsCloseConn: true,
+		LimitError:  true,
+		StreamID:    3,
+	}
+
+	encoded := encodePayload(original, []byte{})
+	assert.Equal(t, byte(ExtCloseConn|ExtLimitError), encoded[1])
+
+	decoded, _ := mustDecodePayload(t, encoded)
+	assertPayloadEqual(t, original, decoded)
+}
+
+func TestResetWithAck(t *testing.T) {
+	original := &PayloadHeader{
+		IsReset:      true,
+		ResetCode:    0xdeadbeef,
+		StreamID:     4,
+		StreamOffset: 0x1000000,
+		Ack:          &Ack{streamID: 2, offset: 10, len: 5, rcvWnd: 1000},
+	}
+
+	encoded := encodePayload(original, []byte{})
+	assert.Equal(t, calcProtoOverhead(true, true, false)+1+4, len(encoded))
+
+	decoded, decodedData := mustDecodePayload(t, encoded)
+	assertPayloadEqual(t, original, decoded)
+	assert.Empty(t, decodedData)
+}
+
+func TestResetCodeZero(t *testing.T) {
+	original := &PayloadHeader{
+		IsReset:  true,
+		StreamID: 4,
+	}
+
+	decoded, _ := roundTrip(t, original, []byte{})
+	assertPayloadEqual(t, original, decoded)
+}
+
+func TestCloseWriteWithData(t *testing.T) {
+	original := &PayloadHeader{
+		CloseWrite:   true,
+		StreamID:     2,
+		StreamOffset: 500,
+		Ack:          &Ack{streamID: 2, offset: 100, len: 10, rcvWnd: 1000},
+	}
+	originalData := []byte("last chunk")
+
+	decoded, decodedData := roundTrip(t, original, originalData)
+	assertPayloadEqual(t, original, decoded)
+	assert.False(t, decoded.IsClose)
+	assert.Equal(t, originalData, decodedData)
+}
+
+func TestCloseRead(t *testing.T) {
+	original := &PayloadHeader{
+		CloseRead:    true,
+		StreamID:     2,
+		StreamOffset: 300,
+	}
+
+	decoded, decodedData := roundTrip(t, original, []byte{})
+	assertPayloadEqual(t, original, decoded)
+	assert.Empty(t, decodedData)
+}
+
+func TestStreamRcvWndAckOnly(t *testing.T) {
+	original := &PayloadHeader{
+		Ack: &Ack{streamID: 4, offset: 100, len: 10, rcvWnd: 1000000, streamRcvWnd: 4096, isStreamRcvWnd: true},
+	}
+
+	encoded := encodePayload(original, nil)
+	assert.Equal(t, uint8(ExtStreamRcvWnd), encoded[1])
+
+	decoded, decodedData := roundTrip(t, original, nil)
+	assertPayloadEqual(t, original, decoded)
+	assert.Nil(t, decodedData)
+}
+
+func TestStreamRcvWndWithDataAndReset(t *testing.T) {
+	original := &PayloadHeader{
+		IsReset:      true,
+		ResetCode:    7,
+		StreamID:     2,
+		StreamOffset: 0x1000000,
+		Ack:          &Ack{streamID: 4, offset: 100, len: 10, rcvWnd: 1000000, streamRcvWnd: 0, isStreamRcvWnd: true},
+	}
+
+	decoded, decodedData := roundTrip(t, original, []byte{})
+	assertPayloadEqual(t, original, decoded)
+	assert.Zero(t, decoded.Ack.streamRcvWnd)
+	assert.Empty(t, decodedData)
+}
+
+func TestPathChallengeNoAck(t *testing.T) {
+	original := &PayloadHeader{
+		PathMsgType: PathChallenge,
+		PathNonce:   0x0102030405060708,
+		StreamID:    3,
+	}
+
+	encoded := encodePayload(original, []byte{})
+	assert.Equal(t, uint8(ExtPath), encoded[1])
+	assert.Equal(t, uint8(PathChallenge), encoded[2])
+
+	decoded, decodedData := roundTrip(t, original, []byte{})
+	assertPayloadEqual(t, original, decoded)
+	assert.Empty(t, decodedData)
+}
+
+func TestPathResponseAckOnly(t *testing.T) {
+	original := &PayloadHeader{
+		PathMsgType: PathResponse,
+		PathNonce:   0xffffffffffffffff,
+		Ack:         &Ack{streamID: 4, offset: 100, len: 10, rcvWnd: 1000000, streamRcvWnd: 4096, isStreamRcvWnd: true},
+	}
+
+	decoded, decodedData := roundTrip(t, original, nil)
+	assertPayloadEqual(t, original, decoded)
+	assert.Nil(t, decodedData)
+}
+
+func TestEcnAckOnly(t *testing.T) {
+	original := &PayloadHeader{
+		Ack: &Ack{streamID: 4, offset: 100, len: 10, rcvWnd: 1000000, ecn: ecnCounts{ect0: 0x01020304, ect1: 5,
+			ce: 0xffff}, isEcn: true},
+	}
+
+	encoded := encodePayload(original, nil)
+	assert.Equal(t, uint8(ExtPath), encoded[1])
+	assert.Equal(t, uint8(PathEcn), encoded[2])
+	assert.Len(t, encoded, calcProtoOverhead(true, false, true)+calcExtLen(ExtPath))
+
+	decoded, decodedData := roundTrip(t, original, nil)
+	assertPayloadEqual(t, original, decoded)
+	assert.Equal(t, PathNone, decoded.PathMsgType)
+	assert.Nil(t, decodedData)
+}
+
+func TestEcnWithPathResponse(t *testing.T) {
+	// the path frame is taken, the counts are echoed with the next ack
+	original := &PayloadHeader{
+		PathMsgType: PathResponse,
+		PathNonce:   7,
+		Ack:         &Ack{streamID: 4, offset: 100, len: 10, rcvWnd: 1000000, ecn: ecnCounts{ce: 1}, isEcn: true},
+	}
+
+	decoded, _ := roundTrip(t, original, nil)
+	assert.Equal(t, PathResponse, decoded.PathMsgType)
+	assert.Equal(t, uint64(7), decoded.PathNonce)
+	assert.False(t, decoded.Ack.isEcn)
+}
+
+func TestNoExtByteWithoutFlags(t *testing.T) {
+	encoded := encodePayload(&PayloadHeader{StreamID: 1}, []byte("data"))
+	assert.Zero(t, encoded[0]&(1<<ExtFlag))
+	assert.Equal(t, calcProtoOverhead(false, false, false)+4, len(encoded))
+}
+
 // =============================================================================
 // Offset Size Tests
 // =============================================================================
@@ -207,7 +427,7 @@ func TestErrorBelowMinSize(t *testing.T) {
 	for _, size := range testCases {
 		data := make([]byte, size)
 		_, _, err := DecodePayload(data)
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrShortPayload)
 	}
 }
 
@@ -216,8 +436,42 @@ func TestErrorInvalidVersion(t *testing.T) {
 	data[0] = 0x1F // Invalid version (bits 0-4 = 31)
 
 	_, _, err := DecodePayload(data)
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "version")
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestErrorUnknownPayloadType(t *testing.T) {
+	encoded := encodePayload(&PayloadHeader{IsCloseConn: true, StreamID: 1}, []byte{})
+
+	// Extension flag set, but no extension in the byte
+	empty := append([]byte{}, encoded...)
+	empty[1] = 0
+	_, _, err := DecodePayload(empty)
+	assert.ErrorIs(t, err, ErrUnknownPayloadType)
+	assert.Contains(t, err.Error(), "ext 0x00")
+	assert.NotContains(t, err.Error(), "version")
+
+	// Extension on an ACK without data header
+	ackOnly := encodePayload(&PayloadHeader{Ack: &Ack{streamID: 1, offset: 10, len: 5, rcvWnd: 1000}}, nil)
+	ackOnly = append([]byte{ackOnly[0] | 1<<ExtFlag, ExtCloseConn}, ackOnly[1:]...)
+	_, _, err = DecodePayload(ackOnly)
+	assert.ErrorIs(t, err, ErrUnknownPayloadType)
+
+	// Stream receive window without an ACK
+	noAck := encodePayload(&PayloadHeader{StreamID: 1, StreamOffset: 10}, []byte("data"))
+	noAck = append([]byte{noAck[0] | 1<<ExtFlag, ExtStreamRcvWnd, 0}, noAck[1:]...)
+	_, _, err = DecodePayload(noAck)
+	assert.ErrorIs(t, err, ErrUnknownPayloadType)
+
+	// Unknown path frame type
+	path := encodePayload(&PayloadHeader{PathMsgType: PathChallenge, StreamID: 1}, []byte{})
+	path[2] = uint8(PathConnIdAck) + 1
+	_, _, err = DecodePayload(path)
+	assert.ErrorIs(t, err, ErrUnknownPayloadType)
+
+	// ECN counts without an ACK
+	path[2] = uint8(PathEcn)
+	_, _, err = DecodePayload(path)
+	assert.ErrorIs(t, err, ErrUnknownPayloadType)
 }
 
 func TestErrorInsufficientData(t *testing.T) {
@@ -226,7 +480,7 @@ func TestErrorInsufficientData(t *testing.T) {
 	data[0] = 0x00 // Type 00
 
 	_, _, err := DecodePayload(data)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrShortPayload)
 }
 
 // =============================================================================
@@ -280,13 +534,33 @@ func TestRcvWindowMax(t *testing.T) {
 // Additional Tests
 // =============================================================================
 
+func TestAckDelay(t *testing.T) {
+	original := &PayloadHeader{
+		Ack: &Ack{streamID: 1, offset: 10, len: 5, rcvWnd: 1000, delayNano: 25*msNano + 300},
+	}
+
+	decoded, decodedData := roundTrip(t, original, nil)
+
+	assertPayloadEqual(t, original, decoded)
+	assert.Nil(t, decodedData)
+	assert.Equal(t, uint64(25*msNano), decoded.Ack.delayNano)
+}
+
+func TestAckDelayCapped(t *testing.T) {
+	assert.Equal(t, uint8(0), EncodeAckDelay(0))
+	assert.Equal(t, uint8(0), EncodeAckDelay(msNano-1))
+	assert.Equal(t, uint8(255), EncodeAckDelay(MaxAckDelay))
+	assert.Equal(t, uint8(255), EncodeAckDelay(secondNano))
+	assert.Equal(t, MaxAckDelay, DecodeAckDelay(255))
+}
+
 func TestOverheadCalculation(t *testing.T) {
 	assert.Equal(t, 8, calcProtoOverhead(false, false, false)) // No ACK, 24-bit
 	assert.Equal(t, 11, calcProtoOverhead(false, true, false)) // No ACK, 48-bit
-	assert.Equal(t, 18, calcProtoOverhead(true, false, false)) // ACK, 24-bit
-	assert.Equal(t, 24, calcProtoOverhead(true, true, false))  // ACK, 48-bit
-	assert.Equal(t, 11, calcProtoOverhead(true, false, true))  // ACK, no data header, 24-bit
-	assert.Equal(t, 14, calcProtoOverhead(true, true, true))   // ACK, no data header, 48-bit
+	assert.Equal(t, 19, calcProtoOverhead(true, false, false)) // ACK, 24-bit
+	assert.Equal(t, 25, calcProtoOverhead(true, true, false))  // ACK, 48-bit
+	assert.Equal(t, 12, calcProtoOverhead(true, false, true))  // ACK, no data header, 24-bit
+	assert.Equal(t, 15, calcProtoOverhead(true, true, true))   // ACK, no data header, 48-bit
 }
 
 func TestLargeData(t *testing.T) {
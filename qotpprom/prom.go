@@ -0,0 +1,80 @@
+// Package qotpprom reports the metrics of qotp to Prometheus, see qotp.WithMetrics.
+package qotpprom
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qo-proto/qotp"
+)
+
+// registerer creates the metrics of qotp as vectors, a vector that another listener registered already is
+// reused with the labels of the listener
+type registerer struct {
+	reg prometheus.Registerer
+}
+
+// New returns a qotp.MetricsRegisterer that registers the metrics with reg, e.g., prometheus.DefaultRegisterer
+func New(reg prometheus.Registerer) qotp.MetricsRegisterer {
+	return registerer{reg: reg}
+}
+
+func (r registerer) Counter(name string, help string, labels map[string]string) (qotp.Counter, error) {
+	vec, err := registerVec(r.reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, labelNames(labels)))
+	if err != nil {
+		return nil, err
+	}
+	return vec.GetMetricWith(labels)
+}
+
+func (r registerer) Histogram(name string, help string, buckets []float64, labels map[string]string) (
+	qotp.Observer, error) {
+	vec, err := registerVec(r.reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+	}, labelNames(labels)))
+	if err != nil {
+		return nil, err
+	}
+	return vec.GetMetricWith(labels)
+}
+
+func (r registerer) GaugeFunc(name string, help string, labels map[string]string, f func() float64) (
+	func(), error) {
+	g := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, f)
+	if err := r.reg.Register(g); err != nil {
+		return nil, err
+	}
+	return func() { r.reg.Unregister(g) }, nil
+}
+
+// registerVec registers a vector, or returns the one that is registered already
+func registerVec[T prometheus.Collector](reg prometheus.Registerer, vec T) (T, error) {
+	err := reg.Register(vec)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing, nil
+		}
+	}
+	return vec, err
+}
+
+// labelNames are the names of the labels, sorted so that each listener asks for the same vector
+func labelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,71 @@
+package qotpprom
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qo-proto/qotp"
+	"github.com/stretchr/testify/assert"
+)
+
+// familyNames returns the names of the metric families in reg, and the number of series of each
+func familyNames(t *testing.T, reg *prometheus.Registry) map[string]int {
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+	names := map[string]int{}
+	for _, f := range families {
+		names[f.GetName()] = len(f.GetMetric())
+	}
+	return names
+}
+
+func TestListeners(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	l1, err := qotp.Listen(qotp.WithListenAddr("127.0.0.1:0"), qotp.WithMetrics(New(reg)))
+	assert.Nil(t, err)
+	l2, err := qotp.Listen(qotp.WithListenAddr("0.0.0.0:0"), qotp.WithMetrics(New(reg)))
+	assert.Nil(t, err)
+
+	// the listeners share the vectors, labeled by their address, with a series each, the drop reasons have one series per reason
+	names := familyNames(t, reg)
+	assert.Equal(t, 2, names["qotp_connections_total"])
+	assert.Equal(t, 2, names["qotp_rtt_seconds"])
+	assert.Equal(t, 2, names["qotp_connections_active"])
+	assert.Equal(t, 2, names["qotp_streams_active"])
+	assert.Equal(t, 22, names["qotp_packets_dropped_total"])
+
+	// the gauges of a closed listener are gone, the counters stay
+	assert.Nil(t, l1.Close())
+	names = familyNames(t, reg)
+	assert.Equal(t, 1, names["qotp_connections_active"])
+	assert.Equal(t, 2, names["qotp_connections_total"])
+	assert.Nil(t, l2.Close())
+}
+
+func TestRegisterer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r := New(reg)
+	labels := map[string]string{"listener": "a", "reason": "b"}
+	c, err := r.Counter("test_total", "Test.", labels)
+	assert.Nil(t, err)
+	c.Add(2)
+	// the same name and labels is the same counter
+	c, err = r.Counter("test_total", "Test.", map[string]string{"reason": "b", "listener": "a"})
+	assert.Nil(t, err)
+	c.Add(1)
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, families, 1)
+	assert.Equal(t, 3.0, families[0].GetMetric()[0].GetCounter().GetValue())
+
+	// another type with the same name, or the same gauge twice, is an error
+	_, err = r.Histogram("test_total", "Test.", []float64{1}, labels)
+	assert.Error(t, err)
+	unregister, err := r.GaugeFunc("test_gauge", "Test.", labels, func() float64 { return 1 })
+	assert.Nil(t, err)
+	_, err = r.GaugeFunc("test_gauge", "Test.", labels, func() float64 { return 1 })
+	assert.Error(t, err)
+	unregister()
+	_, err = r.GaugeFunc("test_gauge", "Test.", labels, func() float64 { return 1 })
+	assert.Nil(t, err)
+}
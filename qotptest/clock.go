@@ -0,0 +1,106 @@
+// Package qotptest has helpers to test applications of qotp.
+package qotptest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SimulatedClock is a qotp.TimerClock that only moves with Advance, so that retransmissions, idle timeouts
+// and deadlines can be tested without sleeping, see qotp.WithClock. It is safe for concurrent use.
+type SimulatedClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when a timer is added
+	nowNano int64
+	timers  []*timer
+}
+
+// timer is a pending AfterFunc or Sleep
+type timer struct {
+	atNano int64
+	f      func()
+}
+
+// NewSimulatedClock returns a clock that starts at start
+func NewSimulatedClock(start time.Time) *SimulatedClock {
+	c := &SimulatedClock{nowNano: start.UnixNano()}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the time in nanoseconds since the Unix epoch, see qotp.Clock
+func (c *SimulatedClock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nowNano
+}
+
+// AfterFunc calls f once the clock was advanced by d, see qotp.TimerClock. f runs in the goroutine of Advance,
+// before it returns. A d that is not positive calls f right away in its own goroutine, as the caller of
+// AfterFunc may hold a lock that f takes.
+func (c *SimulatedClock) AfterFunc(d time.Duration, f func()) (stop func() bool) {
+	if d <= 0 {
+		go f()
+		return func() bool { return false }
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &timer{atNano: c.nowNano + int64(d), f: f}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.remove(t)
+	}
+}
+
+// Sleep blocks until the clock was advanced by d
+func (c *SimulatedClock) Sleep(d time.Duration) {
+	done := make(chan struct{})
+	c.AfterFunc(d, func() { close(done) })
+	<-done
+}
+
+// Advance moves the clock forward by d and calls the functions of the timers that are due, in the order of
+// their time. The clock is at the time of a timer while its function runs.
+func (c *SimulatedClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	endNano := c.nowNano + int64(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].atNano < c.timers[j].atNano })
+		if len(c.timers) == 0 || c.timers[0].atNano > endNano {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.nowNano = max(c.nowNano, t.atNano)
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.nowNano = endNano
+	c.mu.Unlock()
+}
+
+// WaitForTimers blocks until at least n timers or sleeping goroutines wait for the clock, e.g., before
+// Advance in a test that started a goroutine that calls Sleep
+func (c *SimulatedClock) WaitForTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// remove drops t and returns true if it was pending
+func (c *SimulatedClock) remove(t *timer) bool {
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
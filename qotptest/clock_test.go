@@ -0,0 +1,47 @@
+package qotptest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulatedClockAfterFunc(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewSimulatedClock(start)
+	assert.Equal(t, start.UnixNano(), c.Now())
+
+	var fired []int64
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, c.Now()) })
+	c.AfterFunc(time.Second, func() { fired = append(fired, c.Now()) })
+	stop := c.AfterFunc(time.Second, func() { t.Error("stopped timer fired") })
+	assert.True(t, stop())
+	assert.False(t, stop())
+
+	c.Advance(500 * time.Millisecond)
+	assert.Empty(t, fired)
+	c.Advance(2 * time.Second)
+	// in the order of their time, the clock is at the time of the timer
+	assert.Equal(t, []int64{start.Add(time.Second).UnixNano(), start.Add(2 * time.Second).UnixNano()}, fired)
+	assert.Equal(t, start.Add(2500*time.Millisecond).UnixNano(), c.Now())
+}
+
+func TestSimulatedClockSleep(t *testing.T) {
+	c := NewSimulatedClock(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		c.Sleep(time.Second)
+		close(done)
+	}()
+
+	c.WaitForTimers(1)
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("woke up too early")
+	default:
+	}
+	c.Advance(time.Millisecond)
+	<-done
+}
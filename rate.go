@@ -0,0 +1,108 @@
+package qotp
+
+import (
+	"errors"
+	"time"
+)
+
+// defaultRateWindow is the window of SendRate and ReceiveRate if WithRateWindow is not set
+const defaultRateWindow = time.Second
+
+// rateSamples is how many samples of the byte counters a window has
+const rateSamples = 10
+
+// Send and receive rates. Each flush samples the byte counters of a connection, at most rateSamples times per
+// window, into a ring. The rate is the difference of the newest sample and the oldest one that still covers
+// the window, divided by the time between them, so it is a moving average over the window. An idle
+// connection keeps being sampled by the flushes, and its rate decays to 0 within the window.
+
+type rateSample struct {
+	timeNano uint64
+	bytes    uint64
+}
+
+// rateMeter holds the samples of a byte counter, one slot more than rateSamples so that the oldest sample
+// still covers the whole window
+type rateMeter struct {
+	samples [rateSamples + 1]rateSample
+	next    int // slot of the next sample
+	n       int // samples in the ring
+}
+
+func (r *rateMeter) newest(i int) *rateSample {
+	return &r.samples[(r.next-1-i+2*len(r.samples))%len(r.samples)]
+}
+
+// sample adds the counter, if the last sample is at least a rateSamples-th of the window old
+func (r *rateMeter) sample(bytes uint64, nowNano uint64, windowNano uint64) {
+	if r.n > 0 && nowNano < r.newest(0).timeNano+windowNano/rateSamples {
+		return
+	}
+	r.samples[r.next] = rateSample{timeNano: nowNano, bytes: bytes}
+	r.next = (r.next + 1) % len(r.samples)
+	r.n = min(r.n+1, len(r.samples))
+}
+
+// rate is bytes per second from the newest sample back to the first one at the start of the window or before,
+// the oldest one if the ring does not reach that far
+func (r *rateMeter) rate(windowNano uint64) uint64 {
+	if r.n < 2 {
+		return 0
+	}
+	to := r.newest(0)
+	from := to
+	for i := 1; i < r.n; i++ {
+		from = r.newest(i)
+		if to.timeNano-from.timeNano >= windowNano {
+			break
+		}
+	}
+	if to.timeNano <= from.timeNano {
+		return 0
+	}
+	return (to.bytes - from.bytes) * secondNano / (to.timeNano - from.timeNano)
+}
+
+// WithRateWindow sets the window of the moving average of SendRate and ReceiveRate, default one second
+func WithRateWindow(window time.Duration) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.rateWindowNano != 0 {
+			return errors.New("rate window already set")
+		}
+		if window <= 0 {
+			return errors.New("rate window needs window > 0")
+		}
+		o.rateWindowNano = uint64(window.Nanoseconds())
+		return nil
+	}
+}
+
+func (l *Listener) rateWindow() uint64 {
+	if l.rateWindowNano == 0 {
+		return uint64(defaultRateWindow.Nanoseconds())
+	}
+	return l.rateWindowNano
+}
+
+// SendRate is the moving average of the encrypted bytes per second sent on the wire, see WithRateWindow
+func (c *Conn) SendRate() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sendRate.rate(c.listener.rateWindow())
+}
+
+// ReceiveRate is SendRate for the bytes received
+func (c *Conn) ReceiveRate() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.receiveRate.rate(c.listener.rateWindow())
+}
+
+// sampleRates is called by each flush
+func (c *Conn) sampleRates(nowNano uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	windowNano := c.listener.rateWindow()
+	c.sendRate.sample(c.bytesSent, nowNano, windowNano)
+	c.receiveRate.sample(c.bytesReceived, nowNano, windowNano)
+}
@@ -0,0 +1,87 @@
+package qotp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateMeter(t *testing.T) {
+	var r rateMeter
+	windowNano := uint64(secondNano)
+	assert.Zero(t, r.rate(windowNano))
+
+	// 1000 bytes every 10ms, sampled every 100ms
+	for i := range uint64(300) {
+		r.sample(i*1000, i*10*msNano, windowNano)
+	}
+	assert.Equal(t, uint64(100_000), r.rate(windowNano))
+	assert.Equal(t, rateSamples+1, r.n)
+
+	// idle, the rate decays within the window
+	r.sample(300_000, 3500*msNano, windowNano)
+	assert.Less(t, r.rate(windowNano), uint64(100_000))
+	r.sample(300_000, 4500*msNano, windowNano)
+	assert.Zero(t, r.rate(windowNano))
+
+	// flushes less often than the window, the rate is over the last interval
+	var slow rateMeter
+	slow.sample(0, 0, windowNano)
+	slow.sample(500_000, 5*secondNano, windowNano)
+	assert.Equal(t, uint64(100_000), slow.rate(windowNano))
+}
+
+func TestRateTransfer(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	connPair.Conn1.bandwidth, connPair.Conn2.bandwidth = 0, 0 // the simulated link has 10kB/s otherwise
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	// 1000 bytes every 10ms, 100kB/s of payload
+	data := createTestData(1000)
+	nowNano := connPair.Conn1.localTime
+	for range 300 {
+		nowNano += 10 * msNano
+		_, err := streamA.Write(data)
+		assert.Nil(t, err)
+		connA.listener.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		for {
+			b, err := streamB.Read()
+			assert.Nil(t, err)
+			if b == nil {
+				break
+			}
+		}
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+
+	// the wire rate is the payload rate plus the overhead of the packets, A only receives acks
+	assert.InDelta(t, 100_000, connA.SendRate(), 5_000)
+	assert.Equal(t, connA.SendRate(), connB.ReceiveRate())
+	assert.Less(t, connA.ReceiveRate(), uint64(10_000))
+}
+
+func TestRateWindowOption(t *testing.T) {
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"), WithRateWindow(5*time.Second))
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	assert.Equal(t, uint64(5*secondNano), listener.rateWindow())
+
+	_, err = Listen(WithRateWindow(0))
+	assert.Error(t, err)
+	_, err = Listen(WithRateWindow(time.Second), WithRateWindow(time.Second))
+	assert.Error(t, err)
+}
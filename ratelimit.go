@@ -0,0 +1,111 @@
+package qotp
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+	"sync"
+)
+
+// maxRateLimitBuckets is how many source prefixes the handshake rate limit tracks, the least recently used
+// one is evicted first
+const maxRateLimitBuckets = 8192
+
+// The prefix lengths of a source, a host usually has a whole IPv6 /64, and a /24 is often one network
+const (
+	rateLimitPrefixIPv4 = 24
+	rateLimitPrefixIPv6 = 64
+)
+
+// errHandshakeRateLimited is returned for an init of a source above WithHandshakeRateLimit, it is not decrypted
+var errHandshakeRateLimited = errors.New("handshake rate limited")
+
+// Handshake rate limit, see WithHandshakeRateLimit. Each init of a peer costs an X25519 operation, and every
+// InitCryptoSnd a second one, before we know if it is authentic. A token bucket per source prefix, /24 for IPv4
+// and /64 for IPv6, limits the inits a source can make us process, an init without a token is dropped before
+// the ECDH. Data packets and the replies to our own inits are not limited. The buckets are kept in a bounded
+// LRU. While it is full, a new bucket starts empty, so a flood from many prefixes cannot evict the buckets and
+// get full ones.
+
+type tokenBucket struct {
+	tokens   float64
+	lastNano uint64
+}
+
+type handshakeRateLimiter struct {
+	perSecond float64
+	burst     float64
+	buckets   *LinkedMap[netip.Prefix, *tokenBucket] // in the order of their last use
+	mu        sync.Mutex
+}
+
+func newHandshakeRateLimiter(perSecond int, burst int) *handshakeRateLimiter {
+	return &handshakeRateLimiter{
+		perSecond: float64(perSecond),
+		burst:     float64(burst),
+		buckets:   NewLinkedMap[netip.Prefix, *tokenBucket](),
+	}
+}
+
+// allow takes a token of the prefix of the source, nil allows every init
+func (r *handshakeRateLimiter) allow(addr netip.Addr, nowNano uint64) bool {
+	if r == nil {
+		return true
+	}
+	prefix := rateLimitPrefix(addr)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buckets.Remove(prefix) // put back at the end, as the most recently used
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, lastNano: nowNano}
+		if r.buckets.Size() >= maxRateLimitBuckets {
+			if oldest, _, ok := r.buckets.First(); ok {
+				r.buckets.Remove(oldest)
+			}
+			b.tokens = 0
+		}
+	}
+	r.buckets.Put(prefix, b)
+
+	if nowNano > b.lastNano {
+		b.tokens = min(r.burst, b.tokens+float64(nowNano-b.lastNano)*r.perSecond/float64(secondNano))
+		b.lastNano = nowNano
+	}
+	if b.tokens < 1 {
+		slog.Debug(" Decode/HandshakeRateLimited", gId(), slog.String("remote", addr.String()))
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// penalize takes a token of the source of a packet that did not authenticate, the next inits of the prefix are
+// limited sooner
+func (r *handshakeRateLimiter) penalize(addr netip.Addr, nowNano uint64) {
+	if r == nil {
+		return
+	}
+	slog.Debug(" Decode/Penalized", gId(), slog.String("remote", addr.String()))
+	r.allow(addr, nowNano)
+}
+
+// rateLimitPrefix is the prefix of addr that shares a bucket, an IPv4-mapped IPv6 address is IPv4
+func rateLimitPrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := rateLimitPrefixIPv6
+	if addr.Is4() {
+		bits = rateLimitPrefixIPv4
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		// the zero address, e.g., of a test connection
+		return netip.Prefix{}
+	}
+	return prefix
+}
+
+// isPeerInit is true for the inits that create a connection on our side
+func isPeerInit(msgType CryptoMsgType) bool {
+	return msgType == InitSnd || msgType == InitCryptoSnd || msgType == InitSignedSnd
+}
@@ -0,0 +1,201 @@
+package qotp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeRateLimit(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1))
+	assert.Nil(t, err)
+	reg := newTestMetrics()
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2),
+		WithListenAddr("127.0.0.1:9002"), WithMetrics(reg), WithHandshakeRateLimit(1, 3))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+
+	// one source sends 5 inits at once, only the burst of 3 is decrypted
+	var conns []*Conn
+	for range 5 {
+		connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+		assert.Nil(t, err)
+		_, err = connA.Stream(0).Write([]byte("hallo"))
+		assert.Nil(t, err)
+		conns = append(conns, connA)
+	}
+	for i := 0; i < 10 && connPair.nrOutgoingPacketsSender() < 5; i++ {
+		listenerA.Flush(0)
+	}
+	assert.Equal(t, 5, connPair.nrOutgoingPacketsSender())
+	inits := make([][]byte, 5)
+	for i := range inits {
+		inits[i] = append([]byte{}, connPair.Conn1.writeQueue[i].data...)
+	}
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsRecipient() > 0 {
+		_, err = listenerB.Listen(MinDeadLine, 0)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 3, listenerB.connMap.Size())
+	v, _ := gatherMetric(t, reg, "qotp_packets_dropped_total", "127.0.0.1:9002", "reason", dropRateLimited)
+	assert.Equal(t, 2.0, v)
+
+	// the limit is per source, and the bucket refills with perSecond
+	source := netip.MustParseAddrPort("192.0.2.1:4000")
+	_, _, _, err = listenerB.decode(inits[3], netip.MustParseAddrPort("198.51.100.1:4000"), 0)
+	assert.Nil(t, err)
+	_, _, _, err = listenerB.decode(inits[4], source, 0)
+	assert.Nil(t, err)
+	for range 2 {
+		_, _, _, err = listenerB.decode(inits[4], source, 0)
+		assert.ErrorIs(t, err, errDuplicateInit)
+	}
+	_, _, _, err = listenerB.decode(inits[4], source, 0)
+	assert.ErrorIs(t, err, errHandshakeRateLimited)
+	_, _, _, err = listenerB.decode(inits[4], source, secondNano)
+	assert.ErrorIs(t, err, errDuplicateInit)
+
+	// the Data packets of the connections are not limited, more than the burst arrive
+	connA := conns[0]
+	nowNano := uint64(0)
+	for i := 0; i < 10 && !connA.isHandshakeDoneOnRcv; i++ {
+		nowNano += secondNano
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = listenerA.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+	assert.True(t, connA.isHandshakeDoneOnRcv)
+	connB := listenerB.connMap.Get(connA.connId)
+	for i := range 5 {
+		_, err = connA.Stream(0).Write([]byte{byte(i)})
+		assert.Nil(t, err)
+		nowNano = max(nowNano+secondNano, connA.nextWriteTime)
+		listenerA.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+	var received []byte
+	for range 10 {
+		b, err := connB.Stream(0).Read()
+		assert.Nil(t, err)
+		received = append(received, b...)
+	}
+	assert.Equal(t, []byte("hallo\x00\x01\x02\x03\x04"), received)
+	v, _ = gatherMetric(t, reg, "qotp_packets_dropped_total", "127.0.0.1:9002", "reason", dropRateLimited)
+	assert.Equal(t, 2.0, v)
+}
+
+func TestHandshakeRateLimitBuckets(t *testing.T) {
+	_, err := Listen(WithHandshakeRateLimit(1, 1), WithHandshakeRateLimit(1, 1))
+	assert.Error(t, err)
+	_, err = Listen(WithHandshakeRateLimit(0, 1))
+	assert.Error(t, err)
+
+	// the least recently used source is evicted, while the buckets are full it starts with an empty one
+	r := newHandshakeRateLimiter(1, 1)
+	first := netip.MustParseAddr("192.0.2.1")
+	assert.True(t, r.allow(first, 0))
+	assert.False(t, r.allow(first, 0))
+	for i := range maxRateLimitBuckets - 1 {
+		assert.True(t, r.allow(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 1}), 0))
+	}
+	assert.Equal(t, maxRateLimitBuckets, r.buckets.Size())
+	assert.False(t, r.allow(netip.MustParseAddr("198.51.100.1"), 0))
+	assert.False(t, r.allow(first, 0))
+	assert.True(t, r.allow(first, secondNano))
+
+	var noLimit *handshakeRateLimiter
+	assert.True(t, noLimit.allow(first, 0))
+}
+
+func TestHandshakeRateLimitManySources(t *testing.T) {
+	// the hosts of an IPv4 /24 share a bucket
+	r := newHandshakeRateLimiter(1, 3)
+	allowed := 0
+	for i := range 256 {
+		if r.allow(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), 0) {
+			allowed++
+		}
+	}
+	assert.Equal(t, 3, allowed)
+	assert.True(t, r.allow(netip.MustParseAddr("::ffff:192.0.2.1"), secondNano))
+	assert.False(t, r.allow(netip.MustParseAddr("::ffff:192.0.2.1"), secondNano))
+
+	// as do the addresses of an IPv6 /64, another /64 has its own bucket
+	allowed = 0
+	for i := range 256 {
+		addr := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 8: byte(i >> 8), 15: byte(i)})
+		if r.allow(addr, 0) {
+			allowed++
+		}
+	}
+	assert.Equal(t, 3, allowed)
+	assert.True(t, r.allow(netip.MustParseAddr("2001:db8:0:1::1"), 0))
+	assert.Equal(t, 3, r.buckets.Size())
+
+	// a flood from many prefixes fills the buckets, then the new ones start empty
+	r = newHandshakeRateLimiter(1, 3)
+	allowed = 0
+	for i := range 2 * maxRateLimitBuckets {
+		if r.allow(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 1}), 0) {
+			allowed++
+		}
+	}
+	assert.Equal(t, maxRateLimitBuckets, allowed)
+	assert.Equal(t, maxRateLimitBuckets, r.buckets.Size())
+}
+
+func TestHandshakeRateLimitPenalty(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	listenerB.handshakeRateLimiter = newHandshakeRateLimiter(1, 3)
+
+	// sendTest sends a Data packet of A to B, after changing it with corrupt
+	nowNano := connPair.Conn1.localTime
+	sendTest := func(corrupt func(data []byte) []byte) error {
+		_, err := streamA.Write([]byte("hallo"))
+		assert.Nil(t, err)
+		nowNano = max(nowNano, connA.nextWriteTime) + secondNano
+		connA.listener.Flush(nowNano)
+		connPair.Conn1.writeQueue[0].data = corrupt(connPair.Conn1.writeQueue[0].data)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for i := 0; i < 10 && err == nil; i++ {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+		}
+		return err
+	}
+	tokens := func() float64 {
+		b := listenerB.handshakeRateLimiter.buckets.Get(netip.Prefix{})
+		if b == nil {
+			return 3
+		}
+		return b.tokens
+	}
+
+	// a truncated packet is only dropped
+	err := sendTest(func(data []byte) []byte { return data[:MinPacketSize-1] })
+	assert.ErrorIs(t, err, ErrPacketTooShort)
+	assert.Equal(t, 3.0, tokens())
+
+	// one that does not authenticate costs the source a token of its inits
+	err = sendTest(func(data []byte) []byte {
+		data[len(data)-1] ^= 0xff
+		return data
+	})
+	assert.ErrorIs(t, err, ErrAuthFailed)
+	assert.Equal(t, 2.0, tokens())
+}
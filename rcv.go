@@ -23,14 +23,19 @@ type RcvBuffer struct {
 	segments                   *SortedMap[uint64, RcvValue]
 	nextInOrderOffsetToWaitFor uint64 // Next expected offset
 	closeAtOffset              *uint64
+	size                       int // Current size of this stream
 }
 
 type ReceiveBuffer struct {
-	streams  map[uint32]*RcvBuffer
-	capacity int // Max buffer size
-	size     int // Current size
-	ackList  []*Ack
-	mu       *sync.Mutex
+	streams        map[uint32]*RcvBuffer
+	capacity       int // Max buffer size
+	streamCapacity int // Max buffer size of a single stream
+	size           int // Current size
+	ackList        []*Ack
+	mu             *sync.Mutex
+
+	// how far past the next offset to read a segment can end, 0 means no limit, see WithReassemblyLimit
+	reassemblyLimit int
 }
 
 func NewRcvBuffer() *RcvBuffer {
@@ -42,10 +47,11 @@ func NewRcvBuffer() *RcvBuffer {
 func NewReceiveBuffer(capacity int) *ReceiveBuffer {
 	slog.Debug("Rcv/NewReceiveBuffer")
 	return &ReceiveBuffer{
-		streams:  make(map[uint32]*RcvBuffer),
-		capacity: capacity,
-		ackList:  []*Ack{},
-		mu:       &sync.Mutex{},
+		streams:        make(map[uint32]*RcvBuffer),
+		capacity:       capacity,
+		streamCapacity: capacity,
+		ackList:        []*Ack{},
+		mu:             &sync.Mutex{},
 	}
 }
 
@@ -62,7 +68,7 @@ func (rb *ReceiveBuffer) EmptyInsert(streamID uint32, offset uint64, nowNano uin
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
 
-	rb.ackList = append(rb.ackList, &Ack{streamID: streamID, offset: offset, len: 0})
+	rb.ackList = append(rb.ackList, &Ack{streamID: streamID, offset: offset, len: 0, rcvTimeNano: nowNano})
 
 	return RcvInsertOk
 }
@@ -80,10 +86,22 @@ func (rb *ReceiveBuffer) Insert(streamID uint32, offset uint64, nowNano uint64,
 		slog.Debug("Rcv/BufferFull", slog.Int("rb.size+dataLen", rb.size+dataLen), slog.Int("rb.capacity", rb.capacity))
 		return RcvInsertBufferFull
 	}
+	if stream.size+dataLen > rb.streamCapacity {
+		slog.Debug("Rcv/StreamBufferFull", slog.Int("stream.size+dataLen", stream.size+dataLen),
+			slog.Int("rb.streamCapacity", rb.streamCapacity))
+		return RcvInsertBufferFull
+	}
+	if rb.reassemblyLimit > 0 && offset > stream.nextInOrderOffsetToWaitFor &&
+		offset+uint64(dataLen) > stream.nextInOrderOffsetToWaitFor+uint64(rb.reassemblyLimit) {
+		// not acked, the sender retransmits it once the gap is filled
+		slog.Debug("Rcv/ReassemblyLimit", slog.Uint64("offset", offset), slog.Int("len(data)", dataLen),
+			slog.Uint64("next", stream.nextInOrderOffsetToWaitFor))
+		return RcvInsertBufferFull
+	}
 
 	// Now we need to add the ack to the list even if it's a duplicate,
 	// as the ack may have been lost, we need to send it again
-	rb.ackList = append(rb.ackList, &Ack{streamID: streamID, offset: offset, len: uint16(dataLen)})
+	rb.ackList = append(rb.ackList, &Ack{streamID: streamID, offset: offset, len: uint16(dataLen), rcvTimeNano: nowNano})
 	slog.Debug("Rcv/AddedAck", slog.Uint64("offset", offset), slog.Int("ackListLen", len(rb.ackList)))
 
 	// Check if the incoming segment is completely before the next expected offset.
@@ -112,6 +130,7 @@ func (rb *ReceiveBuffer) Insert(streamID uint32, offset uint64, nowNano uint64,
 			// and continue to insert the larger segment
 			stream.segments.Remove(offset)
 			rb.size -= existingLen
+			stream.size -= existingLen
 			slog.Debug("Rcv/Replace/WithLarger",
 				slog.Uint64("offset", offset),
 				slog.Int("old_len", existingLen),
@@ -119,8 +138,10 @@ func (rb *ReceiveBuffer) Insert(streamID uint32, offset uint64, nowNano uint64,
 		}
 
 		slog.Debug("Rcv/Ok", slog.Uint64("offset", offset), slog.Int("len(data)", dataLen))
-		stream.segments.Put(offset, RcvValue{data: userData, receiveTimeNano: nowNano})
+		// userData is in a pooled buffer of the decoder, keep a copy
+		stream.segments.Put(offset, RcvValue{data: bytes.Clone(userData), receiveTimeNano: nowNano})
 		rb.size += dataLen
+		stream.size += dataLen
 		return RcvInsertOk
 	}
 	// first check if the previous is overlapping
@@ -166,6 +187,7 @@ func (rb *ReceiveBuffer) Insert(streamID uint32, offset uint64, nowNano uint64,
 				// We completely overlap the next segment - remove it since we have more data
 				stream.segments.Remove(nextOffset)
 				rb.size -= len(nextData.data)
+				stream.size -= len(nextData.data)
 
 				// Assert that our overlapping portion matches the next segment data
 				ourOverlapStart := nextOffset - finalOffset
@@ -202,8 +224,9 @@ func (rb *ReceiveBuffer) Insert(streamID uint32, offset uint64, nowNano uint64,
 
 	// Now we have the correct offset and data slice - store it
 	slog.Debug("Rcv/final", slog.Uint64("offset", finalOffset), slog.Int("len(data)", len(finalUserData)), slog.Uint64("next", stream.nextInOrderOffsetToWaitFor))
-	stream.segments.Put(finalOffset, RcvValue{data: finalUserData, receiveTimeNano: nowNano})
+	stream.segments.Put(finalOffset, RcvValue{data: bytes.Clone(finalUserData), receiveTimeNano: nowNano})
 	rb.size += len(finalUserData)
+	stream.size += len(finalUserData)
 
 	return RcvInsertOk
 }
@@ -218,6 +241,49 @@ func (rb *ReceiveBuffer) Close(streamID uint32, closeOffset uint64) {
 	}
 }
 
+// RemoveStream drops all buffered data of a stream and returns the offset up to which data was read,
+// pending acks are kept
+func (rb *ReceiveBuffer) RemoveStream(streamID uint32) (readOffset uint64) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	stream := rb.streams[streamID]
+	if stream == nil {
+		return 0
+	}
+
+	for {
+		offset, value, ok := stream.segments.Min()
+		if !ok {
+			break
+		}
+		stream.segments.Remove(offset)
+		rb.size -= len(value.data)
+	}
+	delete(rb.streams, streamID)
+	return stream.nextInOrderOffsetToWaitFor
+}
+
+// Discard acks data without storing it, used if the stream is not read anymore
+func (rb *ReceiveBuffer) Discard(streamID uint32, offset uint64, nowNano uint64, dataLen int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.ackList = append(rb.ackList, &Ack{streamID: streamID, offset: offset, len: uint16(dataLen), rcvTimeNano: nowNano})
+}
+
+// GetOffsetRead returns the offset up to which data was removed in order
+func (rb *ReceiveBuffer) GetOffsetRead(streamID uint32) (offset uint64) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	stream := rb.streams[streamID]
+	if stream == nil {
+		return 0
+	}
+	return stream.nextInOrderOffsetToWaitFor
+}
+
 func (rb *ReceiveBuffer) GetOffsetClosedAt(streamID uint32) (offset *uint64) {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
@@ -252,6 +318,7 @@ func (rb *ReceiveBuffer) RemoveOldestInOrder(streamID uint32) (offset uint64, da
 	if oldestOffset == stream.nextInOrderOffsetToWaitFor {
 		stream.segments.Remove(oldestOffset)
 		rb.size -= len(oldestValue.data)
+		stream.size -= len(oldestValue.data)
 
 		nextOffset := oldestOffset
 		if nextOffset < stream.nextInOrderOffsetToWaitFor {
@@ -278,6 +345,18 @@ func (rb *ReceiveBuffer) Size() int {
 	return rb.size
 }
 
+// StreamRcvWindow returns how much data a stream can still buffer, limited by the stream and the total capacity
+func (rb *ReceiveBuffer) StreamRcvWindow(streamID uint32) uint64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	streamSize := 0
+	if stream := rb.streams[streamID]; stream != nil {
+		streamSize = stream.size
+	}
+	return uint64(max(0, min(rb.streamCapacity-streamSize, rb.capacity-rb.size)))
+}
+
 func (rb *ReceiveBuffer) Available() int {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
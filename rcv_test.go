@@ -22,6 +22,19 @@ func TestRcvSingleSegment(t *testing.T) {
 	require.Empty(t, data)
 }
 
+func TestRcvSegmentIsCopied(t *testing.T) {
+	rb := NewReceiveBuffer(1000)
+
+	// the decoder reuses its buffer for the next packet
+	userData := []byte("data")
+	status := rb.Insert(1, 0, 0, userData)
+	assert.Equal(t, RcvInsertOk, status)
+	copy(userData, "xxxx")
+
+	_, data, _ := rb.RemoveOldestInOrder(1)
+	assert.Equal(t, []byte("data"), data)
+}
+
 func TestRcvDuplicateSegment(t *testing.T) {
 	rb := NewReceiveBuffer(1000)
 
@@ -113,6 +126,38 @@ func TestRcvBufferFullExact(t *testing.T) {
 	assert.Equal(t, []byte("data"), data)
 }
 
+func TestRcvStreamBufferFull(t *testing.T) {
+	rb := NewReceiveBuffer(1000)
+	rb.streamCapacity = 8
+
+	status := rb.Insert(1, 0, 0, []byte("data"))
+	assert.Equal(t, RcvInsertOk, status)
+	assert.Equal(t, uint64(4), rb.StreamRcvWindow(1))
+
+	status = rb.Insert(1, 4, 0, []byte("more-data"))
+	assert.Equal(t, RcvInsertBufferFull, status)
+
+	// Other streams are not affected
+	status = rb.Insert(2, 0, 0, []byte("other123"))
+	assert.Equal(t, RcvInsertOk, status)
+	assert.Equal(t, uint64(0), rb.StreamRcvWindow(2))
+	assert.Equal(t, uint64(8), rb.StreamRcvWindow(3))
+
+	// Reading frees the window of the stream
+	_, data, _ := rb.RemoveOldestInOrder(2)
+	assert.Equal(t, []byte("other123"), data)
+	assert.Equal(t, uint64(8), rb.StreamRcvWindow(2))
+}
+
+func TestRcvStreamRcvWindowLimitedByCapacity(t *testing.T) {
+	rb := NewReceiveBuffer(10)
+	rb.streamCapacity = 8
+
+	status := rb.Insert(1, 0, 0, []byte("data"))
+	assert.Equal(t, RcvInsertOk, status)
+	assert.Equal(t, uint64(6), rb.StreamRcvWindow(2))
+}
+
 func TestRcvRemoveWithHigherOffset(t *testing.T) {
 	rb := NewReceiveBuffer(4)
 
@@ -486,4 +531,39 @@ func TestRcvDuplicateAfterCloseGeneratesAck(t *testing.T) {
 	assert.NotNil(t, ack)
 	assert.Equal(t, uint64(0), ack.offset)
 	assert.Equal(t, uint16(4), ack.len)
-}
\ No newline at end of file
+}
+
+func TestRcvReassemblyLimit(t *testing.T) {
+	rb := NewReceiveBuffer(1000)
+	rb.reassemblyLimit = 200
+	data := createTestData(600)
+
+	// offset 100 first, it waits for the gap
+	assert.Equal(t, RcvInsertOk, rb.Insert(1, 100, 0, data[100:200]))
+	_, out, _ := rb.RemoveOldestInOrder(1)
+	assert.Nil(t, out)
+
+	// offset 0 fills the gap, the data is read in order
+	assert.Equal(t, RcvInsertOk, rb.Insert(1, 0, 0, data[:100]))
+	offset, out, _ := rb.RemoveOldestInOrder(1)
+	assert.Equal(t, uint64(0), offset)
+	assert.Equal(t, data[:100], out)
+	offset, out, _ = rb.RemoveOldestInOrder(1)
+	assert.Equal(t, uint64(100), offset)
+	assert.Equal(t, data[100:200], out)
+
+	// next is 200: up to offset 400 is buffered, beyond is dropped without an ack
+	rb.ackList = nil
+	assert.Equal(t, RcvInsertOk, rb.Insert(1, 300, 0, data[300:400]))
+	assert.Equal(t, RcvInsertBufferFull, rb.Insert(1, 350, 0, data[350:450]))
+	assert.Len(t, rb.ackList, 1)
+	assert.Equal(t, 100, rb.Size())
+
+	// the next in order segment is accepted even if it is larger than the limit
+	assert.Equal(t, RcvInsertOk, rb.Insert(1, 200, 0, data[200:500]))
+
+	_, err := Listen(WithReassemblyLimit(0))
+	assert.Error(t, err)
+	_, err = Listen(WithReassemblyLimit(100), WithReassemblyLimit(100))
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+package qotp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ReadAll reads until the peer closed the stream, like io.ReadAll, it blocks while no data is buffered. If the
+// stream has more than maxBytes, it returns ErrPayloadTooLarge with the bytes read so far. The data is only
+// received while Listen is called, e.g., by Loop in another goroutine, it must not be called from the goroutine
+// that calls Listen.
+func (s *Stream) ReadAll(maxBytes int64) ([]byte, error) {
+	return s.ReadAllContext(context.Background(), maxBytes)
+}
+
+// ReadAllContext is ReadAll that returns the bytes read so far and the error of ctx once it is done
+func (s *Stream) ReadAllContext(ctx context.Context, maxBytes int64) ([]byte, error) {
+	var all []byte
+	isConnDone := false
+	for {
+		received := s.conn.received() // before the read, so that a packet in between is not missed
+		b, err := s.Read()
+		all = append(all, b...)
+		if int64(len(all)) > maxBytes {
+			return all, fmt.Errorf("%w: more than %d bytes", ErrPayloadTooLarge, maxBytes)
+		}
+		if errors.Is(err, io.EOF) {
+			return all, nil
+		}
+		if err != nil {
+			return all, err
+		}
+		if len(b) > 0 {
+			continue
+		}
+		if isConnDone {
+			return all, ErrConnectionClosed
+		}
+		select {
+		case <-received:
+		case <-ctx.Done():
+			return all, ctx.Err()
+		case <-s.conn.Context().Done():
+			isConnDone = true // the data received before the close is still read
+		}
+	}
+}
+
+// received returns a channel that is closed once the next packet of the peer was processed
+func (c *Conn) received() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.receivedCh == nil {
+		c.receivedCh = make(chan struct{})
+	}
+	return c.receivedCh
+}
+
+// onReceived wakes the readers of ReadAll
+func (c *Conn) onReceived() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.receivedCh != nil {
+		close(c.receivedCh)
+		c.receivedCh = nil
+	}
+}
@@ -0,0 +1,87 @@
+package qotp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exchangeReadAllTest delivers the packets of A to B and the acks back until done returns true
+func exchangeReadAllTest(t *testing.T, connA *Conn, listenerB *Listener, connPair *ConnPair, done func() bool) {
+	nowNano := connPair.Conn1.localTime
+	for i := 0; i < 100 && !done(); i++ {
+		nowNano = max(nowNano+10*msNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+		_, err := connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// ReadAll blocks until the peer closed the stream
+	type result struct {
+		data []byte
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		data, err := streamB.ReadAll(1000)
+		resultCh <- result{data, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, resultCh)
+
+	_, err := streamA.Write([]byte("part1 "))
+	assert.Nil(t, err)
+	exchangeReadAllTest(t, connA, listenerB, connPair, func() bool { return connA.snd.IsDrained() })
+	assert.Empty(t, resultCh)
+	_, err = streamA.Write([]byte("part2"))
+	assert.Nil(t, err)
+	streamA.Close()
+	exchangeReadAllTest(t, connA, listenerB, connPair, func() bool { return len(resultCh) > 0 })
+	if assert.Len(t, resultCh, 1) {
+		r := <-resultCh
+		assert.Nil(t, r.err)
+		assert.Equal(t, []byte("part1 part2"), r.data)
+	}
+}
+
+func TestReadAllLimit(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// no data and a done context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data, err := streamB.ReadAllContext(ctx, 10)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, data)
+
+	// more than the limit returns the bytes read so far
+	streamA := connA.Stream(4)
+	_, err = streamA.Write(createTestData(100))
+	assert.Nil(t, err)
+	streamA.Close()
+	exchangeReadAllTest(t, connA, listenerB, connPair, func() bool { return streamB.conn.streams.Contains(4) })
+	data, err = streamB.conn.Stream(4).ReadAll(10)
+	assert.ErrorIs(t, err, ErrPayloadTooLarge)
+	assert.Greater(t, len(data), 10)
+	assert.Equal(t, createTestData(100)[:len(data)], data)
+}
@@ -0,0 +1,192 @@
+package qotp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Rekeying replaces the shared secret of a connection with the next generation, derived from it with
+// HMAC-SHA256 like the key update of QUIC. The generation is not sent: a Data packet that does not open with
+// the current secret is tried with the previous and the next one, a packet that opens with the next one
+// switches the receiver to it. The side that rekeys sends with the new secret right away and does not rekey
+// again until a packet of the peer with it arrived. The previous secret is kept for reordered packets for
+// prevKeysPtos PTOs, then it is zeroized, from then on the packets sent with it cannot be decrypted anymore,
+// even if a later secret leaks.
+
+// prevKeysPtos is how many PTOs the previous secret is kept after a rekey, a packet reordered by more is lost
+const prevKeysPtos = 3
+
+// RekeyEvent is passed to the callback of OnRekey once the connection switched to the next shared secret
+type RekeyEvent struct {
+	KeyGeneration uint64    // the generation now in use
+	Time          time.Time // of the switch, from the clock of the listener
+	PacketsSent   uint64    // Data packets sent with the previous generation
+	BytesSent     uint64    // encrypted bytes of these packets
+}
+
+// nextSharedSecret derives the shared secret of the next generation
+func nextSharedSecret(sharedSecret []byte) []byte {
+	mac := hmac.New(sha256.New, sharedSecret)
+	mac.Write([]byte("qotp rekey"))
+	return mac.Sum(nil)
+}
+
+// Rekey switches to the next shared secret with the next Data packet. If the peer did not confirm the last
+// rekey yet, the switch waits until it did.
+func (c *Conn) Rekey() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isCloseConnRequested || c.closeErr != nil {
+		return ErrConnectionClosed
+	}
+	c.isRekeyRequested.Store(true)
+	return nil
+}
+
+// KeyGeneration returns how often the shared secret was replaced, 0 is the one of the handshake
+func (c *Conn) KeyGeneration() uint64 {
+	return c.keyGen.Load()
+}
+
+// OnRekey sets a callback that is called after each rekey, by Rekey, WithRekeyAfter or the peer. It runs on the
+// goroutine that reads and writes the packets and should return quickly.
+func (c *Conn) OnRekey(cb func(RekeyEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRekey = cb
+}
+
+// nextAeads returns the aeads of the next generation, derived once they are needed
+func (c *Conn) nextAeads() (*aeads, error) {
+	if c.aeadsNext == nil {
+		if c.sharedSecret == nil {
+			return nil, errors.New("no shared secret to rekey")
+		}
+		sharedSecretNext := nextSharedSecret(c.sharedSecret)
+		a, err := newAeads(sharedSecretNext, c.packetCipher())
+		if err != nil {
+			zeroize(sharedSecretNext)
+			return nil, err
+		}
+		c.sharedSecretNext, c.aeadsNext = sharedSecretNext, a
+	}
+	return c.aeadsNext, nil
+}
+
+// rekey switches to the next generation, the current one becomes the previous one, the previous one is
+// zeroized
+func (c *Conn) rekey() error {
+	current, err := c.dataAeads()
+	if err != nil {
+		return err
+	}
+	next, err := c.nextAeads()
+	if err != nil {
+		return err
+	}
+	c.dropPrevKeys()
+	c.sharedSecretPrev, c.aeadsPrev = c.sharedSecret, current
+	c.sharedSecret, c.aeads = c.sharedSecretNext, next
+	c.sharedSecretNext, c.aeadsNext = nil, nil
+	c.prevKeysUntilNano = 0 // set by the next flush, see expirePrevKeys
+	event := RekeyEvent{
+		KeyGeneration: c.keyGen.Add(1),
+		Time:          c.listener.now(),
+		PacketsSent:   c.packetsSinceRekey,
+		BytesSent:     c.bytesSinceRekey,
+	}
+	c.bytesSinceRekey, c.packetsSinceRekey = 0, 0
+	c.listener.logRekey(c.connId, event.KeyGeneration, c.sharedSecret)
+	slog.Debug("Rekey", gId(), c.debug(), slog.Uint64("packetsSent", event.PacketsSent),
+		slog.Uint64("bytesSent", event.BytesSent))
+
+	c.mu.Lock()
+	cb := c.onRekey
+	c.mu.Unlock()
+	if cb != nil {
+		cb(event)
+	}
+	return nil
+}
+
+// dropPrevKeys zeroizes the previous generation
+func (c *Conn) dropPrevKeys() {
+	zeroize(c.sharedSecretPrev)
+	c.aeadsPrev.zeroize()
+	c.sharedSecretPrev, c.aeadsPrev = nil, nil
+}
+
+// expirePrevKeys drops the previous generation prevKeysPtos PTOs after the rekey, the time starts with the
+// first flush after it
+func (c *Conn) expirePrevKeys(nowNano uint64) {
+	if c.aeadsPrev == nil {
+		return
+	}
+	if c.prevKeysUntilNano == 0 {
+		c.prevKeysUntilNano = nowNano + prevKeysPtos*c.ptoNano()
+		return
+	}
+	if nowNano >= c.prevKeysUntilNano {
+		slog.Debug("Rekey/DropPrevKeys", gId(), c.debug())
+		c.dropPrevKeys()
+	}
+}
+
+// maybeRekey switches to the next generation before a Data packet is encrypted, if Rekey was called or the
+// limit of WithRekeyAfter is reached
+func (c *Conn) maybeRekey() error {
+	if !c.isHandshakeDoneOnRcv || c.isRekeyPending {
+		return nil
+	}
+	l := c.listener
+	isDue := (l.rekeyAfterBytes > 0 && c.bytesSinceRekey >= l.rekeyAfterBytes) ||
+		(l.rekeyAfterPackets > 0 && c.packetsSinceRekey >= l.rekeyAfterPackets)
+	if !isDue && !c.isRekeyRequested.Load() {
+		return nil
+	}
+	c.isRekeyRequested.Store(false)
+	if err := c.rekey(); err != nil {
+		return err
+	}
+	c.isRekeyPending = true
+	return nil
+}
+
+// openData decrypts a Data packet of the peer with the current shared secret, or else with the previous or
+// the next one
+func (c *Conn) openData(encData []byte) (*Message, error) {
+	current, err := c.dataAeads()
+	if err != nil {
+		return nil, err
+	}
+	m, err := decryptData(encData, c.isSenderOnInit, c.epochCryptoRcv, current, c.ivRcv)
+	if err == nil {
+		c.isRekeyPending = false // the peer sends with our generation
+		return m, nil
+	}
+
+	if c.aeadsPrev != nil {
+		m, errPrev := decryptData(encData, c.isSenderOnInit, c.epochCryptoRcv, c.aeadsPrev, c.ivRcv)
+		if errPrev == nil {
+			return m, nil // sent before the peer switched
+		}
+	}
+
+	next, errNext := c.nextAeads()
+	if errNext != nil {
+		return nil, err
+	}
+	m, errNext = decryptData(encData, c.isSenderOnInit, c.epochCryptoRcv, next, c.ivRcv)
+	if errNext != nil {
+		return nil, err
+	}
+	if err = c.rekey(); err != nil {
+		m.Release()
+		return nil, err
+	}
+	c.isRekeyPending = false
+	return m, nil
+}
@@ -0,0 +1,154 @@
+package qotp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flushRekeyTest flushes the written data of conn until a packet is queued, returns the time it used
+func flushRekeyTest(t *testing.T, conn *Conn, s *Stream, nowNano uint64, nrPackets func() int) uint64 {
+	assert.Nil(t, s.Flush())
+	conn.srtt, conn.rttvar, conn.bwMax = 10*msNano, 1*msNano, 0
+	before := nrPackets()
+	for i := 0; i < 6 && nrPackets() == before; i++ {
+		nowNano = max(nowNano+msNano, conn.nextWriteTime)
+		conn.listener.Flush(nowNano)
+	}
+	assert.Greater(t, nrPackets(), before)
+	return nowNano
+}
+
+// readRekeyTest lets listener receive until n bytes are read from s
+func readRekeyTest(t *testing.T, listener *Listener, s *Stream, nowNano uint64, n int) []byte {
+	var received []byte
+	for i := 0; i < 100 && len(received) < n; i++ {
+		_, err := listener.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+		b, err := s.Read()
+		assert.Nil(t, err)
+		received = append(received, b...)
+	}
+	return received
+}
+
+func TestRekeyReordered(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	_, err := connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	secretGen0 := connA.sharedSecret
+	var events []RekeyEvent
+	connA.OnRekey(func(e RekeyEvent) { events = append(events, e) })
+
+	// the packet before the rekey arrives after the one with the new secret
+	nowNano := connPair.Conn1.localTime + secondNano
+	_, err = streamA.Write([]byte("old"))
+	assert.Nil(t, err)
+	nowNano = flushRekeyTest(t, connA, streamA, nowNano, connPair.nrOutgoingPacketsSender)
+	assert.Nil(t, connA.Rekey())
+	_, err = streamA.Write([]byte("new"))
+	assert.Nil(t, err)
+	nowNano = flushRekeyTest(t, connA, streamA, nowNano, connPair.nrOutgoingPacketsSender)
+	assert.Equal(t, uint64(1), connA.KeyGeneration())
+	assert.True(t, connA.isRekeyPending)
+	assert.NotEqual(t, secretGen0, connA.sharedSecret)
+
+	n := connPair.nrOutgoingPacketsSender()
+	_, err = connPair.senderToRecipient(n-1, n-2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("oldnew"), readRekeyTest(t, listenerB, streamB, connPair.Conn2.localTime, 6))
+	assert.Equal(t, uint64(1), connB.KeyGeneration())
+	assert.Equal(t, connA.sharedSecret, connB.sharedSecret)
+
+	// the reply of B with the new secret confirms the rekey, now B rekeys
+	assert.Nil(t, connB.Rekey())
+	_, err = streamB.Write([]byte("reply"))
+	assert.Nil(t, err)
+	flushRekeyTest(t, connB, streamB, connPair.Conn2.localTime+secondNano, connPair.nrOutgoingPacketsReceiver)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("reply"), readRekeyTest(t, connA.listener, streamA, nowNano, 5))
+	assert.Equal(t, uint64(2), connA.KeyGeneration())
+	assert.Equal(t, uint64(2), connB.KeyGeneration())
+	assert.False(t, connA.isRekeyPending)
+	assert.True(t, connB.isRekeyPending)
+
+	// the first rekey of A was its own, the second one by B
+	assert.Len(t, events, 2)
+	assert.Equal(t, uint64(1), events[0].KeyGeneration)
+	assert.Equal(t, uint64(1), events[0].PacketsSent)
+	assert.Greater(t, events[0].BytesSent, uint64(0))
+	assert.Equal(t, uint64(2), events[1].KeyGeneration)
+	assert.Equal(t, uint64(1), events[1].PacketsSent)
+	assert.False(t, events[1].Time.Before(events[0].Time))
+	assert.Equal(t, uint64(2), connA.Stats().KeyGeneration)
+
+	// the secret of generation 0 is gone, the one of generation 1 is kept for reordered packets
+	assert.Equal(t, make([]byte, len(secretGen0)), secretGen0)
+	assert.Equal(t, nextSharedSecret(connA.sharedSecretPrev), connA.sharedSecret)
+
+	// and zeroized prevKeysPtos PTOs after the rekey
+	secretGen1 := connA.sharedSecretPrev
+	connA.listener.Flush(nowNano + secondNano)
+	assert.NotNil(t, connA.aeadsPrev)
+	connA.listener.Flush(nowNano + 2*secondNano + prevKeysPtos*connA.ptoNano())
+	assert.Nil(t, connA.aeadsPrev)
+	assert.Nil(t, connA.sharedSecretPrev)
+	assert.Equal(t, make([]byte, len(secretGen1)), secretGen1)
+}
+
+func TestRekeyAfter(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithRekeyAfter(0, 2))
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2))
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, testPrvKey2.PublicKey())
+	assert.Nil(t, err)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	// every second packet of A uses the next secret, once the ack of B confirmed the last one
+	nowNano := connPair.Conn1.localTime + secondNano
+	for i := 0; i < 8; i++ {
+		data := []byte{'a' + byte(i)}
+		_, err = streamA.Write(data)
+		assert.Nil(t, err)
+		nowNano = flushRekeyTest(t, connA, streamA, nowNano, connPair.nrOutgoingPacketsSender)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		assert.Equal(t, data, readRekeyTest(t, listenerB, streamB, connPair.Conn2.localTime, 1))
+
+		listenerB.Flush(connPair.Conn2.localTime + secondNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		_, err = listenerA.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	assert.GreaterOrEqual(t, connA.KeyGeneration(), uint64(2))
+	assert.Equal(t, connA.KeyGeneration(), connB.KeyGeneration())
+}
+
+func TestRekeyOption(t *testing.T) {
+	_, err := Listen(WithRekeyAfter(0, 0))
+	assert.Error(t, err)
+	_, err = Listen(WithRekeyAfter(1<<30, 0), WithRekeyAfter(0, 100))
+	assert.Error(t, err)
+
+	connPair := NewConnPair("alice", "bob")
+	l, err := Listen(WithNetworkConn(connPair.Conn1), WithRekeyAfter(1<<30, 1000))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1<<30), l.rekeyAfterBytes)
+	assert.Equal(t, uint64(1000), l.rekeyAfterPackets)
+
+	conn, err := l.Dial(netip.AddrPort{})
+	assert.Nil(t, err)
+	assert.Nil(t, conn.Rekey())
+	conn.closeErr = ErrConnectionClosed
+	assert.ErrorIs(t, conn.Rekey(), ErrConnectionClosed)
+}
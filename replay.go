@@ -0,0 +1,108 @@
+package qotp
+
+import "fmt"
+
+const (
+	// defaultReplayWindow is the number of packets below the highest received one that are still accepted,
+	// like the 64 bit window of IPsec
+	defaultReplayWindow = 64
+	maxReplayWindow     = 4096
+	// defaultSnWindow is the number of packets a Data packet may be ahead of the highest received one, the
+	// peer would have to lose that many packets in a row
+	defaultSnWindow = 1 << 20
+)
+
+// errReplayedPacket is returned by decode for a Data packet with a sequence number that was already received,
+// or that is too old for the replay window, the packet is dropped and counted, the connection stays
+var errReplayedPacket = fmt.Errorf("replayed packet: %w", ErrBadSequenceNumber)
+
+// errSnOutOfWindow is returned by decode for a Data packet with a sequence number too far ahead of the highest
+// received one, see WithSequenceWindow, the packet is dropped and counted, the connection stays
+var errSnOutOfWindow = fmt.Errorf("sequence number out of window: %w", ErrBadSequenceNumber)
+
+// replayWindow is a sliding anti-replay window over the sequence numbers of the Data packets of the peer. Bit i
+// of the bitmap is set if top-i was received. A sequence number above top moves the window, one within the
+// window is accepted once, one below it is dropped.
+type replayWindow struct {
+	bitmap []uint64 // nil until the first packet
+	top    uint64
+}
+
+// replaySeq combines epoch and SN of a packet, the epoch would need to exceed 16 bits to overflow, that is
+// 2^64 packets
+func replaySeq(epoch uint64, sn uint64) uint64 {
+	return epoch<<48 | sn
+}
+
+// packetNumber counts the packets of seq across the epochs, the SN starts over with each epoch, see
+// snRotateAfter
+func packetNumber(seq uint64) uint64 {
+	return (seq>>48)*snRotateAfter + seq&(1<<48-1)
+}
+
+// isAhead returns true if seq is more than window packets above the highest received one. Unlike accept, it
+// does not change the window, so it may be checked before a packet is processed any further.
+func (w *replayWindow) isAhead(seq uint64, window uint64) bool {
+	return w.bitmap != nil && packetNumber(seq) > packetNumber(w.top)+window
+}
+
+// accept checks seq against the window and marks it as received, only packets that are authenticated may be
+// passed, otherwise a forged packet could move the window. The window has bits bits, a multiple of 64.
+func (w *replayWindow) accept(seq uint64, bits int) bool {
+	if w.bitmap == nil {
+		w.bitmap = make([]uint64, bits/64)
+		w.top = seq
+		w.bitmap[0] = 1
+		return true
+	}
+	if seq > w.top {
+		w.shift(seq - w.top)
+		w.top = seq
+		w.bitmap[0] |= 1
+		return true
+	}
+
+	diff := w.top - seq
+	if diff >= uint64(len(w.bitmap))*64 {
+		return false // too old
+	}
+	word, bit := diff/64, diff%64
+	if w.bitmap[word]&(1<<bit) != 0 {
+		return false // duplicate
+	}
+	w.bitmap[word] |= 1 << bit
+	return true
+}
+
+// shift moves the bits of the window n sequence numbers to the past
+func (w *replayWindow) shift(n uint64) {
+	if n >= uint64(len(w.bitmap))*64 {
+		clear(w.bitmap)
+		return
+	}
+	words, bits := int(n/64), n%64
+	for i := len(w.bitmap) - 1; i >= 0; i-- {
+		var v uint64
+		if j := i - words; j >= 0 {
+			v = w.bitmap[j] << bits
+			if bits > 0 && j > 0 {
+				v |= w.bitmap[j-1] >> (64 - bits)
+			}
+		}
+		w.bitmap[i] = v
+	}
+}
+
+func (l *Listener) replayWindow() int {
+	if l.replayWindowBits == 0 {
+		return defaultReplayWindow
+	}
+	return l.replayWindowBits
+}
+
+func (l *Listener) snWindow() uint64 {
+	if l.snWindowPackets == 0 {
+		return defaultSnWindow
+	}
+	return l.snWindowPackets
+}
@@ -0,0 +1,186 @@
+package qotp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := replayWindow{}
+	assert.True(t, w.accept(10, 128))
+	assert.False(t, w.accept(10, 128))
+
+	// fresh packets move the window, reordered ones are accepted once
+	assert.True(t, w.accept(12, 128))
+	assert.True(t, w.accept(11, 128))
+	assert.False(t, w.accept(11, 128))
+	assert.False(t, w.accept(12, 128))
+
+	// across the word boundary of the bitmap
+	assert.True(t, w.accept(80, 128))
+	assert.False(t, w.accept(12, 128))
+	assert.True(t, w.accept(13, 128))
+	assert.False(t, w.accept(13, 128))
+
+	// too old for the window
+	assert.True(t, w.accept(200, 128))
+	assert.False(t, w.accept(72, 128))
+	assert.True(t, w.accept(73, 128))
+	assert.False(t, w.accept(80, 128))
+
+	// a jump beyond the window clears it
+	assert.True(t, w.accept(1000, 128))
+	assert.True(t, w.accept(999, 128))
+	assert.False(t, w.accept(200, 128))
+}
+
+func TestReplayWindowShift(t *testing.T) {
+	w := replayWindow{}
+	for seq := uint64(0); seq < 256; seq += 3 {
+		assert.True(t, w.accept(seq, 256))
+	}
+	for seq := uint64(1); seq < 256; seq++ {
+		assert.Equal(t, seq%3 != 0, w.accept(seq, 256), "seq %d", seq)
+	}
+	assert.False(t, w.accept(0, 256))
+}
+
+func TestReplaySeqEpoch(t *testing.T) {
+	w := replayWindow{}
+	assert.True(t, w.accept(replaySeq(0, (1<<48)-1), 64))
+	assert.True(t, w.accept(replaySeq(1, 0), 64))
+	assert.False(t, w.accept(replaySeq(0, (1<<48)-1), 64))
+}
+
+func TestReplayCapturedPacket(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	_, err := streamA.Write([]byte("pay"))
+	assert.Nil(t, err)
+	nowNano := connPair.Conn1.localTime + secondNano
+	connA.listener.Flush(nowNano)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	captured := bytes.Clone(connPair.Conn1.writeQueue[0].data)
+
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("pay"), b)
+
+	// the captured packet is authentic, but dropped before it reaches the stream
+	_, _, _, err = listenerB.decode(captured, netip.AddrPort{}, nowNano)
+	assert.ErrorIs(t, err, errReplayedPacket)
+
+	connPair.Conn1.writeQueue = append(connPair.Conn1.writeQueue, packetData{data: captured})
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	s, err := listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+	assert.Equal(t, uint64(1), connB.droppedPackets)
+	b, err = streamB.Read()
+	assert.Nil(t, err)
+	assert.Empty(t, b)
+}
+
+func TestReplayWindowOption(t *testing.T) {
+	_, err := Listen(WithReplayWindow(100))
+	assert.Error(t, err)
+	_, err = Listen(WithReplayWindow(2 * maxReplayWindow))
+	assert.Error(t, err)
+
+	connPair := NewConnPair("alice", "bob")
+	l, err := Listen(WithNetworkConn(connPair.Conn1), WithReplayWindow(256))
+	assert.Nil(t, err)
+	assert.Equal(t, 256, l.replayWindow())
+	assert.Equal(t, defaultReplayWindow, (&Listener{}).replayWindow())
+}
+
+func TestSequenceWindow(t *testing.T) {
+	w := replayWindow{}
+	assert.False(t, w.isAhead(1<<40, 100)) // the first packet sets the window
+	assert.True(t, w.accept(1000, 64))
+	assert.False(t, w.isAhead(1100, 100))
+	assert.True(t, w.isAhead(1101, 100))
+	assert.False(t, w.isAhead(0, 100)) // behind is the replay window
+
+	// the SN starts over with the next epoch
+	w = replayWindow{}
+	assert.True(t, w.accept(replaySeq(0, snRotateAfter-1), 64))
+	assert.False(t, w.isAhead(replaySeq(1, 99), 100))
+	assert.True(t, w.isAhead(replaySeq(1, 100), 100))
+}
+
+func TestSequenceWindowDrop(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	listenerB.snWindowPackets = maxReplayWindow
+
+	// a first Data packet sets the window
+	_, err := streamA.Write([]byte("first"))
+	assert.Nil(t, err)
+	nowNano := connPair.Conn1.localTime + secondNano
+	connA.listener.Flush(nowNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, nowNano)
+	assert.Nil(t, err)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("first"), b)
+	top := connB.replay.top
+
+	// authentic packets, crafted at the edge of the window and just beyond it
+	craft := func(sn uint64, msg string) []byte {
+		connA.snCrypto = sn
+		_, err := streamA.Write([]byte(msg))
+		assert.Nil(t, err)
+		nowNano += secondNano
+		connA.listener.Flush(nowNano)
+		assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+		data := bytes.Clone(connPair.Conn1.writeQueue[0].data)
+		connPair.Conn1.writeQueue = nil
+		return data
+	}
+	beyond := craft(top+maxReplayWindow+1, "beyond")
+	edge := craft(top+maxReplayWindow, "edge")
+
+	_, _, _, err = listenerB.decode(beyond, netip.AddrPort{}, nowNano)
+	assert.ErrorIs(t, err, errSnOutOfWindow)
+	assert.ErrorIs(t, err, ErrBadSequenceNumber)
+	assert.Equal(t, top, connB.replay.top)
+
+	// the drop is counted, the connection stays
+	connPair.Conn1.writeQueue = append(connPair.Conn1.writeQueue, packetData{data: beyond}, packetData{data: edge})
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsRecipient() > 0 {
+		_, err = listenerB.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, uint64(1), connB.droppedPackets)
+	assert.Equal(t, top+maxReplayWindow, connB.replay.top)
+	assert.Equal(t, connEstablished, connB.state)
+}
+
+func TestSequenceWindowOption(t *testing.T) {
+	_, err := Listen(WithSequenceWindow(100))
+	assert.Error(t, err)
+	_, err = Listen(WithSequenceWindow(1<<16), WithSequenceWindow(1<<16))
+	assert.Error(t, err)
+
+	connPair := NewConnPair("alice", "bob")
+	l, err := Listen(WithNetworkConn(connPair.Conn1), WithSequenceWindow(1<<16))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1<<16), l.snWindow())
+	assert.Equal(t, uint64(defaultSnWindow), (&Listener{}).snWindow())
+}
@@ -0,0 +1,146 @@
+package qotp
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// RetransmitScheduler decides which packets in flight are sent again, once the handshake is done, see
+// WithRetransmitScheduler. Flush calls it for the packets of a stream that are not acked yet, oldest first,
+// while it returns isNext, and sends the first packet with isResend again. Each resend counts as a loss, the
+// bandwidth estimate is reduced like after an RTO. An error closes the connection.
+//
+// A scheduler has to resend every packet that is not acked eventually, otherwise the stream stalls until the
+// idle timeout. Fast retransmit after duplicate acks and the probes of LossRecovery still run before it, the
+// init packets keep their own timeout, see WithHandshakeTimeout.
+type RetransmitScheduler interface {
+	Retransmit(p InFlightPacket) (isResend bool, isNext bool, err error)
+}
+
+// InFlightPacket is a packet of a stream that was sent, but is not acked yet
+type InFlightPacket struct {
+	StreamID     uint32
+	Offset       uint64
+	Len          int
+	SentTimeNano uint64 // the last time it was sent
+	SentNr       int    // how often it was sent, 1 after the first send
+	RtoNano      uint64 // RTO of the connection, without backoff
+	SrttNano     uint64 // smoothed RTT, 0 without RTT sample
+	NowNano      uint64
+}
+
+// RtoRetransmitScheduler is the default RetransmitScheduler: only the oldest packet is checked, it is sent again
+// once the RTO with backoff expired, and after maxRetry sends the connection is closed
+type RtoRetransmitScheduler struct{}
+
+func (RtoRetransmitScheduler) Retransmit(p InFlightPacket) (isResend bool, isNext bool, err error) {
+	rtoNano, err := backoff(p.RtoNano, p.SentNr)
+	if err != nil {
+		return false, false, err
+	}
+	return p.NowNano-p.SentTimeNano > rtoNano, false, nil
+}
+
+// WithRetransmitScheduler replaces RtoRetransmitScheduler, e.g., to experiment with more aggressive resends
+func WithRetransmitScheduler(scheduler RetransmitScheduler) ListenFunc {
+	return func(o *ListenOption) error {
+		if o.retransmitScheduler != nil {
+			return errors.New("retransmit scheduler already set")
+		}
+		if scheduler == nil {
+			return errors.New("retransmit scheduler not set")
+		}
+		o.retransmitScheduler = scheduler
+		return nil
+	}
+}
+
+func (l *Listener) retransmitter() RetransmitScheduler {
+	if l.retransmitScheduler == nil {
+		return RtoRetransmitScheduler{}
+	}
+	return l.retransmitScheduler
+}
+
+// scheduledBatch is how many packets in flight ScheduledRetransmit copies at a time, the scheduler is called on
+// the copies without the lock of the send buffer
+const scheduledBatch = 8
+
+// ScheduledRetransmit is ReadyToRetransmit for Data packets, the scheduler picks the packet. A ping it picks is
+// removed instead, pings are not sent again. The scheduler is not called with the lock of the send buffer held,
+// a packet acked meanwhile is not sent again.
+func (sb *SendBuffer) ScheduledRetransmit(streamID uint32, scheduler RetransmitScheduler, ack *Ack, mtu int,
+	rtoNano uint64, srttNano uint64, nowNano uint64) (data []byte, offset uint64, isClose bool, err error) {
+	var after *packetKey
+	for {
+		keys, packets := sb.inFlightPackets(streamID, after, rtoNano, srttNano, nowNano)
+		for i, p := range packets {
+			isResend, isNext, err := scheduler.Retransmit(p)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			if isResend {
+				return sb.retransmitScheduled(streamID, keys[i], ack, mtu, nowNano)
+			}
+			if !isNext {
+				return nil, 0, false, nil
+			}
+		}
+		if len(keys) < scheduledBatch {
+			return nil, 0, false, nil
+		}
+		after = &keys[len(keys)-1]
+	}
+}
+
+// inFlightPackets copies up to scheduledBatch packets in flight of a stream, oldest first, after the key after.
+// Nothing is returned if after was acked meanwhile.
+func (sb *SendBuffer) inFlightPackets(streamID uint32, after *packetKey, rtoNano uint64, srttNano uint64,
+	nowNano uint64) (keys []packetKey, packets []InFlightPacket) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil || (after != nil && !stream.dataInFlightMap.Contains(*after)) {
+		return nil, nil
+	}
+	for key, info := range stream.dataInFlightMap.Iterator(after) {
+		keys = append(keys, key)
+		packets = append(packets, InFlightPacket{
+			StreamID:     streamID,
+			Offset:       key.offset(),
+			Len:          len(info.data),
+			SentTimeNano: info.sentTimeNano,
+			SentNr:       info.sentNr,
+			RtoNano:      rtoNano,
+			SrttNano:     srttNano,
+			NowNano:      nowNano,
+		})
+		if len(keys) == scheduledBatch {
+			break
+		}
+	}
+	return keys, packets
+}
+
+// retransmitScheduled resends the packet the scheduler picked, if it is still in flight
+func (sb *SendBuffer) retransmitScheduled(streamID uint32, key packetKey, ack *Ack, mtu int, nowNano uint64) (
+	data []byte, offset uint64, isClose bool, err error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil {
+		return nil, 0, false, nil
+	}
+	info := stream.dataInFlightMap.Get(key)
+	if info == nil {
+		return nil, 0, false, nil
+	}
+	if info.pingRequest {
+		stream.dataInFlightMap.Remove(key)
+		return nil, 0, false, nil
+	}
+	slog.Debug("ScheduledRetransmit", slog.Uint64("offset", key.offset()), info.debug())
+	return stream.retransmit(key, info, ack, mtu, Data, nowNano)
+}
@@ -0,0 +1,152 @@
+package qotp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eagerRetransmitScheduler resends every packet that is not acked after a fixed time, without backoff
+type eagerRetransmitScheduler struct {
+	afterNano uint64
+}
+
+func (s eagerRetransmitScheduler) Retransmit(p InFlightPacket) (isResend bool, isNext bool, err error) {
+	return p.NowNano-p.SentTimeNano > s.afterNano, true, nil
+}
+
+// recoverRetransmitTest drops the first Data packet of A, it returns how long B waits for the data
+func recoverRetransmitTest(t *testing.T, scheduler RetransmitScheduler) uint64 {
+	connA, listenerB, connPair := setupStreamTest(t)
+	connPair.Conn1.bandwidth, connPair.Conn2.bandwidth = 0, 0
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	if scheduler != nil {
+		connA.listener.retransmitScheduler = scheduler
+	}
+
+	// acks that arrive after 100ms, the tail loss probe of the default then waits about two RTTs
+	nowNano := max(connPair.Conn1.localTime, connPair.Conn2.localTime)
+	for range 3 {
+		_, err := streamA.Write([]byte("warm"))
+		assert.Nil(t, err)
+		nowNano = max(nowNano, connA.nextWriteTime) + msNano
+		connA.listener.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		_, err = streamB.Read()
+		assert.Nil(t, err)
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		nowNano += 100 * msNano
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+
+	// the warm-up packets are too small for a bandwidth estimate, pace by the RTT
+	connA.bwMax = 0
+
+	_, err := streamA.Write([]byte("lost"))
+	assert.Nil(t, err)
+	startNano := max(nowNano, connA.nextWriteTime) + msNano
+	connA.listener.Flush(startNano)
+	assert.Len(t, connPair.Conn1.writeQueue, 1)
+	connPair.Conn1.writeQueue = nil
+
+	for nowNano := startNano + msNano; nowNano < startNano+secondNano; nowNano += msNano {
+		connA.listener.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		if data, _ := streamB.Read(); data != nil {
+			assert.Equal(t, []byte("lost"), data)
+			return nowNano - startNano
+		}
+	}
+	assert.Fail(t, "not recovered")
+	return 0
+}
+
+func TestRetransmitScheduler(t *testing.T) {
+	defaultNano := recoverRetransmitTest(t, nil)
+	eagerNano := recoverRetransmitTest(t, eagerRetransmitScheduler{afterNano: 20 * msNano})
+	// the default waits for the tail loss probe after two RTTs, the eager scheduler resends after 20ms
+	assert.GreaterOrEqual(t, defaultNano, uint64(200*msNano))
+	assert.Less(t, eagerNano, uint64(30*msNano))
+}
+
+func TestRetransmitSchedulerRto(t *testing.T) {
+	p := InFlightPacket{SentTimeNano: 0, SentNr: 1, RtoNano: 100 * msNano, NowNano: 100 * msNano}
+	isResend, isNext, err := RtoRetransmitScheduler{}.Retransmit(p)
+	assert.Nil(t, err)
+	assert.False(t, isResend)
+	assert.False(t, isNext)
+
+	p.NowNano++
+	isResend, _, err = RtoRetransmitScheduler{}.Retransmit(p)
+	assert.Nil(t, err)
+	assert.True(t, isResend)
+
+	p.SentNr = maxRetry + 1
+	_, _, err = RtoRetransmitScheduler{}.Retransmit(p)
+	assert.Error(t, err)
+
+	// a scheduler error closes the connection
+	sb := NewSendBuffer(1000)
+	sb.QueueData(1, []byte("test"))
+	sb.ReadyToSend(1, Data, nil, 1000, 0)
+	errScheduler := errors.New("scheduler")
+	_, _, _, err = sb.ScheduledRetransmit(1, schedulerFunc(func(InFlightPacket) (bool, bool, error) {
+		return false, false, errScheduler
+	}), nil, 1000, 100, 0, 200)
+	assert.ErrorIs(t, err, errScheduler)
+
+	_, err = Listen(WithRetransmitScheduler(nil))
+	assert.Error(t, err)
+	_, err = Listen(WithRetransmitScheduler(RtoRetransmitScheduler{}), WithRetransmitScheduler(RtoRetransmitScheduler{}))
+	assert.Error(t, err)
+}
+
+func TestRetransmitSchedulerUnlocked(t *testing.T) {
+	sb := NewSendBuffer(10000)
+	for i := range 2*scheduledBatch + 1 {
+		sb.QueueData(1, []byte{byte(i)})
+		sb.ReadyToSend(1, Data, nil, 1000, uint64(i))
+	}
+
+	// the scheduler can use the send buffer, and walks past the first batch to the last packet
+	var nrCalls int
+	data, offset, _, err := sb.ScheduledRetransmit(1, schedulerFunc(func(p InFlightPacket) (bool, bool, error) {
+		nrCalls++
+		assert.Positive(t, sb.InFlight(1))
+		return p.Offset == 2*scheduledBatch, true, nil
+	}), nil, 1000, 100, 0, 200)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*scheduledBatch+1, nrCalls)
+	assert.Equal(t, uint64(2*scheduledBatch), offset)
+	assert.Equal(t, []byte{2 * scheduledBatch}, data)
+
+	// a packet acked while the scheduler runs is not sent again
+	data, _, _, err = sb.ScheduledRetransmit(1, schedulerFunc(func(p InFlightPacket) (bool, bool, error) {
+		sb.AcknowledgeRange(&Ack{streamID: 1, offset: p.Offset, len: uint16(p.Len)})
+		return true, true, nil
+	}), nil, 1000, 100, 0, 200)
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+}
+
+type schedulerFunc func(p InFlightPacket) (bool, bool, error)
+
+func (f schedulerFunc) Retransmit(p InFlightPacket) (bool, bool, error) {
+	return f(p)
+}
@@ -0,0 +1,40 @@
+package qotp
+
+import "fmt"
+
+// SendState tells what limited the last flush of a stream of a connection, for debugging the congestion
+// control. qotp paces with the bandwidth estimate of BBR and has no congestion window of its own, the only
+// windows are the receive windows of the peer.
+type SendState uint8
+
+const (
+	SendStateIdle          SendState = iota // not flushed yet
+	SendStateSending                        // a packet with data was sent, nothing limited it
+	SendStatePacingLimited                  // waiting for the next packet of the pacing rate
+	SendStateWindowLimited                  // the receive window of the peer, of the connection or the stream, is full
+	SendStateAppLimited                     // no data to send, or data held back to be coalesced
+)
+
+func (s SendState) String() string {
+	switch s {
+	case SendStateIdle:
+		return "idle"
+	case SendStateSending:
+		return "sending"
+	case SendStatePacingLimited:
+		return "pacing-limited"
+	case SendStateWindowLimited:
+		return "window-limited"
+	case SendStateAppLimited:
+		return "app-limited"
+	}
+	return fmt.Sprintf("SendState(%d)", uint8(s))
+}
+
+// SendState returns what limited the last flush of the data of this connection. Handshake, control and close
+// packets do not change it.
+func (c *Conn) SendState() SendState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sendState
+}
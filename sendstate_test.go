@@ -0,0 +1,44 @@
+package qotp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendState(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+	// the data of the handshake does not count
+	assert.Equal(t, SendStateIdle, connA.SendState())
+	connA.srtt, connA.rttvar, connA.bwMax = 10*msNano, 1*msNano, 0
+	nowNano := connPair.Conn1.localTime + secondNano
+
+	// no data written
+	connA.listener.Flush(nowNano)
+	assert.Equal(t, SendStateAppLimited, connA.SendState())
+
+	_, err := streamA.Write([]byte("data"))
+	assert.Nil(t, err)
+	assert.Nil(t, streamA.Flush())
+	connA.listener.Flush(nowNano)
+	assert.Equal(t, SendStateSending, connA.SendState())
+
+	// the next packet waits for the pacing rate
+	_, err = streamA.Write([]byte("more"))
+	assert.Nil(t, err)
+	assert.Nil(t, streamA.Flush())
+	connA.listener.Flush(nowNano)
+	assert.Equal(t, SendStatePacingLimited, connA.SendState())
+
+	// the receive window of the peer is smaller than a packet
+	connA.rcvWndSize = 100
+	nowNano = connA.nextWriteTime
+	connA.listener.Flush(nowNano)
+	assert.Equal(t, SendStateWindowLimited, connA.SendState())
+
+	connA.rcvWndSize = 1 << 20
+	connA.listener.Flush(nowNano)
+	assert.Equal(t, SendStateSending, connA.SendState())
+	assert.Equal(t, "sending", connA.SendState().String())
+}
@@ -0,0 +1,116 @@
+package qotp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// maxCloseReasonSize is the longest reason of CloseWithError, the close frame has to fit into any packet
+const maxCloseReasonSize = 256
+
+// gracefulStopPoll is how often GracefulStop checks if all connections are gone
+const gracefulStopPoll = 10 * time.Millisecond
+
+var (
+	ErrCloseReasonTooLong = errors.New("close reason too long")
+	errListenerStopping   = errors.New("listener is stopping")
+)
+
+// CloseError is the reason of the peer that closed the connection with CloseWithError, it matches
+// ErrConnectionClosed with errors.Is
+type CloseError struct {
+	Code   uint64
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("connection closed by the peer with code %d: %s", e.Code, e.Reason)
+}
+
+func (e *CloseError) Unwrap() error {
+	return ErrConnectionClosed
+}
+
+// Graceful shutdown. A connection close frame can carry an application error code and a reason, see
+// CloseWithError, they are sent instead of the data of the frame. GracefulStop drains the listener: no new
+// connection is accepted, and each connection is closed once all data of its streams was sent and acked.
+
+// CloseWithError closes the connection like CloseConnection, the peer gets the code and the reason as a
+// CloseError from its streams
+func (c *Conn) CloseWithError(code uint64, reason string) error {
+	if len(reason) > maxCloseReasonSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrCloseReasonTooLong, len(reason), maxCloseReasonSize)
+	}
+	c.mu.Lock()
+	if !c.isCloseConnRequested && c.closeErr == nil {
+		c.closeCode, c.closeReason = code, reason
+	}
+	c.mu.Unlock()
+	return c.CloseConnection()
+}
+
+// GracefulStop stops accepting new connections, closes each connection once its streams sent all data and got
+// it acked, and waits until all connections are gone, then the listener is closed. Loop has to run meanwhile.
+// If ctx is done first, the listener is closed right away and the error of ctx is returned.
+func (l *Listener) GracefulStop(ctx context.Context) error {
+	slog.Debug("Listener/GracefulStop", gId(), l.debug(), slog.Int("conns", l.connMap.Size()))
+	l.isStopping.Store(true)
+	if err := l.localConn.TimeoutReadNow(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(gracefulStopPoll)
+	defer ticker.Stop()
+	for l.connMap.Size() > 0 {
+		select {
+		case <-ctx.Done():
+			if err := l.Close(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return l.Close()
+}
+
+// drainConns closes the connections without data to send or in flight, while the listener is stopping
+func (l *Listener) drainConns() {
+	if !l.isStopping.Load() {
+		return
+	}
+	for _, conn := range l.connMap.Iterator(nil) {
+		if conn.isCloseConnRequested || conn.closeErr != nil || !conn.snd.IsDrained() {
+			continue
+		}
+		if err := conn.CloseConnection(); err != nil {
+			slog.Info("close on graceful stop", conn.debug(), slog.Any("error", err))
+		}
+	}
+}
+
+// closeErrOf is the error of a connection the peer closed, a CloseError if it sent a code or a reason
+func closeErrOf(p *PayloadHeader) error {
+	if p.CloseCode == 0 && p.CloseReason == "" {
+		return ErrConnectionClosed
+	}
+	return &CloseError{Code: p.CloseCode, Reason: p.CloseReason}
+}
+
+// putCloseReason encodes the code and the reason of a connection close
+func putCloseReason(code uint64, reason string) []byte {
+	b := make([]byte, 8+len(reason))
+	PutUint64(b, code)
+	copy(b[8:], reason)
+	return b
+}
+
+func decodeCloseReason(b []byte) (code uint64, reason string, err error) {
+	if len(b) < 8 {
+		return 0, "", fmt.Errorf("%w: close code of %d bytes", ErrShortPayload, len(b))
+	}
+	return Uint64(b), string(b[8:]), nil
+}
@@ -0,0 +1,117 @@
+package qotp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownCloseReasonEncoding(t *testing.T) {
+	p := &PayloadHeader{IsCloseConn: true, CloseCode: 42, CloseReason: "bye", StreamID: 1}
+	encoded, _ := EncodePayload(p, []byte{})
+	decoded, userData, err := DecodePayload(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), decoded.CloseCode)
+	assert.Equal(t, "bye", decoded.CloseReason)
+	assert.Equal(t, []byte{}, userData)
+
+	// a close without a code has no data, as before
+	plain, _ := EncodePayload(&PayloadHeader{IsCloseConn: true, StreamID: 1}, []byte{})
+	assert.Less(t, len(plain), len(encoded))
+	decoded, _, err = DecodePayload(plain)
+	assert.Nil(t, err)
+	assert.Zero(t, decoded.CloseCode)
+	assert.Equal(t, ErrConnectionClosed, closeErrOf(decoded))
+
+	// a code needs 8 bytes
+	_, _, err = DecodePayload(append(plain, 1, 2, 3))
+	assert.ErrorIs(t, err, ErrShortPayload)
+}
+
+func TestShutdownCloseWithError(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	assert.ErrorIs(t, connA.CloseWithError(1, strings.Repeat("x", maxCloseReasonSize+1)), ErrCloseReasonTooLong)
+	assert.Nil(t, connA.CloseWithError(42, "going away"))
+
+	nowNano := connPair.Conn1.localTime + secondNano
+	connA.listener.Flush(nowNano)
+	_, err := connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsRecipient() > 0 {
+		_, err = listenerB.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+
+	_, err = streamB.Read()
+	var closeErr *CloseError
+	assert.True(t, errors.As(err, &closeErr))
+	assert.Equal(t, &CloseError{Code: 42, Reason: "going away"}, closeErr)
+	assert.ErrorIs(t, err, ErrConnectionClosed)
+}
+
+func TestShutdownDrain(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	listenerB.isStopping.Store(true)
+	deliverToB := func(nowNano uint64) {
+		_, err := connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+
+	// no new connection is accepted
+	assert.ErrorIs(t, listenerB.acceptConn(nil, connB.remoteAddr), ErrConnectionRejected)
+
+	// the Data of A completes the handshake of B
+	_, err := streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	nowNano := max(connPair.Conn1.localTime+secondNano, connA.nextWriteTime)
+	connA.listener.Flush(nowNano)
+	deliverToB(nowNano)
+
+	// the data of B is in flight, the connection stays open
+	_, err = streamB.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	nowNano = max(nowNano+secondNano, connB.nextWriteTime)
+	listenerB.Flush(nowNano)
+	assert.False(t, connB.isCloseConnRequested)
+
+	// once A acked it, B closes the connection
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for connPair.nrIncomingPacketsSender() > 0 {
+		_, err = connA.listener.Listen(MinDeadLine, nowNano)
+		assert.Nil(t, err)
+	}
+	nowNano = max(nowNano+secondNano, connA.nextWriteTime)
+	connA.listener.Flush(nowNano)
+	deliverToB(nowNano)
+	assert.True(t, connB.snd.IsDrained())
+	listenerB.Flush(nowNano)
+	assert.True(t, connB.isCloseConnRequested)
+}
+
+func TestShutdownGracefulStop(t *testing.T) {
+	listener, err := Listen(WithListenAddr("127.0.0.1:0"))
+	assert.Nil(t, err)
+	assert.Nil(t, listener.GracefulStop(context.Background()))
+	assert.True(t, listener.closed)
+
+	// a connection that is not drained in time, its init was never sent
+	connA, _, _ := setupStreamTest(t)
+	_, err = connA.Stream(0).Write([]byte("hallo"))
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, connA.listener.GracefulStop(ctx), context.Canceled)
+	assert.True(t, connA.listener.closed)
+}
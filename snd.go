@@ -5,6 +5,9 @@ import (
 	"sync"
 )
 
+// defaultCoalesceDelay is how long a small write is held back at most, see WithCoalesceDelay
+const defaultCoalesceDelay = uint64(10 * msNano)
+
 type InsertStatus int
 
 const (
@@ -40,17 +43,32 @@ func (s *SendInfo) debug() slog.Attr {
 // StreamBuffer represents a single stream's userData and metadata
 type StreamBuffer struct {
 	dataInFlightMap *LinkedMap[packetKey, *SendInfo]
+	dataInFlight    int // len of the data in dataInFlightMap
 	queuedData      []byte
 	bytesSentOffset uint64
 	pingRequest     bool
 	closeAtOffset   *uint64
+	isCloseWrite    bool // half close, the close packet needs the extension byte
+
+	// Nagle, a packet smaller than the MTU is held back while data is in flight, see ReadyToSend
+	coalesceStartNano uint64 // when the queued data was held back first, 0 means not held back
+	isCoalescing      bool
+	flushAtOffset     uint64 // queued data below this offset is sent right away, see FlushQueued
 }
 
 type SendBuffer struct {
 	streams  map[uint32]*StreamBuffer // Changed to LinkedHashMap
 	capacity int                      //len(dataToSend) of all streams cannot become larger than capacity
 	size     int                      //len(dataToSend) of all streams
-	mu       *sync.Mutex
+	// queued and unacked data of a single stream cannot become larger than streamCapacity, 0 means no limit
+	streamCapacity int
+	freedCh        chan struct{} // closed once acked or removed data frees capacity, see freed
+	// small packets are held back for up to coalesceDelayNano while data is in flight, 0 disables it
+	coalesceDelayNano uint64
+	// the first write after nothing was sent for coalesceDelayNano is not held back, see WithImmediateFirstWrite
+	isImmediateFirstWrite bool
+	lastSendNano          uint64
+	mu                    *sync.Mutex
 }
 
 func NewStreamBuffer() *StreamBuffer {
@@ -85,9 +103,44 @@ func newSendInfo(data []byte, nowNano uint64, isPing bool) *SendInfo {
 	}
 }
 
+// available is the capacity left for queued data
+func (sb *SendBuffer) available() int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.capacity - sb.size
+}
+
+// freed returns a channel that is closed once capacity is freed, by an ack or a removed stream
+func (sb *SendBuffer) freed() <-chan struct{} {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.freedCh == nil {
+		sb.freedCh = make(chan struct{})
+	}
+	return sb.freedCh
+}
+
+// onFreed wakes the writers waiting for capacity, the lock is held
+func (sb *SendBuffer) onFreed() {
+	if sb.freedCh != nil {
+		close(sb.freedCh)
+		sb.freedCh = nil
+	}
+}
+
 // QueueData stores the userData in the dataMap, does not send yet
 func (sb *SendBuffer) QueueData(streamId uint32, userData []byte) (n int, status InsertStatus) {
-	if len(userData) <= 0 {
+	return sb.QueueDataVec(streamId, [][]byte{userData})
+}
+
+// QueueDataVec is QueueData for the concatenation of vecs, each is appended to the queued data of the stream,
+// there is no copy of the concatenation
+func (sb *SendBuffer) QueueDataVec(streamId uint32, vecs [][]byte) (n int, status InsertStatus) {
+	total := 0
+	for _, vec := range vecs {
+		total += len(vec)
+	}
+	if total <= 0 {
 		return 0, InsertStatusNoData
 	}
 
@@ -96,24 +149,29 @@ func (sb *SendBuffer) QueueData(streamId uint32, userData []byte) (n int, status
 
 	// Calculate how much userData we can insert
 	remainingCapacitySnd := sb.capacity - sb.size
-	if remainingCapacitySnd == 0 {
-		return 0, InsertStatusSndFull
+	if sb.streamCapacity > 0 {
+		streamSize := 0
+		if stream := sb.streams[streamId]; stream != nil {
+			streamSize = len(stream.queuedData) + stream.dataInFlight
+		}
+		remainingCapacitySnd = min(remainingCapacitySnd, sb.streamCapacity-streamSize)
 	}
-
-	// We fill up the chunk up to the capacity of snd
-	// chunk is then what we will queue, and we report
-	// how much bytes we queued
-	chunk := userData
-	if len(userData) > remainingCapacitySnd {
-		chunk = userData[:remainingCapacitySnd]
-		status = InsertStatusSndFull
-	} else {
-		status = InsertStatusOk
+	if remainingCapacitySnd <= 0 {
+		return 0, InsertStatusSndFull
 	}
-	n = len(chunk)
 
+	// We fill up the chunks up to the capacity of snd
+	// and we report how much bytes we queued
+	status = InsertStatusOk
 	stream := sb.getOrCreateStream(streamId)
-	stream.queuedData = append(stream.queuedData, chunk...)
+	for _, chunk := range vecs {
+		if len(chunk) > remainingCapacitySnd-n {
+			chunk = chunk[:remainingCapacitySnd-n]
+			status = InsertStatusSndFull
+		}
+		stream.queuedData = append(stream.queuedData, chunk...)
+		n += len(chunk)
+	}
 	sb.size += n
 
 	return n, status
@@ -146,7 +204,7 @@ func (sb *SendBuffer) ReadyToSend(streamID uint32, msgType CryptoMsgType, ack *A
 		stream.pingRequest = false
 		key := createPacketKey(stream.bytesSentOffset, 0)
 		stream.dataInFlightMap.Put(key, newSendInfo([]byte{}, nowNano, true))
-		return []byte{}, 0, false
+		return []byte{}, key.offset(), false
 	}
 
 	// Check if all queued data has been sent
@@ -163,20 +221,29 @@ func (sb *SendBuffer) ReadyToSend(streamID uint32, msgType CryptoMsgType, ack *A
 	if msgType != InitSnd {
 		overhead := calcCryptoOverheadWithData(msgType, ack, stream.bytesSentOffset)
 		maxData = mtu - overhead
+		if stream.isCloseWrite {
+			maxData-- // a half close needs the extension byte
+		}
 	}
 
 	// Determine how much to send
 	length := min(uint64(maxData), uint64(len(stream.queuedData)))
 
+	if sb.isCoalesced(stream, msgType, length < uint64(maxData), nowNano) {
+		return nil, 0, false
+	}
+
 	// Extract data from queue
 	packetData = stream.queuedData[:length]
 
 	// Create key and SendInfo with actual data
 	key := createPacketKey(stream.bytesSentOffset, uint16(length))
 	stream.dataInFlightMap.Put(key, newSendInfo(packetData, nowNano, false))
+	stream.dataInFlight += len(packetData)
 
 	// Remove sent data from queue
 	stream.queuedData = stream.queuedData[length:]
+	sb.lastSendNano = nowNano
 
 	// Update sent offset
 	stream.bytesSentOffset += length
@@ -188,6 +255,55 @@ func (sb *SendBuffer) ReadyToSend(streamID uint32, msgType CryptoMsgType, ack *A
 	return packetData, key.offset(), false
 }
 
+// isCoalesced checks if a packet with less than the MTU of data is held back, so that more writes can be
+// sent with it. Like Nagle, it is only held back while data of this stream is in flight, the ack releases it.
+// It is also released after coalesceDelayNano, by FlushQueued, or by a close.
+func (sb *SendBuffer) isCoalesced(stream *StreamBuffer, msgType CryptoMsgType, isPartial bool, nowNano uint64) bool {
+	if sb.coalesceDelayNano == 0 || msgType != Data || !isPartial || stream.dataInFlight == 0 ||
+		stream.closeAtOffset != nil || stream.bytesSentOffset < stream.flushAtOffset || sb.isIdle(nowNano) {
+		stream.isCoalescing = false
+		return false
+	}
+	if !stream.isCoalescing {
+		stream.isCoalescing = true
+		stream.coalesceStartNano = nowNano
+	}
+	if nowNano-stream.coalesceStartNano >= sb.coalesceDelayNano {
+		stream.isCoalescing = false
+		return false
+	}
+	return true
+}
+
+// isIdle is true with WithImmediateFirstWrite if no data was sent for longer than the coalesce delay
+func (sb *SendBuffer) isIdle(nowNano uint64) bool {
+	return sb.isImmediateFirstWrite && nowNano-sb.lastSendNano > sb.coalesceDelayNano
+}
+
+// CoalesceWait returns how long the queued data of a stream is still held back, 0 if it is not
+func (sb *SendBuffer) CoalesceWait(streamID uint32, nowNano uint64) uint64 {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil || !stream.isCoalescing || len(stream.queuedData) == 0 {
+		return 0
+	}
+	if deadline := stream.coalesceStartNano + sb.coalesceDelayNano; deadline > nowNano {
+		return deadline - nowNano
+	}
+	return 0
+}
+
+// FlushQueued sends the data queued so far without holding it back, see isCoalesced
+func (sb *SendBuffer) FlushQueued(streamID uint32) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.getOrCreateStream(streamID)
+	stream.flushAtOffset = stream.bytesSentOffset + uint64(len(stream.queuedData))
+}
+
 // ReadyToRetransmit finds expired dataInFlightMap that need to be resent
 func (sb *SendBuffer) ReadyToRetransmit(streamID uint32, ack *Ack, mtu int, expectedRtoNano uint64, msgType CryptoMsgType, nowNano uint64) (
 	data []byte, offset uint64, isClose bool, err error) {
@@ -209,7 +325,13 @@ func (sb *SendBuffer) ReadyToRetransmit(streamID uint32, ack *Ack, mtu int, expe
 		return nil, 0, false, nil
 	}
 
-	expectedRtoBackoffNano, err := backoff(expectedRtoNano, rtoData.sentNr)
+	rtoNr := rtoData.sentNr
+	if msgType != Data {
+		// Handshake packets are retransmitted until the handshake timeout of the connection, the backoff
+		// stays at its maximum after maxRetry
+		rtoNr = min(rtoNr, maxRetry)
+	}
+	expectedRtoBackoffNano, err := backoff(expectedRtoNano, rtoNr)
 	if err != nil {
 		return nil, 0, false, err
 	}
@@ -226,6 +348,30 @@ func (sb *SendBuffer) ReadyToRetransmit(streamID uint32, ack *Ack, mtu int, expe
 		return nil, 0, false, nil
 	}
 
+	return stream.retransmit(packetKey, rtoData, ack, mtu, msgType, nowNano)
+}
+
+// RetransmitNow resends a packet in flight without waiting for its RTO, e.g., as a probe. Pings are not resent.
+func (sb *SendBuffer) RetransmitNow(streamID uint32, key packetKey, ack *Ack, mtu int, msgType CryptoMsgType, nowNano uint64) (
+	data []byte, offset uint64, isClose bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil {
+		return nil, 0, false
+	}
+	sendInfo := stream.dataInFlightMap.Get(key)
+	if sendInfo == nil || sendInfo.pingRequest {
+		return nil, 0, false
+	}
+	data, offset, isClose, _ = stream.retransmit(key, sendInfo, ack, mtu, msgType, nowNano)
+	return data, offset, isClose
+}
+
+// retransmit resends a packet, it is split if the ack needs more space than when it was sent first
+func (stream *StreamBuffer) retransmit(packetKey packetKey, rtoData *SendInfo, ack *Ack, mtu int, msgType CryptoMsgType, nowNano uint64) (
+	data []byte, offset uint64, isClose bool, err error) {
 	// Get data directly from SendInfo
 	data = rtoData.data
 	length := uint16(len(data))
@@ -235,6 +381,9 @@ func (sb *SendBuffer) ReadyToRetransmit(streamID uint32, ack *Ack, mtu int, expe
 	if msgType != InitSnd {
 		overhead := calcCryptoOverheadWithData(msgType, ack, packetKey.offset())
 		maxData = mtu - overhead
+		if stream.isCloseWrite {
+			maxData-- // a half close needs the extension byte
+		}
 	}
 
 	if length <= uint16(maxData) {
@@ -301,6 +450,8 @@ func (sb *SendBuffer) AcknowledgeRange(ack *Ack) (status AckStatus, sentTimeNano
 
 	// Update global size tracking
 	sb.size -= len(sendInfo.data)
+	stream.dataInFlight -= len(sendInfo.data)
+	sb.onFreed()
 	return AckStatusOk, sendInfo.sentTimeNano
 }
 
@@ -324,6 +475,78 @@ func (sb *SendBuffer) GetOffsetAcked(streamID uint32) (offset uint64) {
 	return stream.bytesSentOffset // Changed from bytesSentUserOffset
 }
 
+// InFlight returns the data of a stream that was sent but not acked yet
+func (sb *SendBuffer) InFlight(streamID uint32) (size int) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil {
+		return 0
+	}
+	return stream.dataInFlight
+}
+
+// IsQueueEmpty checks if no stream has data or a ping waiting to be sent for the first time
+func (sb *SendBuffer) IsQueueEmpty() bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	for _, stream := range sb.streams {
+		if len(stream.queuedData) > 0 || stream.pingRequest {
+			return false
+		}
+	}
+	return true
+}
+
+// IsDrained checks if no stream has data waiting to be sent or in flight
+func (sb *SendBuffer) IsDrained() bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	for _, stream := range sb.streams {
+		if len(stream.queuedData) > 0 || stream.pingRequest || stream.dataInFlightMap.Size() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// IsQueued checks if a stream has data waiting to be sent for the first time
+func (sb *SendBuffer) IsQueued(streamID uint32) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	return stream != nil && len(stream.queuedData) > 0
+}
+
+// OldestInFlight returns the packet of a stream that was sent but not acked yet with the lowest offset
+func (sb *SendBuffer) OldestInFlight(streamID uint32) (key packetKey, ok bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil {
+		return 0, false
+	}
+	key, _, ok = stream.dataInFlightMap.First()
+	return key, ok
+}
+
+// IsInFlight checks if a sent packet is still waiting for its ack
+func (sb *SendBuffer) IsInFlight(streamID uint32, key packetKey) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil {
+		return false
+	}
+	return stream.dataInFlightMap.Contains(key)
+}
+
 func (sb *SendBuffer) GetOffsetClosedAt(streamID uint32) (offset *uint64) {
 	sb.mu.Lock()
 	defer sb.mu.Unlock()
@@ -348,6 +571,35 @@ func (sb *SendBuffer) Close(streamID uint32) {
 	}
 }
 
+// CloseWrite closes the stream like Close, but the close packet is sent as a half close
+func (sb *SendBuffer) CloseWrite(streamID uint32) {
+	sb.Close(streamID)
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.streams[streamID].isCloseWrite = true
+}
+
+// RemoveStream drops all queued and in-flight data of a stream and returns the number of in-flight bytes
+// and the offset up to which data was sent
+func (sb *SendBuffer) RemoveStream(streamID uint32) (inFlight int, sentOffset uint64) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil {
+		return 0, 0
+	}
+
+	for _, sendInfo := range stream.dataInFlightMap.Iterator(nil) {
+		inFlight += len(sendInfo.data)
+	}
+	sb.size -= inFlight + len(stream.queuedData)
+	delete(sb.streams, streamID)
+	sb.onFreed()
+	return inFlight, stream.bytesSentOffset
+}
+
 type packetKey uint64
 
 func (p packetKey) offset() uint64 {
@@ -27,6 +27,26 @@ func TestSndInsert(t *testing.T) {
 	assert.Equal(t, 3, nr)
 }
 
+func TestSndInsertVec(t *testing.T) {
+	sb := NewSendBuffer(1000)
+	n, status := sb.QueueDataVec(1, [][]byte{[]byte("head"), nil, []byte("body")})
+	assert.Equal(t, InsertStatusOk, status)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, []byte("headbody"), sb.streams[1].queuedData)
+	assert.Equal(t, 8, sb.size)
+
+	n, status = sb.QueueDataVec(1, [][]byte{nil, {}})
+	assert.Equal(t, InsertStatusNoData, status)
+	assert.Zero(t, n)
+
+	// the capacity cuts within a slice
+	sb2 := NewSendBuffer(6)
+	n, status = sb2.QueueDataVec(1, [][]byte{[]byte("head"), []byte("body")})
+	assert.Equal(t, InsertStatusSndFull, status)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, []byte("headbo"), sb2.streams[1].queuedData)
+}
+
 func TestSndAcknowledgeRangeBasic(t *testing.T) {
 	sb := NewSendBuffer(1000)
 	
@@ -595,4 +615,88 @@ func TestSndPingTimeout(t *testing.T) {
 	assert.Equal(t, uint64(0), offset)
 	assert.False(t, isClose)
 	assert.Equal(t, 0, stream.dataInFlightMap.Size())
-}
\ No newline at end of file
+}
+func TestSndCoalesce(t *testing.T) {
+	sb := NewSendBuffer(10000)
+	sb.coalesceDelayNano = 10 * msNano
+
+	// nothing in flight, the first small write is sent right away
+	sb.QueueData(1, []byte("a"))
+	data, _, _ := sb.ReadyToSend(1, Data, nil, 1000, 0)
+	assert.Equal(t, []byte("a"), data)
+
+	// data in flight, small writes are held back and sent together
+	sb.QueueData(1, []byte("b"))
+	data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, msNano)
+	assert.Nil(t, data)
+	sb.QueueData(1, []byte("c"))
+	assert.Equal(t, uint64(9*msNano), sb.CoalesceWait(1, 2*msNano))
+	data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 2*msNano)
+	assert.Nil(t, data)
+
+	// the delay expired
+	data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 11*msNano)
+	assert.Equal(t, []byte("bc"), data)
+	assert.Zero(t, sb.CoalesceWait(1, 11*msNano))
+
+	// a full packet is not held back
+	sb.QueueData(1, make([]byte, 1500))
+	data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 12*msNano)
+	assert.NotNil(t, data)
+	data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 12*msNano)
+	assert.Nil(t, data)
+
+	// Flush sends what is queued so far
+	sb.FlushQueued(1)
+	data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 13*msNano)
+	assert.NotNil(t, data)
+	sb.QueueData(1, []byte("d"))
+	data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 13*msNano)
+	assert.Nil(t, data)
+
+	// the ack releases it
+	for key, _, ok := sb.streams[1].dataInFlightMap.First(); ok; key, _, ok = sb.streams[1].dataInFlightMap.First() {
+		sb.AcknowledgeRange(&Ack{streamID: 1, offset: key.offset(), len: key.length()})
+	}
+	data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 14*msNano)
+	assert.Equal(t, []byte("d"), data)
+
+	// a close is not held back
+	sb.QueueData(1, []byte("e"))
+	sb.Close(1)
+	data, _, isClose := sb.ReadyToSend(1, Data, nil, 1000, 15*msNano)
+	assert.Equal(t, []byte("e"), data)
+	assert.True(t, isClose)
+}
+
+func TestSndImmediateFirstWrite(t *testing.T) {
+	for _, isImmediate := range []bool{false, true} {
+		sb := NewSendBuffer(10000)
+		sb.coalesceDelayNano = 10 * msNano
+		sb.isImmediateFirstWrite = isImmediate
+
+		// a request, its data is still in flight when the next one is written
+		sb.QueueData(1, []byte("a"))
+		data, _, _ := sb.ReadyToSend(1, Data, nil, 1000, 0)
+		assert.Equal(t, []byte("a"), data)
+
+		// the first write after idle is sent right away only with the option
+		sb.QueueData(1, []byte("b"))
+		data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 50*msNano)
+		if !isImmediate {
+			assert.Nil(t, data)
+			continue
+		}
+		assert.Equal(t, []byte("b"), data)
+
+		// the writes right after it are coalesced again
+		sb.QueueData(1, []byte("c"))
+		data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 51*msNano)
+		assert.Nil(t, data)
+		sb.QueueData(1, []byte("d"))
+		data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 52*msNano)
+		assert.Nil(t, data)
+		data, _, _ = sb.ReadyToSend(1, Data, nil, 1000, 61*msNano)
+		assert.Equal(t, []byte("cd"), data)
+	}
+}
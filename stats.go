@@ -0,0 +1,90 @@
+package qotp
+
+import (
+	"math"
+	"time"
+)
+
+// ConnectionStats is a snapshot of the statistics of a connection, see Conn.Stats. The counters start at the
+// last ResetStats, the other fields are the current values.
+type ConnectionStats struct {
+	PacketsSent     uint64
+	PacketsReceived uint64
+	PacketsLost     uint64 // packets retransmitted after the RTO, probes are not counted
+	BytesSent       uint64 // encrypted bytes on the wire
+	BytesReceived   uint64
+	Retransmissions uint64 // packets sent again after the RTO or as probe
+
+	SmoothedRTT       time.Duration // 0 without RTT sample
+	BandwidthEstimate uint64        // bytes per second, 0 without estimate
+	CWND              uint64        // bandwidth-delay product in bytes, qotp paces and has no window of its own
+	InFlight          uint64        // bytes sent, but not acked yet
+	KeyGeneration     uint64        // rekeys of the shared secret, see Conn.Rekey, not summed by AggregateStats
+}
+
+// Stats returns a snapshot of the statistics of the connection, it does not allocate
+func (c *Conn) Stats() ConnectionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := ConnectionStats{
+		PacketsSent:       c.packetsSent - c.statsBase.PacketsSent,
+		PacketsReceived:   c.packetsReceived - c.statsBase.PacketsReceived,
+		PacketsLost:       c.packetsLost - c.statsBase.PacketsLost,
+		BytesSent:         c.bytesSent - c.statsBase.BytesSent,
+		BytesReceived:     c.bytesReceived - c.statsBase.BytesReceived,
+		Retransmissions:   c.retransmits - c.statsBase.Retransmissions,
+		SmoothedRTT:       time.Duration(c.srtt),
+		BandwidthEstimate: c.bwMax,
+		InFlight:          uint64(max(c.dataInFlight, 0)),
+		KeyGeneration:     c.keyGen.Load(),
+	}
+	if c.rttMinNano != math.MaxUint64 {
+		stats.CWND = c.bwMax * c.rttMinNano / secondNano
+	}
+	return stats
+}
+
+// ResetStats starts the counters of Stats from 0, e.g., to sample them per period. The connection summary,
+// see WithConnectionSummaryLog, still has the totals.
+func (c *Conn) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.statsBase = ConnectionStats{
+		PacketsSent:     c.packetsSent,
+		PacketsReceived: c.packetsReceived,
+		PacketsLost:     c.packetsLost,
+		BytesSent:       c.bytesSent,
+		BytesReceived:   c.bytesReceived,
+		Retransmissions: c.retransmits,
+	}
+}
+
+// AggregateStats sums the statistics of all open connections. SmoothedRTT is the average of the connections
+// with an RTT sample.
+func (l *Listener) AggregateStats() ConnectionStats {
+	var total ConnectionStats
+	var rttSum time.Duration
+	rttCount := 0
+	for _, conn := range l.connMap.Iterator(nil) {
+		stats := conn.Stats()
+		total.PacketsSent += stats.PacketsSent
+		total.PacketsReceived += stats.PacketsReceived
+		total.PacketsLost += stats.PacketsLost
+		total.BytesSent += stats.BytesSent
+		total.BytesReceived += stats.BytesReceived
+		total.Retransmissions += stats.Retransmissions
+		total.BandwidthEstimate += stats.BandwidthEstimate
+		total.CWND += stats.CWND
+		total.InFlight += stats.InFlight
+		if stats.SmoothedRTT > 0 {
+			rttSum += stats.SmoothedRTT
+			rttCount++
+		}
+	}
+	if rttCount > 0 {
+		total.SmoothedRTT = rttSum / time.Duration(rttCount)
+	}
+	return total
+}
@@ -1,22 +1,93 @@
 package qotp
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Stream struct {
 	streamID     uint32
 	conn         *Conn
-	closedAtNano uint64 // 0 means not closed
+	closedAtNano atomic.Uint64 // 0 means not closed, written by Read and by the goroutine of Listen
+	streamErr    error         // set if the stream was terminated by the peer
 	mu           sync.Mutex
+
+	// Control frame (reset or stop sending), retransmitted until acked
+	ctrlFrame    *PayloadHeader
+	ctrlSentNano uint64
+	ctrlAcked    bool
+
+	// Half close, the stream is closed once both directions are done
+	isHalfClose  bool
+	isCloseWrite bool
+	isCloseRead  bool
+	writeDone    atomic.Bool
+	readDone     atomic.Bool
+	writeErr     error // set if the peer does not read anymore
+
+	// Receive window of the peer for this stream, only sent by the peer if it limits us more than its
+	// connection window
+	rcvWndSize      uint64
+	isRcvWndLimited bool
+	rcvWndProbeNano uint64 // last ping sent to probe a full window
+	// since when the full window blocks queued data, 0 if it does not, see WithFlowControlStallTimeout
+	rcvWndBlockedNano uint64
+	isRcvWndStalled   bool
+
+	// Weighted scheduling, see Conn.scheduleStreams
+	weight uint8
+	vTime  uint64
+
+	// Deadlines of Read and Write, see SetDeadline
+	readDeadline  deadline
+	writeDeadline deadline
+
+	span trace.Span // nil without a tracer, see trace.go
+}
+
+// DefaultPriority is the weight of a new stream, SetPriority can raise or lower it
+const DefaultPriority uint8 = 16
+
+var (
+	ErrStreamReset       = errors.New("stream reset")
+	ErrStreamStopSending = errors.New("stream not read by peer anymore")
+	// ErrPeerFlowControlStalled is returned by Write if the receive window of the peer blocked the queued data
+	// for longer than WithFlowControlStallTimeout, while the peer acked the window probes. The peer is alive
+	// but does not read, the application can reset the stream. Write works again once the peer reads.
+	ErrPeerFlowControlStalled = errors.New("peer does not read, flow control stalled")
+)
+
+// StreamResetError is returned by Read and Write if the peer reset the stream, it matches ErrStreamReset
+type StreamResetError struct {
+	Code uint32
+}
+
+func (e *StreamResetError) Error() string {
+	return fmt.Sprintf("stream reset by peer, code %d", e.Code)
+}
+
+func (e *StreamResetError) Is(target error) bool {
+	return target == ErrStreamReset
 }
 
 func (s *Stream) StreamID() uint32 {
 	return s.streamID
 }
 
+// Conn returns the connection of the stream, e.g., for its UserData in the callback of Loop
+func (s *Stream) Conn() *Conn {
+	return s.conn
+}
+
 func (s *Stream) NotifyDataAvailable() error {
 	return s.conn.listener.localConn.TimeoutReadNow()
 }
@@ -25,12 +96,119 @@ func (s *Stream) Ping() {
 	s.conn.snd.QueuePing(s.streamID)
 }
 
+// SetPriority sets the weight of the stream in the send scheduler. If several streams have data queued, each
+// gets a share of the sent bytes proportional to its weight, e.g., a stream with weight 32 sends twice as much
+// as one with the DefaultPriority. A weight of 0 is treated as 1.
+func (s *Stream) SetPriority(weight uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.weight = max(weight, 1)
+}
+
+func (s *Stream) priority() uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.weight
+}
+
 func (s *Stream) Close() {
 	s.conn.snd.Close(s.streamID)
+	s.traceStreamEvent("close")
+}
+
+// Reset aborts the stream immediately. Queued and unacked data is discarded and not retransmitted, the peer
+// gets a reset frame with the error code, its Read and Write return a *StreamResetError. Local Read and Write
+// return ErrStreamReset.
+func (s *Stream) Reset(errorCode uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isResetRequested() || s.streamErr != nil {
+		return nil
+	}
+	slog.Debug("Reset", gId(), s.debug(), slog.Uint64("code", uint64(errorCode)))
+
+	sentOffset := s.conn.removeSndStream(s.streamID)
+	s.conn.rcv.RemoveStream(s.streamID)
+
+	s.streamErr = ErrStreamReset
+	s.setCtrlFrame(&PayloadHeader{
+		IsReset:      true,
+		ResetCode:    errorCode,
+		StreamID:     s.streamID,
+		StreamOffset: sentOffset,
+	})
+	return s.conn.listener.localConn.TimeoutReadNow()
+}
+
+// CloseWrite closes the write direction only, the peer reads until io.EOF and can still write to us. Acks
+// are sent as before. The stream is closed once the read direction is done as well.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.streamErr != nil {
+		return s.streamErr
+	}
+	if s.isCloseWrite {
+		return nil
+	}
+	slog.Debug("CloseWrite", gId(), s.debug())
+
+	s.isCloseWrite = true
+	s.isHalfClose = true
+	if s.writeErr != nil {
+		// the peer does not read anymore, there is nothing to close
+		return nil
+	}
+	s.conn.snd.CloseWrite(s.streamID)
+	return s.conn.listener.localConn.TimeoutReadNow()
+}
+
+// CloseRead closes the read direction only. Buffered and incoming data is dropped, and the peer is asked to
+// stop sending, its Write returns ErrStreamStopSending. We can still write to the peer.
+func (s *Stream) CloseRead() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.streamErr != nil {
+		return s.streamErr
+	}
+	if s.isCloseRead {
+		return nil
+	}
+	slog.Debug("CloseRead", gId(), s.debug())
+
+	s.isCloseRead = true
+	s.isHalfClose = true
+	readOffset := s.conn.rcv.RemoveStream(s.streamID)
+	s.setCtrlFrame(&PayloadHeader{
+		CloseRead:    true,
+		StreamID:     s.streamID,
+		StreamOffset: readOffset,
+	})
+	return s.conn.listener.localConn.TimeoutReadNow()
+}
+
+func (s *Stream) setCtrlFrame(p *PayloadHeader) {
+	s.ctrlFrame = p
+	s.ctrlSentNano = 0
+	s.ctrlAcked = false
+}
+
+func (s *Stream) isResetRequested() bool {
+	return s.ctrlFrame != nil && s.ctrlFrame.IsReset
+}
+
+// closeIfDone closes a half closed stream once both directions are done
+func (s *Stream) closeIfDone(nowNano uint64) {
+	if s.writeDone.Load() && s.readDone.Load() {
+		s.closedAtNano.CompareAndSwap(0, nowNano)
+	}
 }
 
 func (s *Stream) IsClosed() bool {
-	return s.closedAtNano != 0
+	return s.closedAtNano.Load() != 0
 }
 
 func (s *Stream) IsCloseRequested() bool {
@@ -45,43 +223,121 @@ func (s *Stream) Read() (userData []byte, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.readDeadline.isExceeded(s.conn.listener.now()) {
+		return nil, os.ErrDeadlineExceeded
+	}
+	if err := s.conn.listener.ctxErr(); err != nil {
+		return nil, err
+	}
+
+	if s.streamErr != nil {
+		return nil, s.streamErr
+	}
+	if s.isSendOnly() {
+		return nil, ErrStreamUnidirectional
+	}
+
+	if s.isCloseRead || s.readDone.Load() {
+		return nil, io.EOF
+	}
+
 	closeOffset := s.conn.rcv.GetOffsetClosedAt(s.streamID)
-	if s.closedAtNano != 0 {
+	if s.closedAtNano.Load() != 0 {
 		slog.Debug("Read/closed", gId(), s.debug())
 		return nil, io.ErrUnexpectedEOF
 	}
 
 	offset, data, receiveTimeNano := s.conn.rcv.RemoveOldestInOrder(s.streamID)
 
+	// deliver what we have received before the connection was closed
+	if data == nil && s.conn.closeErr != nil {
+		slog.Debug("Read/connclosed", gId(), s.debug())
+		return nil, s.conn.closeErr
+	}
+
 	// check if our receive buffer is marked as closed
 	if closeOffset != nil {
-		// it is marked to close
-		if offset >= *closeOffset {
+		// it is marked to close, a close without data arrives after all data was read
+		if (data != nil && offset >= *closeOffset) ||
+			(data == nil && s.conn.rcv.GetOffsetRead(s.streamID) >= *closeOffset) {
 			// we got all data, mark as closed //TODO check wrap around
-			s.closedAtNano = receiveTimeNano
+			if data == nil {
+				receiveTimeNano = s.conn.lastReadTimeNano
+			}
+			if s.isHalfClose {
+				s.readDone.Store(true)
+				s.closeIfDone(receiveTimeNano)
+			} else {
+				s.closedAtNano.Store(receiveTimeNano)
+			}
 			slog.Debug("Read/close", gId(), s.debug(), slog.String("b…", string(data[:min(16, len(data))])))
+			if len(data) > 0 {
+				s.traceStreamOp("qotp.stream.read", len(data))
+			}
 			return data, io.EOF
 		}
 	}
 
 	slog.Debug("Read", gId(), s.debug(), slog.String("b…", string(data[:min(16, len(data))])))
+	if len(data) > 0 {
+		s.traceStreamOp("qotp.stream.read", len(data))
+	}
 	return data, nil
 }
 
 func (s *Stream) Write(userData []byte) (n int, err error) {
+	return s.WriteVec([][]byte{userData})
+}
+
+// WriteVec writes the concatenation of vecs like Write, e.g., a header and a body, without concatenating them
+// first. The slices are copied into the send buffer of the stream and can be reused once WriteVec returned.
+func (s *Stream) WriteVec(vecs [][]byte) (n int, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.closedAtNano != 0 || s.conn.snd.GetOffsetClosedAt(s.streamID) != nil {
+	if s.writeDeadline.isExceeded(s.conn.listener.now()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err := s.conn.listener.ctxErr(); err != nil {
+		return 0, err
+	}
+
+	if s.conn.closeErr != nil {
+		return 0, s.conn.closeErr
+	}
+	if s.conn.isCloseConnRequested {
+		return 0, ErrConnectionClosed
+	}
+	if s.streamErr != nil {
+		return 0, s.streamErr
+	}
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+	if s.isReceiveOnly() {
+		return 0, ErrStreamUnidirectional
+	}
+	if s.isRcvWndStalled {
+		return 0, ErrPeerFlowControlStalled
+	}
+
+	if s.closedAtNano.Load() != 0 || s.conn.snd.GetOffsetClosedAt(s.streamID) != nil {
 		return 0, io.ErrUnexpectedEOF
 	}
 
+	var userData []byte // the first slice with data, for the log
+	for _, vec := range vecs {
+		if len(vec) > 0 {
+			userData = vec
+			break
+		}
+	}
 	if len(userData) == 0 {
 		return 0, nil
 	}
 
 	slog.Debug("Write", gId(), s.debug(), slog.String("b…", string(userData[:min(16, len(userData))])))
-	n, status := s.conn.snd.QueueData(s.streamID, userData)
+	n, status := s.conn.snd.QueueDataVec(s.streamID, vecs)
 	if status != InsertStatusOk {
 		slog.Debug("Status Nok", gId(), s.debug(), slog.Any("status", status))
 	} else {
@@ -91,10 +347,105 @@ func (s *Stream) Write(userData []byte) (n int, err error) {
 			return 0, err
 		}
 	}
+	if n > 0 {
+		s.traceStreamOp("qotp.stream.write", n)
+	}
 
 	return n, nil
 }
 
+// WriteContext writes all of userData, it blocks while the send buffer is full until acks of the peer free
+// space, see WithSendBuffer. Once ctx is done or the stream cannot be written anymore, it returns the bytes
+// written so far and the error. The acks are only received while Listen is called, e.g., by Loop in another
+// goroutine, it must not be called from the goroutine that calls Listen.
+func (s *Stream) WriteContext(ctx context.Context, userData []byte) (n int, err error) {
+	for {
+		freed := s.conn.snd.freed() // before the write, so that an ack in between is not missed
+		m, err := s.Write(userData[n:])
+		n += m
+		if err != nil || n == len(userData) {
+			return n, err
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case <-s.conn.Context().Done():
+			if _, err := s.Write(nil); err != nil {
+				return n, err
+			}
+			return n, ErrConnectionClosed
+		}
+	}
+}
+
+// Flush sends the data written so far right away, without waiting for more writes to fill the packet, see
+// WithCoalesceDelay
+func (s *Stream) Flush() error {
+	s.conn.snd.FlushQueued(s.streamID)
+	return s.conn.listener.localConn.TimeoutReadNow()
+}
+
+// SetDeadline sets the read and write deadline, see SetReadDeadline and SetWriteDeadline
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline.set(t, s.conn.listener, s.wakeOnDeadline)
+	s.writeDeadline.set(t, s.conn.listener, s.wakeOnDeadline)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of Read, like net.Conn. Once it passed, Read returns os.ErrDeadlineExceeded,
+// also if data is available, until the deadline is moved. The listener is woken up when it passes, so that a
+// Loop waiting for packets calls its callback. A zero time clears the deadline.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline.set(t, s.conn.listener, s.wakeOnDeadline)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write, see SetReadDeadline
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline.set(t, s.conn.listener, s.wakeOnDeadline)
+	return nil
+}
+
+func (s *Stream) wakeOnDeadline() {
+	if err := s.NotifyDataAvailable(); err != nil {
+		slog.Debug("Deadline/wake", gId(), s.debug(), slog.Any("error", err))
+	}
+}
+
+// deadline is a read or write deadline of a stream, its timer wakes up the listener once it passes
+type deadline struct {
+	t         time.Time
+	stopTimer func() bool
+}
+
+// set replaces the deadline, the timer of the old one is stopped. A deadline in the past wakes up right away.
+// The timer runs on the clock of the listener.
+func (d *deadline) set(t time.Time, l *Listener, wake func()) {
+	d.stop()
+	d.t = t
+	if !t.IsZero() {
+		d.stopTimer = l.afterFunc(t.Sub(l.now()), wake)
+	}
+}
+
+func (d *deadline) stop() {
+	if d.stopTimer != nil {
+		d.stopTimer()
+		d.stopTimer = nil
+	}
+}
+
+func (d *deadline) isExceeded(now time.Time) bool {
+	return !d.t.IsZero() && !now.Before(d.t)
+}
+
 func (s *Stream) debug() slog.Attr {
 	if s.conn == nil {
 		return slog.String("net", "s.conn is nil")
@@ -1,9 +1,14 @@
 package qotp
 
 import (
+	"context"
 	"io"
+	"net"
 	"net/netip"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -29,6 +34,35 @@ func setupStreamTest(t *testing.T) (connA *Conn, listenerB *Listener, connPair *
 	return connA, listenerB, connPair
 }
 
+// handshakeStreamTest sends "hallo" on stream 0 and delivers the reply, so that the handshake is done on both sides
+func handshakeStreamTest(t *testing.T, connA *Conn, listenerB *Listener, connPair *ConnPair) (streamA *Stream, streamB *Stream) {
+	streamA = connA.Stream(0)
+	_, err := streamA.Write([]byte("hallo"))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	for i := 0; i < 100 && streamB == nil; i++ {
+		streamB, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	}
+	assert.Nil(t, err)
+	assert.NotNil(t, streamB)
+	b, err := streamB.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hallo"), b)
+
+	listenerB.Flush(connPair.Conn2.localTime)
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && !connA.isHandshakeDoneOnRcv; i++ {
+		_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.Nil(t, err)
+	}
+	assert.True(t, connA.isHandshakeDoneOnRcv)
+	return streamA, streamB
+}
+
 func TestStreamBasicSendReceive(t *testing.T) {
 	connA, listenerB, connPair := setupStreamTest(t)
 
@@ -210,10 +244,312 @@ func TestStreamMaxRetransmissions(t *testing.T) {
 	minPacing = connA.listener.Flush(((200 + 400 + 800 + 1600 + 3200) * msNano) + 5)
 	assert.Equal(t, uint64(0), minPacing) // Fifth retransmission
 
-	// This should fail after maximum retries
-	minPacing = connA.listener.Flush((6210 * msNano) + 5)
-	// After max retries, connection should be removed
-	assert.Equal(t, 0, connA.listener.connMap.Size(), "connection should be removed after max retries")
+	err = connPair.dropSender(0)
+	assert.Nil(t, err)
+
+	// The handshake is not limited by the number of retries, the backoff stays at its maximum
+	minPacing = connA.listener.Flush(((200 + 400 + 800 + 1600 + 3200 + 3200) * msNano) + 6)
+	assert.Equal(t, uint64(0), minPacing) // Sixth retransmission
+	assert.Equal(t, 1, connA.listener.connMap.Size())
+
+	// After the handshake timeout, connection should be removed
+	minPacing = connA.listener.Flush(defaultHandshakeMaxTimeout + 1)
+	assert.Equal(t, 0, connA.listener.connMap.Size(), "connection should be removed after handshake timeout")
+	_, err = streamA1.Write([]byte("too late"))
+	assert.ErrorIs(t, err, ErrHandshakeTimeout)
+}
+
+func TestStreamReset(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// Queue more data than fits into one packet, then abort
+	_, err := streamA.Write(make([]byte, 5000))
+	assert.Nil(t, err)
+	connA.listener.Flush(connPair.Conn1.localTime + secondNano)
+	err = connPair.dropSender()
+	assert.Nil(t, err)
+
+	err = streamA.Reset(42)
+	assert.Nil(t, err)
+	assert.Zero(t, connA.snd.size)
+	assert.Zero(t, connA.dataInFlight)
+	_, err = streamA.Write([]byte("more"))
+	assert.ErrorIs(t, err, ErrStreamReset)
+	_, err = streamA.Read()
+	assert.ErrorIs(t, err, ErrStreamReset)
+
+	// Only the reset frame is sent, no retransmission of the dropped data
+	connA.listener.Flush(connA.nextWriteTime)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	var s *Stream
+	for i := 0; i < 100 && s == nil; i++ {
+		s, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, streamB, s)
+	_, err = streamB.Read()
+	assert.ErrorIs(t, err, ErrStreamReset)
+	var resetErr *StreamResetError
+	assert.ErrorAs(t, err, &resetErr)
+	assert.Equal(t, uint32(42), resetErr.Code)
+	_, err = streamB.Write([]byte("reply"))
+	assert.ErrorAs(t, err, &resetErr)
+
+	// B acks the reset frame, both sides release the stream
+	listenerB.Flush(connPair.Conn2.localTime + secondNano)
+	assert.Equal(t, 0, streamB.conn.streams.Size())
+	_, err = connPair.recipientToSenderAll()
+	assert.Nil(t, err)
+	for i := 0; i < 100 && !streamA.IsClosed(); i++ {
+		_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+		assert.Nil(t, err)
+	}
+	assert.True(t, streamA.IsClosed())
+	connA.listener.Flush(connA.nextWriteTime)
+	assert.Equal(t, 0, connA.streams.Size())
+}
+
+func TestStreamResetRetransmit(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+
+	streamA, _ := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	err := streamA.Reset(7)
+	assert.Nil(t, err)
+
+	// Reset frame is lost, it is sent again after the RTO
+	now := connPair.Conn1.localTime + secondNano
+	connA.listener.Flush(now)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	err = connPair.dropSender()
+	assert.Nil(t, err)
+
+	connA.listener.Flush(now + 10*msNano)
+	assert.Equal(t, 0, connPair.nrOutgoingPacketsSender())
+
+	connA.listener.Flush(max(now+connA.rtoNano(), connA.nextWriteTime))
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+	assert.False(t, streamA.IsClosed())
+}
+
+func TestStreamResetInFlight(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	handshakeStreamTest(t, connA, listenerB, connPair)
+	_, err := connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+
+	// small RTT and no bandwidth estimate, so that several packets go out before the PTO
+	connA.srtt = 10 * msNano
+	connA.rttvar = 1 * msNano
+	connA.bwMax = 0
+
+	// A large stream and a small one in flight, none of the packets arrive
+	streamLarge := connA.Stream(1)
+	_, err = streamLarge.Write(make([]byte, 20000))
+	assert.Nil(t, err)
+	streamSmall := connA.Stream(2)
+	_, err = streamSmall.Write([]byte("small"))
+	assert.Nil(t, err)
+	nowNano := connPair.Conn1.localTime + secondNano
+	for i := 0; i < 6; i++ {
+		nowNano = max(nowNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+	}
+	assert.Equal(t, 6, connPair.nrOutgoingPacketsSender())
+	err = connPair.dropSender()
+	assert.Nil(t, err)
+
+	inFlightLarge := connA.snd.InFlight(streamLarge.streamID)
+	assert.Greater(t, inFlightLarge, 4*1000)
+	assert.Equal(t, 5, connA.snd.InFlight(streamSmall.streamID))
+	inFlight := connA.dataInFlight
+	lossSize := connA.loss.size()
+
+	// The reset stream no longer counts as in flight and has no loss timers left
+	err = streamLarge.Reset(1)
+	assert.Nil(t, err)
+	assert.Equal(t, max(0, inFlight-inFlightLarge), connA.dataInFlight)
+	assert.Less(t, connA.loss.size(), lossSize)
+	for k := range connA.loss.inFlight.Iterator(nil) {
+		assert.NotEqual(t, streamLarge.streamID, k.streamID)
+	}
+
+	// Past the RTO, only the reset frame and the small stream are sent, nothing of the reset stream
+	nowNano += 2 * connA.rtoNano()
+	for i := 0; i < 6; i++ {
+		nowNano = max(nowNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+	}
+	assert.Greater(t, connPair.nrOutgoingPacketsSender(), 0)
+	for _, p := range connPair.Conn1.writeQueue {
+		assert.Less(t, len(p.data), 100)
+	}
+}
+
+// exchangeStreamTest flushes and delivers packets in both directions for a few rounds, returns the streams
+// that B received
+func exchangeStreamTest(t *testing.T, connA *Conn, listenerB *Listener, connPair *ConnPair) (streamsB []*Stream) {
+	for i := 0; i < 4; i++ {
+		connA.listener.Flush(max(connPair.Conn1.localTime, connA.nextWriteTime))
+		_, err := connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for j := 0; j < 10; j++ {
+			s, err := listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.Nil(t, err)
+			if s != nil {
+				streamsB = append(streamsB, s)
+			}
+		}
+
+		for _, connB := range listenerB.connMap.Iterator(nil) {
+			listenerB.Flush(max(connPair.Conn2.localTime, connB.nextWriteTime))
+		}
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for j := 0; j < 10; j++ {
+			_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+			assert.Nil(t, err)
+		}
+	}
+	return streamsB
+}
+
+func TestStreamCloseWrite(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// A is done writing, but waits for the response
+	_, err := streamA.Write([]byte("request"))
+	assert.Nil(t, err)
+	err = streamA.CloseWrite()
+	assert.Nil(t, err)
+	_, err = streamA.Write([]byte("more"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	exchangeStreamTest(t, connA, listenerB, connPair)
+
+	b, err := streamB.Read()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, []byte("request"), b)
+	assert.False(t, streamA.IsClosed())
+	assert.False(t, streamB.IsClosed())
+
+	// B can still write, A still reads
+	_, err = streamB.Write([]byte("response"))
+	assert.Nil(t, err)
+	exchangeStreamTest(t, connA, listenerB, connPair)
+	b, err = streamA.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("response"), b)
+
+	// B closes its write direction as well, without data, both streams are done
+	err = streamB.CloseWrite()
+	assert.Nil(t, err)
+	exchangeStreamTest(t, connA, listenerB, connPair)
+	_, err = streamA.Read()
+	assert.ErrorIs(t, err, io.EOF)
+	exchangeStreamTest(t, connA, listenerB, connPair)
+
+	assert.True(t, streamA.IsClosed())
+	assert.True(t, streamB.IsClosed())
+}
+
+func TestStreamCloseRead(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// B does not want to read anymore, A is asked to stop sending
+	err := streamB.CloseRead()
+	assert.Nil(t, err)
+	_, err = streamA.Write([]byte("dropped"))
+	assert.Nil(t, err)
+	exchangeStreamTest(t, connA, listenerB, connPair)
+
+	_, err = streamB.Read()
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = streamA.Write([]byte("too late"))
+	assert.ErrorIs(t, err, ErrStreamStopSending)
+	assert.Zero(t, connA.snd.size)
+	assert.Zero(t, streamB.conn.rcv.Size())
+
+	// B can still write, A still reads
+	_, err = streamB.Write([]byte("response"))
+	assert.Nil(t, err)
+	exchangeStreamTest(t, connA, listenerB, connPair)
+	b, err := streamA.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("response"), b)
+	assert.False(t, streamA.IsClosed())
+
+	// B is done writing, A reads EOF and A stops reading, both streams are done
+	err = streamB.CloseWrite()
+	assert.Nil(t, err)
+	exchangeStreamTest(t, connA, listenerB, connPair)
+	_, err = streamA.Read()
+	assert.ErrorIs(t, err, io.EOF)
+	exchangeStreamTest(t, connA, listenerB, connPair)
+
+	assert.True(t, streamA.IsClosed())
+	assert.True(t, streamB.IsClosed())
+}
+
+func TestStreamRcvWindowBlocksOnlyOneStream(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+
+	_, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+	connB.rcv.streamCapacity = 8 * 1024
+
+	// B never reads from the slow stream, but reads everything from the fast stream
+	slowA := connA.Stream(1)
+	fastA := connA.Stream(2)
+	data := make([]byte, 32*1024)
+	_, err := slowA.Write(data)
+	assert.Nil(t, err)
+	_, err = fastA.Write(data)
+	assert.Nil(t, err)
+
+	received := 0
+	for i := 0; i < 100 && received < len(data); i++ {
+		exchangeStreamTest(t, connA, listenerB, connPair)
+		for fastB := connB.streams.Get(2); fastB != nil; {
+			b, err := fastB.Read()
+			assert.Nil(t, err)
+			if len(b) == 0 {
+				break
+			}
+			received += len(b)
+		}
+	}
+	assert.Equal(t, len(data), received)
+
+	// The slow stream is blocked by its window, not by the connection window
+	assert.LessOrEqual(t, connB.rcv.streams[1].size, connB.rcv.streamCapacity)
+	assert.True(t, slowA.isRcvWndLimited)
+	assert.Less(t, connA.snd.GetOffsetAcked(1), uint64(len(data)))
+
+	// Once B reads the slow stream, the probes open its window again
+	slowB := connB.streams.Get(1)
+	assert.NotNil(t, slowB)
+	received = 0
+	for i := 0; i < 100 && received < len(data); i++ {
+		for {
+			b, err := slowB.Read()
+			assert.Nil(t, err)
+			if len(b) == 0 {
+				break
+			}
+			received += len(b)
+		}
+		exchangeStreamTest(t, connA, listenerB, connPair)
+	}
+	assert.Equal(t, len(data), received)
 }
 
 func TestStreamCloseInitiatedBySender(t *testing.T) {
@@ -412,4 +748,336 @@ func TestStreamDuplicatePacketHandling(t *testing.T) {
 
 	// Second read of duplicate should not deliver duplicate data
 	// (depends on implementation - protocol should handle duplicates)
-}
\ No newline at end of file
+}
+func TestStreamInfoSnapshot(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// B read "hallo", the next data is buffered until it is read
+	_, err := streamA.Write([]byte("more"))
+	assert.NoError(t, err)
+	for i := 0; i < 100 && !connA.snd.IsQueueEmpty(); i++ {
+		connA.listener.Flush(connPair.Conn1.localTime)
+		connPair.Conn1.localTime += 10 * msNano
+	}
+	_, err = connPair.senderToRecipientAll()
+	assert.NoError(t, err)
+	for i := 0; i < 10 && len(connPair.Conn2.readQueue) > 0; i++ {
+		_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+		assert.NoError(t, err)
+	}
+	infoB := streamB.conn.Streams()[0]
+	assert.Equal(t, uint64(5), infoB.ReadOffset)
+	assert.Equal(t, 4, infoB.BytesBuffered)
+	_, err = streamB.Read()
+	assert.NoError(t, err)
+	infoB = streamB.conn.Streams()[0]
+	assert.Equal(t, uint64(9), infoB.ReadOffset)
+	assert.Zero(t, infoB.BytesBuffered)
+
+	_, err = connA.Stream(1).Write([]byte("queued"))
+	assert.NoError(t, err)
+	connA.Stream(1).SetPriority(32)
+	connA.Stream(2).Close()
+	assert.NoError(t, connA.Stream(3).CloseWrite())
+	assert.NoError(t, connA.Stream(4).Reset(7))
+
+	infos := connA.Streams()
+	assert.Len(t, infos, 5)
+	for i, info := range infos {
+		assert.Equal(t, uint32(i), info.StreamID)
+	}
+	assert.Equal(t, StreamInfo{StreamID: 0, State: StreamOpen, Priority: DefaultPriority, WriteOffset: 9,
+		SentOffset: 9, BytesInFlight: 4}, infos[0])
+	assert.Equal(t, StreamInfo{StreamID: 1, State: StreamOpen, Priority: 32, WriteOffset: 6, BytesQueued: 6},
+		infos[1])
+	assert.Equal(t, StreamCloseRequested, infos[2].State)
+	assert.Equal(t, StreamHalfClosed, infos[3].State)
+	assert.Equal(t, StreamReset, infos[4].State)
+	assert.Equal(t, "reset", infos[4].State.String())
+
+	// the snapshot is a copy
+	infos[1].BytesQueued = 0
+	assert.Equal(t, 6, connA.Streams()[1].BytesQueued)
+}
+
+// wakeCountConn counts how often the listener is woken up
+type wakeCountConn struct {
+	*PairedConn
+	wakes atomic.Int32
+}
+
+func (w *wakeCountConn) TimeoutReadNow() error {
+	w.wakes.Add(1)
+	return nil
+}
+
+func TestStreamReadWriteDeadline(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// nothing to read, without deadline this is not an error
+	b, err := streamB.Read()
+	assert.NoError(t, err)
+	assert.Nil(t, b)
+
+	assert.NoError(t, streamB.SetReadDeadline(time.Now().Add(-time.Second)))
+	_, err = streamB.Read()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var netErr net.Error
+	assert.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	// the write direction is not affected
+	_, err = streamB.Write([]byte("reply"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, streamA.SetWriteDeadline(time.Now().Add(-time.Second)))
+	n, err := streamA.Write([]byte("late"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Zero(t, n)
+
+	// a zero time clears the deadline, a deadline in the future is not exceeded yet
+	assert.NoError(t, streamB.SetReadDeadline(time.Time{}))
+	_, err = streamB.Read()
+	assert.NoError(t, err)
+	assert.NoError(t, streamA.SetDeadline(time.Now().Add(time.Hour)))
+	_, err = streamA.Write([]byte("in time"))
+	assert.NoError(t, err)
+	_, err = streamA.Read()
+	assert.NoError(t, err)
+}
+
+func TestStreamDeadlineWakesListener(t *testing.T) {
+	connPair := NewConnPair("alice", "bob")
+	conn := &wakeCountConn{PairedConn: connPair.Conn1}
+	listener, err := Listen(WithNetworkConn(conn), WithPrvKeyId(testPrvKey1))
+	assert.NoError(t, err)
+	c, err := listener.Dial(netip.AddrPort{})
+	assert.NoError(t, err)
+	stream := c.Stream(0)
+
+	assert.NoError(t, stream.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	assert.Eventually(t, func() bool {
+		return conn.wakes.Load() == 1
+	}, time.Second, time.Millisecond)
+	_, err = stream.Read()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// a deadline that is cleared or moved before it passes does not wake up
+	assert.NoError(t, stream.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	assert.NoError(t, stream.SetWriteDeadline(time.Time{}))
+	assert.NoError(t, stream.SetReadDeadline(time.Now().Add(time.Hour)))
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, int32(1), conn.wakes.Load())
+	_, err = stream.Read()
+	assert.NoError(t, err)
+}
+
+func TestStreamShortWrites(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// the stream ID and the offset fill a payload to MinProtoSize, a write of 1 byte needs no padding
+	nowNano := connPair.Conn1.localTime
+	for size := 1; size <= MinProtoSize; size++ {
+		msg := []byte("12345678")[:size]
+		_, err := streamA.Write(msg)
+		assert.Nil(t, err)
+		assert.Nil(t, streamA.Flush())
+
+		var received []byte
+		for i := 0; i < 10 && len(received) < size; i++ {
+			connA.srtt, connA.rttvar, connA.bwMax = 10*msNano, 1*msNano, 0
+			nowNano = max(nowNano+msNano, connA.nextWriteTime)
+			connA.listener.Flush(nowNano)
+			_, err = connPair.senderToRecipientAll()
+			assert.Nil(t, err)
+			_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+			assert.Nil(t, err)
+			b, err := streamB.Read()
+			assert.Nil(t, err)
+			received = append(received, b...)
+
+			listenerB.Flush(connPair.Conn2.localTime)
+			_, err = connPair.recipientToSenderAll()
+			assert.Nil(t, err)
+			_, err = connA.listener.Listen(MinDeadLine, connPair.Conn1.localTime)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, msg, received, "size %d", size)
+	}
+}
+
+func TestStreamWriteVec(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+
+	// a header and a body larger than a packet arrive as their concatenation
+	header := []byte("len=3000;")
+	body := createTestData(3000)
+	n, err := streamA.WriteVec([][]byte{header, nil, body})
+	assert.Nil(t, err)
+	assert.Equal(t, len(header)+len(body), n)
+	n, err = streamA.WriteVec(nil)
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+
+	var received []byte
+	nowNano := connPair.Conn1.localTime
+	for i := 0; i < 20 && len(received) < len(header)+len(body); i++ {
+		nowNano = max(nowNano+msNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		b, err := streamB.Read()
+		assert.Nil(t, err)
+		received = append(received, b...)
+
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, append(header, body...), received)
+}
+
+func TestStreamSendBuffer(t *testing.T) {
+	_, err := Listen(WithSendBuffer(1000), WithSendBuffer(1000))
+	assert.Error(t, err)
+	_, err = Listen(WithSendBuffer(0))
+	assert.Error(t, err)
+
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connA.snd.streamCapacity = 1000
+
+	// the peer does not ack, a write returns what fits, the other streams have their own limit
+	n, err := streamA.Write(createTestData(1500))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, n)
+	n, err = streamA.Write([]byte("x"))
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+	n, err = connA.Stream(2).Write(createTestData(1500))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, n)
+	connA.snd.RemoveStream(2)
+
+	// WriteContext blocks until the acks free space
+	data := createTestData(2500)
+	type result struct {
+		n   int
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		n, err := streamA.WriteContext(context.Background(), data)
+		resultCh <- result{n, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, resultCh)
+
+	received := []byte{}
+	nowNano := connPair.Conn1.localTime
+	var res *result
+	for i := 0; i < 100 && (res == nil || len(received) < 1000+len(data)); i++ {
+		nowNano = max(nowNano+10*msNano, connA.nextWriteTime)
+		connA.listener.Flush(nowNano)
+		_, err = connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		b, err := streamB.Read()
+		assert.Nil(t, err)
+		received = append(received, b...)
+
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		select {
+		case r := <-resultCh:
+			res = &r
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if assert.NotNil(t, res) {
+		assert.Nil(t, res.err)
+		assert.Equal(t, len(data), res.n)
+	}
+	assert.Equal(t, append(createTestData(1500)[:1000], data...), received)
+
+	// a full buffer and a done context return the bytes written so far
+	assert.Equal(t, 1000, connA.snd.streamCapacity)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n, err = streamA.WriteContext(ctx, createTestData(1500))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1000, n)
+}
+
+func TestStreamFlowControlStalled(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connA.listener.flowControlStallNano = secondNano
+	connA.srtt, connA.rttvar, connA.bwMax = 10*msNano, 1*msNano, 0
+	streamB.conn.rcv.streamCapacity = 8 * 1024
+
+	nowNano := connPair.Conn1.localTime
+	exchange := func() {
+		nowNano += 100 * msNano
+		connA.listener.Flush(nowNano)
+		_, err := connPair.senderToRecipientAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsRecipient() > 0 {
+			_, err = listenerB.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+		listenerB.Flush(nowNano)
+		_, err = connPair.recipientToSenderAll()
+		assert.Nil(t, err)
+		for connPair.nrIncomingPacketsSender() > 0 {
+			_, err = connA.listener.Listen(MinDeadLine, nowNano)
+			assert.Nil(t, err)
+		}
+	}
+
+	// B never reads, its window of the stream stays full, the probes are acked
+	_, err := streamA.Write(make([]byte, 32*1024))
+	assert.Nil(t, err)
+	startNano := nowNano
+	for i := 0; i < 100 && err == nil; i++ {
+		exchange()
+		_, err = streamA.Write([]byte("x"))
+	}
+	assert.ErrorIs(t, err, ErrPeerFlowControlStalled)
+	assert.GreaterOrEqual(t, nowNano-startNano, uint64(secondNano))
+	assert.Nil(t, connA.closeErr)
+
+	// once the peer reads, the stream is not stalled anymore
+	for i := 0; i < 100 && err != nil; i++ {
+		_, err = streamB.Read()
+		assert.Nil(t, err)
+		exchange()
+		_, err = streamA.Write([]byte("x"))
+	}
+	assert.Nil(t, err)
+
+	_, err = Listen(WithFlowControlStallTimeout(time.Second), WithFlowControlStallTimeout(time.Second))
+	assert.Error(t, err)
+	_, err = Listen(WithFlowControlStallTimeout(0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package qotp
+
+import (
+	"cmp"
+	"slices"
+)
+
+// StreamState is the state of a stream in StreamInfo
+type StreamState uint8
+
+const (
+	StreamOpen           StreamState = iota
+	StreamHalfClosed                 // CloseWrite or CloseRead, one direction is still open
+	StreamCloseRequested             // Close was called, the close is not acked yet
+	StreamClosed
+	StreamReset // reset by us or by the peer
+)
+
+func (s StreamState) String() string {
+	switch s {
+	case StreamOpen:
+		return "open"
+	case StreamHalfClosed:
+		return "half closed"
+	case StreamCloseRequested:
+		return "close requested"
+	case StreamClosed:
+		return "closed"
+	case StreamReset:
+		return "reset"
+	}
+	return "unknown"
+}
+
+// StreamInfo is a snapshot of a stream, see Conn.Streams. It is a copy, changing it does not change the stream.
+type StreamInfo struct {
+	StreamID uint32
+	State    StreamState
+	Priority uint8
+
+	ReadOffset    uint64 // bytes read by the application
+	BytesBuffered int    // bytes received, but not read yet
+	WriteOffset   uint64 // bytes written by the application
+	SentOffset    uint64 // bytes sent at least once
+	BytesQueued   int    // bytes written, but not sent yet
+	BytesInFlight int    // bytes sent, but not acked yet
+}
+
+// Streams returns a snapshot of the streams of the connection, ordered by stream ID. Streams that are cleaned
+// up after their close are not included.
+func (c *Conn) Streams() []StreamInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var streams []*Stream
+	for _, s := range c.streams.Iterator(nil) {
+		streams = append(streams, s)
+	}
+
+	infos := make([]StreamInfo, 0, len(streams))
+	for _, s := range streams {
+		infos = append(infos, s.info())
+	}
+	slices.SortFunc(infos, func(a, b StreamInfo) int {
+		return cmp.Compare(a.StreamID, b.StreamID)
+	})
+	return infos
+}
+
+func (s *Stream) info() StreamInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sentOffset, queued, inFlight := s.conn.snd.streamInfo(s.streamID)
+	return StreamInfo{
+		StreamID:      s.streamID,
+		State:         s.state(),
+		Priority:      s.weight,
+		ReadOffset:    s.conn.rcv.GetOffsetRead(s.streamID),
+		BytesBuffered: s.conn.rcv.streamSize(s.streamID),
+		WriteOffset:   sentOffset + uint64(queued),
+		SentOffset:    sentOffset,
+		BytesQueued:   queued,
+		BytesInFlight: inFlight,
+	}
+}
+
+func (s *Stream) state() StreamState {
+	switch {
+	case s.streamErr != nil:
+		return StreamReset
+	case s.closedAtNano.Load() != 0:
+		return StreamClosed
+	case s.isHalfClose:
+		return StreamHalfClosed
+	case s.conn.snd.GetOffsetClosedAt(s.streamID) != nil:
+		return StreamCloseRequested
+	}
+	return StreamOpen
+}
+
+// streamInfo returns the send state of a stream for StreamInfo
+func (sb *SendBuffer) streamInfo(streamID uint32) (sentOffset uint64, queued int, inFlight int) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	stream := sb.streams[streamID]
+	if stream == nil {
+		return 0, 0, 0
+	}
+	return stream.bytesSentOffset, len(stream.queuedData), stream.dataInFlight
+}
+
+// streamSize returns the received bytes of a stream that are not read yet
+func (rb *ReceiveBuffer) streamSize(streamID uint32) int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	stream := rb.streams[streamID]
+	if stream == nil {
+		return 0
+	}
+	return stream.size
+}
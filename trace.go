@@ -0,0 +1,146 @@
+package qotp
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing with OpenTelemetry, enabled with WithTracer. A connection has a span from its creation to its
+// cleanup. Each handshake phase is a child span, named after the init we sent, from its first send until the
+// handshake is done on our side. A stream has a child span from open to cleanup, each Write and Read that
+// moved data is a child span of it. Without a tracer, no span is created and the fields stay nil.
+
+// tracePeerKeySize is the prefix of the identity key of the peer in the span attributes
+const tracePeerKeySize = 8
+
+// traceConnStart starts the span of a new connection
+func (c *Conn) traceConnStart() {
+	tracer := c.listener.tracer
+	if tracer == nil {
+		return
+	}
+	kind := trace.SpanKindServer
+	if c.isSenderOnInit {
+		kind = trace.SpanKindClient
+	}
+	_, c.span = tracer.Start(context.Background(), "qotp.conn", trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("qotp.conn_id", fmt.Sprintf("%016x", c.connId)),
+			attribute.String("qotp.peer", c.remoteAddr.String()),
+			attribute.Bool("qotp.sender", c.isSenderOnInit)))
+}
+
+// traceHandshakeSent starts the span of the handshake phase of msgType when the init is sent the first time.
+// If the sender falls back to another init, the phase of the previous one ends.
+func (c *Conn) traceHandshakeSent(msgType CryptoMsgType) {
+	if c.span == nil || msgType == Data || c.isHandshakeDoneOnRcv {
+		return
+	}
+	if c.handshakeSpan != nil {
+		if c.handshakeMsgType == msgType {
+			return
+		}
+		c.handshakeSpan.End()
+	}
+	c.handshakeMsgType = msgType
+	_, c.handshakeSpan = c.listener.tracer.Start(trace.ContextWithSpan(context.Background(), c.span),
+		"qotp.handshake."+msgType.String(),
+		trace.WithAttributes(attribute.String("qotp.conn_id", fmt.Sprintf("%016x", c.connId))))
+}
+
+// traceHandshakeDone ends the span of the handshake phase, with the RTT and the key of the peer
+func (c *Conn) traceHandshakeDone() {
+	if c.span == nil {
+		return
+	}
+	attrs := []attribute.KeyValue{attribute.Float64("qotp.rtt_ms", float64(c.srtt)/msNano)}
+	if peerKey := c.tracePeerKey(); peerKey != "" {
+		attrs = append(attrs, attribute.String("qotp.peer_key", peerKey))
+	}
+	c.span.SetAttributes(attrs...)
+	if c.handshakeSpan != nil {
+		c.handshakeSpan.SetAttributes(attrs...)
+		c.handshakeSpan.End()
+		c.handshakeSpan = nil
+	}
+}
+
+// traceConnEnd ends the spans of the connection, its streams and of a handshake that did not finish. Reasons
+// of a regular close are not errors.
+func (c *Conn) traceConnEnd(reason error) {
+	if c.span == nil {
+		return
+	}
+	if c.closeErr != nil {
+		reason = c.closeErr
+	}
+	if errors.Is(reason, ErrConnectionClosed) {
+		reason = nil
+	}
+	for _, s := range c.streams.Iterator(nil) {
+		traceEnd(s.span, reason)
+	}
+	if c.handshakeSpan != nil {
+		traceEnd(c.handshakeSpan, reason)
+		c.handshakeSpan = nil
+	}
+	c.span.SetAttributes(
+		attribute.Int64("qotp.bytes_in", int64(c.bytesReceived)),
+		attribute.Int64("qotp.bytes_out", int64(c.bytesSent)),
+		attribute.Int64("qotp.retransmits", int64(c.retransmits)))
+	traceEnd(c.span, reason)
+}
+
+func (c *Conn) tracePeerKey() string {
+	switch {
+	case c.pubKeyIdRcv != nil:
+		return hex.EncodeToString(c.pubKeyIdRcv.Bytes()[:tracePeerKeySize])
+	case c.pubKeyEdRcv != nil:
+		return hex.EncodeToString(c.pubKeyEdRcv[:tracePeerKeySize])
+	}
+	return ""
+}
+
+// traceStreamOpen starts the span of a new stream
+func (s *Stream) traceStreamOpen() {
+	if s.conn.span == nil {
+		return
+	}
+	_, s.span = s.conn.listener.tracer.Start(trace.ContextWithSpan(context.Background(), s.conn.span),
+		"qotp.stream", trace.WithAttributes(attribute.Int64("qotp.stream_id", int64(s.streamID))))
+}
+
+// traceStreamOp records a Write or Read of n bytes as child span of the stream
+func (s *Stream) traceStreamOp(name string, n int) {
+	if s.span == nil {
+		return
+	}
+	_, span := s.conn.listener.tracer.Start(trace.ContextWithSpan(context.Background(), s.span), name,
+		trace.WithAttributes(attribute.Int("qotp.bytes", n)))
+	span.End()
+}
+
+func (s *Stream) traceStreamEvent(name string) {
+	if s.span == nil {
+		return
+	}
+	s.span.AddEvent(name)
+}
+
+// traceEnd ends a span, with an error status if there is an error
+func traceEnd(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
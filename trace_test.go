@@ -0,0 +1,181 @@
+package qotp
+
+import (
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingTracer keeps the spans it started, so that tests can check names, parents and attributes
+type recordingTracer struct {
+	noop.Tracer
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	noop.Span
+	name   string
+	parent *recordingSpan
+	attrs  map[attribute.Key]attribute.Value
+	events []string
+	status codes.Code
+	ended  int
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (
+	context.Context, trace.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &recordingSpan{name: name, attrs: map[attribute.Key]attribute.Value{}}
+	if parent, ok := trace.SpanFromContext(ctx).(*recordingSpan); ok {
+		span.parent = parent
+	}
+	cfg := trace.NewSpanStartConfig(opts...)
+	span.SetAttributes(cfg.Attributes()...)
+	t.spans = append(t.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func (t *recordingTracer) named(name string) (spans []*recordingSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, span := range t.spans {
+		if span.name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+func (s *recordingSpan) AddEvent(name string, _ ...trace.EventOption) {
+	s.events = append(s.events, name)
+}
+func (s *recordingSpan) SetStatus(code codes.Code, _ string) { s.status = code }
+func (s *recordingSpan) End(...trace.SpanEndOption)          { s.ended++ }
+
+func TestTraceHandshakeAndStream(t *testing.T) {
+	tracerA, tracerB := &recordingTracer{}, &recordingTracer{}
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithTracer(tracerA))
+	assert.Nil(t, err)
+	listenerB, err := Listen(WithNetworkConn(connPair.Conn2), WithPrvKeyId(testPrvKey2), WithTracer(tracerB))
+	assert.Nil(t, err)
+	pubKeyIdRcv, err := decodeHexPubKey(hexPubKey2)
+	assert.Nil(t, err)
+	connA, err := listenerA.DialWithCrypto(netip.AddrPort{}, pubKeyIdRcv)
+	assert.Nil(t, err)
+
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	connB := streamB.conn
+
+	// the sender traces its InitCryptoSnd until the reply arrived, with the RTT of the reply
+	connSpanA := tracerA.named("qotp.conn")
+	assert.Len(t, connSpanA, 1)
+	handshakeA := tracerA.named("qotp.handshake.InitCryptoSnd")
+	assert.Len(t, handshakeA, 1)
+	assert.Equal(t, connSpanA[0], handshakeA[0].parent)
+	assert.Equal(t, 1, handshakeA[0].ended)
+	assert.Greater(t, handshakeA[0].attrs["qotp.rtt_ms"].AsFloat64(), 0.0)
+	assert.Equal(t, connSpanA[0].attrs["qotp.conn_id"], handshakeA[0].attrs["qotp.conn_id"])
+	assert.Equal(t, hex.EncodeToString(testPrvKey2.PublicKey().Bytes()[:8]),
+		handshakeA[0].attrs["qotp.peer_key"].AsString())
+
+	// the receiver traces its InitCryptoRcv until the first Data packet arrives
+	handshakeB := tracerB.named("qotp.handshake.InitCryptoRcv")
+	assert.Len(t, handshakeB, 1)
+	assert.Zero(t, handshakeB[0].ended)
+	assert.Equal(t, connSpanA[0].attrs["qotp.conn_id"], handshakeB[0].attrs["qotp.conn_id"])
+
+	// write and read are child spans of their stream
+	streamSpanA := tracerA.named("qotp.stream")
+	assert.Len(t, streamSpanA, 1)
+	assert.Equal(t, connSpanA[0], streamSpanA[0].parent)
+	writes := tracerA.named("qotp.stream.write")
+	assert.Len(t, writes, 1)
+	assert.Equal(t, streamSpanA[0], writes[0].parent)
+	assert.Equal(t, int64(5), writes[0].attrs["qotp.bytes"].AsInt64())
+	reads := tracerB.named("qotp.stream.read")
+	assert.Len(t, reads, 1)
+	assert.Equal(t, tracerB.named("qotp.stream")[0], reads[0].parent)
+
+	_, err = streamA.Write([]byte("data"))
+	assert.Nil(t, err)
+	nowNano := connPair.Conn1.localTime + secondNano
+	connA.listener.Flush(nowNano)
+	_, err = connPair.senderToRecipientAll()
+	assert.Nil(t, err)
+	_, err = listenerB.Listen(MinDeadLine, connPair.Conn2.localTime)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, handshakeB[0].ended)
+	assert.Len(t, tracerA.named("qotp.stream.write"), 2)
+
+	// an empty read is not traced
+	_, err = streamB.Read()
+	assert.Nil(t, err)
+	_, err = streamB.Read()
+	assert.Nil(t, err)
+	assert.Len(t, tracerB.named("qotp.stream.read"), 2)
+
+	// close and cleanup end the stream and the connection without error
+	streamA.Close()
+	assert.Equal(t, []string{"close"}, streamSpanA[0].events)
+	connA.cleanupStream(streamA.streamID)
+	assert.Equal(t, 1, streamSpanA[0].ended)
+	connA.cleanupConn(nil, nowNano)
+	assert.Equal(t, 1, connSpanA[0].ended)
+	assert.Equal(t, codes.Unset, connSpanA[0].status)
+
+	// the open stream of B ends with its connection, with the error
+	connB.cleanupConn(errIdleTimeout, nowNano)
+	assert.Equal(t, 1, tracerB.named("qotp.stream")[0].ended)
+	assert.Equal(t, codes.Error, tracerB.named("qotp.stream")[0].status)
+	assert.Equal(t, codes.Error, tracerB.named("qotp.conn")[0].status)
+}
+
+func TestTraceHandshakeTimeout(t *testing.T) {
+	tracer := &recordingTracer{}
+	connPair := NewConnPair("alice", "bob")
+	listenerA, err := Listen(WithNetworkConn(connPair.Conn1), WithPrvKeyId(testPrvKey1), WithTracer(tracer))
+	assert.Nil(t, err)
+	connA, err := listenerA.Dial(netip.AddrPort{})
+	assert.Nil(t, err)
+	_, err = connA.Stream(0).Write([]byte("hallo"))
+	assert.Nil(t, err)
+	listenerA.Flush(0)
+	assert.Equal(t, 1, connPair.nrOutgoingPacketsSender())
+
+	// the handshake span of a connection that fails is ended with the error
+	handshake := tracer.named("qotp.handshake.InitSnd")
+	assert.Len(t, handshake, 1)
+	assert.Zero(t, handshake[0].ended)
+	connA.closeErr = ErrHandshakeTimeout
+	connA.cleanupConn(nil, 0)
+	assert.Equal(t, 1, handshake[0].ended)
+	assert.Equal(t, codes.Error, handshake[0].status)
+}
+
+func TestTraceDisabled(t *testing.T) {
+	connA, listenerB, connPair := setupStreamTest(t)
+	streamA, streamB := handshakeStreamTest(t, connA, listenerB, connPair)
+	assert.Nil(t, connA.span)
+	assert.Nil(t, connA.handshakeSpan)
+	assert.Nil(t, streamA.span)
+	assert.Nil(t, streamB.conn.span)
+
+	_, err := Listen(WithTracer(nil))
+	assert.Error(t, err)
+}
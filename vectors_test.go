@@ -0,0 +1,275 @@
+package qotp
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Known-answer vectors of the crypto layer in testdata/vectors.json. They pin the wire format, a change of the
+// bytes breaks the interop with older versions and needs a new CryptoVersion. go test -run TestVectors -update
+// writes the file again.
+
+var isUpdateVectors = flag.Bool("update", false, "write testdata/vectors.json")
+
+const vectorsFile = "testdata/vectors.json"
+
+// vectorKeys are the keys of all vectors, Alice dials Bob
+type vectorKeys struct {
+	PrvIdAlice   string `json:"prvIdAlice"`
+	PrvIdBob     string `json:"prvIdBob"`
+	PrvEpAlice   string `json:"prvEpAlice"`
+	PrvEpBob     string `json:"prvEpBob"`
+	SeedEd25519  string `json:"seedEd25519Alice"`
+	HandshakeMtu int    `json:"handshakeMtu"`
+}
+
+type vector struct {
+	Name     string `json:"name"`
+	MsgType  string `json:"msgType"`
+	IsSender bool   `json:"isSender"` // Data of Alice, else of Bob
+	Sn       uint64 `json:"sn"`
+	Epoch    uint64 `json:"epoch"`
+	IsXorIV  bool   `json:"isXorIV"`
+	IsPadded bool   `json:"isPadded"`
+	ConnId   string `json:"connId"` // the 8 bytes on the wire
+	Payload  string `json:"payload"`
+	Packet   string `json:"packet"`
+}
+
+type vectorFile struct {
+	Comment string     `json:"comment"`
+	Keys    vectorKeys `json:"keys"`
+	Vectors []vector   `json:"vectors"`
+}
+
+var (
+	// the seeds differ in the second byte, X25519 clears the lowest bits of the first one
+	vectorPrvIdAlice      = vectorPrvKey(1)
+	vectorPrvIdBob        = vectorPrvKey(2)
+	vectorPrvEpAlice      = vectorPrvKey(3)
+	vectorPrvEpBob        = vectorPrvKey(4)
+	vectorPrvEdAlice      = ed25519.NewKeyFromSeed(vectorSeed(5))
+	vectorHandshakeMtu    = 256
+	vectorPayload         = []byte("qotp known-answer test payload")
+	vectorConnId          = hex.EncodeToString(vectorPrvEpAlice.PublicKey().Bytes()[:ConnIdSize])
+	vectorSharedSecret, _ = sharedSecretECDH(vectorPrvEpAlice, vectorPrvEpBob.PublicKey())
+)
+
+func vectorSeed(i byte) []byte {
+	seed := make([]byte, 32)
+	seed[1], seed[31] = i, i
+	return seed
+}
+
+func vectorPrvKey(i byte) *ecdh.PrivateKey {
+	prvKey, err := ecdh.X25519().NewPrivateKey(vectorSeed(i))
+	if err != nil {
+		panic(err)
+	}
+	return prvKey
+}
+
+// vectorInputs are the vectors without the packet
+func vectorInputs() []vector {
+	payload := hex.EncodeToString(vectorPayload)
+	return []vector{
+		{Name: "InitSnd", MsgType: "InitSnd", IsSender: true, ConnId: vectorConnId},
+		{Name: "InitRcv", MsgType: "InitRcv", ConnId: vectorConnId, Payload: payload},
+		{Name: "InitCryptoSnd", MsgType: "InitCryptoSnd", IsSender: true, ConnId: vectorConnId, Payload: payload},
+		{Name: "InitCryptoRcv", MsgType: "InitCryptoRcv", ConnId: vectorConnId, Payload: payload},
+		{Name: "InitSignedSnd", MsgType: "InitSignedSnd", IsSender: true, ConnId: vectorConnId, Payload: payload},
+		{Name: "Data dialer", MsgType: "Data", IsSender: true, Sn: 1, ConnId: vectorConnId, Payload: payload},
+		{Name: "Data receiver", MsgType: "Data", Sn: 1, ConnId: vectorConnId, Payload: payload},
+		{Name: "Data epoch", MsgType: "Data", IsSender: true, Sn: 0xfedcba987654, Epoch: 3, ConnId: vectorConnId,
+			Payload: payload},
+		{Name: "Data xor-iv", MsgType: "Data", IsSender: true, Sn: 2, IsXorIV: true, ConnId: vectorConnId,
+			Payload: payload},
+		{Name: "DataPadded", MsgType: "DataPadded", IsSender: true, Sn: 3, IsPadded: true, ConnId: vectorConnId,
+			Payload: payload},
+	}
+}
+
+func vectorKeysOf() vectorKeys {
+	return vectorKeys{
+		PrvIdAlice:   hex.EncodeToString(vectorPrvIdAlice.Bytes()),
+		PrvIdBob:     hex.EncodeToString(vectorPrvIdBob.Bytes()),
+		PrvEpAlice:   hex.EncodeToString(vectorPrvEpAlice.Bytes()),
+		PrvEpBob:     hex.EncodeToString(vectorPrvEpBob.Bytes()),
+		SeedEd25519:  hex.EncodeToString(vectorPrvEdAlice.Seed()),
+		HandshakeMtu: vectorHandshakeMtu,
+	}
+}
+
+// vectorIV returns the IV of the direction of the vector, nil for the split nonce
+func vectorIV(v vector) []byte {
+	if !v.IsXorIV {
+		return nil
+	}
+	ivSender, ivReceiver := deriveNonceIVs(vectorSharedSecret)
+	if v.IsSender {
+		return ivSender
+	}
+	return ivReceiver
+}
+
+// encodeVector creates the packet of a vector
+func encodeVector(v vector) ([]byte, error) {
+	payload, err := hex.DecodeString(v.Payload)
+	if err != nil {
+		return nil, err
+	}
+	connIdBytes, err := hex.DecodeString(v.ConnId)
+	if err != nil || len(connIdBytes) != ConnIdSize {
+		return nil, fmt.Errorf("connection id %q: %w", v.ConnId, os.ErrInvalid)
+	}
+	connId := Uint64(connIdBytes)
+	switch v.MsgType {
+	case "InitSnd":
+		_, encData, err := encryptInitSnd(vectorPrvIdAlice.PublicKey(), vectorPrvEpAlice.PublicKey(), vectorHandshakeMtu)
+		return encData, err
+	case "InitRcv":
+		return encryptInitRcv(connId, vectorPrvIdBob.PublicKey(), vectorPrvEpAlice.PublicKey(), vectorPrvEpBob, v.Sn, payload)
+	case "InitCryptoSnd":
+		_, encData, err := encryptInitCryptoSnd(vectorPrvIdBob.PublicKey(), vectorPrvIdAlice.PublicKey(), vectorPrvEpAlice, v.Sn,
+			vectorHandshakeMtu, payload)
+		return encData, err
+	case "InitCryptoRcv":
+		return encryptInitCryptoRcv(connId, vectorPrvEpAlice.PublicKey(), vectorPrvEpBob, v.Sn, payload)
+	case "InitSignedSnd":
+		_, encData, err := encryptInitSignedSnd(vectorPrvIdBob.PublicKey(), vectorPrvEdAlice, vectorPrvEpAlice, v.Sn,
+			vectorHandshakeMtu, payload)
+		return encData, err
+	case "Data", "DataPadded":
+		a, err := newAeads(vectorSharedSecret, &chachaSuite)
+		if err != nil {
+			return nil, err
+		}
+		if v.IsPadded {
+			payload = padData(5, payload)
+		}
+		return encryptData(connId, v.IsSender, a, vectorIV(v), v.Sn, v.Epoch, v.IsPadded, payload)
+	}
+	return nil, fmt.Errorf("message type %q: %w", v.MsgType, os.ErrInvalid)
+}
+
+// decodeVector decrypts the packet of a vector as its receiver and checks the keys it carries
+func decodeVector(t *testing.T, v vector, packet []byte) (payload []byte, sn uint64) {
+	switch v.MsgType {
+	case "InitSnd":
+		pubKeyIdSnd, pubKeyEpSnd, err := decryptInitSnd(packet, vectorHandshakeMtu)
+		assert.NoError(t, err)
+		assert.True(t, pubKeyIdSnd.Equal(vectorPrvIdAlice.PublicKey()))
+		assert.True(t, pubKeyEpSnd.Equal(vectorPrvEpAlice.PublicKey()))
+		return nil, 0
+	case "InitRcv":
+		sharedSecret, pubKeyIdRcv, pubKeyEpRcv, m, err := decryptInitRcv(packet, vectorPrvEpAlice)
+		assert.NoError(t, err)
+		assert.Equal(t, vectorSharedSecret, sharedSecret)
+		assert.True(t, pubKeyIdRcv.Equal(vectorPrvIdBob.PublicKey()))
+		assert.True(t, pubKeyEpRcv.Equal(vectorPrvEpBob.PublicKey()))
+		return m.PayloadRaw, m.SnConn
+	case "InitCryptoSnd":
+		pubKeyIdSnd, pubKeyEpSnd, m, err := decryptInitCryptoSnd(packet, vectorPrvIdBob, vectorHandshakeMtu)
+		assert.NoError(t, err)
+		assert.True(t, pubKeyIdSnd.Equal(vectorPrvIdAlice.PublicKey()))
+		assert.True(t, pubKeyEpSnd.Equal(vectorPrvEpAlice.PublicKey()))
+		return m.PayloadRaw, m.SnConn
+	case "InitCryptoRcv":
+		sharedSecret, pubKeyEpRcv, m, err := decryptInitCryptoRcv(packet, vectorPrvEpAlice)
+		assert.NoError(t, err)
+		assert.Equal(t, vectorSharedSecret, sharedSecret)
+		assert.True(t, pubKeyEpRcv.Equal(vectorPrvEpBob.PublicKey()))
+		return m.PayloadRaw, m.SnConn
+	case "InitSignedSnd":
+		pubKeyEdSnd, pubKeyEpSnd, m, err := decryptInitSignedSnd(packet, vectorPrvIdBob, vectorHandshakeMtu)
+		assert.NoError(t, err)
+		assert.Equal(t, vectorPrvEdAlice.Public(), pubKeyEdSnd)
+		assert.True(t, pubKeyEpSnd.Equal(vectorPrvEpAlice.PublicKey()))
+		return m.PayloadRaw, m.SnConn
+	case "Data", "DataPadded":
+		a, err := newAeads(vectorSharedSecret, &chachaSuite)
+		assert.NoError(t, err)
+		m, err := decryptData(packet, !v.IsSender, v.Epoch, a, vectorIV(v))
+		assert.NoError(t, err)
+		if err != nil {
+			return nil, 0
+		}
+		assert.Equal(t, v.Epoch, m.currentEpochCrypt)
+		return m.PayloadRaw, m.SnConn
+	}
+	t.Fatalf("unknown message type %v", v.MsgType)
+	return nil, 0
+}
+
+// setVectorGrease turns greasing off, the version of the header is then always CryptoVersion
+func setVectorGrease(t *testing.T) {
+	oldRand := greaseRand
+	greaseRand = nil
+	t.Cleanup(func() { greaseRand = oldRand })
+}
+
+// setVectorFiller leaves the filler of the inits zeros instead of random
+func setVectorFiller(t *testing.T) {
+	oldRand := fillerRand
+	fillerRand = nil
+	t.Cleanup(func() { fillerRand = oldRand })
+}
+
+func TestVectors(t *testing.T) {
+	setVectorGrease(t)
+	setVectorFiller(t)
+	if *isUpdateVectors {
+		f := vectorFile{
+			Comment: fmt.Sprintf("qotp crypto layer, CryptoVersion %d, byte values in hex, see vectors_test.go", CryptoVersion),
+			Keys:    vectorKeysOf(),
+		}
+		for _, v := range vectorInputs() {
+			packet, err := encodeVector(v)
+			assert.NoError(t, err)
+			v.Packet = hex.EncodeToString(packet)
+			f.Vectors = append(f.Vectors, v)
+		}
+		b, err := json.MarshalIndent(f, "", "  ")
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll("testdata", 0o755))
+		assert.NoError(t, os.WriteFile(vectorsFile, append(b, '\n'), 0o644))
+	}
+
+	b, err := os.ReadFile(vectorsFile)
+	assert.NoError(t, err)
+	var f vectorFile
+	assert.NoError(t, json.Unmarshal(b, &f))
+	assert.Equal(t, vectorKeysOf(), f.Keys)
+	assert.Len(t, f.Vectors, len(vectorInputs()))
+
+	for _, v := range f.Vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			// encode to the bytes of the file
+			packet, err := encodeVector(v)
+			assert.NoError(t, err)
+			assert.Equal(t, v.Packet, hex.EncodeToString(packet))
+
+			// decode from the bytes of the file
+			want, err := hex.DecodeString(v.Packet)
+			assert.NoError(t, err)
+			header := want[0]
+			if isHeaderProtected(header) {
+				a, err := newAeads(vectorSharedSecret, &chachaSuite)
+				assert.NoError(t, err)
+				header = unmaskedHeader(t, a, v.IsSender, want)
+			}
+			assert.Equal(t, uint8(CryptoVersion), header&0x1f)
+			payload, sn := decodeVector(t, v, want)
+			assert.Equal(t, v.Payload, hex.EncodeToString(payload))
+			assert.Equal(t, v.Sn, sn)
+		})
+	}
+}